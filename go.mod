@@ -6,11 +6,11 @@ require (
 	github.com/badfortrains/mdns v0.0.0-20160325001438-447166384f51
 	github.com/golang/protobuf v1.5.0
 	github.com/miekg/dns v1.1.8 // indirect
-	github.com/stretchr/testify v1.3.0
+	github.com/stretchr/testify v1.4.0
 	github.com/xlab/portaudio-go v0.0.0-20170905165025-132d041879db
 	github.com/xlab/vorbis-go v0.0.0-20190125051917-087364aef51d
-	golang.org/x/crypto v0.0.0-20190418165655-df01cb2cc480
-	golang.org/x/net v0.0.0-20190420063019-afa5a82059c6 // indirect
-	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	golang.org/x/oauth2 v0.0.0-20210514164344-f6687ab2804c
+	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
 	google.golang.org/protobuf v1.27.1
 )
@@ -0,0 +1,111 @@
+package connection
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Dialer opens the network connections to the Spotify servers (AP). It is implemented by *net.Dialer, by the
+// dialers of golang.org/x/net/proxy (e.g. SOCKS5), and by HTTPConnectDialer.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// DialerFunc is an adapter allowing the use of ordinary functions as Dialer
+type DialerFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (f DialerFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
+
+// HTTPConnectDialer opens connections through an HTTP proxy supporting the CONNECT method
+type HTTPConnectDialer struct {
+	// ProxyAddress is the host:port address of the proxy
+	ProxyAddress string
+	// Header holds additional headers sent with the CONNECT request, e.g. Proxy-Authorization
+	Header http.Header
+	// Forward is the dialer used to reach the proxy, a zero net.Dialer is used when nil
+	Forward Dialer
+}
+
+func (d *HTTPConnectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	forward := d.Forward
+	if forward == nil {
+		forward = &net.Dialer{}
+	}
+
+	conn, err := forward.DialContext(ctx, network, d.ProxyAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bound the CONNECT exchange by the context as well
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: d.Header,
+	}
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT to %s: %w", address, err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT to %s: %w", address, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT to %s: %s", address, resp.Status)
+	}
+
+	if ctx.Err() != nil {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	conn.SetDeadline(time.Time{})
+
+	if reader.Buffered() > 0 {
+		// The proxy already relayed some data from the server, don't lose it
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn whose first reads are served from a buffer
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,83 @@
+package connection
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// startFakeProxy starts an HTTP proxy accepting a single CONNECT request, answering with status, and then echoing
+// everything it receives
+func startFakeProxy(t *testing.T, status int) (net.Listener, chan *http.Request) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := make(chan *http.Request, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		requests <- req
+
+		resp := &http.Response{StatusCode: status, ProtoMajor: 1, ProtoMinor: 1}
+		resp.Write(conn)
+		if status == http.StatusOK {
+			io.Copy(conn, reader)
+		}
+	}()
+
+	return listener, requests
+}
+
+func TestHTTPConnectDialer(t *testing.T) {
+	listener, requests := startFakeProxy(t, http.StatusOK)
+	defer listener.Close()
+
+	dialer := &HTTPConnectDialer{
+		ProxyAddress: listener.Addr().String(),
+		Header:       http.Header{"Proxy-Authorization": []string{"Basic dGVzdDp0ZXN0"}},
+	}
+	conn, err := dialer.DialContext(context.Background(), "tcp", "ap.spotify.com:4070")
+	if err != nil {
+		t.Fatalf("Dial through proxy failed: %v", err)
+	}
+	defer conn.Close()
+
+	req := <-requests
+	if req.Method != "CONNECT" || req.Host != "ap.spotify.com:4070" {
+		t.Errorf("Wrong CONNECT request. Got %s %s", req.Method, req.Host)
+	}
+	if req.Header.Get("Proxy-Authorization") != "Basic dGVzdDp0ZXN0" {
+		t.Errorf("Missing proxy authorization header")
+	}
+
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("Tunnel not established. Got %q, %v", buf, err)
+	}
+}
+
+func TestHTTPConnectDialerRefused(t *testing.T) {
+	listener, _ := startFakeProxy(t, http.StatusForbidden)
+	defer listener.Close()
+
+	dialer := &HTTPConnectDialer{ProxyAddress: listener.Addr().String()}
+	_, err := dialer.DialContext(context.Background(), "tcp", "ap.spotify.com:4070")
+	if err == nil {
+		t.Errorf("Expected an error when the proxy refuses the tunnel")
+	}
+}
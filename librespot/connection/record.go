@@ -0,0 +1,435 @@
+package connection
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/librespot-org/librespot-golang/Spotify"
+)
+
+// Recordings are made of a header (recordMagic followed by the format version), then of one record per packet:
+// [ uint8 direction, int64 unix timestamp in nanoseconds, uint8 cmd, uint32 len, payload ]
+var recordMagic = []byte("LSPT")
+
+const recordVersion = 1
+
+// maxRecordedPacketSize is the size of the largest packet payload, whose length is a uint16 in the encrypted stream
+const maxRecordedPacketSize = 1<<16 - 1
+
+// secretURIPrefixes are the prefixes of the mercury URIs whose responses hold secrets, their payloads are blanked
+var secretURIPrefixes = []string{"hm://keymaster/"}
+
+// ErrReplayDiverged is returned by the Replayer when the client sends a packet which doesn't match the recording
+var ErrReplayDiverged = errors.New("replay diverged from the recording")
+
+// Direction tells whether a recorded packet has been sent to, or received from, the AP
+type Direction uint8
+
+const (
+	DirectionSent     Direction = 0
+	DirectionReceived Direction = 1
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirectionSent:
+		return "sent"
+	case DirectionReceived:
+		return "received"
+	default:
+		return fmt.Sprintf("Direction(%d)", uint8(d))
+	}
+}
+
+// RecordedPacket is a decrypted packet exchanged with the AP
+type RecordedPacket struct {
+	Time      time.Time
+	Direction Direction
+	Cmd       uint8
+	Data      []byte
+}
+
+func (p RecordedPacket) String() string {
+	arrow := ">"
+	if p.Direction == DirectionReceived {
+		arrow = "<"
+	}
+	return fmt.Sprintf("%s %s 0x%02x (%d bytes)", p.Time.Format(time.RFC3339Nano), arrow, p.Cmd, len(p.Data))
+}
+
+// PacketRecorder writes the decrypted packets of the streams it wraps to a recording. A single recorder can wrap the
+// successive streams of a session, e.g. across reconnections. The secrets are blanked before being recorded, so that
+// recordings can be shared: the credentials found in the login packet and in the APWelcome, the audio keys, and the
+// payloads of the keymaster responses, which hold access tokens.
+type PacketRecorder struct {
+	lock    sync.Mutex
+	writer  io.Writer
+	started bool
+	err     error
+	// secretSeqs holds the sequences of the mercury requests whose responses hold secrets, true once their header has
+	// been received
+	secretSeqs map[string]bool
+}
+
+// NewPacketRecorder creates a recorder writing to w
+func NewPacketRecorder(w io.Writer) *PacketRecorder {
+	return &PacketRecorder{writer: w, secretSeqs: make(map[string]bool)}
+}
+
+// Wrap returns a PacketStream recording the packets exchanged through stream
+func (r *PacketRecorder) Wrap(stream PacketStream) PacketStream {
+	return &recordingStream{
+		stream:   stream,
+		recorder: r,
+	}
+}
+
+// Err returns the first error encountered while writing the recording. The streams keep working when the recording
+// fails, the following packets are simply not recorded.
+func (r *PacketRecorder) Err() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.err
+}
+
+func (r *PacketRecorder) record(direction Direction, cmd uint8, data []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	data = r.redact(direction, cmd, data)
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, uint8(direction))
+	binary.Write(buf, binary.BigEndian, time.Now().UnixNano())
+	binary.Write(buf, binary.BigEndian, cmd)
+	binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	buf.Write(data)
+
+	if r.err != nil {
+		return
+	}
+
+	if !r.started {
+		r.started = true
+		_, r.err = r.writer.Write(append(append([]byte{}, recordMagic...), recordVersion))
+		if r.err != nil {
+			return
+		}
+	}
+
+	_, r.err = r.writer.Write(buf.Bytes())
+}
+
+// redact returns the payload of a packet without the secrets it may hold. A payload which can't be decoded is
+// dropped altogether. It must be called with the lock held.
+func (r *PacketRecorder) redact(direction Direction, cmd uint8, data []byte) []byte {
+	var message proto.Message
+	switch cmd {
+	case PacketAesKey:
+		// The sequence number of the request is kept, the key is blanked
+		if len(data) < 4 {
+			return nil
+		}
+		return append(append([]byte{}, data[:4]...), make([]byte, len(data)-4)...)
+
+	case PacketMercuryReq:
+		return r.redactMercury(direction, data)
+
+	case PacketLogin:
+		login := &Spotify.ClientResponseEncrypted{}
+		if proto.Unmarshal(data, login) != nil || login.LoginCredentials == nil {
+			return nil
+		}
+		login.LoginCredentials.AuthData = []byte{}
+		message = login
+
+	case PacketAPWelcome:
+		welcome := &Spotify.APWelcome{}
+		if proto.Unmarshal(data, welcome) != nil {
+			return nil
+		}
+		welcome.ReusableAuthCredentials = []byte{}
+		message = welcome
+
+	default:
+		return data
+	}
+
+	redacted, err := proto.Marshal(message)
+	if err != nil {
+		return nil
+	}
+	return redacted
+}
+
+// redactMercury blanks the payloads of the responses to the mercury requests for secretURIPrefixes. The requests are
+// recorded as is, the parts of their responses but the header are emptied. It must be called with the lock held.
+func (r *PacketRecorder) redactMercury(direction Direction, data []byte) []byte {
+	seq, flags, parts, err := decodeMercuryPacket(data)
+	if err != nil {
+		return nil
+	}
+	seqKey := string(seq)
+
+	if direction == DirectionSent {
+		if len(parts) > 0 {
+			header := &Spotify.Header{}
+			if proto.Unmarshal(parts[0], header) == nil && hasSecretURI(header.GetUri()) {
+				r.secretSeqs[seqKey] = false
+			}
+		}
+		return data
+	}
+
+	headerSeen, ok := r.secretSeqs[seqKey]
+	if !ok {
+		return data
+	}
+	for i := range parts {
+		if i == 0 && !headerSeen {
+			continue
+		}
+		parts[i] = []byte{}
+	}
+	r.secretSeqs[seqKey] = true
+	if flags == 1 {
+		// The response is complete
+		delete(r.secretSeqs, seqKey)
+	}
+	return encodeMercuryPacket(seq, flags, parts)
+}
+
+func hasSecretURI(uri string) bool {
+	for _, prefix := range secretURIPrefixes {
+		if strings.HasPrefix(uri, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeMercuryPacket splits a mercury packet into its sequence, flags and parts
+func decodeMercuryPacket(data []byte) (seq []byte, flags uint8, parts [][]byte, err error) {
+	reader := bytes.NewReader(data)
+	var seqLength, count uint16
+	if err = binary.Read(reader, binary.BigEndian, &seqLength); err != nil {
+		return
+	}
+	seq = make([]byte, seqLength)
+	if _, err = io.ReadFull(reader, seq); err != nil {
+		return
+	}
+	if err = binary.Read(reader, binary.BigEndian, &flags); err != nil {
+		return
+	}
+	if err = binary.Read(reader, binary.BigEndian, &count); err != nil {
+		return
+	}
+	for i := uint16(0); i < count; i++ {
+		var size uint16
+		if err = binary.Read(reader, binary.BigEndian, &size); err != nil {
+			return
+		}
+		part := make([]byte, size)
+		if _, err = io.ReadFull(reader, part); err != nil {
+			return
+		}
+		parts = append(parts, part)
+	}
+	return
+}
+
+func encodeMercuryPacket(seq []byte, flags uint8, parts [][]byte) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, uint16(len(seq)))
+	buf.Write(seq)
+	binary.Write(buf, binary.BigEndian, flags)
+	binary.Write(buf, binary.BigEndian, uint16(len(parts)))
+	for _, part := range parts {
+		binary.Write(buf, binary.BigEndian, uint16(len(part)))
+		buf.Write(part)
+	}
+	return buf.Bytes()
+}
+
+type recordingStream struct {
+	stream   PacketStream
+	recorder *PacketRecorder
+}
+
+func (s *recordingStream) SendPacket(cmd uint8, data []byte) error {
+	err := s.stream.SendPacket(cmd, data)
+	if err == nil {
+		s.recorder.record(DirectionSent, cmd, data)
+	}
+	return err
+}
+
+func (s *recordingStream) RecvPacket() (uint8, []byte, error) {
+	cmd, data, err := s.stream.RecvPacket()
+	if err == nil {
+		s.recorder.record(DirectionReceived, cmd, data)
+	}
+	return cmd, data, err
+}
+
+// ReadRecording reads all the packets of a recording made by a PacketRecorder
+func ReadRecording(r io.Reader) ([]RecordedPacket, error) {
+	reader := bufio.NewReader(r)
+
+	header := make([]byte, len(recordMagic)+1)
+	_, err := io.ReadFull(reader, header)
+	if err == io.EOF {
+		// Nothing has been recorded
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading recording header: %w", err)
+	}
+	if !bytes.Equal(header[:len(recordMagic)], recordMagic) {
+		return nil, fmt.Errorf("reading recording header: not a packet recording")
+	}
+	if header[len(recordMagic)] != recordVersion {
+		return nil, fmt.Errorf("reading recording header: unsupported version %d", header[len(recordMagic)])
+	}
+
+	packets := make([]RecordedPacket, 0)
+	for {
+		var direction uint8
+		err = binary.Read(reader, binary.BigEndian, &direction)
+		if err == io.EOF {
+			return packets, nil
+		} else if err != nil {
+			return packets, fmt.Errorf("reading packet %d: %w", len(packets), err)
+		}
+
+		var timestamp int64
+		var cmd uint8
+		var size uint32
+		err = binary.Read(reader, binary.BigEndian, &timestamp)
+		if err == nil {
+			err = binary.Read(reader, binary.BigEndian, &cmd)
+		}
+		if err == nil {
+			err = binary.Read(reader, binary.BigEndian, &size)
+		}
+
+		if err == nil && size > maxRecordedPacketSize {
+			return packets, fmt.Errorf("reading packet %d: size %d exceeds the maximum packet size", len(packets),
+				size)
+		}
+
+		var data []byte
+		if err == nil && size > 0 {
+			data = make([]byte, size)
+			_, err = io.ReadFull(reader, data)
+		}
+		if err != nil {
+			return packets, fmt.Errorf("reading packet %d: %w", len(packets), io.ErrUnexpectedEOF)
+		}
+
+		packets = append(packets, RecordedPacket{
+			Time:      time.Unix(0, timestamp),
+			Direction: Direction(direction),
+			Cmd:       cmd,
+			Data:      data,
+		})
+	}
+}
+
+// Replayer is a PacketStream playing a recording back: RecvPacket returns the received packets in order, each one
+// once the client has sent the packets recorded before it. The packets sent by the client are checked against the
+// recording by their cmd only, as their payloads hold random or time dependent values. Once all the received packets
+// have been returned, RecvPacket blocks like an idle connection until the Replayer is closed.
+type Replayer struct {
+	lock sync.Mutex
+	cond *sync.Cond
+	sent []RecordedPacket
+	// received holds the received packets, along the number of packets sent before each of them
+	received  []RecordedPacket
+	sentFirst []int
+	// nextSent and nextReceived are the indexes of the next packets to send and to receive
+	nextSent     int
+	nextReceived int
+	closed       bool
+}
+
+// NewReplayer creates a Replayer playing the specified packets back
+func NewReplayer(packets []RecordedPacket) *Replayer {
+	r := &Replayer{}
+	r.cond = sync.NewCond(&r.lock)
+
+	for _, packet := range packets {
+		if packet.Direction == DirectionSent {
+			r.sent = append(r.sent, packet)
+		} else {
+			r.received = append(r.received, packet)
+			r.sentFirst = append(r.sentFirst, len(r.sent))
+		}
+	}
+
+	return r
+}
+
+func (r *Replayer) SendPacket(cmd uint8, data []byte) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return io.ErrClosedPipe
+	}
+	if r.nextSent >= len(r.sent) {
+		return fmt.Errorf("%w: unexpected packet 0x%x after the end of the recording", ErrReplayDiverged, cmd)
+	}
+
+	expected := r.sent[r.nextSent]
+	if expected.Cmd != cmd {
+		return fmt.Errorf("%w: packet %d is 0x%x, expected 0x%x", ErrReplayDiverged, r.nextSent, cmd, expected.Cmd)
+	}
+
+	r.nextSent++
+	r.cond.Broadcast()
+
+	return nil
+}
+
+func (r *Replayer) RecvPacket() (uint8, []byte, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for !r.closed && (r.nextReceived >= len(r.received) || r.nextSent < r.sentFirst[r.nextReceived]) {
+		r.cond.Wait()
+	}
+
+	if r.closed {
+		return 0, nil, io.EOF
+	}
+
+	packet := r.received[r.nextReceived]
+	r.nextReceived++
+
+	return packet.Cmd, packet.Data, nil
+}
+
+// Done reports whether all the packets of the recording have been replayed
+func (r *Replayer) Done() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.nextSent == len(r.sent) && r.nextReceived == len(r.received)
+}
+
+// Close stops the replay, the blocked and following RecvPacket calls return io.EOF
+func (r *Replayer) Close() error {
+	r.lock.Lock()
+	r.closed = true
+	r.cond.Broadcast()
+	r.lock.Unlock()
+	return nil
+}
@@ -0,0 +1,215 @@
+package connection
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/librespot-org/librespot-golang/Spotify"
+)
+
+// scriptedStream is a PacketStream receiving predefined packets
+type scriptedStream struct {
+	recv []RecordedPacket
+	sent []RecordedPacket
+}
+
+func (s *scriptedStream) SendPacket(cmd uint8, data []byte) error {
+	s.sent = append(s.sent, RecordedPacket{Cmd: cmd, Data: data})
+	return nil
+}
+
+func (s *scriptedStream) RecvPacket() (uint8, []byte, error) {
+	if len(s.recv) == 0 {
+		return 0, nil, io.EOF
+	}
+	packet := s.recv[0]
+	s.recv = s.recv[1:]
+	return packet.Cmd, packet.Data, nil
+}
+
+func TestRecordPackets(t *testing.T) {
+	login, _ := proto.Marshal(&Spotify.ClientResponseEncrypted{
+		LoginCredentials: &Spotify.LoginCredentials{
+			Username: proto.String("user"),
+			Typ:      Spotify.AuthenticationType_AUTHENTICATION_USER_PASS.Enum(),
+			AuthData: []byte("secret"),
+		},
+		SystemInfo: &Spotify.SystemInfo{
+			CpuFamily: Spotify.CpuFamily_CPU_UNKNOWN.Enum(),
+			Os:        Spotify.Os_OS_UNKNOWN.Enum(),
+		},
+	})
+
+	buf := new(bytes.Buffer)
+	recorder := NewPacketRecorder(buf)
+	stream := recorder.Wrap(&scriptedStream{
+		recv: []RecordedPacket{{Cmd: PacketCountryCode, Data: []byte("SE")}},
+	})
+
+	before := time.Now()
+	stream.SendPacket(PacketLogin, login)
+	stream.RecvPacket()
+	stream.SendPacket(PacketPong, []byte{0, 0, 0, 0})
+	// Failed reads are not recorded
+	stream.RecvPacket()
+
+	if recorder.Err() != nil {
+		t.Fatalf("Recording failed: %v", recorder.Err())
+	}
+
+	packets, err := ReadRecording(buf)
+	if err != nil {
+		t.Fatalf("Failed to read the recording: %v", err)
+	}
+	if len(packets) != 3 {
+		t.Fatalf("Wrong number of packets recorded. Got %v", packets)
+	}
+
+	expected := []struct {
+		direction Direction
+		cmd       uint8
+	}{{DirectionSent, PacketLogin}, {DirectionReceived, PacketCountryCode}, {DirectionSent, PacketPong}}
+	for i, packet := range packets {
+		if packet.Direction != expected[i].direction || packet.Cmd != expected[i].cmd {
+			t.Errorf("Wrong packet %d recorded. Got %v", i, packet)
+		}
+		if packet.Time.Before(before.Add(-time.Second)) {
+			t.Errorf("Wrong timestamp for packet %d. Got %v", i, packet.Time)
+		}
+	}
+
+	recordedLogin := &Spotify.ClientResponseEncrypted{}
+	err = proto.Unmarshal(packets[0].Data, recordedLogin)
+	if err != nil || recordedLogin.GetLoginCredentials().GetUsername() != "user" {
+		t.Errorf("Login packet not recorded. Got %v, %v", recordedLogin, err)
+	}
+	if bytes.Contains(packets[0].Data, []byte("secret")) {
+		t.Errorf("Credentials were recorded")
+	}
+	if string(packets[1].Data) != "SE" {
+		t.Errorf("Wrong payload recorded. Got %q", packets[1].Data)
+	}
+}
+
+func TestRecordSecrets(t *testing.T) {
+	header := func(uri string) []byte {
+		data, _ := proto.Marshal(&Spotify.Header{Uri: proto.String(uri)})
+		return data
+	}
+	seq := []byte{0, 0, 0, 7}
+	token := []byte(`{"accessToken":"secret-token"}`)
+
+	buf := new(bytes.Buffer)
+	recorder := NewPacketRecorder(buf)
+	stream := recorder.Wrap(&scriptedStream{recv: []RecordedPacket{
+		{Cmd: PacketAesKey, Data: append([]byte{0, 0, 0, 1}, bytes.Repeat([]byte{0xaa}, 16)...)},
+		// The token response is split in two packets
+		{Cmd: PacketMercuryReq, Data: encodeMercuryPacket(seq, 2, [][]byte{header("hm://keymaster/token"), token[:10]})},
+		{Cmd: PacketMercuryReq, Data: encodeMercuryPacket(seq, 1, [][]byte{token[10:]})},
+		{Cmd: PacketMercuryReq, Data: encodeMercuryPacket([]byte{0, 0, 0, 8}, 1,
+			[][]byte{header("hm://metadata/4/track/00"), []byte("metadata")})},
+	}})
+
+	stream.RecvPacket()
+	stream.SendPacket(PacketMercuryReq, encodeMercuryPacket(seq, 1, [][]byte{header("hm://keymaster/token")}))
+	for i := 0; i < 3; i++ {
+		stream.RecvPacket()
+	}
+
+	packets, err := ReadRecording(buf)
+	if err != nil || len(packets) != 5 {
+		t.Fatalf("Wrong recording. Got %v, %v", packets, err)
+	}
+	if !bytes.Equal(packets[0].Data, append([]byte{0, 0, 0, 1}, make([]byte, 16)...)) {
+		t.Errorf("Audio key recorded. Got %x", packets[0].Data)
+	}
+	for _, packet := range packets[1:4] {
+		if bytes.Contains(packet.Data, []byte("secret")) {
+			t.Errorf("Token recorded. Got %q", packet.Data)
+		}
+	}
+	if _, _, parts, err := decodeMercuryPacket(packets[2].Data); err != nil || len(parts) != 2 ||
+		!bytes.Equal(parts[0], header("hm://keymaster/token")) {
+		t.Errorf("Header of the token response not recorded. Got %q, %v", parts, err)
+	}
+	if !bytes.Contains(packets[4].Data, []byte("metadata")) {
+		t.Errorf("Other mercury responses must be recorded as is. Got %q", packets[4].Data)
+	}
+}
+
+func TestReadRecordingErrors(t *testing.T) {
+	packets, err := ReadRecording(bytes.NewReader(nil))
+	if err != nil || len(packets) != 0 {
+		t.Errorf("Empty recording not accepted. Got %v, %v", packets, err)
+	}
+
+	_, err = ReadRecording(bytes.NewReader([]byte("not a recording")))
+	if err == nil {
+		t.Errorf("Invalid recording accepted")
+	}
+
+	buf := new(bytes.Buffer)
+	NewPacketRecorder(buf).Wrap(&scriptedStream{}).SendPacket(PacketPong, []byte{1, 2, 3})
+	packets, err = ReadRecording(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	if !errors.Is(err, io.ErrUnexpectedEOF) || len(packets) != 0 {
+		t.Errorf("Truncated recording accepted. Got %v, %v", packets, err)
+	}
+
+	// The size of the packets is checked before allocating their payload
+	huge := append(append([]byte{}, recordMagic...), recordVersion, uint8(DirectionReceived))
+	huge = append(huge, make([]byte, 9)...)
+	huge = append(huge, 0xff, 0xff, 0xff, 0xff)
+	if _, err := ReadRecording(bytes.NewReader(huge)); err == nil {
+		t.Errorf("Oversized packet accepted")
+	}
+}
+
+func TestReplayer(t *testing.T) {
+	replayer := NewReplayer([]RecordedPacket{
+		{Direction: DirectionReceived, Cmd: PacketCountryCode},
+		{Direction: DirectionSent, Cmd: PacketMercuryReq},
+		{Direction: DirectionReceived, Cmd: PacketMercuryReq, Data: []byte{1}},
+	})
+
+	cmd, _, err := replayer.RecvPacket()
+	if err != nil || cmd != PacketCountryCode {
+		t.Fatalf("Wrong first packet. Got 0x%x, %v", cmd, err)
+	}
+
+	// The response must wait for the request
+	received := make(chan uint8)
+	go func() {
+		cmd, _, _ := replayer.RecvPacket()
+		received <- cmd
+	}()
+	select {
+	case <-received:
+		t.Fatal("Response replayed before the request")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	err = replayer.SendPacket(PacketMercuryReq, []byte{})
+	if err != nil {
+		t.Fatalf("Expected request refused: %v", err)
+	}
+	if cmd := <-received; cmd != PacketMercuryReq {
+		t.Errorf("Wrong response replayed. Got 0x%x", cmd)
+	}
+	if !replayer.Done() {
+		t.Errorf("Replay not done")
+	}
+
+	err = replayer.SendPacket(PacketPong, []byte{})
+	if !errors.Is(err, ErrReplayDiverged) {
+		t.Errorf("Expected the replay to diverge. Got %v", err)
+	}
+
+	replayer.Close()
+	if _, _, err := replayer.RecvPacket(); err != io.EOF {
+		t.Errorf("Expected io.EOF once closed. Got %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/librespot-org/librespot-golang/Spotify"
+)
+
+// accountSubscriberBuffer is the capacity of the channels returned by SubscribeAccount
+const accountSubscriberBuffer = 8
+
+// Account describes the account a session is logged in with, as reported by the AP. The AP sends these information
+// in several packets after the login, and may update them during the session, e.g. when the user upgrades to premium.
+type Account struct {
+	// Username is the canonical username of the account
+	Username string
+	// LoginType is the kind of account the user logged in with, a Spotify or a Facebook account. See Product for the
+	// free or premium subscription.
+	LoginType Spotify.AccountType
+	// Product is the subscription of the account, e.g. "premium", "free" or "open", as given by the type product
+	// attribute
+	Product string
+	// Attributes holds all the product attributes, e.g. "catalogue", "head-files-url" or "streaming-rules"
+	Attributes map[string]string
+	// LicenseVersion is the license version of the account, e.g. "1.0.1-FR"
+	LicenseVersion string
+	// Country is the country code of the user
+	Country string
+}
+
+// Premium reports whether the account has a premium subscription, required for the high quality formats and for
+// Spotify Connect
+func (a Account) Premium() bool {
+	return a.Product == "premium"
+}
+
+// Attribute returns the value of the specified product attribute, or "" if the AP didn't send it
+func (a Account) Attribute(name string) string {
+	return a.Attributes[name]
+}
+
+func (a Account) copy() Account {
+	if a.Attributes == nil {
+		return a
+	}
+	attributes := make(map[string]string, len(a.Attributes))
+	for name, value := range a.Attributes {
+		attributes[name] = value
+	}
+	a.Attributes = attributes
+	return a
+}
+
+// accountBroadcaster keeps the account information of a session and fans out its changes to the subscribers
+type accountBroadcaster struct {
+	lock        sync.Mutex
+	account     Account
+	closed      bool
+	subscribers map[chan Account]struct{}
+}
+
+func (b *accountBroadcaster) get() Account {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.account.copy()
+}
+
+// update applies change to the account, and notifies the subscribers if it actually changed
+func (b *accountBroadcaster) update(change func(account *Account)) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	account := b.account.copy()
+	change(&account)
+	if reflect.DeepEqual(account, b.account) {
+		return
+	}
+	b.account = account
+
+	for ch := range b.subscribers {
+		// Never block the session on a slow subscriber, the update is dropped instead
+		select {
+		case ch <- account.copy():
+		default:
+		}
+	}
+}
+
+func (b *accountBroadcaster) subscribe() (<-chan Account, func()) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	ch := make(chan Account, accountSubscriberBuffer)
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+
+	if b.subscribers == nil {
+		b.subscribers = make(map[chan Account]struct{})
+	}
+	b.subscribers[ch] = struct{}{}
+
+	cancel := func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if _, ok := b.subscribers[ch]; ok {
+			close(ch)
+			delete(b.subscribers, ch)
+		}
+	}
+
+	return ch, cancel
+}
+
+// close closes all the subscriber channels, no update is sent afterwards
+func (b *accountBroadcaster) close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.closed = true
+	for ch := range b.subscribers {
+		close(ch)
+		delete(b.subscribers, ch)
+	}
+}
+
+// productInfo is the XML document of the PacketProductInfo packet, e.g.
+// <products><product><type>premium</type><catalogue>premium</catalogue>...</product></products>
+type productInfo struct {
+	Product struct {
+		Attributes []struct {
+			XMLName xml.Name
+			Value   string `xml:",chardata"`
+		} `xml:",any"`
+	} `xml:"product"`
+}
+
+func parseProductInfo(data []byte) (map[string]string, error) {
+	info := &productInfo{}
+	err := xml.Unmarshal(data, info)
+	if err != nil {
+		return nil, err
+	}
+
+	attributes := make(map[string]string, len(info.Product.Attributes))
+	for _, attribute := range info.Product.Attributes {
+		attributes[attribute.XMLName.Local] = attribute.Value
+	}
+	return attributes, nil
+}
+
+// parseLicenseVersion decodes the PacketLicenseVersion packet: [ uint16 id (= 0x001), uint8 len, string license ]
+func parseLicenseVersion(data []byte) (string, error) {
+	reader := bytes.NewReader(data)
+
+	var id uint16
+	var length uint8
+	err := binary.Read(reader, binary.BigEndian, &id)
+	if err == nil {
+		err = binary.Read(reader, binary.BigEndian, &length)
+	}
+	if err != nil || reader.Len() < int(length) {
+		return "", fmt.Errorf("truncated license version")
+	}
+
+	return string(data[3 : 3+int(length)]), nil
+}
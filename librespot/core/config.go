@@ -0,0 +1,232 @@
+package core
+
+import (
+	"context"
+	"crypto/rsa"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/librespot-org/librespot-golang/Spotify"
+	"github.com/librespot-org/librespot-golang/librespot/connection"
+	"github.com/librespot-org/librespot-golang/librespot/discovery"
+	"github.com/librespot-org/librespot-golang/librespot/logging"
+	"github.com/librespot-org/librespot-golang/librespot/mercury"
+	"github.com/librespot-org/librespot-golang/librespot/metrics"
+	"github.com/librespot-org/librespot-golang/librespot/utils"
+)
+
+// DefaultHashCashBudget is the default maximum time spent solving the proof-of-work challenge of the handshake.
+// Legitimate challenges are cheap to solve, so this budget only protects against unreasonable ones.
+const DefaultHashCashBudget = 10 * time.Second
+
+// SessionConfig holds the settings used to create a Session. The zero value is valid and behaves like the
+// package-level Login functions: APs are resolved through Spotify's AP resolve endpoint and dialed directly.
+type SessionConfig struct {
+	// Resolver provides the APs to connect to, in order of preference. When connecting to one of them fails, the
+	// next one is tried. Spotify's AP resolve endpoint is used when nil.
+	Resolver utils.APResolver
+	// Dialer opens the connections to the APs, e.g. through a proxy. A zero net.Dialer is used when nil.
+	Dialer connection.Dialer
+	// ReconnectPolicy is the policy used to reconnect once the connection is lost. DefaultReconnectPolicy is used
+	// when nil.
+	ReconnectPolicy *ReconnectPolicy
+	// ReadTimeout is the time after which the connection is considered dead, and the session reconnects, when no
+	// packet has been received from the AP. DefaultReadTimeout is used when 0, a negative value disables the timeout.
+	ReadTimeout time.Duration
+	// MercuryTimeout is the time after which the mercury requests without response are abandoned, whatever their
+	// context. mercury.DefaultTimeout is used when 0, a negative value disables the timeout.
+	MercuryTimeout time.Duration
+	// MercuryRetryPolicy is the policy followed by the mercury typed getters to retry their requests after a 5xx
+	// response. mercury.DefaultRetryPolicy is used when nil.
+	MercuryRetryPolicy *mercury.RetryPolicy
+	// MetadataCache caches the metadata fetched by the mercury typed getters, e.g. a mercury.MemoryCache or a
+	// mercury.DiskCache. It may be shared by several sessions, such as the sessions of a SessionManager, as the keys
+	// include the country of the user. Nothing is cached when nil.
+	MetadataCache mercury.MetadataCache
+	// MetadataCacheTTL is the time the metadata stay in MetadataCache when the server doesn't specify it.
+	// mercury.DefaultCacheTTL is used when 0.
+	MetadataCacheTTL time.Duration
+	// HashCashBudget is the maximum time spent solving the proof-of-work challenge the AP may send during the
+	// handshake, the connection fails with crypto.ErrHashCashBudget once exceeded. DefaultHashCashBudget is used when 0.
+	HashCashBudget time.Duration
+	// ServerKey is the RSA key the AP must have signed its Diffie-Hellman key with, the connection fails with
+	// crypto.ErrInvalidSignature otherwise. Spotify's key is used when nil.
+	ServerKey *rsa.PublicKey
+	// InsecureSkipVerify disables the verification of the AP signature, which leaves the session open to
+	// man-in-the-middle attacks. It is only meant for test APs unable to sign their key, prefer setting ServerKey.
+	InsecureSkipVerify bool
+	// Logger receives the logs of the session and of its components, nothing is logged when nil. A *slog.Logger can
+	// be used, the messages carry the field names defined in the logging package.
+	Logger logging.Logger
+	// Metrics receives the events of the session, its mercury client and its player, e.g. to expose them to
+	// Prometheus with the metrics/prometheus module. Nothing is reported when nil.
+	Metrics metrics.Metrics
+	// Recorder records the decrypted packets exchanged with the APs when set, e.g. to attach a trace to a bug report
+	Recorder *connection.PacketRecorder
+	// CredentialStore receives the reusable credentials of the session after each login, including the
+	// reconnections, as the AP may rotate them. LoginStored logs in with the credentials it holds. Nothing is saved
+	// when nil.
+	CredentialStore CredentialStore
+}
+
+func (c *SessionConfig) resolver() utils.APResolver {
+	if c.Resolver == nil {
+		return &utils.HTTPAPResolver{}
+	}
+	return c.Resolver
+}
+
+func (c *SessionConfig) dialer() connection.Dialer {
+	if c.Dialer == nil {
+		return &net.Dialer{}
+	}
+	return c.Dialer
+}
+
+func (c *SessionConfig) readTimeout() time.Duration {
+	if c.ReadTimeout == 0 {
+		return DefaultReadTimeout
+	} else if c.ReadTimeout < 0 {
+		return 0
+	}
+	return c.ReadTimeout
+}
+
+func (c *SessionConfig) mercuryTimeout() time.Duration {
+	if c.MercuryTimeout == 0 {
+		return mercury.DefaultTimeout
+	} else if c.MercuryTimeout < 0 {
+		return 0
+	}
+	return c.MercuryTimeout
+}
+
+func (c *SessionConfig) mercuryRetryPolicy() mercury.RetryPolicy {
+	if c.MercuryRetryPolicy == nil {
+		return mercury.DefaultRetryPolicy()
+	}
+	return *c.MercuryRetryPolicy
+}
+
+func (c *SessionConfig) hashCashBudget() time.Duration {
+	if c.HashCashBudget <= 0 {
+		return DefaultHashCashBudget
+	}
+	return c.HashCashBudget
+}
+
+func (c *SessionConfig) reconnectPolicy() ReconnectPolicy {
+	if c.ReconnectPolicy == nil {
+		return DefaultReconnectPolicy()
+	}
+	return *c.ReconnectPolicy
+}
+
+// Login to Spotify using username and password. The context only bounds the login: use Session.Close to terminate
+// the session afterwards.
+func (c *SessionConfig) Login(ctx context.Context, username string, password string, deviceName string) (*Session, error) {
+	s, err := setupSession(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.loginSession(ctx, username, password, deviceName); err != nil {
+		s.Close(ctx)
+		return nil, err
+	}
+	return s, nil
+}
+
+// LoginSaved logs in to Spotify using an existing authData blob
+func (c *SessionConfig) LoginSaved(ctx context.Context, username string, authData []byte, deviceName string) (*Session, error) {
+	return c.loginCredentials(ctx, Credentials{
+		Username: username,
+		Type:     Spotify.AuthenticationType_AUTHENTICATION_STORED_SPOTIFY_CREDENTIALS,
+		AuthData: authData,
+	}, deviceName)
+}
+
+// LoginStored logs in to Spotify using the credentials of username held by the CredentialStore, e.g. saved by a
+// previous Login. It fails with ErrNoCredentials when there are none.
+func (c *SessionConfig) LoginStored(ctx context.Context, username string, deviceName string) (*Session, error) {
+	if c.CredentialStore == nil {
+		return nil, fmt.Errorf("%w: no credential store configured", ErrNoCredentials)
+	}
+	credentials, err := c.CredentialStore.Load(username)
+	if err != nil {
+		return nil, err
+	}
+	return c.loginCredentials(ctx, credentials, deviceName)
+}
+
+func (c *SessionConfig) loginCredentials(ctx context.Context, credentials Credentials, deviceName string) (*Session, error) {
+	s, err := setupSession(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	s.setDevice(utils.GenerateDeviceId(deviceName), deviceName)
+
+	packet, err := makeLoginBlobPacket(credentials.Username, credentials.AuthData, credentials.Type.Enum(), s.deviceId)
+	if err == nil {
+		err = s.login(ctx, packet, credentials.Username)
+	}
+	if err != nil {
+		s.Close(ctx)
+		return nil, err
+	}
+	return s, nil
+}
+
+// LoginWithToken logs in to Spotify using an OAuth access token with the "streaming" scope. The session then
+// reconnects with the reusable credentials returned by the AP, so the token is only needed to log in.
+func (c *SessionConfig) LoginWithToken(ctx context.Context, accessToken string, deviceName string) (*Session, error) {
+	return c.loginCredentials(ctx, Credentials{
+		Type:     Spotify.AuthenticationType_AUTHENTICATION_SPOTIFY_TOKEN,
+		AuthData: []byte(accessToken),
+	}, deviceName)
+}
+
+// LoginWithTokenProvider is like LoginWithToken, with the access token returned by provider
+func (c *SessionConfig) LoginWithTokenProvider(ctx context.Context, provider TokenProvider, deviceName string) (*Session, error) {
+	token, err := provider.Token(ctx)
+	if err != nil {
+		return nil, authError("getting token", err)
+	}
+	return c.LoginWithToken(ctx, token.AccessToken, deviceName)
+}
+
+// LoginDiscovery registers librespot as a Spotify Connect device via mdns, and logs in once a user connects to it.
+// The credentials are saved to the CredentialStore, so that LoginStored can log in again without the user.
+func (c *SessionConfig) LoginDiscovery(ctx context.Context, deviceName string) (*Session, error) {
+	deviceId := utils.GenerateDeviceId(deviceName)
+	disc, err := discovery.LoginFromConnect("", deviceId, deviceName, logging.With(c.Logger, logging.KeyDevice, deviceId))
+	if err != nil {
+		return nil, err
+	}
+	return sessionFromDiscovery(ctx, c, disc)
+}
+
+// LoginDiscoveryBlob logs in using an authentication blob obtained through the Spotify Connect discovery system
+func (c *SessionConfig) LoginDiscoveryBlob(ctx context.Context, username string, blob string, deviceName string) (*Session, error) {
+	deviceId := utils.GenerateDeviceId(deviceName)
+	disc, err := discovery.CreateFromBlob(utils.BlobInfo{
+		Username:    username,
+		DecodedBlob: blob,
+	}, "", deviceId, deviceName, logging.With(c.Logger, logging.KeyDevice, deviceId))
+	if err != nil {
+		return nil, err
+	}
+	return sessionFromDiscovery(ctx, c, disc)
+}
+
+// LoginDiscoveryBlobFile logs in from the credentials at cacheBlobPath previously saved by LoginDiscovery
+func (c *SessionConfig) LoginDiscoveryBlobFile(ctx context.Context, cacheBlobPath, deviceName string) (*Session, error) {
+	deviceId := utils.GenerateDeviceId(deviceName)
+	disc, err := discovery.CreateFromFile(cacheBlobPath, deviceId, deviceName,
+		logging.With(c.Logger, logging.KeyDevice, deviceId))
+	if err != nil {
+		return nil, err
+	}
+	return sessionFromDiscovery(ctx, c, disc)
+}
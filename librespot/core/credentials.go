@@ -0,0 +1,271 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/librespot-org/librespot-golang/Spotify"
+	"github.com/librespot-org/librespot-golang/librespot/crypto"
+	"golang.org/x/crypto/scrypt"
+)
+
+// ErrNoCredentials is returned by CredentialStore.Load when no credentials are stored for the username
+var ErrNoCredentials = errors.New("no stored credentials")
+
+// Credentials are the reusable credentials of an account, as returned by the AP once logged in
+type Credentials struct {
+	// Username is the canonical username of the account
+	Username string `json:"username"`
+	// Type is the kind of AuthData, usually AUTHENTICATION_STORED_SPOTIFY_CREDENTIALS
+	Type Spotify.AuthenticationType `json:"type"`
+	// AuthData is the opaque credentials blob
+	AuthData []byte `json:"auth_data"`
+}
+
+// CredentialStore persists the reusable credentials of the accounts. When set in the SessionConfig, the sessions
+// save their credentials after each login, including the reconnections, as the AP may rotate them. The stores must
+// be safe for concurrent use.
+type CredentialStore interface {
+	// Load returns the credentials of username, or ErrNoCredentials if there are none
+	Load(username string) (Credentials, error)
+	// Save stores credentials, replacing the previous ones of the same username
+	Save(credentials Credentials) error
+	// Delete removes the credentials of username, it doesn't fail if there are none
+	Delete(username string) error
+}
+
+// MemoryCredentialStore keeps the credentials in memory, e.g. for tests or short-lived processes. The zero value is
+// ready to use.
+type MemoryCredentialStore struct {
+	lock        sync.Mutex
+	credentials map[string]Credentials
+}
+
+func (s *MemoryCredentialStore) Load(username string) (Credentials, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	credentials, ok := s.credentials[username]
+	if !ok {
+		return Credentials{}, fmt.Errorf("%w for %s", ErrNoCredentials, username)
+	}
+	credentials.AuthData = append([]byte{}, credentials.AuthData...)
+	return credentials, nil
+}
+
+func (s *MemoryCredentialStore) Save(credentials Credentials) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.credentials == nil {
+		s.credentials = make(map[string]Credentials)
+	}
+	credentials.AuthData = append([]byte{}, credentials.AuthData...)
+	s.credentials[credentials.Username] = credentials
+	return nil
+}
+
+func (s *MemoryCredentialStore) Delete(username string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.credentials, username)
+	return nil
+}
+
+// FileCredentialStore keeps the credentials of all the accounts in a JSON file, only readable by its owner. The file
+// is replaced atomically on each change, so it is never left half-written. The credentials are stored in clear, wrap
+// the store with NewEncryptedCredentialStore to encrypt them.
+type FileCredentialStore struct {
+	// Path is the path of the file, it is created on the first Save
+	Path string
+
+	lock sync.Mutex
+}
+
+func (s *FileCredentialStore) read() (map[string]Credentials, error) {
+	data, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return make(map[string]Credentials), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	all := make(map[string]Credentials)
+	err = json.Unmarshal(data, &all)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", s.Path, err)
+	}
+	return all, nil
+}
+
+func (s *FileCredentialStore) write(all map[string]Credentials) error {
+	data, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Chmod(0600)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), s.Path)
+}
+
+func (s *FileCredentialStore) Load(username string) (Credentials, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	all, err := s.read()
+	if err != nil {
+		return Credentials{}, err
+	}
+	credentials, ok := all[username]
+	if !ok {
+		return Credentials{}, fmt.Errorf("%w for %s", ErrNoCredentials, username)
+	}
+	return credentials, nil
+}
+
+func (s *FileCredentialStore) Save(credentials Credentials) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	all, err := s.read()
+	if err != nil {
+		return err
+	}
+	all[credentials.Username] = credentials
+	return s.write(all)
+}
+
+func (s *FileCredentialStore) Delete(username string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	all, err := s.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := all[username]; !ok {
+		return nil
+	}
+	delete(all, username)
+	return s.write(all)
+}
+
+// ErrWrongPassphrase is returned when the credentials can't be decrypted, because the passphrase is wrong or the
+// encrypted data has been altered
+var ErrWrongPassphrase = errors.New("wrong passphrase or corrupted credentials")
+
+// The format of the encrypted credentials: [ uint8 version, salt, nonce, AES-GCM ciphertext ], the key being derived
+// from the passphrase and the salt with scrypt
+const (
+	encryptedCredentialsVersion = 1
+	encryptedSaltSize           = 16
+	scryptN                     = 1 << 15
+	scryptR                     = 8
+	scryptP                     = 1
+)
+
+type encryptedCredentialStore struct {
+	store      CredentialStore
+	passphrase []byte
+}
+
+// NewEncryptedCredentialStore returns a CredentialStore encrypting the credentials with AES-GCM before saving them to
+// store, with a key derived from passphrase using scrypt. The username and type of the credentials are kept in clear,
+// so that store can index them, but they are authenticated along with the encrypted data.
+func NewEncryptedCredentialStore(store CredentialStore, passphrase []byte) CredentialStore {
+	return &encryptedCredentialStore{store: store, passphrase: append([]byte{}, passphrase...)}
+}
+
+func (s *encryptedCredentialStore) aead(salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(s.passphrase, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// additionalData binds the ciphertext to the clear fields of the credentials
+func additionalData(credentials Credentials) []byte {
+	return []byte(fmt.Sprintf("%s\x00%d", credentials.Username, credentials.Type))
+}
+
+func (s *encryptedCredentialStore) Load(username string) (Credentials, error) {
+	credentials, err := s.store.Load(username)
+	if err != nil {
+		return credentials, err
+	}
+
+	data := credentials.AuthData
+	if len(data) < 1+encryptedSaltSize || data[0] != encryptedCredentialsVersion {
+		return Credentials{}, ErrWrongPassphrase
+	}
+	salt := data[1 : 1+encryptedSaltSize]
+	aead, err := s.aead(salt)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	sealed := data[1+encryptedSaltSize:]
+	if len(sealed) < aead.NonceSize() {
+		return Credentials{}, ErrWrongPassphrase
+	}
+	nonce := sealed[:aead.NonceSize()]
+	authData, err := aead.Open(nil, nonce, sealed[aead.NonceSize():], additionalData(credentials))
+	if err != nil {
+		return Credentials{}, ErrWrongPassphrase
+	}
+
+	credentials.AuthData = authData
+	return credentials, nil
+}
+
+func (s *encryptedCredentialStore) Save(credentials Credentials) error {
+	salt := crypto.RandomVec(encryptedSaltSize)
+	aead, err := s.aead(salt)
+	if err != nil {
+		return err
+	}
+	nonce := crypto.RandomVec(aead.NonceSize())
+
+	data := append([]byte{encryptedCredentialsVersion}, salt...)
+	data = append(data, nonce...)
+	data = aead.Seal(data, nonce, credentials.AuthData, additionalData(credentials))
+
+	credentials.AuthData = data
+	return s.store.Save(credentials)
+}
+
+func (s *encryptedCredentialStore) Delete(username string) error {
+	return s.store.Delete(username)
+}
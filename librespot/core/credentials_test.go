@@ -0,0 +1,187 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/librespot-org/librespot-golang/Spotify"
+)
+
+func testCredentialStore(t *testing.T, store CredentialStore) {
+	t.Helper()
+
+	if _, err := store.Load("testUser"); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("Expected no credentials. Got %v", err)
+	}
+
+	credentials := Credentials{
+		Username: "testUser",
+		Type:     Spotify.AuthenticationType_AUTHENTICATION_STORED_SPOTIFY_CREDENTIALS,
+		AuthData: []byte("blob"),
+	}
+	for _, c := range []Credentials{credentials, {Username: "otherUser", AuthData: []byte("other")}} {
+		if err := store.Save(c); err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+	}
+	got, err := store.Load("testUser")
+	if err != nil || got.Username != credentials.Username || got.Type != credentials.Type ||
+		!bytes.Equal(got.AuthData, credentials.AuthData) {
+		t.Errorf("Wrong credentials loaded. Got %+v, %v", got, err)
+	}
+
+	// Saving again replaces the credentials
+	credentials.AuthData = []byte("rotated")
+	if err := store.Save(credentials); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if got, err := store.Load("testUser"); err != nil || string(got.AuthData) != "rotated" {
+		t.Errorf("Credentials not replaced. Got %+v, %v", got, err)
+	}
+
+	if err := store.Delete("testUser"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := store.Delete("testUser"); err != nil {
+		t.Errorf("Deleting missing credentials failed: %v", err)
+	}
+	if _, err := store.Load("testUser"); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("Expected the credentials to be deleted. Got %v", err)
+	}
+	if got, err := store.Load("otherUser"); err != nil || string(got.AuthData) != "other" {
+		t.Errorf("Wrong credentials deleted. Got %+v, %v", got, err)
+	}
+}
+
+func TestCredentialStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("memory", func(t *testing.T) {
+		testCredentialStore(t, &MemoryCredentialStore{})
+	})
+
+	t.Run("file", func(t *testing.T) {
+		path := filepath.Join(dir, "plain.json")
+		testCredentialStore(t, &FileCredentialStore{Path: path})
+
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("Wrong file permissions. Got %v", info.Mode())
+		}
+	})
+
+	t.Run("encrypted", func(t *testing.T) {
+		path := filepath.Join(dir, "encrypted.json")
+		testCredentialStore(t, NewEncryptedCredentialStore(&FileCredentialStore{Path: path}, []byte("secret")))
+
+		stored, err := (&FileCredentialStore{Path: path}).Load("otherUser")
+		if err != nil || bytes.Contains(stored.AuthData, []byte("other")) {
+			t.Errorf("Credentials stored in clear. Got %+v, %v", stored, err)
+		}
+
+		store := NewEncryptedCredentialStore(&FileCredentialStore{Path: path}, []byte("wrong"))
+		if _, err := store.Load("otherUser"); !errors.Is(err, ErrWrongPassphrase) {
+			t.Errorf("Expected a wrong passphrase error. Got %v", err)
+		}
+	})
+}
+
+func TestEncryptedCredentialsTampering(t *testing.T) {
+	inner := &MemoryCredentialStore{}
+	store := NewEncryptedCredentialStore(inner, []byte("secret"))
+	err := store.Save(Credentials{Username: "testUser", AuthData: []byte("blob")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The username is authenticated: the credentials of an account can't be moved to another one
+	credentials, _ := inner.Load("testUser")
+	credentials.Username = "otherUser"
+	inner.Save(credentials)
+	if _, err := store.Load("otherUser"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("Expected the moved credentials to be refused. Got %v", err)
+	}
+
+	credentials, _ = inner.Load("testUser")
+	credentials.AuthData[len(credentials.AuthData)-1] ^= 1
+	inner.Save(credentials)
+	if _, err := store.Load("testUser"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("Expected the altered credentials to be refused. Got %v", err)
+	}
+}
+
+func TestSessionCredentialStore(t *testing.T) {
+	server, config := newFakeAP(t)
+	defer server.Close()
+	store := &MemoryCredentialStore{}
+	config.CredentialStore = store
+	config.ReconnectPolicy = &ReconnectPolicy{InitialDelay: 10 * time.Millisecond}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := config.LoginStored(ctx, "testUser", "myDevice"); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("Expected no credentials. Got %v", err)
+	}
+
+	s, err := config.Login(ctx, "testUser", "123", "myDevice")
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	saved, err := store.Load("testUser")
+	if err != nil || !bytes.Equal(saved.AuthData, s.ReusableAuthBlob()) ||
+		saved.Type != Spotify.AuthenticationType_AUTHENTICATION_STORED_SPOTIFY_CREDENTIALS {
+		t.Fatalf("Credentials not saved after login. Got %+v, %v", saved, err)
+	}
+
+	// The credentials rotated by the AP while reconnecting are saved
+	rotated := server.RotateCredentials("testUser")
+	states, _ := s.SubscribeState()
+	server.Disconnect()
+	for state := StateReconnecting; state != StateAuthenticated; {
+		select {
+		case state = <-states:
+		case <-ctx.Done():
+			t.Fatalf("Session did not reconnect")
+		}
+	}
+	if saved, err := store.Load("testUser"); err != nil || !bytes.Equal(saved.AuthData, rotated) {
+		t.Errorf("Rotated credentials not saved. Got %+v, %v", saved, err)
+	}
+	s.Close(ctx)
+
+	s, err = config.LoginStored(ctx, "testUser", "myDevice")
+	if err != nil {
+		t.Fatalf("LoginStored failed: %v", err)
+	}
+	s.Close(ctx)
+
+	// The session manager looks up the accounts it doesn't know in the store
+	manager := NewSessionManager(ManagerConfig{Session: *config, DeviceName: "myDevice"})
+	defer manager.Close(ctx)
+	if s, err := manager.Get(ctx, "testUser"); err != nil || s.Username() != "testUser" {
+		t.Errorf("Stored account not logged in. Got %v", err)
+	}
+	if err := manager.Remove(ctx, "testUser"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if _, err := store.Load("testUser"); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("Removed account still stored. Got %v", err)
+	}
+	if _, err := manager.Get(ctx, "testUser"); !errors.Is(err, ErrUnknownAccount) {
+		t.Errorf("Expected an unknown account error. Got %v", err)
+	}
+}
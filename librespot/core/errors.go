@@ -0,0 +1,123 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/librespot-org/librespot-golang/Spotify"
+)
+
+var (
+	// ErrConnection is the kind of the errors happening while reaching the AP, or once the connection to it is lost
+	ErrConnection = errors.New("connection failed")
+	// ErrHandshake is the kind of the errors happening while negotiating the encrypted connection with the AP, before
+	// any authentication takes place
+	ErrHandshake = errors.New("handshake failed")
+	// ErrAuthFailed is the kind of the errors returned when the AP rejects the provided credentials
+	ErrAuthFailed = errors.New("authentication failed")
+	// ErrProtocol is the kind of the errors caused by a malformed or unexpected packet
+	ErrProtocol = errors.New("protocol error")
+)
+
+// SessionError is the error returned by the session operations. Its kind is one of ErrConnection, ErrHandshake,
+// ErrAuthFailed or ErrProtocol, and can be tested with errors.Is. The underlying cause, if any, is available through
+// errors.Unwrap.
+type SessionError struct {
+	// Kind is the sentinel error describing the category of the failure
+	Kind error
+	// Op is the operation that failed
+	Op string
+	// Err is the underlying cause, it may be nil
+	Err error
+}
+
+func (e *SessionError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%v: %s", e.Kind, e.Op)
+	}
+	return fmt.Sprintf("%v: %s: %v", e.Kind, e.Op, e.Err)
+}
+
+func (e *SessionError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the kind of this error
+func (e *SessionError) Is(target error) bool {
+	return target == e.Kind
+}
+
+func connectionError(op string, err error) error {
+	return &SessionError{Kind: ErrConnection, Op: op, Err: err}
+}
+
+func handshakeError(op string, err error) error {
+	return &SessionError{Kind: ErrHandshake, Op: op, Err: err}
+}
+
+func authError(op string, err error) error {
+	return &SessionError{Kind: ErrAuthFailed, Op: op, Err: err}
+}
+
+func protocolError(op string, err error) error {
+	return &SessionError{Kind: ErrProtocol, Op: op, Err: err}
+}
+
+// LoginError is the error returned when the AP refuses the login, either during the handshake or in response to the
+// credentials. It matches ErrAuthFailed with errors.Is when the credentials or the account are rejected, ErrConnection
+// when the AP asks to try again elsewhere, and ErrProtocol otherwise. Use errors.As to inspect the reason of the
+// failure.
+type LoginError struct {
+	// Code is the reason of the failure given by the AP
+	Code Spotify.ErrorCode
+	// RetryDelay is the delay suggested by the AP before trying again, it is 0 when not provided
+	RetryDelay int32
+	// Expiry is the expiry value sent by the AP along the failure, it is 0 when not provided
+	Expiry int32
+	// Description is the human-readable description of the failure, it is often empty
+	Description string
+}
+
+func newLoginError(failed *Spotify.APLoginFailed) *LoginError {
+	return &LoginError{
+		Code:        failed.GetErrorCode(),
+		RetryDelay:  failed.GetRetryDelay(),
+		Expiry:      failed.GetExpiry(),
+		Description: failed.GetErrorDescription(),
+	}
+}
+
+func (e *LoginError) Error() string {
+	if e.Description == "" {
+		return fmt.Sprintf("%v: %v", e.kind(), e.Code)
+	}
+	return fmt.Sprintf("%v: %v (%s)", e.kind(), e.Code, e.Description)
+}
+
+// Is reports whether target is the kind of the failure, which depends on its code
+func (e *LoginError) Is(target error) bool {
+	return target == e.kind()
+}
+
+func (e *LoginError) kind() error {
+	switch e.Code {
+	case Spotify.ErrorCode_TryAnotherAP, Spotify.ErrorCode_BadConnectionId:
+		// Logging in again, possibly through another AP, may succeed
+		return ErrConnection
+	case Spotify.ErrorCode_ProtocolError:
+		return ErrProtocol
+	default:
+		return ErrAuthFailed
+	}
+}
+
+// TryAnotherAP reports whether the AP asked to log in through another AP instead
+func (e *LoginError) TryAnotherAP() bool {
+	return e.Code == Spotify.ErrorCode_TryAnotherAP
+}
+
+// isTryAnotherAP reports whether err is a LoginError asking to try another AP
+func isTryAnotherAP(err error) bool {
+	var loginErr *LoginError
+	return errors.As(err, &loginErr) && loginErr.TryAnotherAP()
+}
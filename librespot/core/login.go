@@ -2,58 +2,52 @@ package core
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"fmt"
 	"github.com/golang/protobuf/proto"
 	"github.com/librespot-org/librespot-golang/Spotify"
 	"github.com/librespot-org/librespot-golang/librespot/connection"
 	"github.com/librespot-org/librespot-golang/librespot/discovery"
+	"github.com/librespot-org/librespot-golang/librespot/logging"
 	"github.com/librespot-org/librespot-golang/librespot/utils"
-	"log"
 )
 
 var Version = "master"
 var BuildID = "dev"
 
+// maxAPAttempts is the number of APs we try to log in through, when they ask us to try another AP
+const maxAPAttempts = 3
+
 // Login to Spotify using username and password
 func Login(username string, password string, deviceName string) (*Session, error) {
-	s, err := setupSession()
-	if err != nil {
-		return s, err
-	}
+	return LoginContext(context.Background(), username, password, deviceName)
+}
 
-	return s, s.loginSession(username, password, deviceName)
+// LoginContext is like Login, but gives up connecting and authenticating once ctx is done. The context only bounds
+// the login: use Session.Close to terminate the session afterwards.
+func LoginContext(ctx context.Context, username string, password string, deviceName string) (*Session, error) {
+	return (&SessionConfig{}).Login(ctx, username, password, deviceName)
 }
 
-func (s *Session) loginSession(username string, password string, deviceName string) error {
-	s.deviceId = utils.GenerateDeviceId(deviceName)
-	s.deviceName = deviceName
+func (s *Session) loginSession(ctx context.Context, username string, password string, deviceName string) error {
+	s.setDevice(utils.GenerateDeviceId(deviceName), deviceName)
 
-	err := s.startConnection()
+	loginPacket, err := makeLoginPasswordPacket(username, password, s.deviceId)
 	if err != nil {
 		return err
 	}
-	loginPacket := makeLoginPasswordPacket(username, password, s.deviceId)
-	return s.doLogin(loginPacket, username)
+	return s.login(ctx, loginPacket, username)
 }
 
 // Login to Spotify using an existing authData blob
 func LoginSaved(username string, authData []byte, deviceName string) (*Session, error) {
-	s, err := setupSession()
-	if err != nil {
-		return s, err
-	}
-	s.deviceId = utils.GenerateDeviceId(deviceName)
-	s.deviceName = deviceName
-
-	err = s.startConnection()
-	if err != nil {
-		return s, err
-	}
+	return LoginSavedContext(context.Background(), username, authData, deviceName)
+}
 
-	packet := makeLoginBlobPacket(username, authData,
-		Spotify.AuthenticationType_AUTHENTICATION_STORED_SPOTIFY_CREDENTIALS.Enum(), s.deviceId)
-	return s, s.doLogin(packet, username)
+// LoginSavedContext is like LoginSaved, but gives up connecting and authenticating once ctx is done.
+func LoginSavedContext(ctx context.Context, username string, authData []byte, deviceName string) (*Session, error) {
+	return (&SessionConfig{}).LoginSaved(ctx, username, authData, deviceName)
 }
 
 // Registers librespot as a Spotify Connect device via mdns. When user connects, logs on to Spotify and saves
@@ -61,58 +55,98 @@ func LoginSaved(username string, authData []byte, deviceName string) (*Session,
 // Spotify Connect devices and control them.
 func LoginDiscovery(cacheBlobPath string, deviceName string) (*Session, error) {
 	deviceId := utils.GenerateDeviceId(deviceName)
-	disc := discovery.LoginFromConnect(cacheBlobPath, deviceId, deviceName)
-	return sessionFromDiscovery(disc)
+	disc, err := discovery.LoginFromConnect(cacheBlobPath, deviceId, deviceName, nil)
+	if err != nil {
+		return nil, err
+	}
+	return sessionFromDiscovery(context.Background(), &SessionConfig{}, disc)
 }
 
 // Login using an authentication blob through Spotify Connect discovery system, reading an existing blob data. To read
 // from a file, see LoginDiscoveryBlobFile.
 func LoginDiscoveryBlob(username string, blob string, deviceName string) (*Session, error) {
-	deviceId := utils.GenerateDeviceId(deviceName)
-	disc := discovery.CreateFromBlob(utils.BlobInfo{
-		Username:    username,
-		DecodedBlob: blob,
-	}, "", deviceId, deviceName)
-	return sessionFromDiscovery(disc)
+	return LoginDiscoveryBlobContext(context.Background(), username, blob, deviceName)
+}
+
+// LoginDiscoveryBlobContext is like LoginDiscoveryBlob, but gives up connecting and authenticating once ctx is done.
+func LoginDiscoveryBlobContext(ctx context.Context, username string, blob string, deviceName string) (*Session, error) {
+	return (&SessionConfig{}).LoginDiscoveryBlob(ctx, username, blob, deviceName)
 }
 
 // Login from credentials at cacheBlobPath previously saved by LoginDiscovery. Similar to LoginDiscoveryBlob, except
 // it reads it directly from a file.
 func LoginDiscoveryBlobFile(cacheBlobPath, deviceName string) (*Session, error) {
-	deviceId := utils.GenerateDeviceId(deviceName)
-	disc := discovery.CreateFromFile(cacheBlobPath, deviceId, deviceName)
-	return sessionFromDiscovery(disc)
+	return LoginDiscoveryBlobFileContext(context.Background(), cacheBlobPath, deviceName)
 }
 
-// Login to Spotify using the OAuth method
-func LoginOAuth(deviceName string, clientId string, clientSecret string) (*Session, error) {
-	token := getOAuthToken(clientId, clientSecret)
-	return loginOAuthToken(token.AccessToken, deviceName)
+// LoginDiscoveryBlobFileContext is like LoginDiscoveryBlobFile, but gives up connecting and authenticating once ctx
+// is done.
+func LoginDiscoveryBlobFileContext(ctx context.Context, cacheBlobPath, deviceName string) (*Session, error) {
+	return (&SessionConfig{}).LoginDiscoveryBlobFile(ctx, cacheBlobPath, deviceName)
 }
 
-func loginOAuthToken(accessToken string, deviceName string) (*Session, error) {
-	s, err := setupSession()
+// Login to Spotify using the OAuth method. It prints the URL the user must visit to authorize the application, and
+// listens for the redirect on http://localhost:8888/callback.
+func LoginOAuth(deviceName string, clientId string, clientSecret string) (*Session, error) {
+	token, err := getOAuthToken(context.Background(), clientId, clientSecret)
 	if err != nil {
-		return s, err
+		return nil, err
 	}
+	return LoginWithToken(context.Background(), token.AccessToken, deviceName)
+}
 
-	s.deviceId = utils.GenerateDeviceId(deviceName)
-	s.deviceName = deviceName
+// LoginWithToken logs in to Spotify using an OAuth access token with the "streaming" scope, e.g. obtained through
+// AuthorizePKCE
+func LoginWithToken(ctx context.Context, accessToken string, deviceName string) (*Session, error) {
+	return (&SessionConfig{}).LoginWithToken(ctx, accessToken, deviceName)
+}
 
-	err = s.startConnection()
-	if err != nil {
-		return s, err
+// login performs the handshake on the current connection and authenticates with the given login packet. When the AP
+// asks us to try another AP, it connects to a different one and tries again, up to maxAPAttempts times.
+func (s *Session) login(ctx context.Context, packet []byte, username string) error {
+	stop := s.watchContext(ctx)
+	defer stop()
+
+	var err error
+	for attempt := 0; attempt < maxAPAttempts; attempt++ {
+		if attempt > 0 {
+			s.rejectAP()
+			if err := s.doConnect(ctx); err != nil {
+				return contextError(ctx, err)
+			}
+		}
+
+		err = s.startConnection(ctx)
+		if err == nil {
+			err = s.doLogin(packet, username)
+		}
+
+		if !isTryAnotherAP(err) {
+			break
+		}
+	}
+
+	return contextError(ctx, err)
+}
+
+// rejectAP disconnects from the current AP, and makes sure we avoid it for the next connections
+func (s *Session) rejectAP() {
+	s.connLock.Lock()
+	if s.rejectedAPs == nil {
+		s.rejectedAPs = make(map[string]bool)
+	}
+	if s.apUrl != "" {
+		s.rejectedAPs[s.apUrl] = true
 	}
+	s.connLock.Unlock()
 
-	packet := makeLoginBlobPacket("", []byte(accessToken),
-		Spotify.AuthenticationType_AUTHENTICATION_SPOTIFY_TOKEN.Enum(), s.deviceId)
-	return s, s.doLogin(packet, "")
+	s.disconnect()
 }
 
 func (s *Session) doLogin(packet []byte, username string) error {
 	err := s.stream.SendPacket(connection.PacketLogin, packet)
 	if err != nil {
-		log.Fatal("bad shannon write", err)
+		return connectionError("writing login", err)
 	}
 
 	// Pll once for authentication response
@@ -124,42 +158,84 @@ func (s *Session) doLogin(packet []byte, username string) error {
 	// Store the few interesting values
 	s.username = welcome.GetCanonicalUsername()
 	if s.username == "" {
-		// Spotify might not return a canonical username, so reuse the blob's one instead
-		s.username = s.discovery.LoginBlob().Username
+		// Spotify might not return a canonical username, so reuse the one we logged in with instead
+		s.username = username
 	}
+	previousAuthBlob := s.reusableAuthBlob
 	s.reusableAuthBlob = welcome.GetReusableAuthCredentials()
+	s.account.update(func(account *Account) {
+		account.Username = s.username
+		account.LoginType = welcome.GetAccountTypeLoggedIn()
+	})
+	if !bytes.Equal(previousAuthBlob, s.reusableAuthBlob) {
+		s.saveCredentials(welcome.GetReusableAuthCredentialsType())
+	}
+
+	if s.ctx.Err() != nil {
+		// The session has been closed during the login
+		return s.ctx.Err()
+	}
+	s.state.set(StateAuthenticated)
 
 	// Poll for acknowledge before loading - needed for gopherjs
 	// s.poll()
+	s.routines.Add(1)
 	go s.runPollLoop()
 
 	return nil
 }
 
+// saveCredentials saves the reusable credentials to the credential store, if any. A failure doesn't fail the login,
+// the session can go on with the credentials it holds.
+func (s *Session) saveCredentials(authType Spotify.AuthenticationType) {
+	if s.credentials == nil || len(s.reusableAuthBlob) == 0 {
+		return
+	}
+
+	err := s.credentials.Save(Credentials{
+		Username: s.username,
+		Type:     authType,
+		AuthData: s.reusableAuthBlob,
+	})
+	if err != nil {
+		s.log.Warn("failed to save credentials", logging.KeyError, err)
+	} else {
+		s.log.Debug("saved credentials", "username", s.username)
+	}
+}
+
 func (s *Session) handleLogin() (*Spotify.APWelcome, error) {
 	cmd, data, err := s.stream.RecvPacket()
 	if err != nil {
-		return nil, fmt.Errorf("authentication failed: %v", err)
+		return nil, connectionError("reading login response", err)
 	}
 
 	if cmd == connection.PacketAuthFailure {
-		return nil, fmt.Errorf("authentication failed")
+		failed := &Spotify.APLoginFailed{}
+		err := proto.Unmarshal(data, failed)
+		if err != nil {
+			return nil, protocolError("decoding login failure", err)
+		}
+		return nil, newLoginError(failed)
 	} else if cmd == connection.PacketAPWelcome {
 		welcome := &Spotify.APWelcome{}
 		err := proto.Unmarshal(data, welcome)
 		if err != nil {
-			return nil, fmt.Errorf("authentication failed: %v", err)
+			return nil, protocolError("decoding APWelcome", err)
 		}
-		fmt.Println("Authentication succeeded: Welcome,", welcome.GetCanonicalUsername())
-		fmt.Println("Blob type:", welcome.GetReusableAuthCredentialsType())
+		s.log.Info("authenticated", "username", welcome.GetCanonicalUsername(),
+			"blob_type", welcome.GetReusableAuthCredentialsType().String())
 		return welcome, nil
 	} else {
-		return nil, fmt.Errorf("authentication failed: unexpected cmd %v", cmd)
+		return nil, protocolError("reading login response", fmt.Errorf("unexpected cmd 0x%x", cmd))
 	}
 }
 
-func (s *Session) getLoginBlobPacket(blob utils.BlobInfo) []byte {
-	data, _ := base64.StdEncoding.DecodeString(blob.DecodedBlob)
+func (s *Session) getLoginBlobPacket(blob utils.BlobInfo) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(blob.DecodedBlob)
+	if err != nil {
+		return nil, authError("decoding login blob", err)
+	}
 
 	buffer := bytes.NewBuffer(data)
 	buffer.ReadByte()
@@ -173,13 +249,13 @@ func (s *Session) getLoginBlobPacket(blob utils.BlobInfo) []byte {
 	return makeLoginBlobPacket(blob.Username, authData, &authType, s.deviceId)
 }
 
-func makeLoginPasswordPacket(username string, password string, deviceId string) []byte {
+func makeLoginPasswordPacket(username string, password string, deviceId string) ([]byte, error) {
 	return makeLoginBlobPacket(username, []byte(password),
 		Spotify.AuthenticationType_AUTHENTICATION_USER_PASS.Enum(), deviceId)
 }
 
 func makeLoginBlobPacket(username string, authData []byte,
-	authType *Spotify.AuthenticationType, deviceId string) []byte {
+	authType *Spotify.AuthenticationType, deviceId string) ([]byte, error) {
 	versionString := "librespot-golang_" + Version + "_" + BuildID
 
 	packet := &Spotify.ClientResponseEncrypted{
@@ -199,7 +275,7 @@ func makeLoginBlobPacket(username string, authData []byte,
 
 	packetData, err := proto.Marshal(packet)
 	if err != nil {
-		log.Fatal("login marshaling error: ", err)
+		return nil, protocolError("building login packet", err)
 	}
-	return packetData
+	return packetData, nil
 }
@@ -0,0 +1,452 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/librespot-org/librespot-golang/librespot/connection"
+)
+
+// ErrAPBusy is returned when connecting to an AP which already has as many connections as allowed by
+// ManagerConfig.MaxConnsPerAP. The sessions then try the next AP.
+var ErrAPBusy = errors.New("too many connections to the AP")
+
+// ErrUnknownAccount is returned by SessionManager.Get for a username without credentials
+var ErrUnknownAccount = errors.New("unknown account")
+
+// ErrManagerClosed is returned by the operations of a closed SessionManager
+var ErrManagerClosed = errors.New("session manager closed")
+
+// ManagerConfig holds the settings of a SessionManager
+type ManagerConfig struct {
+	// Session is the configuration of the sessions. Its Dialer is wrapped to enforce MaxConnsPerAP.
+	Session SessionConfig
+	// DeviceName is the device name the sessions log in with
+	DeviceName string
+	// MaxConnsPerAP caps the number of connections open to each AP by the sessions of the manager, 0 means no limit
+	MaxConnsPerAP int
+	// IdleTimeout is the time after which a session which hasn't been returned by Get is closed, 0 means never. Its
+	// credentials are kept, so the next Get logs in again.
+	IdleTimeout time.Duration
+	// OnCredentials is called with the reusable credentials of an account whenever they change, including when the AP
+	// rotates them while a session reconnects, so that they can be persisted and passed to Restore after a restart. It
+	// is called from the goroutine logging in.
+	OnCredentials func(username string, authData []byte)
+}
+
+// SessionManager maintains a pool of sessions keyed by username, e.g. for a backend serving many users. It keeps the
+// reusable credentials of each account to log in again when a session has been closed or evicted, using LoginSaved.
+// Its methods are safe for concurrent use.
+type SessionManager struct {
+	config  ManagerConfig
+	session SessionConfig
+
+	lock     sync.Mutex
+	accounts map[string]*managedAccount
+	closed   bool
+
+	stop     chan struct{}
+	routines sync.WaitGroup
+}
+
+// managedAccount is an account of a SessionManager, its lock serializes the logins of the account
+type managedAccount struct {
+	lock     sync.Mutex
+	session  *Session
+	lastUsed time.Time
+
+	// authLock guards authData, which the sessions update while logging in, whether lock is held or not
+	authLock sync.Mutex
+	authData []byte
+}
+
+// credentials returns the reusable credentials of the account, nil if there are none
+func (a *managedAccount) credentials() []byte {
+	a.authLock.Lock()
+	defer a.authLock.Unlock()
+	return a.authData
+}
+
+// NewSessionManager creates a manager without any account. Use Login to add accounts, or Restore to add the
+// accounts whose credentials have been persisted.
+func NewSessionManager(config ManagerConfig) *SessionManager {
+	m := &SessionManager{
+		config:   config,
+		session:  config.Session,
+		accounts: make(map[string]*managedAccount),
+		stop:     make(chan struct{}),
+	}
+
+	if config.MaxConnsPerAP > 0 {
+		m.session.Dialer = &apLimiter{
+			dialer: config.Session.dialer(),
+			max:    config.MaxConnsPerAP,
+			conns:  make(map[string]int),
+		}
+	}
+
+	if config.IdleTimeout > 0 {
+		m.routines.Add(1)
+		go m.evictIdle()
+	}
+
+	return m
+}
+
+// Login logs in to an account with its password and adds it to the manager. The session of the account, if any, is
+// replaced.
+func (m *SessionManager) Login(ctx context.Context, username string, password string) (*Session, error) {
+	account, err := m.account(username, true)
+	if err != nil {
+		return nil, err
+	}
+
+	account.lock.Lock()
+	defer account.lock.Unlock()
+
+	s, err := m.sessionConfig(username, account).Login(ctx, username, password, m.config.DeviceName)
+	if err != nil {
+		if account.session == nil && account.credentials() == nil {
+			// Don't keep an account which never logged in
+			m.forget(username, account)
+		}
+		return nil, err
+	}
+
+	m.replaceSession(ctx, username, account, s)
+	return s, nil
+}
+
+// Restore adds accounts with their reusable credentials, as given to ManagerConfig.OnCredentials, and logs them in
+// concurrently. The accounts are added even when logging in fails, it is tried again by Get. It returns the errors
+// of the accounts which failed to log in, keyed by username.
+func (m *SessionManager) Restore(ctx context.Context, credentials map[string][]byte) map[string]error {
+	for username, authData := range credentials {
+		m.AddCredentials(username, authData)
+	}
+
+	errs := make(map[string]error)
+	var errsLock sync.Mutex
+	var wg sync.WaitGroup
+	for username := range credentials {
+		wg.Add(1)
+		go func(username string) {
+			defer wg.Done()
+			_, err := m.Get(ctx, username)
+			if err != nil {
+				errsLock.Lock()
+				errs[username] = err
+				errsLock.Unlock()
+			}
+		}(username)
+	}
+	wg.Wait()
+
+	return errs
+}
+
+// AddCredentials adds an account with its reusable credentials without logging in, Get logs in when needed
+func (m *SessionManager) AddCredentials(username string, authData []byte) {
+	account, err := m.account(username, true)
+	if err != nil {
+		return
+	}
+
+	account.authLock.Lock()
+	account.authData = authData
+	account.authLock.Unlock()
+}
+
+// Get returns the session of an account, logging in again with its stored credentials if it has been closed or
+// evicted. The accounts which have never been added are looked up in the CredentialStore of the session
+// configuration, if any. It fails with ErrUnknownAccount if the account has no credentials.
+func (m *SessionManager) Get(ctx context.Context, username string) (*Session, error) {
+	account, err := m.account(username, false)
+	if errors.Is(err, ErrUnknownAccount) && m.config.Session.CredentialStore != nil {
+		credentials, loadErr := m.config.Session.CredentialStore.Load(username)
+		if loadErr == nil {
+			m.AddCredentials(username, credentials.AuthData)
+			account, err = m.account(username, false)
+		} else if !errors.Is(loadErr, ErrNoCredentials) {
+			return nil, loadErr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	account.lock.Lock()
+	defer account.lock.Unlock()
+
+	if account.session != nil && account.session.State() != StateClosed {
+		account.lastUsed = time.Now()
+		return account.session, nil
+	}
+	authData := account.credentials()
+	if authData == nil {
+		return nil, fmt.Errorf("%w: %s has no stored credentials", ErrUnknownAccount, username)
+	}
+
+	s, err := m.sessionConfig(username, account).LoginSaved(ctx, username, authData, m.config.DeviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	m.replaceSession(ctx, username, account, s)
+	return s, nil
+}
+
+// replaceSession makes s the session of the account and records its credentials, account.lock must be held
+func (m *SessionManager) replaceSession(ctx context.Context, username string, account *managedAccount, s *Session) {
+	if account.session != nil && account.session != s {
+		account.session.Close(ctx)
+	}
+	account.session = s
+	account.lastUsed = time.Now()
+	m.updateCredentials(username, account, s.ReusableAuthBlob())
+}
+
+// updateCredentials records the reusable credentials of an account, and reports them to OnCredentials if they changed
+func (m *SessionManager) updateCredentials(username string, account *managedAccount, authData []byte) {
+	account.authLock.Lock()
+	if authData == nil || bytes.Equal(authData, account.authData) {
+		account.authLock.Unlock()
+		return
+	}
+	account.authData = authData
+	account.authLock.Unlock()
+
+	if m.config.OnCredentials != nil {
+		m.config.OnCredentials(username, authData)
+	}
+}
+
+// sessionConfig returns the configuration of the sessions of an account. Its CredentialStore reports the credentials
+// saved by the sessions to the manager, including the ones rotated by the AP while reconnecting.
+func (m *SessionManager) sessionConfig(username string, account *managedAccount) *SessionConfig {
+	config := m.session
+	config.CredentialStore = &accountCredentials{
+		store:    m.config.Session.CredentialStore,
+		manager:  m,
+		username: username,
+		account:  account,
+	}
+	return &config
+}
+
+// Remove closes the session of an account and forgets its credentials, deleting them from the CredentialStore of the
+// session configuration, if any. The session is closed even when deleting the credentials fails.
+func (m *SessionManager) Remove(ctx context.Context, username string) error {
+	m.lock.Lock()
+	account, ok := m.accounts[username]
+	delete(m.accounts, username)
+	m.lock.Unlock()
+
+	// The manager can't reach the session once the account is forgotten, so it must be closed whatever happens next
+	var closeErr error
+	if ok {
+		account.lock.Lock()
+		if account.session != nil {
+			closeErr = account.session.Close(ctx)
+		}
+		account.lock.Unlock()
+	}
+
+	if m.config.Session.CredentialStore != nil {
+		err := m.config.Session.CredentialStore.Delete(username)
+		if err != nil && closeErr != nil {
+			return fmt.Errorf("%w (closing the session: %v)", err, closeErr)
+		} else if err != nil {
+			return err
+		}
+	}
+	return closeErr
+}
+
+// Usernames returns the usernames of the accounts of the manager, sorted
+func (m *SessionManager) Usernames() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	usernames := make([]string, 0, len(m.accounts))
+	for username := range m.accounts {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	return usernames
+}
+
+// Close closes all the sessions and stops the manager, which must not be used afterwards. It returns the first
+// error returned by Session.Close, e.g. if ctx is done before all the sessions are closed.
+func (m *SessionManager) Close(ctx context.Context) error {
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		return nil
+	}
+	m.closed = true
+	close(m.stop)
+	accounts := m.accounts
+	m.accounts = make(map[string]*managedAccount)
+	m.lock.Unlock()
+
+	var firstErr error
+	for _, account := range accounts {
+		account.lock.Lock()
+		if account.session != nil {
+			if err := account.session.Close(ctx); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		account.lock.Unlock()
+	}
+
+	m.routines.Wait()
+	return firstErr
+}
+
+// account returns the account of a username, creating it if create is set
+func (m *SessionManager) account(username string, create bool) (*managedAccount, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closed {
+		return nil, ErrManagerClosed
+	}
+
+	account, ok := m.accounts[username]
+	if !ok {
+		if !create {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownAccount, username)
+		}
+		account = &managedAccount{}
+		m.accounts[username] = account
+	}
+	return account, nil
+}
+
+// forget removes account from the manager, unless it has been replaced in the meantime
+func (m *SessionManager) forget(username string, account *managedAccount) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.accounts[username] == account {
+		delete(m.accounts, username)
+	}
+}
+
+// evictIdle periodically closes the sessions unused for longer than the idle timeout
+func (m *SessionManager) evictIdle() {
+	defer m.routines.Done()
+
+	ticker := time.NewTicker(m.config.IdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.stop:
+			return
+		}
+
+		m.lock.Lock()
+		accounts := make([]*managedAccount, 0, len(m.accounts))
+		for _, account := range m.accounts {
+			accounts = append(accounts, account)
+		}
+		m.lock.Unlock()
+
+		for _, account := range accounts {
+			account.lock.Lock()
+			if account.session != nil && time.Since(account.lastUsed) > m.config.IdleTimeout {
+				account.session.Close(context.Background())
+				account.session = nil
+			}
+			account.lock.Unlock()
+		}
+	}
+}
+
+// accountCredentials is the CredentialStore of the sessions of a managed account. It forwards to the CredentialStore
+// of the session configuration, if any, and records the saved credentials in the account.
+type accountCredentials struct {
+	store    CredentialStore
+	manager  *SessionManager
+	username string
+	account  *managedAccount
+}
+
+func (c *accountCredentials) Load(username string) (Credentials, error) {
+	if c.store == nil {
+		return Credentials{}, fmt.Errorf("%w: %s", ErrNoCredentials, username)
+	}
+	return c.store.Load(username)
+}
+
+func (c *accountCredentials) Save(credentials Credentials) error {
+	c.manager.updateCredentials(c.username, c.account, credentials.AuthData)
+	if c.store == nil {
+		return nil
+	}
+	return c.store.Save(credentials)
+}
+
+func (c *accountCredentials) Delete(username string) error {
+	if c.store == nil {
+		return nil
+	}
+	return c.store.Delete(username)
+}
+
+// apLimiter is a connection.Dialer capping the number of connections open to each address
+type apLimiter struct {
+	dialer connection.Dialer
+	max    int
+
+	lock  sync.Mutex
+	conns map[string]int
+}
+
+func (l *apLimiter) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	l.lock.Lock()
+	if l.conns[address] >= l.max {
+		l.lock.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrAPBusy, address)
+	}
+	l.conns[address]++
+	l.lock.Unlock()
+
+	conn, err := l.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		l.release(address)
+		return nil, err
+	}
+	return &limitedConn{Conn: conn, release: func() { l.release(address) }}, nil
+}
+
+func (l *apLimiter) release(address string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.conns[address]--
+	if l.conns[address] <= 0 {
+		delete(l.conns, address)
+	}
+}
+
+// limitedConn frees its slot in the apLimiter once closed
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
@@ -0,0 +1,209 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionManager(t *testing.T) {
+	server, config := newFakeAP(t)
+	defer server.Close()
+	server.AddUser("otherUser", "456")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var credsLock sync.Mutex
+	creds := map[string][]byte{}
+	managerConfig := ManagerConfig{
+		Session:    *config,
+		DeviceName: "myDevice",
+		OnCredentials: func(username string, authData []byte) {
+			credsLock.Lock()
+			creds[username] = authData
+			credsLock.Unlock()
+		},
+	}
+	manager := NewSessionManager(managerConfig)
+
+	s, err := manager.Login(ctx, "testUser", "123")
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if _, err := manager.Login(ctx, "otherUser", "wrong"); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("Expected the login to fail. Got %v", err)
+	}
+
+	got, err := manager.Get(ctx, "testUser")
+	if err != nil || got != s {
+		t.Errorf("Expected the pooled session. Got %v, %v", got, err)
+	}
+	if _, err := manager.Get(ctx, "otherUser"); !errors.Is(err, ErrUnknownAccount) {
+		t.Errorf("Expected an unknown account error. Got %v", err)
+	}
+
+	// A closed session is replaced using the stored credentials
+	s.Close(ctx)
+	got, err = manager.Get(ctx, "testUser")
+	if err != nil || got == s || got.State() != StateAuthenticated {
+		t.Errorf("Expected a new session. Got %v, %v", got, err)
+	}
+
+	manager.Close(ctx)
+	if got.State() != StateClosed {
+		t.Errorf("Session not closed with the manager")
+	}
+
+	// A new manager restores the accounts from the persisted credentials
+	credsLock.Lock()
+	saved := creds
+	credsLock.Unlock()
+	if len(saved) != 1 || saved["testUser"] == nil {
+		t.Fatalf("Wrong credentials persisted. Got %v", saved)
+	}
+
+	manager = NewSessionManager(managerConfig)
+	defer manager.Close(ctx)
+
+	errs := manager.Restore(ctx, map[string][]byte{"testUser": saved["testUser"], "otherUser": []byte("invalid")})
+	if len(errs) != 1 || !errors.Is(errs["otherUser"], ErrAuthFailed) {
+		t.Errorf("Wrong restore errors. Got %v", errs)
+	}
+	if usernames := manager.Usernames(); len(usernames) != 2 {
+		t.Errorf("Wrong accounts restored. Got %v", usernames)
+	}
+	if s, err := manager.Get(ctx, "testUser"); err != nil || s.Username() != "testUser" {
+		t.Errorf("Restored account not logged in. Got %v", err)
+	}
+}
+
+func TestSessionManagerLimits(t *testing.T) {
+	server, config := newFakeAP(t)
+	defer server.Close()
+	server.AddUser("otherUser", "456")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	manager := NewSessionManager(ManagerConfig{
+		Session:       *config,
+		DeviceName:    "myDevice",
+		MaxConnsPerAP: 1,
+		IdleTimeout:   100 * time.Millisecond,
+	})
+	defer manager.Close(ctx)
+
+	s, err := manager.Login(ctx, "testUser", "123")
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+
+	// The only AP already has a connection
+	_, err = manager.Login(ctx, "otherUser", "456")
+	if !errors.Is(err, ErrConnection) || !errors.Is(err, ErrAPBusy) {
+		t.Errorf("Expected the AP to be busy. Got %v", err)
+	}
+
+	// The idle session gets evicted, which frees the AP
+	for s.State() != StateClosed && ctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.State() != StateClosed {
+		t.Fatalf("Idle session not evicted")
+	}
+
+	if _, err := manager.Login(ctx, "otherUser", "456"); err != nil {
+		t.Errorf("Login failed once the AP is free: %v", err)
+	}
+}
+
+func TestSessionManagerRotatedCredentials(t *testing.T) {
+	server, config := newFakeAP(t)
+	defer server.Close()
+	config.ReconnectPolicy = &ReconnectPolicy{InitialDelay: 10 * time.Millisecond}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var credsLock sync.Mutex
+	var persisted []byte
+	manager := NewSessionManager(ManagerConfig{
+		Session:    *config,
+		DeviceName: "myDevice",
+		OnCredentials: func(username string, authData []byte) {
+			credsLock.Lock()
+			persisted = authData
+			credsLock.Unlock()
+		},
+	})
+	defer manager.Close(ctx)
+
+	s, err := manager.Login(ctx, "testUser", "123")
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+
+	// The credentials rotated by the AP while the session reconnects are reported to the manager
+	rotated := server.RotateCredentials("testUser")
+	states, _ := s.SubscribeState()
+	server.Disconnect()
+	for state := StateReconnecting; state != StateAuthenticated; {
+		select {
+		case state = <-states:
+		case <-ctx.Done():
+			t.Fatalf("Session did not reconnect")
+		}
+	}
+	credsLock.Lock()
+	if !bytes.Equal(persisted, rotated) {
+		t.Errorf("Rotated credentials not reported. Got %x, expected %x", persisted, rotated)
+	}
+	credsLock.Unlock()
+
+	// The manager logs in again with the rotated credentials once the session is closed
+	s.Close(ctx)
+	if s, err := manager.Get(ctx, "testUser"); err != nil || s.State() != StateAuthenticated {
+		t.Errorf("Failed to log in again with the rotated credentials: %v", err)
+	}
+}
+
+// failingDeleteStore is a CredentialStore failing to delete credentials
+type failingDeleteStore struct {
+	MemoryCredentialStore
+}
+
+func (s *failingDeleteStore) Delete(username string) error {
+	return errors.New("read-only store")
+}
+
+func TestSessionManagerRemove(t *testing.T) {
+	server, config := newFakeAP(t)
+	defer server.Close()
+	config.CredentialStore = &failingDeleteStore{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	manager := NewSessionManager(ManagerConfig{Session: *config, DeviceName: "myDevice"})
+	defer manager.Close(ctx)
+
+	s, err := manager.Login(ctx, "testUser", "123")
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+
+	// The session must not outlive its account, even when its credentials can't be deleted
+	if err := manager.Remove(ctx, "testUser"); err == nil {
+		t.Errorf("Expected the deletion error")
+	}
+	if s.State() != StateClosed {
+		t.Errorf("Session not closed when deleting the credentials failed. Got %v", s.State())
+	}
+	if usernames := manager.Usernames(); len(usernames) != 0 {
+		t.Errorf("Account not removed. Got %v", usernames)
+	}
+}
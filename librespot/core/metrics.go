@@ -0,0 +1,28 @@
+package core
+
+import (
+	"github.com/librespot-org/librespot-golang/librespot/connection"
+	"github.com/librespot-org/librespot-golang/librespot/metrics"
+)
+
+// meteredStream reports the packets going through a PacketStream to a Metrics
+type meteredStream struct {
+	stream  connection.PacketStream
+	metrics metrics.Metrics
+}
+
+func (m *meteredStream) SendPacket(cmd uint8, data []byte) error {
+	err := m.stream.SendPacket(cmd, data)
+	if err == nil {
+		m.metrics.PacketSent(cmd, len(data))
+	}
+	return err
+}
+
+func (m *meteredStream) RecvPacket() (uint8, []byte, error) {
+	cmd, data, err := m.stream.RecvPacket()
+	if err == nil {
+		m.metrics.PacketReceived(cmd, len(data))
+	}
+	return cmd, data, err
+}
@@ -1,80 +1,357 @@
 package core
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/librespot-org/librespot-golang/librespot/crypto"
+)
+
+const (
+	// DefaultAuthURL is the authorization endpoint of Spotify's accounts service
+	DefaultAuthURL = "https://accounts.spotify.com/authorize"
+	// DefaultTokenURL is the token endpoint of Spotify's accounts service
+	DefaultTokenURL = "https://accounts.spotify.com/api/token"
 )
 
+// tokenExpiryDelta is how long before their expiry the tokens are refreshed, so that they don't expire in flight
+const tokenExpiryDelta = time.Minute
+
+// ErrTokenExpired is returned by a TokenProvider when its token has expired and can't be refreshed
+var ErrTokenExpired = errors.New("oauth token expired")
+
+// OAuth is a token issued by Spotify's accounts service
 type OAuth struct {
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
 	Scope        string `json:"scope"`
-	Error        string
+	// ExpiresIn is the lifetime of the access token in seconds, as returned by the accounts service
+	ExpiresIn int `json:"expires_in"`
+	// Expiry is the time the access token expires at, computed from ExpiresIn on receipt. It is zero when the token
+	// doesn't expire.
+	Expiry           time.Time `json:"expiry,omitempty"`
+	Error            string    `json:"error,omitempty"`
+	ErrorDescription string    `json:"error_description,omitempty"`
 }
 
-func GetOauthAccessToken(code string, redirectUri string, clientId string, clientSecret string) (*OAuth, error) {
+// Valid tells if the access token is set and doesn't expire within the next minute
+func (o *OAuth) Valid() bool {
+	return o != nil && o.AccessToken != "" && (o.Expiry.IsZero() || time.Until(o.Expiry) > tokenExpiryDelta)
+}
+
+// OAuthError is returned when the accounts service refuses a token request, e.g. with the "invalid_grant" code once
+// the refresh token has been revoked
+type OAuthError struct {
+	Code        string
+	Description string
+}
+
+func (e *OAuthError) Error() string {
+	if e.Description == "" {
+		return "oauth: " + e.Code
+	}
+	return fmt.Sprintf("oauth: %s: %s", e.Code, e.Description)
+}
+
+// OAuthConfig describes an application registered with Spotify's accounts service
+type OAuthConfig struct {
+	// ClientId is the id of the application
+	ClientId string
+	// ClientSecret is the secret of the application. It may be empty when using PKCE, which is meant for the
+	// applications unable to keep a secret, such as desktop tools.
+	ClientSecret string
+	// RedirectURI is the URI the accounts service redirects to once the user has authorized the application. It
+	// must be registered with the application. AuthorizePKCE listens on it when it is a loopback address, and on a
+	// random port of 127.0.0.1 when it is empty.
+	RedirectURI string
+	// Scopes are the scopes requested, "streaming" is needed to log in to the APs and is used when empty
+	Scopes []string
+	// AuthURL and TokenURL are the endpoints of the accounts service, Spotify's ones are used when empty
+	AuthURL  string
+	TokenURL string
+	// HTTPClient sends the token requests, http.DefaultClient is used when nil
+	HTTPClient *http.Client
+}
+
+func (c *OAuthConfig) scopes() []string {
+	if len(c.Scopes) == 0 {
+		return []string{"streaming"}
+	}
+	return c.Scopes
+}
+
+func (c *OAuthConfig) authURL() string {
+	if c.AuthURL == "" {
+		return DefaultAuthURL
+	}
+	return c.AuthURL
+}
+
+func (c *OAuthConfig) tokenURL() string {
+	if c.TokenURL == "" {
+		return DefaultTokenURL
+	}
+	return c.TokenURL
+}
+
+func (c *OAuthConfig) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+// AuthCodeURL returns the URL of the page asking the user to authorize the application. The state is sent back to
+// the redirect URI, and codeChallenge is the PKCE challenge of the code verifier, or empty without PKCE.
+func (c *OAuthConfig) AuthCodeURL(state string, codeChallenge string) string {
+	val := url.Values{}
+	val.Set("client_id", c.ClientId)
+	val.Set("response_type", "code")
+	val.Set("redirect_uri", c.RedirectURI)
+	val.Set("scope", strings.Join(c.scopes(), " "))
+	val.Set("state", state)
+	if codeChallenge != "" {
+		val.Set("code_challenge_method", "S256")
+		val.Set("code_challenge", codeChallenge)
+	}
+	return c.authURL() + "?" + val.Encode()
+}
+
+// Exchange trades an authorization code for a token. The codeVerifier is the PKCE code verifier, or empty without
+// PKCE.
+func (c *OAuthConfig) Exchange(ctx context.Context, code string, codeVerifier string) (*OAuth, error) {
 	val := url.Values{}
 	val.Set("grant_type", "authorization_code")
 	val.Set("code", code)
-	val.Set("redirect_uri", redirectUri)
-	val.Set("client_id", clientId)
-	val.Set("client_secret", clientSecret)
+	val.Set("redirect_uri", c.RedirectURI)
+	if codeVerifier != "" {
+		val.Set("code_verifier", codeVerifier)
+	}
+	return c.requestToken(ctx, val)
+}
+
+// Refresh obtains a new access token with a refresh token. The accounts service may rotate the refresh token too,
+// the previous one is kept in the returned token otherwise.
+func (c *OAuthConfig) Refresh(ctx context.Context, refreshToken string) (*OAuth, error) {
+	val := url.Values{}
+	val.Set("grant_type", "refresh_token")
+	val.Set("refresh_token", refreshToken)
+
+	auth, err := c.requestToken(ctx, val)
+	if err != nil {
+		return nil, err
+	}
+	if auth.RefreshToken == "" {
+		auth.RefreshToken = refreshToken
+	}
+	return auth, nil
+}
+
+func (c *OAuthConfig) requestToken(ctx context.Context, val url.Values) (*OAuth, error) {
+	val.Set("client_id", c.ClientId)
+	if c.ClientSecret != "" {
+		val.Set("client_secret", c.ClientSecret)
+	}
 
-	resp, err := http.PostForm("https://accounts.spotify.com/api/token", val)
+	resp, err := c.postForm(ctx, val)
 	if err != nil {
 		// Retry since there is an nginx bug that causes http2 streams to get
 		// an initial REFUSED_STREAM response
 		// https://github.com/curl/curl/issues/804
-		resp, err = http.PostForm("https://accounts.spotify.com/api/token", val)
+		resp, err = c.postForm(ctx, val)
 		if err != nil {
 			return nil, err
 		}
 	}
 	defer resp.Body.Close()
-	auth := OAuth{}
+
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
-	err = json.Unmarshal(body, &auth)
+	auth := &OAuth{}
+	err = json.Unmarshal(body, auth)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("oauth: decoding token response (HTTP %d): %w", resp.StatusCode, err)
 	}
 	if auth.Error != "" {
-		return nil, fmt.Errorf("error getting token %v", auth.Error)
+		return nil, &OAuthError{Code: auth.Error, Description: auth.ErrorDescription}
+	}
+	if resp.StatusCode != http.StatusOK || auth.AccessToken == "" {
+		return nil, fmt.Errorf("oauth: no token in response (HTTP %d)", resp.StatusCode)
+	}
+
+	if auth.ExpiresIn > 0 {
+		auth.Expiry = time.Now().Add(time.Duration(auth.ExpiresIn) * time.Second)
+	}
+	return auth, nil
+}
+
+func (c *OAuthConfig) postForm(ctx context.Context, val url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.tokenURL(), strings.NewReader(val.Encode()))
+	if err != nil {
+		return nil, err
 	}
-	return &auth, nil
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.httpClient().Do(req)
 }
 
-func getOAuthToken(clientId string, clientSecret string) OAuth {
-	ch := make(chan OAuth)
+// TokenProvider provides valid access tokens, e.g. to log in with LoginWithTokenProvider
+type TokenProvider interface {
+	// Token returns a token whose access token is valid, refreshing it if needed
+	Token(ctx context.Context) (*OAuth, error)
+}
 
-	fmt.Println("go to this url")
-	urlPath := "https://accounts.spotify.com/authorize?" +
-		"client_id=" + clientId +
-		"&response_type=code" +
-		"&redirect_uri=http://localhost:8888/callback" +
-		"&scope=streaming"
-	fmt.Println(urlPath)
+// RefreshingTokenProvider is a TokenProvider refreshing its token with the refresh token once it expires. Its
+// methods are safe for concurrent use, the concurrent calls share a single refresh.
+type RefreshingTokenProvider struct {
+	config    OAuthConfig
+	onRefresh func(token *OAuth)
 
-	http.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
-		params := r.URL.Query()
-		auth, err := GetOauthAccessToken(params.Get("code"), "http://localhost:8888/callback", clientId, clientSecret)
+	lock  sync.Mutex
+	token *OAuth
+}
+
+// NewTokenProvider creates a RefreshingTokenProvider starting with token, e.g. obtained through AuthorizePKCE or
+// persisted from a previous run. onRefresh is called with each new token, so that the rotated refresh tokens can be
+// persisted, it may be nil.
+func NewTokenProvider(config OAuthConfig, token *OAuth, onRefresh func(token *OAuth)) *RefreshingTokenProvider {
+	return &RefreshingTokenProvider{config: config, token: token, onRefresh: onRefresh}
+}
+
+// Token returns the current token, refreshing it first if it expires within the next minute. It fails with
+// ErrTokenExpired when there is no refresh token, and with an *OAuthError when the refresh is refused.
+func (p *RefreshingTokenProvider) Token(ctx context.Context) (*OAuth, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.token.Valid() {
+		return p.token, nil
+	}
+	if p.token == nil || p.token.RefreshToken == "" {
+		return nil, ErrTokenExpired
+	}
+
+	token, err := p.config.Refresh(ctx, p.token.RefreshToken)
+	if err != nil {
+		return nil, fmt.Errorf("refreshing token: %w", err)
+	}
+	p.token = token
+	if p.onRefresh != nil {
+		p.onRefresh(token)
+	}
+	return token, nil
+}
+
+// AuthorizePKCE signs the user in with the authorization code flow and PKCE, without handling their password. It
+// listens on the loopback redirect URI of the config, and calls open with the URL the user must visit, e.g. to open
+// it in a browser. It returns once the user has authorized the application and the code has been exchanged, or once
+// ctx is done.
+func AuthorizePKCE(ctx context.Context, config OAuthConfig, open func(url string) error) (*OAuth, error) {
+	address := "127.0.0.1:0"
+	path := "/callback"
+	if config.RedirectURI != "" {
+		redirect, err := url.Parse(config.RedirectURI)
 		if err != nil {
-			fmt.Fprintf(w, "Error getting token %q", err)
+			return nil, fmt.Errorf("oauth: parsing redirect URI: %w", err)
+		}
+		address, path = redirect.Host, redirect.Path
+		if path == "" {
+			path = "/"
+		}
+		if host := redirect.Hostname(); host != "localhost" && !net.ParseIP(host).IsLoopback() {
+			return nil, fmt.Errorf("oauth: redirect URI %s is not a loopback address", config.RedirectURI)
+		}
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("oauth: listening for the redirect: %w", err)
+	}
+	if config.RedirectURI == "" {
+		config.RedirectURI = "http://" + listener.Addr().String() + path
+	}
+
+	verifier := base64.RawURLEncoding.EncodeToString(crypto.RandomVec(32))
+	challenge := sha256.Sum256([]byte(verifier))
+	state := hex.EncodeToString(crypto.RandomVec(16))
+
+	type result struct {
+		token *OAuth
+		err   error
+	}
+	results := make(chan result, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		if params.Get("state") != state {
+			http.Error(w, "Invalid state", http.StatusBadRequest)
 			return
 		}
-		fmt.Fprintf(w, "Got token, loggin in")
-		ch <- *auth
+
+		var res result
+		if code := params.Get("error"); code != "" {
+			res.err = &OAuthError{Code: code, Description: params.Get("error_description")}
+		} else {
+			res.token, res.err = config.Exchange(r.Context(), params.Get("code"), verifier)
+		}
+
+		if res.err != nil {
+			fmt.Fprintf(w, "Error getting token %q", res.err)
+		} else {
+			fmt.Fprintf(w, "Got token, you can close this window")
+		}
+		select {
+		case results <- res:
+		default:
+		}
 	})
 
-	go func() {
-		log.Fatal(http.ListenAndServe(":8888", nil))
-	}()
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	defer server.Close()
 
-	return <-ch
+	err = open(config.AuthCodeURL(state, base64.RawURLEncoding.EncodeToString(challenge[:])))
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case res := <-results:
+		return res.token, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// GetOauthAccessToken trades an authorization code for a token, authenticating the application with its secret
+func GetOauthAccessToken(code string, redirectUri string, clientId string, clientSecret string) (*OAuth, error) {
+	config := OAuthConfig{ClientId: clientId, ClientSecret: clientSecret, RedirectURI: redirectUri}
+	return config.Exchange(context.Background(), code, "")
+}
+
+func getOAuthToken(ctx context.Context, clientId string, clientSecret string) (*OAuth, error) {
+	config := OAuthConfig{
+		ClientId:     clientId,
+		ClientSecret: clientSecret,
+		RedirectURI:  "http://localhost:8888/callback",
+	}
+	return AuthorizePKCE(ctx, config, func(url string) error {
+		fmt.Println("go to this url")
+		fmt.Println(url)
+		return nil
+	})
 }
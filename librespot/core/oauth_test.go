@@ -0,0 +1,208 @@
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAccounts is a fake of the token endpoint of Spotify's accounts service
+type fakeAccounts struct {
+	lock      sync.Mutex
+	requests  []url.Values
+	challenge string
+	refreshes int
+}
+
+func (a *fakeAccounts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.requests = append(a.requests, r.PostForm)
+
+	reply := func(status int, body map[string]interface{}) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if r.PostForm.Get("code") != "code" ||
+			base64.RawURLEncoding.EncodeToString(verifier[:]) != a.challenge {
+			reply(http.StatusBadRequest, map[string]interface{}{"error": "invalid_grant"})
+			return
+		}
+		reply(http.StatusOK, map[string]interface{}{
+			"access_token": "access0", "refresh_token": "refresh0", "expires_in": 3600,
+		})
+
+	case "refresh_token":
+		if r.PostForm.Get("refresh_token") == "revoked" {
+			reply(http.StatusBadRequest, map[string]interface{}{
+				"error": "invalid_grant", "error_description": "Refresh token revoked",
+			})
+			return
+		}
+		a.refreshes++
+		body := map[string]interface{}{"access_token": "access" + string(rune('0'+a.refreshes)), "expires_in": 3600}
+		if a.refreshes == 1 {
+			// The first refresh rotates the refresh token
+			body["refresh_token"] = "refresh1"
+		}
+		reply(http.StatusOK, body)
+	}
+}
+
+func TestAuthorizePKCE(t *testing.T) {
+	accounts := &fakeAccounts{}
+	server := httptest.NewServer(accounts)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	config := OAuthConfig{ClientId: "client", AuthURL: server.URL + "/authorize", TokenURL: server.URL + "/api/token"}
+	token, err := AuthorizePKCE(ctx, config, func(authURL string) error {
+		// Play the part of the browser, once the user has authorized the application
+		parsed, err := url.Parse(authURL)
+		if err != nil {
+			return err
+		}
+		params := parsed.Query()
+		if params.Get("scope") != "streaming" || params.Get("code_challenge_method") != "S256" {
+			t.Errorf("Wrong authorization URL: %s", authURL)
+		}
+		accounts.lock.Lock()
+		accounts.challenge = params.Get("code_challenge")
+		accounts.lock.Unlock()
+
+		redirect := params.Get("redirect_uri") + "?" + url.Values{
+			"code": {"code"}, "state": {params.Get("state")},
+		}.Encode()
+		go func() {
+			resp, err := http.Get(redirect)
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("AuthorizePKCE failed: %v", err)
+	}
+	if token.AccessToken != "access0" || token.RefreshToken != "refresh0" || !token.Valid() {
+		t.Errorf("Wrong token. Got %+v", token)
+	}
+	if secret := accounts.requests[0].Get("client_secret"); secret != "" {
+		t.Errorf("Client secret sent with PKCE: %s", secret)
+	}
+
+	// The redirect must carry the state of the request
+	_, err = AuthorizePKCE(ctx, config, func(authURL string) error {
+		parsed, _ := url.Parse(authURL)
+		resp, err := http.Get(parsed.Query().Get("redirect_uri") + "?code=code&state=forged")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Forged redirect accepted. Got HTTP %d", resp.StatusCode)
+		}
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the authorization to be cancelled. Got %v", err)
+	}
+}
+
+func TestTokenProvider(t *testing.T) {
+	accounts := &fakeAccounts{}
+	server := httptest.NewServer(accounts)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	config := OAuthConfig{ClientId: "client", TokenURL: server.URL}
+	var refreshed []*OAuth
+	provider := NewTokenProvider(config, &OAuth{
+		AccessToken: "access0", RefreshToken: "refresh0", Expiry: time.Now().Add(30 * time.Second),
+	}, func(token *OAuth) {
+		refreshed = append(refreshed, token)
+	})
+
+	// The token expires within the expiry delta: it is refreshed once, and the refresh token is rotated
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if token, err := provider.Token(ctx); err != nil || token.AccessToken != "access1" {
+				t.Errorf("Wrong refreshed token. Got %+v, %v", token, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if len(refreshed) != 1 || refreshed[0].RefreshToken != "refresh1" {
+		t.Fatalf("Wrong refreshes. Got %+v", refreshed)
+	}
+
+	// The next refresh uses the rotated refresh token, and keeps it when no new one is returned
+	refreshed[0].Expiry = time.Now()
+	token, err := provider.Token(ctx)
+	if err != nil || token.AccessToken != "access2" || token.RefreshToken != "refresh1" {
+		t.Errorf("Wrong refreshed token. Got %+v, %v", token, err)
+	}
+	if got := accounts.requests[len(accounts.requests)-1].Get("refresh_token"); got != "refresh1" {
+		t.Errorf("Refreshed with the wrong token. Got %s", got)
+	}
+
+	revoked := NewTokenProvider(config, &OAuth{AccessToken: "old", RefreshToken: "revoked", Expiry: time.Now()}, nil)
+	var oauthErr *OAuthError
+	if _, err := revoked.Token(ctx); !errors.As(err, &oauthErr) || oauthErr.Code != "invalid_grant" {
+		t.Errorf("Expected an invalid grant error. Got %v", err)
+	}
+
+	expired := NewTokenProvider(config, &OAuth{AccessToken: "old", Expiry: time.Now()}, nil)
+	if _, err := expired.Token(ctx); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("Expected an expired token error. Got %v", err)
+	}
+}
+
+func TestLoginWithToken(t *testing.T) {
+	server, config := newFakeAP(t)
+	defer server.Close()
+	server.AddToken("validToken", "testUser")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := config.LoginWithToken(ctx, "validToken", "myDevice")
+	if err != nil {
+		t.Fatalf("LoginWithToken failed: %v", err)
+	}
+	defer s.Close(ctx)
+	if s.Username() != "testUser" || s.ReusableAuthBlob() == nil {
+		t.Errorf("Wrong session. Got username %q", s.Username())
+	}
+
+	if _, err := config.LoginWithToken(ctx, "invalidToken", "myDevice"); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("Expected the login to fail. Got %v", err)
+	}
+
+	provider := NewTokenProvider(OAuthConfig{}, &OAuth{AccessToken: "expired", Expiry: time.Now()}, nil)
+	if _, err := config.LoginWithTokenProvider(ctx, provider, "myDevice"); !errors.Is(err, ErrTokenExpired) ||
+		!errors.Is(err, ErrAuthFailed) {
+		t.Errorf("Expected an expired token error. Got %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package core
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ReconnectPolicy describes how a Session tries to reconnect once its connection to the AP is lost. The delay before
+// the n-th attempt (starting at 0) is InitialDelay * Multiplier^n, capped to MaxDelay, and randomly spread by
+// +/- Jitter (as a fraction of the delay) so that many sessions do not hammer the APs at the same time.
+type ReconnectPolicy struct {
+	// InitialDelay is the delay before the first reconnection attempt
+	InitialDelay time.Duration
+	// MaxDelay caps the delay between two attempts, 0 means no cap
+	MaxDelay time.Duration
+	// Multiplier is the factor applied to the delay after each failed attempt
+	Multiplier float64
+	// Jitter is the fraction of the delay, between 0 and 1, by which it is randomly increased or decreased
+	Jitter float64
+	// MaxAttempts is the number of attempts after which the session gives up and closes itself, 0 means no limit
+	MaxAttempts int
+}
+
+// DefaultReconnectPolicy returns the policy used by sessions unless configured otherwise: it starts retrying after a
+// second, up to once a minute, and never gives up.
+func DefaultReconnectPolicy() ReconnectPolicy {
+	return ReconnectPolicy{
+		InitialDelay: 1 * time.Second,
+		MaxDelay:     1 * time.Minute,
+		Multiplier:   2,
+		Jitter:       0.2,
+		MaxAttempts:  0,
+	}
+}
+
+// Delay returns the time to wait before the specified attempt, starting at 0
+func (p ReconnectPolicy) Delay(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	if p.InitialDelay <= 0 {
+		return 0
+	}
+	delay := float64(p.InitialDelay) * math.Pow(multiplier, float64(attempt))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	// Without MaxDelay, the delay eventually overflows a Duration, or even becomes infinite
+	delay = math.Min(delay, math.MaxInt64)
+
+	if p.Jitter > 0 {
+		jitter := math.Min(p.Jitter, 1)
+		delay += delay * jitter * (2*rand.Float64() - 1)
+	}
+
+	if delay >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(delay)
+}
+
+// exhausted reports whether no attempt should be made after the specified number of failed attempts
+func (p ReconnectPolicy) exhausted(failedAttempts int) bool {
+	return p.MaxAttempts > 0 && failedAttempts >= p.MaxAttempts
+}
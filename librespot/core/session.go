@@ -2,10 +2,14 @@ package core
 
 import (
 	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/golang/protobuf/proto"
@@ -13,7 +17,10 @@ import (
 	"github.com/librespot-org/librespot-golang/librespot/connection"
 	"github.com/librespot-org/librespot-golang/librespot/crypto"
 	"github.com/librespot-org/librespot-golang/librespot/discovery"
+	"github.com/librespot-org/librespot-golang/librespot/logging"
 	"github.com/librespot-org/librespot-golang/librespot/mercury"
+	"github.com/librespot-org/librespot-golang/librespot/metadata"
+	"github.com/librespot-org/librespot-golang/librespot/metrics"
 	"github.com/librespot-org/librespot-golang/librespot/player"
 	"github.com/librespot-org/librespot-golang/librespot/utils"
 )
@@ -26,6 +33,13 @@ type Session struct {
 	// shannonConstructor is the constructor used to build the shannon-encrypted PacketStream connection
 	shannonConstructor func(keys crypto.SharedKeys, conn connection.PlainConnection) connection.PacketStream
 
+	// resolver provides the addresses of the APs to connect to
+	resolver utils.APResolver
+	// dialer opens the network connections to the APs
+	dialer connection.Dialer
+	// recorder records the packets exchanged with the APs, it is nil unless enabled in the SessionConfig
+	recorder *connection.PacketRecorder
+
 	/// Managers and helpers
 	// stream is the encrypted connection to the Spotify server
 	stream connection.PacketStream
@@ -37,6 +51,10 @@ type Session struct {
 	player *player.Player
 	// tcpCon is the plain I/O network connection to the server
 	tcpCon io.ReadWriter
+	// apUrl is the address of the AP tcpCon is connected to
+	apUrl string
+	// rejectedAPs holds the addresses of the APs which asked us to try another AP
+	rejectedAPs map[string]bool
 	// keys are the encryption keys used to communicate with the server
 	keys crypto.PrivateKeys
 
@@ -50,8 +68,49 @@ type Session struct {
 	username string
 	// reusableAuthBlob is the reusable authentication blob for Spotify Connect devices
 	reusableAuthBlob []byte
-	// country is the user country returned by the Spotify servers
-	country string
+	// account holds the account information returned by the Spotify servers, and notifies its subscribers
+	account accountBroadcaster
+
+	/// Lifecycle
+	// ctx is the context bounding the lifetime of the session, it is cancelled by Close
+	ctx context.Context
+	// cancel cancels ctx
+	cancel context.CancelFunc
+	// connLock protects tcpCon against concurrent reconnections and closing
+	connLock sync.Mutex
+	// routines tracks the poll loop and reconnection goroutines, so that Close can wait for them
+	routines sync.WaitGroup
+	// closeOnce ensures the session resources are released only once
+	closeOnce sync.Once
+	// state holds the current SessionState and notifies its subscribers
+	state stateBroadcaster
+	// reconnectPolicy is the policy followed to reconnect once the connection is lost
+	reconnectPolicy ReconnectPolicy
+	// mercuryTimeout is the time after which the mercury requests without response are abandoned, 0 disables it
+	mercuryTimeout time.Duration
+	// mercuryRetry is the policy followed by the mercury typed getters to retry their requests
+	mercuryRetry mercury.RetryPolicy
+	// metadataCache caches the metadata fetched by the mercury typed getters for metadataCacheTTL, it may be nil
+	metadataCache    mercury.MetadataCache
+	metadataCacheTTL time.Duration
+	// readTimeout is the time after which the connection is considered dead if no packet is received, 0 disables it
+	readTimeout time.Duration
+	// watchdog keeps track of the liveness of the connection
+	watchdog watchdog
+	// hashCashBudget is the maximum time spent solving the proof-of-work challenge of the handshake
+	hashCashBudget time.Duration
+	// log receives the logs of the session, with its id and device id as fields
+	log logging.Logger
+	// metrics receives the events of the session, it is nil when no metrics are collected
+	metrics metrics.Metrics
+	// serverKey is the key the AP signatures are verified with, nil for Spotify's key
+	serverKey *rsa.PublicKey
+	// skipVerify disables the verification of the AP signature
+	skipVerify bool
+	// credentials receives the reusable credentials after each login, it is nil when they aren't saved
+	credentials CredentialStore
+	// tokens caches the keymaster tokens of the session
+	tokens *tokenCache
 }
 
 func (s *Session) Stream() connection.PacketStream {
@@ -74,6 +133,19 @@ func (s *Session) Username() string {
 	return s.username
 }
 
+// Logger returns the logger of the session, which adds the session and device ids to the messages. It is meant for
+// the components built on top of the session, such as the Spotify Connect controller.
+func (s *Session) Logger() logging.Logger {
+	return s.log
+}
+
+// setDevice sets the device the session advertises. It must be called before logging in.
+func (s *Session) setDevice(deviceId string, deviceName string) {
+	s.deviceId = deviceId
+	s.deviceName = deviceName
+	s.log = logging.With(s.log, logging.KeyDevice, deviceId)
+}
+
 func (s *Session) DeviceId() string {
 	return s.deviceId
 }
@@ -83,179 +155,490 @@ func (s *Session) ReusableAuthBlob() []byte {
 }
 
 func (s *Session) Country() string {
-	return s.country
+	return s.account.get().Country
+}
+
+// Account returns the information about the logged in account received so far. The AP sends them right after the
+// login, so some may still be missing when Login returns: use SubscribeAccount to be notified of their arrival.
+func (s *Session) Account() Account {
+	return s.account.get()
+}
+
+// SubscribeAccount returns a channel receiving the account information each time the AP updates them, and a function
+// cancelling the subscription. The channel is buffered and updates are dropped rather than blocking the session if it
+// is full. It is closed when the session is closed, or once the subscription is cancelled.
+func (s *Session) SubscribeAccount() (<-chan Account, func()) {
+	return s.account.subscribe()
+}
+
+// State returns the current state of the session
+func (s *Session) State() SessionState {
+	return s.state.get()
+}
+
+// Stats returns the liveness and latency statistics of the connection to the AP
+func (s *Session) Stats() ConnectionStats {
+	return s.watchdog.get()
+}
+
+// SubscribeState returns a channel receiving the state transitions of the session, and a function cancelling the
+// subscription. The channel is buffered and updates are dropped rather than blocking the session if it is full. It
+// is closed after StateClosed has been delivered, or once the subscription is cancelled.
+func (s *Session) SubscribeState() (<-chan SessionState, func()) {
+	return s.state.subscribe()
+}
+
+// Close terminates the session: it stops the poll loop and any planned reconnection, closes the player, the
+// mercury client and the underlying connection. It then waits for the background goroutines to exit, or returns
+// ctx.Err() if ctx is done first. Calling Close more than once is safe.
+func (s *Session) Close(ctx context.Context) error {
+	s.closeOnce.Do(func() {
+		s.cancel()
+		s.disconnect()
+
+		if s.mercury != nil {
+			s.mercury.Close()
+		}
+		if s.player != nil {
+			s.player.Close()
+		}
+
+		s.state.set(StateClosed)
+		s.account.close()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		s.routines.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// watchContext closes the underlying connection if ctx is done before the returned stop function is called. This
+// unblocks the reads and writes of the handshake and login when the caller gives up on them.
+func (s *Session) watchContext(ctx context.Context) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.disconnect()
+		case <-stopped:
+		}
+	}()
+
+	return func() { close(stopped) }
 }
 
-func (s *Session) startConnection() error {
+func (s *Session) startConnection(ctx context.Context) error {
+	s.connLock.Lock()
+	tcpCon := s.tcpCon
+	s.connLock.Unlock()
+	if tcpCon == nil {
+		return connectionError("starting handshake", fmt.Errorf("not connected"))
+	}
+
 	// First, start by performing a plaintext connection and send the Hello message
-	conn := connection.MakePlainConnection(s.tcpCon, s.tcpCon)
+	conn := connection.MakePlainConnection(tcpCon, tcpCon)
+
+	helloMessage, err := makeHelloMessage(s.keys.PubKey(), s.keys.ClientNonce())
+	if err != nil {
+		return handshakeError("building client hello", err)
+	}
 
-	helloMessage := makeHelloMessage(s.keys.PubKey(), s.keys.ClientNonce())
 	initClientPacket, err := conn.SendPrefixPacket([]byte{0, 4}, helloMessage)
 	if err != nil {
-		log.Fatal("Error writing client hello", err)
-		return err
+		return handshakeError("writing client hello", err)
 	}
 
 	// Wait and read the hello reply
 	initServerPacket, err := conn.RecvPacket()
 	if err != nil {
-		log.Fatal("Error receving packet for hello: ", err)
-		return err
+		return handshakeError("reading server hello", err)
 	}
 
 	response := Spotify.APResponseMessage{}
 	err = proto.Unmarshal(initServerPacket[4:], &response)
 	if err != nil {
-		log.Fatal("Failed to unmarshal server hello", err)
-		return err
+		return protocolError("decoding server hello", err)
 	}
 
-	remoteKey := response.Challenge.LoginCryptoChallenge.DiffieHellman.Gs
+	if response.LoginFailed != nil {
+		return newLoginError(response.LoginFailed)
+	}
+
+	diffieHellman := response.GetChallenge().GetLoginCryptoChallenge().GetDiffieHellman()
+	if diffieHellman == nil {
+		return protocolError("decoding server hello", fmt.Errorf("missing Diffie-Hellman challenge"))
+	}
+
+	if !s.skipVerify {
+		err = crypto.VerifyServerSignature(s.serverKey, diffieHellman.Gs, diffieHellman.GsSignature)
+		if err != nil {
+			return handshakeError("verifying server signature", err)
+		}
+	}
+
+	remoteKey := diffieHellman.Gs
 	sharedKeys := s.keys.AddRemoteKey(remoteKey, initClientPacket, initServerPacket)
 
+	powResponse, err := s.solvePoW(ctx, response.GetChallenge().GetPowChallenge())
+	if err != nil {
+		return handshakeError("solving proof-of-work challenge", err)
+	}
+
 	plainResponse := &Spotify.ClientResponsePlaintext{
 		LoginCryptoResponse: &Spotify.LoginCryptoResponseUnion{
 			DiffieHellman: &Spotify.LoginCryptoDiffieHellmanResponse{
 				Hmac: sharedKeys.Challenge(),
 			},
 		},
-		PowResponse:    &Spotify.PoWResponseUnion{},
+		PowResponse:    powResponse,
 		CryptoResponse: &Spotify.CryptoResponseUnion{},
 	}
 
 	plainResponseMessage, err := proto.Marshal(plainResponse)
 	if err != nil {
-		log.Fatal("marshaling error: ", err)
-		return err
+		return handshakeError("building client response", err)
 	}
 
 	_, err = conn.SendPrefixPacket([]byte{}, plainResponseMessage)
 	if err != nil {
-		log.Fatal("error writing client plain response ", err)
-		return err
+		return handshakeError("writing client response", err)
 	}
 
 	s.stream = s.shannonConstructor(sharedKeys, conn)
-	s.mercury = s.mercuryConstructor(s.stream)
+	if s.recorder != nil {
+		s.stream = s.recorder.Wrap(s.stream)
+	}
+	if s.metrics != nil {
+		s.stream = &meteredStream{stream: s.stream, metrics: s.metrics}
+	}
+
+	// Keep the mercury client and the player across reconnections, so that the references held by their users
+	// remain valid
+	if s.mercury == nil {
+		s.mercury = s.mercuryConstructor(s.stream)
+		s.mercury.SetLogger(s.log)
+		s.mercury.SetMetrics(s.metrics)
+		s.mercury.SetTimeout(s.mercuryTimeout)
+		s.mercury.SetRetryPolicy(s.mercuryRetry)
+		if s.metadataCache != nil {
+			s.mercury.SetCache(s.metadataCache, s.metadataCacheTTL)
+		}
+	} else {
+		s.mercury.Rebind(s.stream)
+	}
 
-	s.player = player.CreatePlayer(s.stream, s.mercury)
+	if s.player == nil {
+		s.player = player.CreatePlayer(s.stream, s.mercury)
+		s.player.SetLogger(s.log)
+		s.player.SetMetrics(s.metrics)
+	} else {
+		s.player.Rebind(s.stream)
+	}
 
 	return nil
 }
 
-func setupSession() (*Session, error) {
-	session := &Session{
+// solvePoW answers the proof-of-work challenge of the AP, if any, within the hashcash budget of the session
+func (s *Session) solvePoW(ctx context.Context, challenge *Spotify.PoWChallengeUnion) (*Spotify.PoWResponseUnion, error) {
+	hashCash := challenge.GetHashCash()
+	if hashCash == nil {
+		return &Spotify.PoWResponseUnion{}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.hashCashBudget)
+	defer cancel()
+
+	// Unlike login5, the AP challenge comes without login context to derive the seed from, its target is used instead.
+	// The seed only sets where the search starts, any suffix meeting the length is valid.
+	suffix, err := crypto.SolveHashCash(ctx, hashCash.GetPrefix(), hashCash.GetLength(), int64(hashCash.GetTarget()))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Spotify.PoWResponseUnion{
+		HashCash: &Spotify.PoWHashCashResponse{
+			HashSuffix: suffix,
+		},
+	}, nil
+}
+
+// newSession allocates a Session with its default constructors and lifecycle context
+func newSession(config *SessionConfig) *Session {
+	ctx, cancel := context.WithCancel(context.Background())
+	id := hex.EncodeToString(crypto.RandomVec(4))
+	s := &Session{
 		keys:               crypto.GenerateKeys(),
 		mercuryConstructor: mercury.CreateMercury,
 		shannonConstructor: crypto.CreateStream,
+		resolver:           config.resolver(),
+		dialer:             config.dialer(),
+		recorder:           config.Recorder,
+		ctx:                ctx,
+		cancel:             cancel,
+		reconnectPolicy:    config.reconnectPolicy(),
+		readTimeout:        config.readTimeout(),
+		mercuryTimeout:     config.mercuryTimeout(),
+		mercuryRetry:       config.mercuryRetryPolicy(),
+		metadataCache:      config.MetadataCache,
+		metadataCacheTTL:   config.MetadataCacheTTL,
+		hashCashBudget:     config.hashCashBudget(),
+		serverKey:          config.ServerKey,
+		skipVerify:         config.InsecureSkipVerify,
+		log:                logging.With(config.Logger, logging.KeySession, id),
+		metrics:            config.Metrics,
+		credentials:        config.CredentialStore,
 	}
-	err := session.doConnect()
+	s.tokens = newTokenCache(func(clientId string, scopes string) (*metadata.Token, error) {
+		return s.mercury.GetToken(s.ctx, clientId, scopes)
+	})
+	return s
+}
 
-	return session, err
+// setupSession connects a new session to an AP. The session must be closed if logging in fails afterwards, so that
+// its connection is not leaked.
+func setupSession(ctx context.Context, config *SessionConfig) (*Session, error) {
+	session := newSession(config)
+	if err := session.doConnect(ctx); err != nil {
+		session.Close(ctx)
+		return nil, err
+	}
+	return session, nil
 }
 
-func sessionFromDiscovery(d *discovery.Discovery) (*Session, error) {
-	s, err := setupSession()
+func sessionFromDiscovery(ctx context.Context, config *SessionConfig, d *discovery.Discovery) (*Session, error) {
+	s, err := setupSession(ctx, config)
 	if err != nil {
 		return nil, err
 	}
 
 	s.discovery = d
-	s.deviceId = d.DeviceId()
-	s.deviceName = d.DeviceName()
+	s.setDevice(d.DeviceId(), d.DeviceName())
 
-	err = s.startConnection()
+	loginPacket, err := s.getLoginBlobPacket(d.LoginBlob())
+	if err == nil {
+		err = s.login(ctx, loginPacket, d.LoginBlob().Username)
+	}
 	if err != nil {
-		return s, err
+		s.Close(ctx)
+		return nil, err
 	}
+	return s, nil
+}
 
-	loginPacket := s.getLoginBlobPacket(d.LoginBlob())
-	return s, s.doLogin(loginPacket, d.LoginBlob().Username)
+// contextError returns the error of ctx if it is done, as it explains the failure of err better than the I/O error
+// caused by closing the connection.
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
 }
 
-func (s *Session) doConnect() error {
-	apUrl, err := utils.APResolve()
+func (s *Session) doConnect(ctx context.Context) error {
+	apUrls, err := s.resolver.ResolveAP(ctx)
 	if err != nil {
-		log.Println("Failed to get ap url", err)
-		return err
+		return connectionError("resolving AP", err)
+	}
+	if len(apUrls) == 0 {
+		return connectionError("resolving AP", fmt.Errorf("AP endpoint list is empty"))
 	}
 
-	s.tcpCon, err = net.Dial("tcp", apUrl)
+	// Try the APs in order, putting last the ones which asked us to try another AP
+	candidates := make([]string, 0, len(apUrls))
+	rejected := make([]string, 0)
+	for _, url := range apUrls {
+		if s.rejectedAPs[url] {
+			rejected = append(rejected, url)
+		} else {
+			candidates = append(candidates, url)
+		}
+	}
+	candidates = append(candidates, rejected...)
+
+	var conn net.Conn
+	var apUrl string
+	for _, apUrl = range candidates {
+		conn, err = s.dialer.DialContext(ctx, "tcp", apUrl)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		s.log.Warn("failed to connect to AP", logging.KeyAP, apUrl, logging.KeyError, err)
+	}
 	if err != nil {
-		log.Println("Failed to connect:", err)
-		return err
+		return connectionError("connecting to AP", err)
 	}
 
-	return err
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+
+	if s.ctx.Err() != nil {
+		// The session has been closed while we were dialing
+		conn.Close()
+		return s.ctx.Err()
+	}
+	s.tcpCon = conn
+	s.apUrl = apUrl
+	s.log.Info("connected to AP", logging.KeyAP, apUrl)
+
+	return nil
 }
 
 func (s *Session) disconnect() {
-	if s.tcpCon != nil {
-		conn := s.tcpCon.(net.Conn)
-		err := conn.Close()
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+
+	if closer, ok := s.tcpCon.(io.Closer); ok {
+		err := closer.Close()
 		if err != nil {
-			log.Println("Failed to close tcp connection", err)
+			s.log.Debug("failed to close the connection", logging.KeyError, err)
 		}
-		s.tcpCon = nil
 	}
+	s.tcpCon = nil
 }
 
 func (s *Session) doReconnect() error {
 	s.disconnect()
 
-	err := s.doConnect()
+	// The poll loop doesn't watch the handshake and the login, so they are bounded here, or a half-open connection
+	// would block the reconnection forever. Solving the hashcash challenge may take up to its own budget.
+	ctx := s.ctx
+	if s.readTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.readTimeout+s.hashCashBudget)
+		defer cancel()
+	}
+
+	err := s.doConnect(ctx)
 	if err != nil {
 		return err
 	}
 
-	err = s.startConnection()
+	packet, err := makeLoginBlobPacket(s.username, s.reusableAuthBlob,
+		Spotify.AuthenticationType_AUTHENTICATION_STORED_SPOTIFY_CREDENTIALS.Enum(), s.deviceId)
+	if err != nil {
+		return err
+	}
+	err = s.login(ctx, packet, s.username)
 	if err != nil {
 		return err
 	}
 
-	packet := makeLoginBlobPacket(s.username, s.reusableAuthBlob,
-		Spotify.AuthenticationType_AUTHENTICATION_STORED_SPOTIFY_CREDENTIALS.Enum(), s.deviceId)
-	return s.doLogin(packet, s.username)
+	// The mercury client survived the reconnection, but the new AP does not know about its subscriptions yet
+	return s.mercury.Resubscribe(s.ctx)
 }
 
-func (s *Session) planReconnect() {
+// SetReconnectPolicy changes the policy used to reconnect once the connection to the AP is lost. It applies to the
+// next disconnection.
+func (s *Session) SetReconnectPolicy(policy ReconnectPolicy) {
+	s.connLock.Lock()
+	s.reconnectPolicy = policy
+	s.connLock.Unlock()
+}
+
+// planReconnect schedules a reconnection attempt, attempt being the number of attempts that already failed
+func (s *Session) planReconnect(attempt int) {
+	s.state.set(StateReconnecting)
+
+	s.connLock.Lock()
+	policy := s.reconnectPolicy
+	s.connLock.Unlock()
+
+	s.routines.Add(1)
 	go func() {
-		time.Sleep(1 * time.Second)
+		defer s.routines.Done()
 
-		if err := s.doReconnect(); err != nil {
-			// Try to reconnect again in a second
-			s.planReconnect()
+		select {
+		case <-time.After(policy.Delay(attempt)):
+		case <-s.ctx.Done():
+			return
 		}
+
+		err := s.doReconnect()
+		if s.ctx.Err() != nil {
+			return
+		}
+		if s.metrics != nil {
+			s.metrics.Reconnected(err)
+		}
+		if err == nil {
+			return
+		}
+
+		s.log.Warn("failed to reconnect", "attempt", attempt+1, logging.KeyError, err)
+
+		if errors.Is(err, ErrAuthFailed) || policy.exhausted(attempt+1) {
+			// Retrying will not help, give up. Close waits for this goroutine, so it must not block on it.
+			s.log.Error("giving up reconnecting", logging.KeyError, err)
+			go s.Close(context.Background())
+			return
+		}
+
+		s.planReconnect(attempt + 1)
 	}()
 }
 
 func (s *Session) runPollLoop() {
+	defer s.routines.Done()
+
+	s.connLock.Lock()
+	deadliner, _ := s.tcpCon.(readDeadliner)
+	s.connLock.Unlock()
+
 	for {
+		if deadliner != nil && s.readTimeout > 0 {
+			// Consider the connection dead if the AP goes quiet, as a half-open connection would block us forever
+			deadliner.SetReadDeadline(time.Now().Add(s.readTimeout))
+		}
+
 		cmd, data, err := s.stream.RecvPacket()
-		if err != nil {
-			log.Println("Error during RecvPacket: ", err)
+		if s.ctx.Err() != nil {
+			// The session has been closed, the error comes from the connection being torn down
+			return
+		}
 
-			if err == io.EOF {
-				// We've been disconnected, reconnect
-				s.planReconnect()
-				break
+		if err != nil {
+			if isTimeout(err) {
+				s.log.Warn("no packet received from the AP, reconnecting", "timeout", s.readTimeout)
+				s.watchdog.timedOut()
+			} else {
+				s.log.Warn("connection lost, reconnecting", logging.KeyError, err)
 			}
-		} else {
-			s.handle(cmd, data)
+
+			// The stream can't be read further after an error, whatever its cause, reconnect
+			s.planReconnect(0)
+			return
+		}
+
+		s.watchdog.packetReceived(cmd, time.Now())
+		if err = s.handle(cmd, data); err != nil {
+			s.log.Warn("failed to handle packet", logging.KeyCmd, cmd, logging.KeyError, err)
 		}
 	}
 }
 
-func (s *Session) handle(cmd uint8, data []byte) {
+func (s *Session) handle(cmd uint8, data []byte) error {
 	//fmt.Printf("handle, cmd=0x%x data=%x\n", cmd, data)
 
 	switch {
 	case cmd == connection.PacketPing:
 		// Ping
+		s.watchdog.pongSentAt(time.Now())
 		err := s.stream.SendPacket(connection.PacketPong, data)
 		if err != nil {
-			log.Fatal("Error handling PacketPing", err)
+			return connectionError("answering ping", err)
 		}
 
 	case cmd == connection.PacketPongAck:
@@ -268,13 +651,16 @@ func (s *Session) handle(cmd uint8, data []byte) {
 
 	case cmd == connection.PacketCountryCode:
 		// Handle country code
-		s.country = fmt.Sprintf("%s", data)
+		s.mercury.SetCountry(string(data))
+		s.account.update(func(account *Account) {
+			account.Country = string(data)
+		})
 
 	case 0xb2 <= cmd && cmd <= 0xb6:
 		// Mercury responses
 		err := s.mercury.Handle(cmd, bytes.NewReader(data))
 		if err != nil {
-			log.Fatal("Handle 0xbx", err)
+			return protocolError(fmt.Sprintf("handling mercury packet 0x%x", cmd), err)
 		}
 
 	case cmd == connection.PacketSecretBlock:
@@ -285,6 +671,14 @@ func (s *Session) handle(cmd uint8, data []byte) {
 
 	case cmd == connection.PacketProductInfo:
 		// Has some info about A/B testing status, product setup, etc... in an XML fashion.
+		attributes, err := parseProductInfo(data)
+		if err != nil {
+			return protocolError("decoding product info", err)
+		}
+		s.account.update(func(account *Account) {
+			account.Product = attributes["type"]
+			account.Attributes = attributes
+		})
 
 	case cmd == 0x1f:
 		// Unknown, data is zeroes only
@@ -292,18 +686,27 @@ func (s *Session) handle(cmd uint8, data []byte) {
 	case cmd == connection.PacketLicenseVersion:
 		// This is a simple blob containing the current Spotify license version (e.g. 1.0.1-FR). Format of the blob
 		// is [ uint16 id (= 0x001), uint8 len, string license ]
+		license, err := parseLicenseVersion(data)
+		if err != nil {
+			return protocolError("decoding license version", err)
+		}
+		s.account.update(func(account *Account) {
+			account.LicenseVersion = license
+		})
 
 	default:
-		fmt.Printf("Unhandled cmd 0x%x\n", cmd)
+		s.log.Debug("unhandled packet", logging.KeyCmd, cmd)
 	}
+
+	return nil
 }
 
-func (s *Session) poll() {
+func (s *Session) poll() error {
 	cmd, data, err := s.stream.RecvPacket()
 	if err != nil {
-		log.Fatal("poll error", err)
+		return err
 	}
-	s.handle(cmd, data)
+	return s.handle(cmd, data)
 }
 
 func readInt(b *bytes.Buffer) uint32 {
@@ -326,7 +729,7 @@ func readBytes(b *bytes.Buffer) []byte {
 	return data
 }
 
-func makeHelloMessage(publicKey []byte, nonce []byte) []byte {
+func makeHelloMessage(publicKey []byte, nonce []byte) ([]byte, error) {
 	hello := &Spotify.ClientHello{
 		BuildInfo: &Spotify.BuildInfo{
 			Product:  Spotify.Product_PRODUCT_PARTNER.Enum(),
@@ -348,10 +751,5 @@ func makeHelloMessage(publicKey []byte, nonce []byte) []byte {
 		Padding: []byte{0x1e},
 	}
 
-	packetData, err := proto.Marshal(hello)
-	if err != nil {
-		log.Fatal("login marshaling error: ", err)
-	}
-
-	return packetData
+	return proto.Marshal(hello)
 }
@@ -2,16 +2,28 @@ package core
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/golang/protobuf/proto"
 	"github.com/librespot-org/librespot-golang/Spotify"
 	"github.com/librespot-org/librespot-golang/librespot/connection"
 	"github.com/librespot-org/librespot-golang/librespot/crypto"
+	"github.com/librespot-org/librespot-golang/librespot/logging"
 	"github.com/librespot-org/librespot-golang/librespot/mercury"
-	"github.com/librespot-org/librespot-golang/librespot/spirc"
+	"github.com/librespot-org/librespot-golang/librespot/metrics"
+	"github.com/librespot-org/librespot-golang/librespot/player"
+	"github.com/librespot-org/librespot-golang/librespot/spotifyid"
+	"github.com/librespot-org/librespot-golang/librespot/testing/fakeap"
+	"github.com/librespot-org/librespot-golang/librespot/utils"
 	"io"
-	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type shanPacket struct {
@@ -30,179 +42,1175 @@ func (f *fakeStream) SendPacket(cmd uint8, data []byte) (err error) {
 }
 
 func (f *fakeStream) RecvPacket() (cmd uint8, buf []byte, err error) {
-	p := <-f.recvPackets
+	p, ok := <-f.recvPackets
+	if !ok {
+		return 0, nil, io.EOF
+	}
 	return p.cmd, p.buf, nil
 }
 
-func readPlainPart(reader io.Reader, prefixSize uint32) ([]byte, error) {
-	if prefixSize > 0 {
-		prefix := make([]byte, prefixSize)
-		_, _ = io.ReadFull(reader, prefix)
+type fakeCon struct {
+	reader *bytes.Buffer
+	writer *bytes.Buffer
+}
+
+func (f *fakeCon) Write(b []byte) (n int, err error) {
+	return f.writer.Write(b)
+}
+
+func (f *fakeCon) Read(b []byte) (n int, err error) {
+	return f.reader.Read(b)
+}
+
+// newFakeAP starts a fake AP knowing the user "testUser", and returns the config to connect to it
+func newFakeAP(t *testing.T) (*fakeap.Server, *SessionConfig) {
+	server, err := fakeap.NewServer()
+	if err != nil {
+		t.Fatal(err)
 	}
+	server.AddUser("testUser", "123")
 
-	var size uint32
-	binary.Read(reader, binary.BigEndian, &size)
-	buf := make([]byte, size-4-prefixSize)
-	_, err := io.ReadFull(reader, buf)
-	return buf, err
+	return server, &SessionConfig{Resolver: server.Resolver(), ServerKey: server.PublicKey()}
 }
 
-func checkHead(t *testing.T, buf io.Reader) {
-	handleHead(buf)
-	headerData, _ := parsePart(buf)
-	header := &Spotify.Header{}
-	proto.Unmarshal(headerData, header)
+func TestLogin(t *testing.T) {
+	server, config := newFakeAP(t)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	if *header.Uri != "hm://remote/user/fakeUser/" {
-		t.Errorf("Wrong username  Got %q, ", header.Uri)
+	s, err := config.Login(ctx, "testUser", "123", "myDevice")
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
 	}
 
-	if *header.Method != "SEND" {
-		t.Errorf("Wrong method")
+	if s.Username() != "testUser" {
+		t.Errorf("Wrong username. Got %q", s.Username())
+	}
+	if !bytes.Equal(s.ReusableAuthBlob(), []byte("fakeap-blob-testUser")) {
+		t.Errorf("Wrong authdata returned. Got %v", s.ReusableAuthBlob())
+	}
+	if s.State() != StateAuthenticated {
+		t.Errorf("Wrong state after login. Got %v", s.State())
+	}
+	s.Close(ctx)
+
+	// The reusable credentials allow logging in again
+	s, err = config.LoginSaved(ctx, "testUser", s.ReusableAuthBlob(), "myDevice")
+	if err != nil {
+		t.Fatalf("LoginSaved failed: %v", err)
+	}
+	s.Close(ctx)
+
+	// A failed login returns no session, and must not leak its connection
+	var conn *closeTracker
+	config.Dialer = connection.DialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		c, err := (&net.Dialer{}).DialContext(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		conn = &closeTracker{Conn: c}
+		return conn, nil
+	})
+	s, err = config.Login(ctx, "testUser", "wrong", "myDevice")
+	var loginErr *LoginError
+	if !errors.As(err, &loginErr) || loginErr.Code != Spotify.ErrorCode_BadCredentials {
+		t.Errorf("Expected a BadCredentials login error. Got %v", err)
+	}
+	if s != nil {
+		t.Errorf("Session returned along with the login error")
+	}
+	if conn == nil || atomic.LoadInt32(&conn.closed) == 0 {
+		t.Errorf("Connection not closed after the failed login")
 	}
 }
 
-type fakeCon struct {
-	reader *bytes.Buffer
-	writer *bytes.Buffer
+// closeTracker records whether the connection it wraps has been closed
+type closeTracker struct {
+	net.Conn
+	closed int32
 }
 
-func (f *fakeCon) Write(b []byte) (n int, err error) {
-	return f.writer.Write(b)
+func (c *closeTracker) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return c.Conn.Close()
 }
 
-func (f *fakeCon) Read(b []byte) (n int, err error) {
-	return f.reader.Read(b)
+// trackID returns the id of the track with the specified GID
+func trackID(gid []byte) spotifyid.SpotifyID {
+	id, _ := spotifyid.FromGID(spotifyid.Track, gid)
+	return id
 }
 
-func TestLogin(t *testing.T) {
+func TestGetTrack(t *testing.T) {
+	server, config := newFakeAP(t)
+	defer server.Close()
+
+	gid := []byte{0x00, 0x65, 0xfc, 0x32, 0x1d, 0xb7, 0x4b, 0x10, 0xc4, 0x1f, 0x2a, 0x64, 0x46, 0x45, 0x1b, 0x4d}
+	server.AddTrack(&Spotify.Track{
+		Gid:  gid,
+		Name: proto.String("Test track"),
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := config.Login(ctx, "testUser", "123", "myDevice")
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	defer s.Close(ctx)
+
+	track, err := s.Mercury().GetTrack(ctx, trackID(gid))
+	if err != nil {
+		t.Fatalf("GetTrack failed: %v", err)
+	}
+	if track.GetName() != "Test track" {
+		t.Errorf("Wrong track returned. Got %v", track)
+	}
+
+	// Large responses are split in several packets
+	gid[0] = 0xff
+	name := strings.Repeat("long name ", 20000)
+	server.AddTrack(&Spotify.Track{
+		Gid:  gid,
+		Name: proto.String(name),
+	})
+
+	track, err = s.Mercury().GetTrack(ctx, trackID(gid))
+	if err != nil || track.GetName() != name {
+		t.Errorf("Wrong large track returned. Got %d bytes, error %v", len(track.GetName()), err)
+	}
+}
+
+func TestLoadTrack(t *testing.T) {
+	server, config := newFakeAP(t)
+	defer server.Close()
+
+	fileId := bytes.Repeat([]byte{0xf1}, 20)
+	trackId := bytes.Repeat([]byte{0x71}, 16)
+	key := bytes.Repeat([]byte{0x6b}, 16)
+
+	// Spread the file over several chunks, the last one being incomplete
+	audio := make([]byte, 300000)
+	for i := range audio {
+		audio[i] = byte(i * 7)
+	}
+	server.AddAudioFile(fileId, key, audio)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := config.Login(ctx, "testUser", "123", "myDevice")
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	defer s.Close(ctx)
+
+	file, err := s.Player().LoadTrack(&Spotify.AudioFile{
+		FileId: fileId,
+		Format: Spotify.AudioFile_MP3_160.Enum(),
+	}, trackId)
+	if err != nil {
+		t.Fatalf("LoadTrack failed: %v", err)
+	}
+
+	// The audio file returns no data while the chunks are being downloaded
+	data := make([]byte, 0, len(audio))
+	buf := make([]byte, 65536)
+	for ctx.Err() == nil {
+		n, err := file.Read(buf)
+		data = append(data, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if n == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if !bytes.Equal(data, audio) {
+		t.Errorf("Wrong audio data. Got %d bytes, want %d", len(data), len(audio))
+	}
+}
+
+func TestClose(t *testing.T) {
+	stream := &fakeStream{
+		recvPackets: make(chan shanPacket),
+		sendPackets: make(chan shanPacket, 2),
+	}
+
+	s := newSession(&SessionConfig{})
+	s.stream = stream
+	s.mercury = mercury.CreateMercury(stream)
+	states, _ := s.SubscribeState()
+
+	s.routines.Add(1)
+	go s.runPollLoop()
+
+	// Leave a mercury request pending, it must be failed by Close
+	status := make(chan int32, 1)
+	s.mercury.Request(context.Background(), mercury.Request{Method: "GET", Uri: "hm://test"}, func(res mercury.Response) {
+		status <- res.StatusCode
+	})
+	<-stream.sendPackets
+
+	go func() {
+		// Tear down the fake connection once the session has been closed
+		for range states {
+		}
+		close(stream.recvPackets)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Close(ctx); err != nil {
+		t.Fatalf("Close did not wait for the poll loop: %v", err)
+	}
+
+	if s.State() != StateClosed {
+		t.Errorf("Wrong state after Close. Got %v", s.State())
+	}
+	if code := <-status; code != 500 {
+		t.Errorf("Pending request not failed. Got status %d", code)
+	}
+	if err := s.Close(ctx); err != nil {
+		t.Errorf("Second Close failed: %v", err)
+	}
+}
+
+func TestHandshakeProtocolError(t *testing.T) {
 	conn := &fakeCon{
 		reader: bytes.NewBuffer(make([]byte, 0)),
 		writer: bytes.NewBuffer(make([]byte, 0)),
 	}
 
-	fakeShan := &fakeStream{
-		recvPackets: make(chan shanPacket),
-		sendPackets: make(chan shanPacket),
-	}
-
-	s := &Session{
-		deviceId:           "testDevice",
-		keys:               crypto.GenerateKeysFromPrivate(big.NewInt(20.0), make([]byte, 10)),
-		tcpCon:             conn,
-		shannonConstructor: func(keys crypto.SharedKeys, conn connection.PlainConnection) connection.PacketStream { return fakeShan },
-		mercuryConstructor: mercury.CreateMercury,
-	}
-
-	serverResponse := &Spotify.APResponseMessage{
-		Challenge: &Spotify.APChallenge{
-			LoginCryptoChallenge: &Spotify.LoginCryptoChallengeUnion{
-				DiffieHellman: &Spotify.LoginCryptoDiffieHellmanChallenge{
-					Gs:                 []byte{25},
-					ServerSignatureKey: proto.Int32(5),
-					GsSignature:        []byte{5},
-				},
-			},
-			FingerprintChallenge: &Spotify.FingerprintChallengeUnion{},
-			PowChallenge:         &Spotify.PoWChallengeUnion{},
-			CryptoChallenge:      &Spotify.CryptoChallengeUnion{},
-			ServerNonce:          []byte{5},
-		},
+	s := newSession(&SessionConfig{})
+	s.tcpCon = conn
+
+	// A server hello without any login crypto challenge
+	serverResponseData, _ := proto.Marshal(&Spotify.APResponseMessage{})
+	binary.Write(conn.reader, binary.BigEndian, uint32(len(serverResponseData)+4))
+	conn.reader.Write(serverResponseData)
+
+	err := s.startConnection(context.Background())
+	if !errors.Is(err, ErrProtocol) {
+		t.Errorf("Expected a protocol error. Got %v", err)
+	}
+	if errors.Is(err, ErrAuthFailed) {
+		t.Errorf("Protocol error matched ErrAuthFailed")
+	}
+}
+
+func TestLoginFailed(t *testing.T) {
+	stream := &fakeStream{
+		recvPackets: make(chan shanPacket, 1),
+		sendPackets: make(chan shanPacket, 1),
+	}
+
+	s := newSession(&SessionConfig{})
+	s.stream = stream
+
+	failed, _ := proto.Marshal(&Spotify.APLoginFailed{
+		ErrorCode:  Spotify.ErrorCode_PremiumAccountRequired.Enum(),
+		RetryDelay: proto.Int32(10),
+	})
+	stream.recvPackets <- shanPacket{cmd: connection.PacketAuthFailure, buf: failed}
+
+	err := s.doLogin([]byte{}, "testUser")
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("Expected an authentication error. Got %v", err)
+	}
+
+	var loginErr *LoginError
+	if !errors.As(err, &loginErr) {
+		t.Fatalf("Expected a LoginError. Got %T", err)
+	}
+	if loginErr.Code != Spotify.ErrorCode_PremiumAccountRequired || loginErr.RetryDelay != 10 {
+		t.Errorf("Wrong login error decoded. Got %+v", loginErr)
+	}
+	if loginErr.TryAnotherAP() {
+		t.Errorf("PremiumAccountRequired must not ask to try another AP")
 	}
+}
 
-	serverResponseData, _ := proto.Marshal(serverResponse)
+func TestHandshakeLoginFailed(t *testing.T) {
+	conn := &fakeCon{
+		reader: bytes.NewBuffer(make([]byte, 0)),
+		writer: bytes.NewBuffer(make([]byte, 0)),
+	}
+
+	s := newSession(&SessionConfig{})
+	s.tcpCon = conn
+
+	serverResponseData, _ := proto.Marshal(&Spotify.APResponseMessage{
+		LoginFailed: &Spotify.APLoginFailed{
+			ErrorCode: Spotify.ErrorCode_TryAnotherAP.Enum(),
+		},
+	})
 	binary.Write(conn.reader, binary.BigEndian, uint32(len(serverResponseData)+4))
-	//Write initial server response to plain connection
 	conn.reader.Write(serverResponseData)
 
-	result := make(chan []byte, 2)
-	go func() {
-		err := s.loginSession("testUser", "123", "myDevice")
+	err := s.startConnection(context.Background())
+	if !isTryAnotherAP(err) {
+		t.Errorf("Expected a TryAnotherAP login error. Got %v", err)
+	}
+	// Running out of APs to try must not be taken for rejected credentials, which stop reconnecting for good
+	if errors.Is(err, ErrAuthFailed) || !errors.Is(err, ErrConnection) {
+		t.Errorf("A TryAnotherAP login error must match ErrConnection only. Got %v", err)
+	}
+	var loginErr *LoginError
+	if errors.As(err, &loginErr) && !strings.HasPrefix(loginErr.Error(), ErrConnection.Error()) {
+		t.Errorf("The message of the login error must agree with its kind. Got %q", loginErr.Error())
+	}
+}
+
+func TestReconnectPolicyDelay(t *testing.T) {
+	policy := ReconnectPolicy{
+		InitialDelay: time.Second,
+		MaxDelay:     10 * time.Second,
+		Multiplier:   2,
+		MaxAttempts:  3,
+	}
+
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second}
+	for attempt, delay := range expected {
+		if got := policy.Delay(attempt); got != delay {
+			t.Errorf("Wrong delay for attempt %d. Got %v, want %v", attempt, got, delay)
+		}
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := policy.Delay(1); got < time.Second || got > 3*time.Second {
+			t.Fatalf("Jittered delay out of bounds. Got %v", got)
+		}
+	}
+
+	if policy.exhausted(2) || !policy.exhausted(3) {
+		t.Errorf("Wrong exhaustion for MaxAttempts=3")
+	}
+
+	// Without a cap, the delay grows until the largest Duration, it must not overflow
+	policy = ReconnectPolicy{InitialDelay: time.Second, Multiplier: 2, Jitter: 0.5}
+	for _, attempt := range []int{40, 63, 100, 2000} {
+		if got := policy.Delay(attempt); got < policy.Delay(30) {
+			t.Errorf("Delay overflowed for attempt %d. Got %v", attempt, got)
+		}
+	}
+	policy.InitialDelay = 0
+	if got := policy.Delay(2000); got != 0 {
+		t.Errorf("Wrong delay without an initial delay. Got %v", got)
+	}
+}
+
+func TestReconnectResubscribe(t *testing.T) {
+	server, config := newFakeAP(t)
+	defer server.Close()
+	config.ReconnectPolicy = &ReconnectPolicy{InitialDelay: 10 * time.Millisecond}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := config.Login(ctx, "testUser", "123", "myDevice")
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	defer s.Close(ctx)
+	states, _ := s.SubscribeState()
+
+	const uri = "hm://remote/user/testUser/"
+	recv := make(chan mercury.Response, 1)
+	if _, err := s.Mercury().Subscribe(ctx, uri, recv); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	server.Disconnect()
+	expected := []SessionState{StateReconnecting, StateAuthenticated}
+	for _, state := range expected {
+		select {
+		case got := <-states:
+			if got != state {
+				t.Fatalf("Wrong state transition. Got %v, want %v", got, state)
+			}
+		case <-ctx.Done():
+			t.Fatalf("Session did not reconnect")
+		}
+	}
+
+	// The subscriptions are sent again to the new connection once logged in
+	for {
+		sent, err := server.Publish(uri, []byte("event"))
 		if err != nil {
-			t.Errorf("bad return values")
+			t.Fatalf("Publish failed: %v", err)
+		}
+		if sent > 0 {
+			break
+		}
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatalf("Subscription not renewed after reconnecting")
 		}
-		result <- s.reusableAuthBlob
+	}
+
+	select {
+	case res := <-recv:
+		if res.Uri != uri || string(res.CombinePayload()) != "event" {
+			t.Errorf("Wrong event received. Got %+v", res)
+		}
+	case <-ctx.Done():
+		t.Fatalf("No event received after reconnecting")
+	}
+}
+
+func TestConnectFallback(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	dialed := make([]string, 0)
+	config := &SessionConfig{
+		Resolver: utils.StaticAPResolver{"ap1.invalid:4070", listener.Addr().String()},
+		Dialer: connection.DialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialed = append(dialed, address)
+			if address == "ap1.invalid:4070" {
+				return nil, errors.New("connection refused")
+			}
+			return (&net.Dialer{}).DialContext(ctx, network, address)
+		}),
+	}
+
+	s := newSession(config)
+	defer s.Close(context.Background())
+
+	err = s.doConnect(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to connect to the fallback AP: %v", err)
+	}
+	if s.apUrl != listener.Addr().String() || len(dialed) != 2 {
+		t.Errorf("Wrong AP order. Dialed %v, connected to %q", dialed, s.apUrl)
+	}
+
+	// An AP asking us to try another one is tried last
+	s.rejectAP()
+	dialed = dialed[:0]
+	s.doConnect(context.Background())
+	if len(dialed) != 2 || dialed[1] != listener.Addr().String() {
+		t.Errorf("Rejected AP not tried last. Dialed %v", dialed)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	server, config := newFakeAP(t)
+	defer server.Close()
+
+	gid := bytes.Repeat([]byte{0x42}, 16)
+	server.AddTrack(&Spotify.Track{
+		Gid:  gid,
+		Name: proto.String("Recorded track"),
+	})
+
+	recording := new(bytes.Buffer)
+	config.Recorder = connection.NewPacketRecorder(recording)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := config.Login(ctx, "testUser", "123", "myDevice")
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	s.Mercury().GetTrack(ctx, trackID(gid))
+	s.Close(ctx)
+
+	packets, err := connection.ReadRecording(recording)
+	if err != nil {
+		t.Fatalf("Failed to read the recording: %v", err)
+	}
+
+	// Play the session back without any AP
+	replayer := connection.NewReplayer(packets)
+	s = newSession(&SessionConfig{})
+	s.stream = replayer
+	s.mercury = mercury.CreateMercury(replayer)
+	go func() {
+		<-s.ctx.Done()
+		replayer.Close()
 	}()
+	defer s.Close(ctx)
 
-	//Get the login packet sent to the spotify server from spotcontrol
-	loginPacket := <-fakeShan.sendPackets
-	clientResponse := &Spotify.ClientResponseEncrypted{}
-	proto.Unmarshal(loginPacket.buf, clientResponse)
+	packet, _ := makeLoginPasswordPacket("testUser", "", "myDevice")
+	err = s.doLogin(packet, "testUser")
+	if err != nil {
+		t.Fatalf("Replayed login failed: %v", err)
+	}
 
-	if *clientResponse.LoginCredentials.Username != "testUser" {
-		t.Errorf("bad auth user")
+	track, err := s.Mercury().GetTrack(ctx, trackID(gid))
+	if err != nil || track.GetName() != "Recorded track" {
+		t.Errorf("Wrong replayed track. Got %v, %v", track, err)
 	}
-	if !bytes.Equal(clientResponse.LoginCredentials.AuthData, []byte("123")) {
-		t.Errorf("bad auth password")
+	if !replayer.Done() {
+		t.Errorf("Recording not fully replayed")
 	}
+}
 
-	plainClientRes := &Spotify.ClientResponsePlaintext{}
-	// Discard original hello message
-	readPlainPart(conn.writer, 2)
-	// Get plain client response from plain connection
-	plainData, _ := readPlainPart(conn.writer, 0)
-	proto.Unmarshal(plainData, plainClientRes)
-	hmac := []byte{226, 239, 29, 188, 200, 160, 193, 245, 71, 39, 15, 82, 156, 34, 168, 224, 134, 149, 128, 222}
-	if !bytes.Equal(plainClientRes.LoginCryptoResponse.DiffieHellman.Hmac, hmac) {
-		t.Errorf("failed hmac comparison", plainClientRes.LoginCryptoResponse.DiffieHellman.Hmac)
+func TestAccount(t *testing.T) {
+	server, config := newFakeAP(t)
+	defer server.Close()
+	server.ProductInfo = map[string]string{
+		"type":           "premium",
+		"catalogue":      "premium",
+		"head-files-url": "https://heads-fa.spotify.com/head/{file_id}",
 	}
 
-	welcome := &Spotify.APWelcome{
-		CanonicalUsername:           proto.String("testUserCanonical"),
-		AccountTypeLoggedIn:         Spotify.AccountType_Spotify.Enum(),
-		CredentialsTypeLoggedIn:     Spotify.AccountType_Spotify.Enum(),
-		ReusableAuthCredentialsType: Spotify.AuthenticationType_AUTHENTICATION_USER_PASS.Enum(),
-		ReusableAuthCredentials:     []byte{0, 1, 2},
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := config.Login(ctx, "testUser", "123", "myDevice")
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
 	}
-	welcomeData, _ := proto.Marshal(welcome)
+	updates, _ := s.SubscribeAccount()
 
-	fakeShan.recvPackets <- shanPacket{cmd: 0xac, buf: welcomeData}
-	// country code
-	fakeShan.recvPackets <- shanPacket{cmd: 0x1b, buf: []byte{0, 1}}
-	// ignore subscribe
-	<-fakeShan.sendPackets
-	welcomeRes := <-result
-	if !bytes.Equal(welcomeRes, []byte{0, 1, 2}) {
-		t.Errorf("Wrong authdata returned.  Got %v", welcomeRes)
+	// The account information arrive after the login
+	account := s.Account()
+	for account.LicenseVersion == "" {
+		select {
+		case account = <-updates:
+		case <-ctx.Done():
+			t.Fatalf("Account information not received. Got %+v", s.Account())
+		}
+	}
+
+	if account.Username != "testUser" || account.LoginType != Spotify.AccountType_Spotify {
+		t.Errorf("Wrong account. Got %+v", account)
+	}
+	if !account.Premium() || account.Attribute("head-files-url") != "https://heads-fa.spotify.com/head/{file_id}" {
+		t.Errorf("Wrong product info. Got %+v", account)
+	}
+	if account.LicenseVersion != "1.0.1-SE" || account.Country != "SE" || s.Country() != "SE" {
+		t.Errorf("Wrong license version or country. Got %+v", account)
+	}
+
+	// The product may change during the session
+	server.SendProductInfo(map[string]string{"type": "free", "catalogue": "free"})
+	select {
+	case account = <-updates:
+	case <-ctx.Done():
+		t.Fatal("Product change not notified")
+	}
+	if account.Premium() || account.Attribute("catalogue") != "free" {
+		t.Errorf("Wrong product after change. Got %+v", account)
+	}
+
+	s.Close(ctx)
+	if _, ok := <-updates; ok {
+		t.Errorf("Account updates not closed with the session")
 	}
 }
 
-func TestHello(t *testing.T) {
-	stream := fakeStream{
-		recvPackets: make(chan shanPacket),
-		sendPackets: make(chan shanPacket, 2),
+func TestAccountBroadcaster(t *testing.T) {
+	b := &accountBroadcaster{}
+	updates, cancel := b.subscribe()
+	defer cancel()
+
+	// An update changing nothing isn't notified, even before any attribute is known
+	b.update(func(account *Account) {})
+	b.update(func(account *Account) { account.Username = "testUser" })
+	b.update(func(account *Account) { account.Username = "testUser" })
+	if len(updates) != 1 {
+		t.Fatalf("Expected a single update. Got %d", len(updates))
 	}
+	if account := <-updates; account.Username != "testUser" || account.Attributes != nil {
+		t.Errorf("Wrong update. Got %+v", account)
+	}
+}
 
-	s := &Session{
-		stream:   &stream,
-		deviceId: "testDevice",
+func TestParseAccountPackets(t *testing.T) {
+	attributes, err := parseProductInfo([]byte(`<products><product><type>premium</type>` +
+		`<streaming-rules></streaming-rules><catalogue>premium</catalogue></product></products>`))
+	if err != nil || len(attributes) != 3 || attributes["type"] != "premium" || attributes["catalogue"] != "premium" {
+		t.Errorf("Wrong product info parsed. Got %v, %v", attributes, err)
 	}
-	s.mercury = mercury.CreateMercury(&stream)
-	controller := spirc.CreateController(s, []byte{})
 
-	go controller.SendHello()
+	license, err := parseLicenseVersion([]byte{0, 1, 8, '1', '.', '0', '.', '1', '-', 'F', 'R'})
+	if err != nil || license != "1.0.1-FR" {
+		t.Errorf("Wrong license version parsed. Got %q, %v", license, err)
+	}
+	_, err = parseLicenseVersion([]byte{0, 1, 8, '1'})
+	if err == nil {
+		t.Errorf("Truncated license version accepted")
+	}
+}
 
-	//ignore subscribe packet
-	<-stream.sendPackets
+func TestWatchdog(t *testing.T) {
+	server, config := newFakeAP(t)
+	defer server.Close()
+	config.ReadTimeout = 300 * time.Millisecond
+	config.ReconnectPolicy = &ReconnectPolicy{InitialDelay: 10 * time.Millisecond}
 
-	packet := <-stream.sendPackets
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	if packet.cmd != 0xb2 {
-		t.Errorf("Wrong cmd code.  Got %q, want %q", packet.cmd, 0xb2)
+	s, err := config.Login(ctx, "testUser", "123", "myDevice")
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
 	}
+	defer s.Close(ctx)
+	states, _ := s.SubscribeState()
+
+	server.Ping()
+	for s.Stats().Latency == 0 && ctx.Err() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	stats := s.Stats()
+	if stats.Pings != 1 || stats.LastPing.IsZero() || stats.AverageLatency != stats.Latency ||
+		stats.MaxLatency != stats.Latency {
+		t.Errorf("Wrong ping stats. Got %+v", stats)
+	}
+
+	// The fake AP then goes quiet, the session must notice it and reconnect
+	expected := []SessionState{StateReconnecting, StateAuthenticated}
+	for _, state := range expected {
+		select {
+		case got := <-states:
+			if got != state {
+				t.Fatalf("Wrong state transition. Got %v, want %v", got, state)
+			}
+		case <-ctx.Done():
+			t.Fatalf("Session did not reconnect. Stats %+v", s.Stats())
+		}
+	}
+	if s.Stats().Timeouts == 0 {
+		t.Errorf("Timeout not counted. Got %+v", s.Stats())
+	}
+}
+
+func TestReconnectHandshakeTimeout(t *testing.T) {
+	server, config := newFakeAP(t)
+	defer server.Close()
+	config.ReadTimeout = 300 * time.Millisecond
+	config.HashCashBudget = 100 * time.Millisecond
+	config.ReconnectPolicy = &ReconnectPolicy{InitialDelay: 10 * time.Millisecond}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := config.Login(ctx, "testUser", "123", "myDevice")
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	defer s.Close(ctx)
+	states, _ := s.SubscribeState()
+
+	// The AP goes silent in the middle of the next handshake, the session must give up on it and try again
+	server.StallHandshakes(1)
+	server.Disconnect()
+
+	expected := []SessionState{StateReconnecting, StateAuthenticated}
+	for _, state := range expected {
+		select {
+		case got := <-states:
+			if got != state {
+				t.Fatalf("Wrong state transition. Got %v, want %v", got, state)
+			}
+		case <-ctx.Done():
+			t.Fatalf("Session did not reconnect after a stalled handshake")
+		}
+	}
+}
+
+func TestHashCashChallenge(t *testing.T) {
+	server, config := newFakeAP(t)
+	defer server.Close()
+	server.HashCashLength = 12
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := config.Login(ctx, "testUser", "123", "myDevice")
+	if err != nil {
+		t.Fatalf("Login with a hashcash challenge failed: %v", err)
+	}
+	s.Close(ctx)
+
+	// A challenge which can't be solved within the budget fails the handshake
+	server.HashCashLength = 64
+	config.HashCashBudget = 50 * time.Millisecond
+	_, err = config.Login(ctx, "testUser", "123", "myDevice")
+	if !errors.Is(err, ErrHandshake) || !errors.Is(err, crypto.ErrHashCashBudget) {
+		t.Errorf("Expected a hashcash budget error. Got %v", err)
+	}
+}
+
+func TestServerSignature(t *testing.T) {
+	server, config := newFakeAP(t)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	buf := bytes.NewBuffer(packet.buf)
-	checkHead(t, buf)
+	// The fake AP doesn't hold Spotify's key
+	config.ServerKey = nil
+	_, err := config.Login(ctx, "testUser", "123", "myDevice")
+	if !errors.Is(err, ErrHandshake) || !errors.Is(err, crypto.ErrInvalidSignature) {
+		t.Errorf("Expected an invalid signature error. Got %v", err)
+	}
+
+	config.InsecureSkipVerify = true
+	s, err := config.Login(ctx, "testUser", "123", "myDevice")
+	if err != nil {
+		t.Fatalf("Login without signature verification failed: %v", err)
+	}
+	s.Close(ctx)
+}
+
+// recordingLogger keeps the messages logged, with their level
+type recordingLogger struct {
+	lock     sync.Mutex
+	messages []string
+	args     [][]interface{}
+}
+
+func (l *recordingLogger) record(level string, msg string, args []interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.messages = append(l.messages, level+" "+msg)
+	l.args = append(l.args, args)
+}
+
+func (l *recordingLogger) Debug(msg string, args ...interface{}) { l.record("DEBUG", msg, args) }
+func (l *recordingLogger) Info(msg string, args ...interface{})  { l.record("INFO", msg, args) }
+func (l *recordingLogger) Warn(msg string, args ...interface{})  { l.record("WARN", msg, args) }
+func (l *recordingLogger) Error(msg string, args ...interface{}) { l.record("ERROR", msg, args) }
+
+// find returns the fields of the first message logged with the given level and text, e.g. "INFO connected to AP"
+func (l *recordingLogger) find(message string) (map[interface{}]interface{}, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for i, msg := range l.messages {
+		if msg == message {
+			fields := map[interface{}]interface{}{}
+			for j := 0; j+1 < len(l.args[i]); j += 2 {
+				fields[l.args[i][j]] = l.args[i][j+1]
+			}
+			return fields, true
+		}
+	}
+	return nil, false
+}
+
+func TestLogger(t *testing.T) {
+	server, config := newFakeAP(t)
+	defer server.Close()
+	logger := &recordingLogger{}
+	config.Logger = logger
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := config.Login(ctx, "testUser", "123", "myDevice")
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	defer s.Close(ctx)
+
+	connected, ok := logger.find("INFO connected to AP")
+	if !ok || connected[logging.KeyAP] != server.Addr() || connected[logging.KeySession] == nil {
+		t.Errorf("Connection not logged. Got %v", connected)
+	}
+
+	authenticated, ok := logger.find("INFO authenticated")
+	if !ok {
+		t.Fatal("Authentication not logged")
+	}
+	if authenticated[logging.KeySession] != connected[logging.KeySession] {
+		t.Errorf("Session id changed. Got %v, want %v", authenticated[logging.KeySession], connected[logging.KeySession])
+	}
+	if authenticated[logging.KeyDevice] != s.DeviceId() || authenticated["username"] != "testUser" {
+		t.Errorf("Wrong fields logged. Got %v", authenticated)
+	}
+}
+
+// recordingMetrics counts the events reported by the session
+type recordingMetrics struct {
+	metrics.Nop
+	lock             sync.Mutex
+	received         map[uint8]int
+	mercury          map[string]int32
+	pendingMercury   int
+	audioKeys        int
+	audioKeyErrors   int
+	chunkBytes       int
+	channelsOpen     int
+	channelsOpenPeak int
+}
+
+func (m *recordingMetrics) PacketReceived(cmd uint8, size int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.received[cmd]++
+}
+
+func (m *recordingMetrics) MercuryRequestSent(method string, prefix string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.pendingMercury++
+}
+
+func (m *recordingMetrics) MercuryResponse(method string, prefix string, status int32, latency time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.pendingMercury--
+	m.mercury[method+" "+prefix] = status
+}
+
+func (m *recordingMetrics) AudioKeyReceived(latency time.Duration, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.audioKeys++
+	if err != nil {
+		m.audioKeyErrors++
+	}
+}
+
+func (m *recordingMetrics) ChunkDownloaded(size int, duration time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.chunkBytes += size
+}
+
+func (m *recordingMetrics) ChannelOpened() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.channelsOpen++
+	if m.channelsOpen > m.channelsOpenPeak {
+		m.channelsOpenPeak = m.channelsOpen
+	}
+}
+
+func (m *recordingMetrics) ChannelClosed() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.channelsOpen--
+}
 
-	frameData, _ := parsePart(buf)
-	frame := &Spotify.Frame{}
-	proto.Unmarshal(frameData, frame)
+func TestMercuryStatusError(t *testing.T) {
+	server, config := newFakeAP(t)
+	defer server.Close()
+	config.MercuryRetryPolicy = &mercury.RetryPolicy{MaxAttempts: 3, InitialDelay: time.Millisecond}
+
+	gid := bytes.Repeat([]byte{0x11}, 16)
+	trackUri := fmt.Sprintf("hm://metadata/4/track/%x", gid)
+	var attempts int32
+	server.HandleMercury(trackUri, func(req fakeap.MercuryRequest) fakeap.MercuryResponse {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			return fakeap.MercuryResponse{StatusCode: 503}
+		}
+		data, _ := proto.Marshal(&Spotify.Track{Gid: gid, Name: proto.String("Test track")})
+		return fakeap.MercuryResponse{StatusCode: 200, Payload: [][]byte{data}}
+	})
+	albumUri := "hm://metadata/4/album/" + strings.Repeat("00", 16)
+	server.HandleMercury(albumUri, func(req fakeap.MercuryRequest) fakeap.MercuryResponse {
+		return fakeap.MercuryResponse{StatusCode: 403, UserFields: map[string]string{"MC-Error": "forbidden"}}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := config.Login(ctx, "testUser", "123", "myDevice")
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	defer s.Close(ctx)
+
+	// The transient errors are retried
+	track, err := s.Mercury().GetTrack(ctx, trackID(gid))
+	if err != nil || track.GetName() != "Test track" || atomic.LoadInt32(&attempts) != 3 {
+		t.Errorf("Expected the track after 3 attempts. Got %v after %d attempts", err, attempts)
+	}
+
+	// Once the attempts are exhausted, the last status is returned
+	atomic.StoreInt32(&attempts, -10)
+	var statusErr *mercury.StatusError
+	_, err = s.Mercury().GetTrack(ctx, trackID(gid))
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != 503 || atomic.LoadInt32(&attempts) != -7 {
+		t.Errorf("Expected a 503 status error after 3 attempts. Got %v", err)
+	}
+
+	// The other errors are returned at once, with the user fields of the response
+	album, err := s.Mercury().GetAlbum(ctx, spotifyid.SpotifyID{Type: spotifyid.Album})
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != 403 || statusErr.Uri != albumUri ||
+		statusErr.UserFields["MC-Error"] != "forbidden" || album != nil {
+		t.Errorf("Expected a 403 status error. Got %v, %+v", err, statusErr)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	server, config := newFakeAP(t)
+	defer server.Close()
+
+	gid := bytes.Repeat([]byte{0x11}, 16)
+	server.AddTrack(&Spotify.Track{Gid: gid, Name: proto.String("Test track")})
+	fileId := bytes.Repeat([]byte{0xf1}, 20)
+	audio := make([]byte, 200000)
+	server.AddAudioFile(fileId, bytes.Repeat([]byte{0x6b}, 16), audio)
+
+	recorder := &recordingMetrics{received: map[uint8]int{}, mercury: map[string]int32{}}
+	config.Metrics = recorder
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := config.Login(ctx, "testUser", "123", "myDevice")
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	defer s.Close(ctx)
+
+	_, err = s.Mercury().GetTrack(ctx, trackID(gid))
+	if err != nil {
+		t.Fatalf("GetTrack failed: %v", err)
+	}
+	// The status code of an unknown track is reported
+	var statusErr *mercury.StatusError
+	_, err = s.Mercury().GetTrack(ctx, trackID(bytes.Repeat([]byte{0x22}, 16)))
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != 404 {
+		t.Errorf("Expected a 404 status error. Got %v", err)
+	}
+
+	file, err := s.Player().LoadTrack(&Spotify.AudioFile{
+		FileId: fileId,
+		Format: Spotify.AudioFile_MP3_160.Enum(),
+	}, gid)
+	if err != nil {
+		t.Fatalf("LoadTrack failed: %v", err)
+	}
+	for ctx.Err() == nil {
+		_, err := file.Read(make([]byte, len(audio)))
+		if err == io.EOF {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The AP refuses the key of an unknown file
+	_, err = s.Player().LoadTrack(&Spotify.AudioFile{
+		FileId: bytes.Repeat([]byte{0xf2}, 20),
+		Format: Spotify.AudioFile_MP3_160.Enum(),
+	}, gid)
+	if !errors.Is(err, player.ErrAudioKey) {
+		t.Errorf("Expected an audio key error. Got %v", err)
+	}
+
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+
+	if recorder.received[connection.PacketAPWelcome] != 1 || recorder.received[connection.PacketMercuryReq] != 2 {
+		t.Errorf("Wrong packets counted. Got %v", recorder.received)
+	}
+	if recorder.mercury["GET hm://metadata/"] != 404 || recorder.pendingMercury != 0 {
+		t.Errorf("Wrong mercury requests reported. Got %v, %d pending", recorder.mercury, recorder.pendingMercury)
+	}
+	if recorder.audioKeys != 2 || recorder.audioKeyErrors != 1 {
+		t.Errorf("Wrong audio keys reported. Got %d, %d errors", recorder.audioKeys, recorder.audioKeyErrors)
+	}
+	if recorder.chunkBytes < len(audio) {
+		t.Errorf("Wrong chunk bytes reported. Got %d, want %d", recorder.chunkBytes, len(audio))
+	}
+	if recorder.channelsOpenPeak == 0 || recorder.channelsOpen != 0 {
+		t.Errorf("Wrong channels reported. Peak %d, %d still open", recorder.channelsOpenPeak, recorder.channelsOpen)
+	}
+}
+
+func TestSessionMetadataCache(t *testing.T) {
+	server, config := newFakeAP(t)
+	defer server.Close()
+
+	gid := bytes.Repeat([]byte{0x11}, 16)
+	server.AddTrack(&Spotify.Track{Gid: gid, Name: proto.String("Test track")})
+	cache := mercury.NewMemoryCache(10)
+	config.MetadataCache = cache
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := config.Login(ctx, "testUser", "123", "myDevice")
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	defer s.Close(ctx)
+	updates, _ := s.SubscribeAccount()
+	for account := s.Account(); account.Country == ""; {
+		select {
+		case account = <-updates:
+		case <-ctx.Done():
+			t.Fatal("Country not received")
+		}
+	}
+
+	// The metadata are cached for the country of the user
+	if _, err := s.Mercury().GetTrack(ctx, trackID(gid)); err != nil {
+		t.Fatalf("GetTrack failed: %v", err)
+	}
+	if _, ok := cache.Get(fmt.Sprintf("track/%x/SE", gid)); !ok {
+		t.Error("Expected the track to be cached")
+	}
+}
+
+func TestEditPlaylist(t *testing.T) {
+	server, config := newFakeAP(t)
+	defer server.Close()
+
+	tracks := make([]spotifyid.SpotifyID, 4)
+	uris := make([]string, 4)
+	for i := range tracks {
+		tracks[i] = trackID(bytes.Repeat([]byte{byte(i + 1)}, 16))
+		uris[i] = tracks[i].URI()
+	}
+	playlist := server.AddPlaylist("user/testUser/playlist/abc", "Old name", uris[0], uris[1], uris[2])
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := config.Login(ctx, "testUser", "123", "myDevice")
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	defer s.Close(ctx)
+
+	base, err := s.Mercury().GetPlaylist(ctx, "user/testUser/playlist/abc")
+	if err != nil {
+		t.Fatalf("GetPlaylist failed: %v", err)
+	}
+
+	// Another client moves the first track to the end after it has been read, the edits are rebased on its change
+	playlist.Modify(&Spotify.Op{Kind: Spotify.Op_MOV.Enum(), Mov: &Spotify.Mov{
+		FromIndex: proto.Int32(0), Length: proto.Int32(1), ToIndex: proto.Int32(3)}})
+	content, err := s.Mercury().EditPlaylist(ctx, "user/testUser/playlist/abc", base,
+		mercury.RemoveTracks(tracks[1]),
+		mercury.AddTracks(0, tracks[3]),
+		mercury.MoveTracks(2, 1, 0),
+		mercury.RenamePlaylist("New name"),
+	)
+	if err != nil {
+		t.Fatalf("EditPlaylist failed: %v", err)
+	}
+
+	// The edits target the items of base: the new track goes before the first one, wherever it is now
+	expected := []string{uris[2], uris[3], uris[0]}
+	if items := playlist.Items(); strings.Join(items, ",") != strings.Join(expected, ",") {
+		t.Errorf("Wrong items. Expected %v, got %v", expected, items)
+	}
+	if playlist.Attributes().GetName() != "New name" {
+		t.Errorf("Wrong name. Got %v", playlist.Attributes())
+	}
+	if !bytes.Equal(content.GetRevision(), playlist.Revision()) {
+		t.Errorf("Wrong revision returned. Got %x, expected %x", content.GetRevision(), playlist.Revision())
+	}
+
+	// The edits are abandoned when the playlist keeps changing
+	playlist.BeforeModify(func() {
+		playlist.Modify(&Spotify.Op{Kind: Spotify.Op_UPDATE_LIST_ATTRIBUTES.Enum(),
+			UpdateListAttributes: &Spotify.UpdateListAttributes{}})
+	})
+	_, err = s.Mercury().EditPlaylist(ctx, "user/testUser/playlist/abc", nil,
+		mercury.DescribePlaylist("description"))
+	if !errors.Is(err, mercury.ErrPlaylistConflict) {
+		t.Errorf("Expected ErrPlaylistConflict. Got %v", err)
+	}
+}
+
+func TestWatchPlaylist(t *testing.T) {
+	server, config := newFakeAP(t)
+	defer server.Close()
+
+	uris := make([]string, 3)
+	for i := range uris {
+		uris[i] = trackID(bytes.Repeat([]byte{byte(i + 1)}, 16)).URI()
+	}
+	playlist := server.AddPlaylist("user/testUser/playlist/abc", "Name", uris[0], uris[1])
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := config.Login(ctx, "testUser", "123", "myDevice")
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	defer s.Close(ctx)
+
+	watcher, err := s.Mercury().WatchPlaylist(ctx, "user/testUser/playlist/abc")
+	if err != nil {
+		t.Fatalf("WatchPlaylist failed: %v", err)
+	}
+	defer watcher.Close()
+
+	next := func(kind mercury.PlaylistEventKind) mercury.PlaylistEvent {
+		select {
+		case event := <-watcher.Events():
+			if event.Kind != kind {
+				t.Fatalf("Expected a %s event. Got %s", kind, event.Kind)
+			}
+			return event
+		case <-ctx.Done():
+			t.Fatalf("No %s event received", kind)
+			return mercury.PlaylistEvent{}
+		}
+	}
+	checkContent := func() {
+		content := watcher.Content()
+		var items []string
+		for _, item := range content.GetContents().GetItems() {
+			items = append(items, item.GetUri())
+		}
+		if strings.Join(items, ",") != strings.Join(playlist.Items(), ",") {
+			t.Errorf("Wrong items. Expected %v, got %v", playlist.Items(), items)
+		}
+		if !bytes.Equal(content.GetRevision(), playlist.Revision()) {
+			t.Errorf("Wrong revision. Expected %x, got %x", playlist.Revision(), content.GetRevision())
+		}
+	}
+	checkContent()
+
+	// Another client adds a track
+	playlist.Modify(&Spotify.Op{Kind: Spotify.Op_ADD.Enum(), Add: &Spotify.Add{FromIndex: proto.Int32(1),
+		Items: []*Spotify.Item{{Uri: proto.String(uris[2])}}}})
+	if event := next(mercury.PlaylistItemsAdded); event.Index != 1 || event.Items[0].GetUri() != uris[2] {
+		t.Errorf("Wrong added items: %+v", event)
+	}
+	checkContent()
+
+	// The changes made by the session itself are notified too
+	_, err = s.Mercury().EditPlaylist(ctx, "user/testUser/playlist/abc", watcher.Content(),
+		mercury.RemoveTracks(trackID(bytes.Repeat([]byte{1}, 16))), mercury.MoveTracks(1, 1, 0))
+	if err != nil {
+		t.Fatalf("EditPlaylist failed: %v", err)
+	}
+	if event := next(mercury.PlaylistItemsRemoved); event.Index != 0 || event.Length != 1 {
+		t.Errorf("Wrong removed items: %+v", event)
+	}
+	if event := next(mercury.PlaylistItemsMoved); event.Index != 1 || event.ToIndex != 0 {
+		t.Errorf("Wrong moved items: %+v", event)
+	}
+	checkContent()
 
-	if frame.GetTyp() != Spotify.MessageType_kMessageTypeHello {
-		t.Errorf("Wrong message type")
+	// A change following an unknown revision, e.g. after a missed notification, makes the playlist be fetched again
+	data, _ := proto.Marshal(&Spotify.RevisionTaggedChangeSet{Revision: []byte{0, 0, 1, 0},
+		ChangeSet: &Spotify.ChangeSet{Kind: Spotify.ChangeSet_DELTA.Enum(),
+			Delta: &Spotify.Delta{BaseVersion: []byte{0, 0, 0, 0xff}}}})
+	if _, err := server.PublishContent("hm://playlist/user/testUser/playlist/abc", "", data); err != nil {
+		t.Fatalf("Publish failed: %v", err)
 	}
+	next(mercury.PlaylistResynced)
+	checkContent()
 
-	if *frame.Ident != "testDevice" {
-		t.Errorf("Wrong ident. Got %q, want %q", *frame.Ident, "testDevice")
+	watcher.Close()
+	if _, ok := <-watcher.Events(); ok {
+		t.Errorf("The events channel isn't closed")
 	}
 }
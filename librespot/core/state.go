@@ -0,0 +1,103 @@
+package core
+
+import (
+	"sync"
+)
+
+// SessionState describes where a Session is in its connection lifecycle
+type SessionState int
+
+const (
+	// StateConnecting is the state of a session establishing its first connection to an AP
+	StateConnecting SessionState = iota
+	// StateAuthenticated is the state of a session logged in and polling packets from the AP
+	StateAuthenticated
+	// StateReconnecting is the state of a session which lost its connection and is trying to establish a new one
+	StateReconnecting
+	// StateClosed is the final state of a session, once Close has been called
+	StateClosed
+)
+
+// stateSubscriberBuffer is the capacity of the channels returned by SubscribeState
+const stateSubscriberBuffer = 8
+
+func (st SessionState) String() string {
+	switch st {
+	case StateConnecting:
+		return "connecting"
+	case StateAuthenticated:
+		return "authenticated"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// stateBroadcaster keeps the current state of a session and fans out its changes to the subscribers
+type stateBroadcaster struct {
+	lock        sync.Mutex
+	state       SessionState
+	subscribers map[chan SessionState]struct{}
+}
+
+func (b *stateBroadcaster) get() SessionState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
+
+// set updates the current state and notifies the subscribers. Once the state is StateClosed, it cannot change
+// anymore and all the subscriber channels are closed.
+func (b *stateBroadcaster) set(state SessionState) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.state == StateClosed || b.state == state {
+		return
+	}
+	b.state = state
+
+	for ch := range b.subscribers {
+		// Never block the session on a slow subscriber, the update is dropped instead
+		select {
+		case ch <- state:
+		default:
+		}
+
+		if state == StateClosed {
+			close(ch)
+			delete(b.subscribers, ch)
+		}
+	}
+}
+
+func (b *stateBroadcaster) subscribe() (<-chan SessionState, func()) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	ch := make(chan SessionState, stateSubscriberBuffer)
+	if b.state == StateClosed {
+		ch <- StateClosed
+		close(ch)
+		return ch, func() {}
+	}
+
+	if b.subscribers == nil {
+		b.subscribers = make(map[chan SessionState]struct{})
+	}
+	b.subscribers[ch] = struct{}{}
+
+	cancel := func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if _, ok := b.subscribers[ch]; ok {
+			close(ch)
+			delete(b.subscribers, ch)
+		}
+	}
+
+	return ch, cancel
+}
@@ -0,0 +1,100 @@
+package core
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/librespot-org/librespot-golang/librespot/metadata"
+	"golang.org/x/oauth2"
+	"golang.org/x/sync/singleflight"
+)
+
+// ErrNoToken is returned when the keymaster answers without a token, e.g. for an unknown client id
+var ErrNoToken = errors.New("keymaster returned no token")
+
+// tokenCache caches the keymaster tokens of a session, keyed by client id and scopes
+type tokenCache struct {
+	fetch func(clientId string, scopes string) (*metadata.Token, error)
+
+	lock   sync.Mutex
+	tokens map[string]cachedToken
+	group  singleflight.Group
+}
+
+// cachedToken is a token of a tokenCache, along the time after which a new one is requested
+type cachedToken struct {
+	token     *oauth2.Token
+	refreshAt time.Time
+}
+
+func newTokenCache(fetch func(clientId string, scopes string) (*metadata.Token, error)) *tokenCache {
+	return &tokenCache{fetch: fetch, tokens: make(map[string]cachedToken)}
+}
+
+// token returns the cached token of clientId and scopes, asking the keymaster for a new one if it expires within the
+// next minute, or within half its lifetime for the short-lived tokens. The concurrent requests for the same token
+// share a single keymaster request.
+func (c *tokenCache) token(clientId string, scopes string) (*oauth2.Token, error) {
+	key := clientId + " " + scopes
+
+	c.lock.Lock()
+	cached, ok := c.tokens[key]
+	c.lock.Unlock()
+	if ok && time.Now().Before(cached.refreshAt) {
+		return cached.token, nil
+	}
+
+	result, err, _ := c.group.Do(key, func() (interface{}, error) {
+		requested := time.Now()
+		km, err := c.fetch(clientId, scopes)
+		if err != nil {
+			return nil, err
+		}
+		if km.AccessToken == "" {
+			return nil, ErrNoToken
+		}
+
+		lifetime := time.Duration(km.ExpiresIn) * time.Second
+		token := &oauth2.Token{
+			AccessToken: km.AccessToken,
+			TokenType:   km.TokenType,
+			Expiry:      requested.Add(lifetime),
+		}
+		margin := tokenExpiryDelta
+		if lifetime/2 < margin {
+			margin = lifetime / 2
+		}
+		c.lock.Lock()
+		c.tokens[key] = cachedToken{token: token, refreshAt: token.Expiry.Add(-margin)}
+		c.lock.Unlock()
+		return token, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(*oauth2.Token), nil
+}
+
+// KeymasterTokenSource provides the Web API tokens of a client id and scopes, obtained from the keymaster through the
+// session. It implements oauth2.TokenSource, so that it can be used with oauth2.NewClient to call the Web API.
+type KeymasterTokenSource struct {
+	cache    *tokenCache
+	clientId string
+	scopes   string
+}
+
+// TokenSource returns a token source for the Web API tokens of clientId with the given scopes. The tokens are cached
+// by the session and shared by all its token sources, they are refreshed a minute before they expire.
+func (s *Session) TokenSource(clientId string, scopes ...string) *KeymasterTokenSource {
+	sorted := append([]string{}, scopes...)
+	sort.Strings(sorted)
+	return &KeymasterTokenSource{cache: s.tokens, clientId: clientId, scopes: strings.Join(sorted, ",")}
+}
+
+// Token returns a valid token, asking the keymaster for a new one when the cached one is about to expire
+func (t *KeymasterTokenSource) Token() (*oauth2.Token, error) {
+	return t.cache.token(t.clientId, t.scopes)
+}
@@ -0,0 +1,87 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/librespot-org/librespot-golang/librespot/testing/fakeap"
+	"golang.org/x/oauth2"
+)
+
+var _ oauth2.TokenSource = &KeymasterTokenSource{}
+
+func TestTokenSource(t *testing.T) {
+	server, config := newFakeAP(t)
+	defer server.Close()
+
+	var requests int32
+	var expiresIn int32 = 3600
+	release := make(chan struct{})
+	server.HandleMercury("hm://keymaster/token/authenticated?client_id=client&scope=playlist-read%2Cstreaming",
+		func(req fakeap.MercuryRequest) fakeap.MercuryResponse {
+			n := atomic.AddInt32(&requests, 1)
+			<-release
+			data, _ := json.Marshal(map[string]interface{}{
+				"accessToken": "token" + string(rune('0'+n)),
+				"expiresIn":   atomic.LoadInt32(&expiresIn),
+				"tokenType":   "Bearer",
+				"scope":       []string{"playlist-read", "streaming"},
+			})
+			return fakeap.MercuryResponse{StatusCode: 200, Payload: [][]byte{data}}
+		})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := config.Login(ctx, "testUser", "123", "myDevice")
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	defer s.Close(ctx)
+
+	// The concurrent requests share a single keymaster request, whatever the order of the scopes
+	sources := []oauth2.TokenSource{
+		s.TokenSource("client", "streaming", "playlist-read"),
+		s.TokenSource("client", "playlist-read", "streaming"),
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(source oauth2.TokenSource) {
+			defer wg.Done()
+			token, err := source.Token()
+			if err != nil || token.AccessToken != "token1" || token.Type() != "Bearer" || !token.Valid() {
+				t.Errorf("Wrong token. Got %+v, %v", token, err)
+			}
+		}(sources[i%2])
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("Wrong number of keymaster requests. Got %d", n)
+	}
+
+	// The cached token is reused until it is about to expire
+	atomic.StoreInt32(&expiresIn, 30)
+	s.tokens.lock.Lock()
+	for key, cached := range s.tokens.tokens {
+		cached.refreshAt = time.Now()
+		s.tokens.tokens[key] = cached
+	}
+	s.tokens.lock.Unlock()
+	// A short-lived token is still reused, until half its lifetime remains
+	for _, expected := range []string{"token2", "token2"} {
+		token, err := sources[0].Token()
+		if err != nil || token.AccessToken != expected {
+			t.Errorf("Expected %s. Got %+v, %v", expected, token, err)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("Expected the short-lived token to be cached. Got %d keymaster requests", n)
+	}
+}
@@ -0,0 +1,101 @@
+package core
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/librespot-org/librespot-golang/librespot/connection"
+)
+
+// DefaultReadTimeout is the time after which the connection is considered dead when no packet has been received from
+// the AP. The APs send a ping every 2 minutes, so a healthy connection never stays quiet that long.
+const DefaultReadTimeout = 3 * time.Minute
+
+// ConnectionStats describes the liveness of the connection to the AP, and the latency measured with its pings
+type ConnectionStats struct {
+	// LastPacket is the time the last packet has been received from the AP
+	LastPacket time.Time
+	// LastPing is the time the last ping has been received from the AP
+	LastPing time.Time
+	// Pings is the number of pings received since the session started
+	Pings int
+	// Latency is the last round-trip time measured, between our answer to a ping and its acknowledgement by the AP
+	Latency time.Duration
+	// AverageLatency is the mean of the round-trip times measured since the session started
+	AverageLatency time.Duration
+	// MaxLatency is the highest round-trip time measured since the session started
+	MaxLatency time.Duration
+	// Timeouts is the number of connections dropped because the AP went quiet for longer than the read timeout
+	Timeouts int
+}
+
+// readDeadliner is implemented by the connections supporting read deadlines, such as net.Conn
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// watchdog keeps track of the packets received from the AP, in order to compute the ConnectionStats
+type watchdog struct {
+	lock  sync.Mutex
+	stats ConnectionStats
+	// pongSent is the time our last pong has been sent, it is zero once acknowledged
+	pongSent     time.Time
+	latencySum   time.Duration
+	latencyCount int
+}
+
+func (w *watchdog) get() ConnectionStats {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.stats
+}
+
+func (w *watchdog) packetReceived(cmd uint8, now time.Time) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.stats.LastPacket = now
+
+	switch cmd {
+	case connection.PacketPing:
+		w.stats.LastPing = now
+		w.stats.Pings++
+
+	case connection.PacketPongAck:
+		if w.pongSent.IsZero() {
+			return
+		}
+
+		latency := now.Sub(w.pongSent)
+		w.pongSent = time.Time{}
+
+		w.stats.Latency = latency
+		if latency > w.stats.MaxLatency {
+			w.stats.MaxLatency = latency
+		}
+		w.latencySum += latency
+		w.latencyCount++
+		w.stats.AverageLatency = w.latencySum / time.Duration(w.latencyCount)
+	}
+}
+
+func (w *watchdog) pongSentAt(now time.Time) {
+	w.lock.Lock()
+	w.pongSent = now
+	w.lock.Unlock()
+}
+
+func (w *watchdog) timedOut() {
+	w.lock.Lock()
+	w.stats.Timeouts++
+	w.pongSent = time.Time{}
+	w.lock.Unlock()
+}
+
+// isTimeout reports whether err is caused by a read deadline
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,61 @@
+package crypto
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// ErrHashCashBudget is returned when a hashcash challenge can't be solved within the allowed budget
+var ErrHashCashBudget = errors.New("hashcash budget exhausted")
+
+// hashCashCheckInterval is the number of attempts between two checks of the budget
+const hashCashCheckInterval = 1 << 12
+
+// SolveHashCash solves a hashcash proof-of-work challenge, as Spotify sends them during the handshake and the login5
+// authentication. It looks for a 16 bytes suffix, made of the big-endian seed+counter and counter, such that the bytes
+// 12 to 20 of SHA-1(prefix || suffix) end with at least length zero bits. The scheme is the one of solve_hash_cash in
+// librespot (core/src/hashcash.rs), where the seed is derived from the login context with HashCashSeed. The search
+// stops with ErrHashCashBudget once ctx is done.
+func SolveHashCash(ctx context.Context, prefix []byte, length int32, seed int64) ([]byte, error) {
+	if length < 0 || length > 64 {
+		return nil, fmt.Errorf("invalid hashcash length %d", length)
+	}
+
+	data := make([]byte, len(prefix)+16)
+	copy(data, prefix)
+	suffix := data[len(prefix):]
+
+	for counter := int64(0); ; counter++ {
+		if counter%hashCashCheckInterval == 0 && ctx.Err() != nil {
+			return nil, fmt.Errorf("%w after %d attempts: %v", ErrHashCashBudget, counter, ctx.Err())
+		}
+
+		binary.BigEndian.PutUint64(suffix[0:8], uint64(seed+counter))
+		binary.BigEndian.PutUint64(suffix[8:16], uint64(counter))
+
+		if hashCashZeros(sha1.Sum(data)) >= int(length) {
+			return append([]byte{}, suffix...), nil
+		}
+	}
+}
+
+// HashCashSeed returns the seed of the hashcash challenge of a login context, the big-endian bytes 12 to 20 of its
+// SHA-1 as librespot reads them
+func HashCashSeed(loginContext []byte) int64 {
+	sum := sha1.Sum(loginContext)
+	return int64(binary.BigEndian.Uint64(sum[12:20]))
+}
+
+// CheckHashCash reports whether suffix solves the hashcash challenge of the given prefix and length
+func CheckHashCash(prefix []byte, length int32, suffix []byte) bool {
+	data := append(append([]byte{}, prefix...), suffix...)
+	return len(suffix) == 16 && hashCashZeros(sha1.Sum(data)) >= int(length)
+}
+
+func hashCashZeros(sum [sha1.Size]byte) int {
+	return bits.TrailingZeros64(binary.BigEndian.Uint64(sum[12:20]))
+}
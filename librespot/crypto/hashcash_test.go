@@ -0,0 +1,61 @@
+package crypto
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSolveHashCash(t *testing.T) {
+	// Computed with a standalone transcription of solve_hash_cash from librespot (core/src/hashcash.rs), independent
+	// of this implementation
+	vectors := []struct {
+		context string
+		prefix  string
+		length  int32
+		suffix  string
+	}{
+		{"", "", 0, "95601890afd807090000000000000000"},
+		{"0102030405060708090a0b0c0d0e0f10", "0102030405060708090a0b0c0d0e0f10", 10,
+			"96ec8aefb4e4d90e0000000000000065"},
+		{"6c6f67696e352d636f6e74657874", "68617368636173682d707265666978", 14, "cccbc74bfd39774900000000000003a4"},
+		{"00000000000000000000000000000000", "00000000000000000000000000000000", 16,
+			"a15e160d44512fe3000000000000c8e4"},
+	}
+
+	for _, vector := range vectors {
+		loginContext, _ := hex.DecodeString(vector.context)
+		prefix, _ := hex.DecodeString(vector.prefix)
+		suffix, err := SolveHashCash(context.Background(), prefix, vector.length, HashCashSeed(loginContext))
+		if err != nil {
+			t.Errorf("Failed to solve %+v: %v", vector, err)
+			continue
+		}
+		if hex.EncodeToString(suffix) != vector.suffix {
+			t.Errorf("Wrong suffix for %+v. Got %x", vector, suffix)
+		}
+		if !CheckHashCash(prefix, vector.length, suffix) {
+			t.Errorf("Suffix of %+v not accepted", vector)
+		}
+		if vector.length > 0 && CheckHashCash(prefix, vector.length, make([]byte, 16)) {
+			t.Errorf("Wrong suffix accepted for %+v", vector)
+		}
+	}
+}
+
+func TestSolveHashCashBudget(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err := SolveHashCash(ctx, []byte("prefix"), 64, 0)
+	if !errors.Is(err, ErrHashCashBudget) {
+		t.Errorf("Expected the budget to be exhausted. Got %v", err)
+	}
+
+	_, err = SolveHashCash(context.Background(), []byte("prefix"), 65, 0)
+	if err == nil || errors.Is(err, ErrHashCashBudget) {
+		t.Errorf("Expected an invalid length error. Got %v", err)
+	}
+}
@@ -143,3 +143,13 @@ func (p *PrivateKeys) ClientNonce() []byte {
 func (s *SharedKeys) Challenge() []byte {
 	return s.challenge
 }
+
+// Reversed returns the keys as seen from the other end of the connection, where the send and receive keys are
+// swapped. It allows implementing the server side of the handshake, e.g. in tests.
+func (s *SharedKeys) Reversed() SharedKeys {
+	return SharedKeys{
+		challenge: s.challenge,
+		sendKey:   s.recvKey,
+		recvKey:   s.sendKey,
+	}
+}
@@ -3,12 +3,16 @@ package crypto
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"github.com/librespot-org/librespot-golang/librespot/connection"
 	"io"
-	"log"
 	"sync"
 )
 
+// ErrInvalidMac is returned when the MAC of a received packet doesn't match its content, i.e. the packet has been
+// corrupted or tampered with. The stream can't be read further afterwards.
+var ErrInvalidMac = errors.New("received mac doesn't match")
+
 type shannonStream struct {
 	sendNonce  uint32
 	sendCipher shn_ctx
@@ -111,23 +115,27 @@ func (s *shannonStream) FinishSend() (err error) {
 	return
 }
 
-func (s *shannonStream) finishRecv() {
+func (s *shannonStream) finishRecv() error {
 	count := 4
 
 	mac := make([]byte, count)
-	io.ReadFull(s.reader, mac)
+	_, err := io.ReadFull(s.reader, mac)
+	if err != nil {
+		return err
+	}
 
 	mac2 := make([]byte, count)
 	shn_finish(&s.recvCipher, mac2, count)
 
 	if !bytes.Equal(mac, mac2) {
-		log.Println("received mac doesn't match")
+		return ErrInvalidMac
 	}
 
 	s.recvNonce += 1
 	nonce := make([]uint8, 4)
 	binary.BigEndian.PutUint32(nonce, s.recvNonce)
 	shn_nonce(&s.recvCipher, nonce, len(nonce))
+	return nil
 }
 
 func (s *shannonStream) RecvPacket() (cmd uint8, buf []byte, err error) {
@@ -151,7 +159,7 @@ func (s *shannonStream) RecvPacket() (cmd uint8, buf []byte, err error) {
 		buf = s.Decrypt(buf)
 
 	}
-	s.finishRecv()
+	err = s.finishRecv()
 
 	return cmd, buf, err
 }
@@ -0,0 +1,62 @@
+package crypto
+
+import (
+	stdcrypto "crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"errors"
+	"math/big"
+)
+
+// ErrInvalidSignature is returned when the Diffie-Hellman key sent by the AP isn't signed by the expected key
+var ErrInvalidSignature = errors.New("invalid server signature")
+
+// serverKeyModulus is the modulus of the RSA key Spotify's APs sign their Diffie-Hellman key with
+var serverKeyModulus = []byte{
+	0xac, 0xe0, 0x46, 0x0b, 0xff, 0xc2, 0x30, 0xaf, 0xf4, 0x6b, 0xfe, 0xc3, 0xbf, 0xbf, 0x86, 0x3d,
+	0xa1, 0x91, 0xc6, 0xcc, 0x33, 0x6c, 0x93, 0xa1, 0x4f, 0xb3, 0xb0, 0x16, 0x12, 0xac, 0xac, 0x6a,
+	0xf1, 0x80, 0xe7, 0xf6, 0x14, 0xd9, 0x42, 0x9d, 0xbe, 0x2e, 0x34, 0x66, 0x43, 0xe3, 0x62, 0xd2,
+	0x32, 0x7a, 0x1a, 0x0d, 0x92, 0x3b, 0xae, 0xdd, 0x14, 0x02, 0xb1, 0x81, 0x55, 0x05, 0x61, 0x04,
+	0xd5, 0x2c, 0x96, 0xa4, 0x4c, 0x1e, 0xcc, 0x02, 0x4a, 0xd4, 0xb2, 0x0c, 0x00, 0x1f, 0x17, 0xed,
+	0xc2, 0x2f, 0xc4, 0x35, 0x21, 0xc8, 0xf0, 0xcb, 0xae, 0xd2, 0xad, 0xd7, 0x2b, 0x0f, 0x9d, 0xb3,
+	0xc5, 0x32, 0x1a, 0x2a, 0xfe, 0x59, 0xf3, 0x5a, 0x0d, 0xac, 0x68, 0xf1, 0xfa, 0x62, 0x1e, 0xfb,
+	0x2c, 0x8d, 0x0c, 0xb7, 0x39, 0x2d, 0x92, 0x47, 0xe3, 0xd7, 0x35, 0x1a, 0x6d, 0xbd, 0x24, 0xc2,
+	0xae, 0x25, 0x5b, 0x88, 0xff, 0xab, 0x73, 0x29, 0x8a, 0x0b, 0xcc, 0xcd, 0x0c, 0x58, 0x67, 0x31,
+	0x89, 0xe8, 0xbd, 0x34, 0x80, 0x78, 0x4a, 0x5f, 0xc9, 0x6b, 0x89, 0x9d, 0x95, 0x6b, 0xfc, 0x86,
+	0xd7, 0x4f, 0x33, 0xa6, 0x78, 0x17, 0x96, 0xc9, 0xc3, 0x2d, 0x0d, 0x32, 0xa5, 0xab, 0xcd, 0x05,
+	0x27, 0xe2, 0xf7, 0x10, 0xa3, 0x96, 0x13, 0xc4, 0x2f, 0x99, 0xc0, 0x27, 0xbf, 0xed, 0x04, 0x9c,
+	0x3c, 0x27, 0x58, 0x04, 0xb6, 0xb2, 0x19, 0xf9, 0xc1, 0x2f, 0x02, 0xe9, 0x48, 0x63, 0xec, 0xa1,
+	0xb6, 0x42, 0xa0, 0x9d, 0x48, 0x25, 0xf8, 0xb3, 0x9d, 0xd0, 0xe8, 0x6a, 0xf9, 0x48, 0x4d, 0xa1,
+	0xc2, 0xba, 0x86, 0x30, 0x42, 0xea, 0x9d, 0xb3, 0x08, 0x6c, 0x19, 0x0e, 0x48, 0xb3, 0x9d, 0x66,
+	0xeb, 0x00, 0x06, 0xa2, 0x5a, 0xee, 0xa1, 0x1b, 0x13, 0x87, 0x3c, 0xd7, 0x19, 0xe6, 0x55, 0xbd,
+}
+
+// ServerKey returns the public RSA key of Spotify's APs
+func ServerKey() *rsa.PublicKey {
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(serverKeyModulus),
+		E: 65537,
+	}
+}
+
+// VerifyServerSignature checks the signature of the Diffie-Hellman key gs sent by the AP, which is a PKCS #1 v1.5
+// signature of its SHA-1 hash. Spotify's key is used when key is nil.
+func VerifyServerSignature(key *rsa.PublicKey, gs []byte, signature []byte) error {
+	if key == nil {
+		key = ServerKey()
+	}
+
+	hash := sha1.Sum(gs)
+	err := rsa.VerifyPKCS1v15(key, stdcrypto.SHA1, hash[:], signature)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// SignServerKey signs the Diffie-Hellman key gs like the APs do. It allows implementing the server side of the
+// handshake, e.g. in tests.
+func SignServerKey(key *rsa.PrivateKey, gs []byte) ([]byte, error) {
+	hash := sha1.Sum(gs)
+	return rsa.SignPKCS1v15(nil, key, stdcrypto.SHA1, hash[:])
+}
@@ -0,0 +1,47 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"testing"
+)
+
+func TestServerKey(t *testing.T) {
+	key := ServerKey()
+	if key.N.BitLen() != 2048 || key.N.Bit(0) != 1 {
+		t.Errorf("Invalid server key modulus. Got %d bits", key.N.BitLen())
+	}
+}
+
+func TestVerifyServerSignature(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := GenerateKeys()
+	gs := keys.PubKey()
+	signature, err := SignServerKey(key, gs)
+	if err != nil {
+		t.Fatalf("Signing failed: %v", err)
+	}
+
+	if err := VerifyServerSignature(&key.PublicKey, gs, signature); err != nil {
+		t.Errorf("Valid signature refused: %v", err)
+	}
+
+	tampered := append([]byte{}, gs...)
+	tampered[0] ^= 1
+	if err := VerifyServerSignature(&key.PublicKey, tampered, signature); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Signature of a tampered key accepted. Got %v", err)
+	}
+
+	// Spotify's key is used by default
+	if err := VerifyServerSignature(nil, gs, signature); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Signature of another key accepted. Got %v", err)
+	}
+	if err := VerifyServerSignature(nil, gs, make([]byte, 256)); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Zero signature accepted. Got %v", err)
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"errors"
 	"fmt"
 	"github.com/badfortrains/mdns"
-	"log"
 	"math/rand"
 	"net/http"
 	"net/url"
@@ -15,6 +14,7 @@ import (
 	"sync"
 
 	"github.com/librespot-org/librespot-golang/librespot/crypto"
+	"github.com/librespot-org/librespot-golang/librespot/logging"
 	"github.com/librespot-org/librespot-golang/librespot/utils"
 	"net"
 )
@@ -60,6 +60,8 @@ type Discovery struct {
 	httpServer  *http.Server
 	devices     []connectDeviceMdns
 	devicesLock sync.RWMutex
+
+	log logging.Logger
 }
 
 // makeConnectGetInfo builds a connectGetInfo structure with the provided values
@@ -81,58 +83,74 @@ func makeConnectGetInfo(deviceId string, deviceName string, publicKey string) co
 	}
 }
 
-func blobFromDiscovery(deviceName string) *utils.BlobInfo {
+func blobFromDiscovery(deviceName string) (*utils.BlobInfo, error) {
 	deviceId := utils.GenerateDeviceId(deviceName)
-	d := LoginFromConnect("", deviceId, deviceName)
-	return &d.loginBlob
+	d, err := LoginFromConnect("", deviceId, deviceName, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &d.loginBlob, nil
 }
 
 // Advertises a Spotify service via mdns. It waits for the user to connect to 'librespot' device, extracts login data
-// and returns the resulting login BlobInfo.
-func LoginFromConnect(cachePath string, deviceId string, deviceName string) *Discovery {
+// and returns the resulting login BlobInfo, which is saved to cachePath unless it is empty. The logs go to logger,
+// nothing is logged when nil.
+func LoginFromConnect(cachePath string, deviceId string, deviceName string, logger logging.Logger) (*Discovery, error) {
 	d := Discovery{
 		keys:       crypto.GenerateKeys(),
 		cachePath:  cachePath,
 		deviceId:   deviceId,
 		deviceName: deviceName,
+		log:        logging.OrDiscard(logger),
 	}
 
 	done := make(chan int)
 
 	l, err := net.Listen("tcp", ":8000")
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("discovery: listening for Spotify Connect requests: %w", err)
 	}
 	defer l.Close()
 	go d.startHttp(done, l)
-	d.startDiscoverable()
+
+	err = d.startDiscoverable()
+	if err != nil {
+		return nil, err
+	}
 
 	<-done
 
-	return &d
+	return &d, nil
 }
 
-func CreateFromBlob(blob utils.BlobInfo, cachePath, deviceId string, deviceName string) *Discovery {
+// CreateFromBlob creates a Discovery from existing login information, and starts looking for the Spotify Connect
+// devices of the local network. The logs go to logger, nothing is logged when nil.
+func CreateFromBlob(blob utils.BlobInfo, cachePath, deviceId string, deviceName string, logger logging.Logger) (*Discovery, error) {
 	d := Discovery{
 		keys:       crypto.GenerateKeys(),
 		cachePath:  cachePath,
 		deviceId:   deviceId,
 		loginBlob:  blob,
 		deviceName: deviceName,
+		log:        logging.OrDiscard(logger),
 	}
 
-	d.FindDevices()
+	err := d.FindDevices()
+	if err != nil {
+		return nil, err
+	}
 
-	return &d
+	return &d, nil
 }
 
-func CreateFromFile(cachePath, deviceId string, deviceName string) *Discovery {
+// CreateFromFile is like CreateFromBlob, reading the login information from the file at cachePath
+func CreateFromFile(cachePath, deviceId string, deviceName string, logger logging.Logger) (*Discovery, error) {
 	blob, err := utils.BlobFromFile(cachePath)
 	if err != nil {
-		log.Fatal("failed to get blob from file")
+		return nil, fmt.Errorf("discovery: reading blob from %s: %w", cachePath, err)
 	}
 
-	return CreateFromBlob(blob, cachePath, deviceId, deviceName)
+	return CreateFromBlob(blob, cachePath, deviceId, deviceName, logger)
 }
 
 func (d *Discovery) DeviceId() string {
@@ -153,7 +171,7 @@ func (d *Discovery) Devices() []connectDeviceMdns {
 	return append(res, d.devices...)
 }
 
-func (d *Discovery) FindDevices() {
+func (d *Discovery) FindDevices() error {
 	ch := make(chan *mdns.ServiceEntry, 10)
 
 	d.devices = make([]connectDeviceMdns, 0)
@@ -161,54 +179,66 @@ func (d *Discovery) FindDevices() {
 		for entry := range ch {
 			cPath := findCpath(entry.InfoFields)
 			path := fmt.Sprintf("http://%v:%v%v", entry.AddrV4, entry.Port, cPath)
-			fmt.Println("Found a device", entry)
+			name := strings.Replace(entry.Name, "._spotify-connect._tcp.local.", "", 1)
+			d.log.Debug("discovery: found a device", "name", name, "path", path)
 			d.devicesLock.Lock()
 			d.devices = append(d.devices, connectDeviceMdns{
 				Path: path,
-				Name: strings.Replace(entry.Name, "._spotify-connect._tcp.local.", "", 1),
+				Name: name,
 			})
-			fmt.Println("devices", d.devices)
 			d.devicesLock.Unlock()
 		}
-		fmt.Println("closed")
 	}()
 
 	err := mdns.Lookup("_spotify-connect._tcp.", ch)
 	if err != nil {
-		log.Fatal("lookup error", err)
+		return fmt.Errorf("discovery: looking up Spotify Connect devices: %w", err)
 	}
+	return nil
 }
 
-func (d *Discovery) ConnectToDevice(address string) {
+func (d *Discovery) ConnectToDevice(address string) error {
+	for _, action := range []string{"connectGetInfo", "resetUsers"} {
+		resp, err := http.Get(address + "?action=" + action)
+		if err != nil {
+			return fmt.Errorf("discovery: %s on %s: %w", action, address, err)
+		}
+		resp.Body.Close()
+	}
+
 	resp, err := http.Get(address + "?action=connectGetInfo")
-	resp, err = http.Get(address + "?action=resetUsers")
-	resp, err = http.Get(address + "?action=connectGetInfo")
+	if err != nil {
+		return fmt.Errorf("discovery: connectGetInfo on %s: %w", address, err)
+	}
 
-	fmt.Println("start get")
 	defer resp.Body.Close()
 	decoder := json.NewDecoder(resp.Body)
 	info := connectInfo{}
 	err = decoder.Decode(&info)
 	if err != nil {
-		panic("bad json")
+		return fmt.Errorf("discovery: decoding device info: %w", err)
 	}
-	fmt.Println("resposne", resp)
 
 	client64 := base64.StdEncoding.EncodeToString(d.keys.PubKey())
 	blob, err := d.loginBlob.MakeAuthBlob(info.DeviceID,
 		info.PublicKey, d.keys)
 	if err != nil {
-		panic("bad blob")
+		return fmt.Errorf("discovery: building auth blob: %w", err)
 	}
 
 	body := makeAddUserRequest(d.loginBlob.Username, blob, client64, d.deviceId, d.deviceName)
-	resp, err = http.PostForm(address, body)
-	defer resp.Body.Close()
-	decoder = json.NewDecoder(resp.Body)
+	addResp, err := http.PostForm(address, body)
+	if err != nil {
+		return fmt.Errorf("discovery: addUser on %s: %w", address, err)
+	}
+	defer addResp.Body.Close()
+	decoder = json.NewDecoder(addResp.Body)
 	var f interface{}
 	err = decoder.Decode(&f)
 
-	fmt.Println("got", f, resp, err)
+	d.log.Debug("discovery: addUser response", "address", address, "status", addResp.StatusCode, "body", f,
+		logging.KeyError, err)
+	return nil
 }
 
 func makeAddUserRequest(username string, blob string, key string, deviceId string, deviceName string) url.Values {
@@ -242,7 +272,7 @@ func (d *Discovery) handleAddUser(r *http.Request) error {
 	blob64 := r.FormValue("blob")
 
 	if username == "" || client64 == "" || blob64 == "" {
-		log.Println("Bad Request, addUser")
+		d.log.Warn("discovery: bad addUser request", "username", username)
 		return errors.New("bad username Request")
 	}
 
@@ -252,9 +282,11 @@ func (d *Discovery) handleAddUser(r *http.Request) error {
 		return errors.New("failed to decode blob")
 	}
 
-	err = blob.SaveToFile(d.cachePath)
-	if err != nil {
-		log.Println("failed to cache login info")
+	if d.cachePath != "" {
+		err = blob.SaveToFile(d.cachePath)
+		if err != nil {
+			d.log.Warn("discovery: failed to cache login info", "path", d.cachePath, logging.KeyError, err)
+		}
 	}
 
 	d.loginBlob = blob
@@ -265,7 +297,7 @@ func (d *Discovery) handleAddUser(r *http.Request) error {
 func (d *Discovery) startHttp(done chan int, l net.Listener) {
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		action := r.FormValue("action")
-		fmt.Println("got Request: ", action)
+		d.log.Debug("discovery: received request", "action", action, "remote", r.RemoteAddr)
 		switch {
 		case "connectGetInfo" == action || "resetUsers" == action:
 			client64 := base64.StdEncoding.EncodeToString(d.keys.PubKey())
@@ -289,17 +321,18 @@ func (d *Discovery) startHttp(done chan int, l net.Listener) {
 
 	d.httpServer = &http.Server{}
 	err := d.httpServer.Serve(l)
-	if err != nil {
-		fmt.Println("got an error", err)
+	if err != nil && err != http.ErrServerClosed {
+		d.log.Error("discovery: serving Spotify Connect requests", logging.KeyError, err)
 	}
 }
 
-func (d *Discovery) startDiscoverable() {
-	fmt.Println("start discoverable")
+func (d *Discovery) startDiscoverable() error {
 	info := []string{"VERSION=1.0", "CPath=/"}
 
 	ifaces, err := net.Interfaces()
-	// Handle err
+	if err != nil {
+		return fmt.Errorf("discovery: listing network interfaces: %w", err)
+	}
 	ips := make([]net.IP, 0)
 	for _, i := range ifaces {
 		addrs, _ := i.Addrs()
@@ -311,22 +344,21 @@ func (d *Discovery) startDiscoverable() {
 			case *net.IPAddr:
 				ips = append(ips, v.IP)
 			}
-			fmt.Println("found ip ", ips)
-			// process IP address
 		}
 	}
 
 	service, err := mdns.NewMDNSService("librespot"+strconv.Itoa(rand.Intn(200)),
 		"_spotify-connect._tcp", "", "", 8000, ips, info)
 	if err != nil {
-		fmt.Println(err)
-		log.Fatal("error starting Discovery")
+		return fmt.Errorf("discovery: creating mdns service: %w", err)
 	}
+	d.log.Debug("discovery: advertising the device", "ips", ips)
 	server, err := mdns.NewServer(&mdns.Config{
 		Zone: service,
 	})
 	if err != nil {
-		log.Fatal("error starting Discovery")
+		return fmt.Errorf("discovery: starting mdns server: %w", err)
 	}
 	d.mdnsServer = server
+	return nil
 }
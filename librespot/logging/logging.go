@@ -0,0 +1,151 @@
+// Package logging defines the levelled, structured logger used across librespot. Each message comes with alternating
+// keys and values describing its context, using the field names defined here so that the logs can be filtered and
+// aggregated reliably.
+//
+// The Logger interface is satisfied by a *slog.Logger, and NewStdLogger adapts a standard *log.Logger. Nothing is
+// logged unless a logger is set, e.g. through core.SessionConfig.
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// The field names used in the logs
+const (
+	// KeySession is the random identifier of the session, which tells apart the sessions of a same process
+	KeySession = "session_id"
+	// KeyDevice is the device id the session advertises
+	KeyDevice = "device_id"
+	// KeyAP is the address of the access point
+	KeyAP = "ap"
+	// KeyCmd is the command of a packet
+	KeyCmd = "cmd"
+	// KeyChannel is the number of an audio channel
+	KeyChannel = "channel"
+	// KeySeq is the sequence number of a request
+	KeySeq = "seq"
+	// KeyURI is the URI of a mercury request or event
+	KeyURI = "uri"
+	// KeyError is the error which caused the message
+	KeyError = "error"
+)
+
+// Logger is a levelled, structured logger. Its methods take a message followed by alternating keys and values, like
+// the ones of log/slog.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// Discard is a Logger ignoring all the messages
+var Discard Logger = discard{}
+
+type discard struct{}
+
+func (discard) Debug(msg string, args ...interface{}) {}
+func (discard) Info(msg string, args ...interface{})  {}
+func (discard) Warn(msg string, args ...interface{})  {}
+func (discard) Error(msg string, args ...interface{}) {}
+
+// OrDiscard returns logger, or Discard when it is nil
+func OrDiscard(logger Logger) Logger {
+	if logger == nil {
+		return Discard
+	}
+	return logger
+}
+
+// With returns a Logger adding the provided keys and values to all the messages of logger. A nil logger is treated
+// as Discard.
+func With(logger Logger, args ...interface{}) Logger {
+	logger = OrDiscard(logger)
+	if logger == Discard || len(args) == 0 {
+		return logger
+	}
+
+	if parent, ok := logger.(*withLogger); ok {
+		return &withLogger{logger: parent.logger, args: parent.with(args)}
+	}
+	return &withLogger{logger: logger, args: args}
+}
+
+type withLogger struct {
+	logger Logger
+	args   []interface{}
+}
+
+func (l *withLogger) with(args []interface{}) []interface{} {
+	all := make([]interface{}, 0, len(l.args)+len(args))
+	return append(append(all, l.args...), args...)
+}
+
+func (l *withLogger) Debug(msg string, args ...interface{}) { l.logger.Debug(msg, l.with(args)...) }
+func (l *withLogger) Info(msg string, args ...interface{})  { l.logger.Info(msg, l.with(args)...) }
+func (l *withLogger) Warn(msg string, args ...interface{})  { l.logger.Warn(msg, l.with(args)...) }
+func (l *withLogger) Error(msg string, args ...interface{}) { l.logger.Error(msg, l.with(args)...) }
+
+// Level is the severity of a message. The values are the ones of log/slog.
+type Level int
+
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+func (l Level) String() string {
+	switch {
+	case l < LevelInfo:
+		return "DEBUG"
+	case l < LevelWarn:
+		return "INFO"
+	case l < LevelError:
+		return "WARN"
+	default:
+		return "ERROR"
+	}
+}
+
+// NewStdLogger returns a Logger writing the messages of at least the given level to logger, as a line like
+// `INFO connected ap=ap.spotify.com:4070 session_id=0a1b2c3d`
+func NewStdLogger(logger *log.Logger, level Level) Logger {
+	return &stdLogger{logger: logger, level: level}
+}
+
+type stdLogger struct {
+	logger *log.Logger
+	level  Level
+}
+
+func (l *stdLogger) log(level Level, msg string, args []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	line := &strings.Builder{}
+	line.WriteString(level.String())
+	line.WriteString(" ")
+	line.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			fmt.Fprintf(line, " !BADKEY=%v", args[i])
+			break
+		}
+		value := fmt.Sprint(args[i+1])
+		if strings.ContainsAny(value, " \"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		fmt.Fprintf(line, " %v=%s", args[i], value)
+	}
+	l.logger.Output(3, line.String())
+}
+
+func (l *stdLogger) Debug(msg string, args ...interface{}) { l.log(LevelDebug, msg, args) }
+func (l *stdLogger) Info(msg string, args ...interface{})  { l.log(LevelInfo, msg, args) }
+func (l *stdLogger) Warn(msg string, args ...interface{})  { l.log(LevelWarn, msg, args) }
+func (l *stdLogger) Error(msg string, args ...interface{}) { l.log(LevelError, msg, args) }
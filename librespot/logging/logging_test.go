@@ -0,0 +1,73 @@
+package logging
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+type record struct {
+	level string
+	msg   string
+	args  []interface{}
+}
+
+type recordingLogger struct {
+	records []record
+}
+
+func (l *recordingLogger) Debug(msg string, args ...interface{}) {
+	l.records = append(l.records, record{"debug", msg, args})
+}
+func (l *recordingLogger) Info(msg string, args ...interface{}) {
+	l.records = append(l.records, record{"info", msg, args})
+}
+func (l *recordingLogger) Warn(msg string, args ...interface{}) {
+	l.records = append(l.records, record{"warn", msg, args})
+}
+func (l *recordingLogger) Error(msg string, args ...interface{}) {
+	l.records = append(l.records, record{"error", msg, args})
+}
+
+func TestWith(t *testing.T) {
+	if With(nil, KeySession, "1") != Discard {
+		t.Errorf("Expected a nil logger to discard the messages")
+	}
+
+	recorder := &recordingLogger{}
+	logger := With(With(recorder, KeySession, "1"), KeyDevice, "2")
+	logger.Warn("message", KeySeq, 3)
+
+	if len(recorder.records) != 1 {
+		t.Fatalf("Wrong number of messages. Got %v", recorder.records)
+	}
+	got := recorder.records[0]
+	expected := []interface{}{KeySession, "1", KeyDevice, "2", KeySeq, 3}
+	if got.level != "warn" || got.msg != "message" || len(got.args) != len(expected) {
+		t.Fatalf("Wrong message. Got %v", got)
+	}
+	for i := range expected {
+		if got.args[i] != expected[i] {
+			t.Errorf("Wrong argument %d. Got %v, want %v", i, got.args[i], expected[i])
+		}
+	}
+}
+
+func TestStdLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := NewStdLogger(log.New(buf, "", 0), LevelInfo)
+
+	logger.Debug("hidden")
+	logger.Info("connected", KeyAP, "ap.spotify.com:4070", KeySession, "0a1b")
+	logger.Error("failed", KeyError, "connection reset by peer", "odd")
+
+	expected := "INFO connected ap=ap.spotify.com:4070 session_id=0a1b\n" +
+		"ERROR failed error=\"connection reset by peer\" !BADKEY=odd\n"
+	if buf.String() != expected {
+		t.Errorf("Wrong output. Got %q", buf.String())
+	}
+	if strings.Contains(buf.String(), "hidden") {
+		t.Errorf("Debug message written at the info level")
+	}
+}
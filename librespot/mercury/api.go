@@ -1,69 +1,200 @@
 package mercury
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/librespot-org/librespot-golang/Spotify"
+	"github.com/librespot-org/librespot-golang/librespot/logging"
 	"github.com/librespot-org/librespot-golang/librespot/metadata"
+	"github.com/librespot-org/librespot-golang/librespot/spotifyid"
+	"golang.org/x/sync/singleflight"
 )
 
-func (m *Client) mercuryGet(url string) []byte {
-	done := make(chan []byte)
-	go m.Request(Request{
+// mercuryGet sends a GET request to url and returns the payload of the response. It fails with a StatusError when
+// the response doesn't have a 2xx status code, after retrying the 5xx responses according to the retry policy.
+func (m *Client) mercuryGet(ctx context.Context, url string) ([]byte, error) {
+	res, err := m.doWithRetry(ctx, Request{
 		Method:  "GET",
 		Uri:     url,
 		Payload: [][]byte{},
-	}, func(res Response) {
-		done <- res.CombinePayload()
 	})
+	if err != nil {
+		return nil, err
+	}
+	return res.CombinePayload(), nil
+}
+
+// doWithRetry sends req and returns its response. It fails with a StatusError when the response doesn't have a 2xx
+// status code, after retrying the 5xx responses according to the retry policy.
+func (m *Client) doWithRetry(ctx context.Context, req Request) (Response, error) {
+	for attempt := 1; ; attempt++ {
+		res, err := m.Do(ctx, req)
+		if err != nil {
+			return Response{}, err
+		}
+		err = checkStatus(req, res)
+		if err == nil {
+			return res, nil
+		}
+
+		var statusErr *StatusError
+		if !errors.As(err, &statusErr) || !statusErr.Temporary() || attempt >= m.retry.MaxAttempts {
+			return Response{}, err
+		}
+		m.log.Debug("mercury: retrying request", logging.KeyURI, req.Uri, "status", res.StatusCode, "attempt", attempt)
+
+		select {
+		case <-time.After(m.retry.Delay(attempt - 1)):
+		case <-ctx.Done():
+			return Response{}, err
+		}
+	}
+}
+
+func (m *Client) mercuryGetJson(ctx context.Context, url string, result interface{}) (err error) {
+	data, err := m.mercuryGet(ctx, url)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, result)
+}
 
-	result := <-done
-	return result
+func (m *Client) mercuryGetProto(ctx context.Context, url string, result proto.Message) (err error) {
+	data, err := m.mercuryGet(ctx, url)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(data, result)
 }
 
-func (m *Client) mercuryGetJson(url string, result interface{}) (err error) {
-	data := m.mercuryGet(url)
-	// fmt.Printf("%s", data)
-	err = json.Unmarshal(data, result)
-	return
+// metadataResponse is the result of a metadata request shared by the concurrent getters
+type metadataResponse struct {
+	data []byte
+	// ttl is the time the metadata may stay in the cache, 0 for the TTL of the client
+	ttl time.Duration
+	// cache is false when the server asked not to cache the metadata
+	cache bool
+}
+
+// getMetadata decodes the metadata of the item id into result, after checking it is of type typ. They are read from
+// the cache of the client when possible, otherwise they are fetched from the specified version of the metadata
+// endpoint, the concurrent requests for the same metadata sharing a single mercury request. The shared request isn't
+// bound to ctx, so that a caller giving up doesn't fail the others, only the timeout of the client bounds it.
+func (m *Client) getMetadata(ctx context.Context, version int, typ spotifyid.Type, id spotifyid.SpotifyID,
+	result proto.Message) error {
+	if err := id.Expect(typ); err != nil {
+		return err
+	}
+	if data, ok := m.cacheGet(id); ok && proto.Unmarshal(data, result) == nil {
+		return nil
+	}
+	result.Reset()
+
+	uri := fmt.Sprintf("hm://metadata/%d/%s/%s", version, typ, id.Hex())
+	ch := m.metadataGroup.DoChan(m.cacheKey(id), func() (interface{}, error) {
+		fetchCtx := context.Background()
+		if m.timeout > 0 {
+			var cancel context.CancelFunc
+			fetchCtx, cancel = context.WithTimeout(fetchCtx, m.timeout)
+			defer cancel()
+		}
+
+		res, err := m.doWithRetry(fetchCtx, Request{Method: "GET", Uri: uri, Payload: [][]byte{}})
+		if err != nil {
+			return nil, err
+		}
+		ttl, cache := cachePolicy(res)
+		return metadataResponse{data: res.CombinePayload(), ttl: ttl, cache: cache}, nil
+	})
+
+	var shared singleflight.Result
+	select {
+	case shared = <-ch:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if shared.Err != nil {
+		return shared.Err
+	}
+	res := shared.Val.(metadataResponse)
+	if err := proto.Unmarshal(res.data, result); err != nil {
+		return err
+	}
+	if res.cache {
+		m.cacheSet(id, res.data, res.ttl)
+	}
+	return nil
 }
 
-func (m *Client) mercuryGetProto(url string, result proto.Message) (err error) {
-	data := m.mercuryGet(url)
-	// ioutil.WriteFile("/tmp/proto.blob", data, 0644)
-	err = proto.Unmarshal(data, result)
-	return
+// cachePolicy returns the time the payload of a response may be cached, read from the MC-TTL user field of its header
+// in seconds, and false when its MC-Cache-Policy user field forbids caching it. A TTL of 0 stands for the TTL of the
+// client.
+func cachePolicy(res Response) (time.Duration, bool) {
+	header := &Spotify.Header{}
+	if proto.Unmarshal(res.HeaderData, header) != nil {
+		return 0, true
+	}
+
+	var ttl time.Duration
+	cache := true
+	for _, field := range header.GetUserFields() {
+		switch strings.ToLower(field.GetKey()) {
+		case "mc-ttl":
+			if seconds, err := strconv.Atoi(string(field.GetValue())); err == nil && seconds > 0 {
+				ttl = time.Duration(seconds) * time.Second
+			}
+		case "mc-cache-policy":
+			policy := strings.ToLower(string(field.GetValue()))
+			cache = policy != "no" && policy != "no-cache"
+		}
+	}
+	return ttl, cache
 }
 
-func (m *Client) GetRootPlaylist(username string) (*Spotify.SelectedListContent, error) {
+func (m *Client) GetRootPlaylist(ctx context.Context, username string) (*Spotify.SelectedListContent, error) {
 	uri := fmt.Sprintf("hm://playlist/user/%s/rootlist", username)
 
 	result := &Spotify.SelectedListContent{}
-	err := m.mercuryGetProto(uri, result)
-	return result, err
+	err := m.mercuryGetProto(ctx, uri, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
-func (m *Client) GetPlaylist(id string) (*Spotify.SelectedListContent, error) {
+func (m *Client) GetPlaylist(ctx context.Context, id string) (*Spotify.SelectedListContent, error) {
 	uri := fmt.Sprintf("hm://playlist/%s", id)
 
 	result := &Spotify.SelectedListContent{}
-	err := m.mercuryGetProto(uri, result)
-	return result, err
+	err := m.mercuryGetProto(ctx, uri, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
-func (m *Client) GetToken(clientId string, scopes string) (*metadata.Token, error) {
+func (m *Client) GetToken(ctx context.Context, clientId string, scopes string) (*metadata.Token, error) {
 	uri := fmt.Sprintf("hm://keymaster/token/authenticated?client_id=%s&scope=%s", url.QueryEscape(clientId),
 		url.QueryEscape(scopes))
 
 	token := &metadata.Token{}
-	err := m.mercuryGetJson(uri, token)
-	return token, err
+	err := m.mercuryGetJson(ctx, uri, token)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
 }
 
-func (m *Client) Search(search string, limit int, country string, username string) (*metadata.SearchResponse, error) {
+func (m *Client) Search(ctx context.Context, search string, limit int, country string,
+	username string) (*metadata.SearchResponse, error) {
 	v := url.Values{}
 	v.Set("entityVersion", "2")
 	v.Set("limit", fmt.Sprintf("%d", limit))
@@ -76,57 +207,77 @@ func (m *Client) Search(search string, limit int, country string, username strin
 	uri := fmt.Sprintf("hm://searchview/km/v4/search/%s?%s", url.QueryEscape(search), v.Encode())
 
 	result := &metadata.SearchResponse{}
-	err := m.mercuryGetJson(uri, result)
-	return result, err
+	err := m.mercuryGetJson(ctx, uri, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
-func (m *Client) Suggest(search string) (*metadata.SuggestResult, error) {
+func (m *Client) Suggest(ctx context.Context, search string) (*metadata.SuggestResult, error) {
 	uri := "hm://searchview/km/v3/suggest/" + url.QueryEscape(search) + "?limit=3&intent=2516516747764520149&sequence=0&catalogue=&country=&locale=&platform=zelda&username="
-	data := m.mercuryGet(uri)
-
+	data, err := m.mercuryGet(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
 	return parseSuggest(data)
 }
 
-func (m *Client) GetTrack(id string) (*Spotify.Track, error) {
-	uri := "hm://metadata/4/track/" + id
+// GetTrack returns the metadata of the track id, which must be of type spotifyid.Track
+func (m *Client) GetTrack(ctx context.Context, id spotifyid.SpotifyID) (*Spotify.Track, error) {
 	result := &Spotify.Track{}
-	err := m.mercuryGetProto(uri, result)
-	return result, err
+	err := m.getMetadata(ctx, 4, spotifyid.Track, id, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
-func (m *Client) GetArtist(id string) (*Spotify.Artist, error) {
-	uri := "hm://metadata/4/artist/" + id
+// GetArtist returns the metadata of the artist id, which must be of type spotifyid.Artist
+func (m *Client) GetArtist(ctx context.Context, id spotifyid.SpotifyID) (*Spotify.Artist, error) {
 	result := &Spotify.Artist{}
-	err := m.mercuryGetProto(uri, result)
-	return result, err
+	err := m.getMetadata(ctx, 4, spotifyid.Artist, id, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
-func (m *Client) GetAlbum(id string) (*Spotify.Album, error) {
-	uri := "hm://metadata/4/album/" + id
+// GetAlbum returns the metadata of the album id, which must be of type spotifyid.Album
+func (m *Client) GetAlbum(ctx context.Context, id spotifyid.SpotifyID) (*Spotify.Album, error) {
 	result := &Spotify.Album{}
-	err := m.mercuryGetProto(uri, result)
-	return result, err
+	err := m.getMetadata(ctx, 4, spotifyid.Album, id, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
-func (m *Client) GetEpisode(id string) (*Spotify.Episode, error) {
-	uri := "hm://metadata/3/episode/" + id
+// GetEpisode returns the metadata of the episode id, which must be of type spotifyid.Episode
+func (m *Client) GetEpisode(ctx context.Context, id spotifyid.SpotifyID) (*Spotify.Episode, error) {
 	result := &Spotify.Episode{}
-	err := m.mercuryGetProto(uri, result)
-	return result, err
+	err := m.getMetadata(ctx, 3, spotifyid.Episode, id, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
-func (m *Client) GetShow(id string) (*Spotify.Show, error) {
-	uri := "hm://metadata/3/show/" + id
+// GetShow returns the metadata of the show id, which must be of type spotifyid.Show
+func (m *Client) GetShow(ctx context.Context, id spotifyid.SpotifyID) (*Spotify.Show, error) {
 	result := &Spotify.Show{}
-	err := m.mercuryGetProto(uri, result)
-	return result, err
+	err := m.getMetadata(ctx, 3, spotifyid.Show, id, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
 func parseSuggest(body []byte) (*metadata.SuggestResult, error) {
 	result := &metadata.SuggestResult{}
 	err := json.Unmarshal(body, result)
 	if err != nil {
-		fmt.Println("err", err)
+		return nil, err
 	}
 
 	for _, s := range result.Sections {
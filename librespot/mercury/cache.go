@@ -0,0 +1,155 @@
+package mercury
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultCacheTTL is the time the metadata stay in the cache of a client, unless configured otherwise
+const DefaultCacheTTL = 24 * time.Hour
+
+// MetadataCache stores the metadata fetched by the typed getters of a client, as encoded by the server. The keys are
+// built from the kind of the metadata, its GID and the country of the user, as the metadata depend on the country.
+// A cache is best-effort: failing to store an entry only costs a request later on. It must be safe for concurrent use.
+type MetadataCache interface {
+	// Get returns the data stored for key, false if there is none or it has expired
+	Get(key string) ([]byte, bool)
+	// Set stores data for key until ttl has elapsed
+	Set(key string, data []byte, ttl time.Duration)
+}
+
+type memoryCacheEntry struct {
+	key    string
+	data   []byte
+	expiry time.Time
+}
+
+// MemoryCache is a MetadataCache holding a limited number of entries in memory, evicting the least recently used
+// ones first
+type MemoryCache struct {
+	capacity int
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	// order holds the entries from the most recently used to the least recently used one
+	order *list.List
+}
+
+// NewMemoryCache creates a MemoryCache holding capacity entries at most. A capacity of 0 or less means no limit, the
+// entries are then only removed once expired and read.
+func NewMemoryCache(capacity int) *MemoryCache {
+	return &MemoryCache{capacity: capacity, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+func (c *MemoryCache) Get(key string) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*memoryCacheEntry)
+	if time.Now().After(entry.expiry) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return entry.data, true
+}
+
+func (c *MemoryCache) Set(key string, data []byte, ttl time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry := &memoryCacheEntry{key: key, data: data, expiry: time.Now().Add(ttl)}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+
+	for c.capacity > 0 && c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*memoryCacheEntry).key)
+	}
+}
+
+// Len returns the number of entries in the cache, including the expired ones not evicted yet
+func (c *MemoryCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.order.Len()
+}
+
+// DiskCache is a MetadataCache storing each entry in a file of a directory, so that the metadata survive restarts.
+// The expired entries are removed when read, the size of the directory is not bounded otherwise.
+type DiskCache struct {
+	dir string
+}
+
+// NewDiskCache creates a DiskCache storing its entries in dir, which is created if needed
+func NewDiskCache(dir string) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &DiskCache{dir: dir}, nil
+}
+
+// path returns the file of key, whose name is a hash of the key as the GIDs may contain any character
+func (c *DiskCache) path(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+func (c *DiskCache) Get(key string) ([]byte, bool) {
+	path := c.path(key)
+	content, err := ioutil.ReadFile(path)
+	if err != nil || len(content) < 8 {
+		return nil, false
+	}
+
+	// The files start with the expiry of the entry, in nanoseconds since the epoch
+	expiry := time.Unix(0, int64(binary.BigEndian.Uint64(content)))
+	if time.Now().After(expiry) {
+		os.Remove(path)
+		return nil, false
+	}
+	return content[8:], true
+}
+
+func (c *DiskCache) Set(key string, data []byte, ttl time.Duration) {
+	path := c.path(key)
+	file, err := ioutil.TempFile(c.dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return
+	}
+
+	var expiry [8]byte
+	binary.BigEndian.PutUint64(expiry[:], uint64(time.Now().Add(ttl).UnixNano()))
+	_, err = file.Write(expiry[:])
+	if err == nil {
+		_, err = file.Write(data)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return
+	}
+	// Renaming makes the entry appear atomically to the concurrent readers
+	if os.Rename(file.Name(), path) != nil {
+		os.Remove(file.Name())
+	}
+}
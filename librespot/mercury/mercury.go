@@ -2,13 +2,21 @@ package mercury
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/golang/protobuf/proto"
 	"github.com/librespot-org/librespot-golang/Spotify"
 	"github.com/librespot-org/librespot-golang/librespot/connection"
+	"github.com/librespot-org/librespot-golang/librespot/logging"
+	"github.com/librespot-org/librespot-golang/librespot/metrics"
+	"github.com/librespot-org/librespot-golang/librespot/spotifyid"
+	"golang.org/x/sync/singleflight"
 	"io"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Mercury is the protocol implementation for Spotify Connect playback control and metadata fetching.It works as a
@@ -32,95 +40,402 @@ type Request struct {
 
 type Callback func(Response)
 
+// DefaultTimeout is the default time after which a request without response is abandoned
+const DefaultTimeout = 30 * time.Second
+
+// ErrConnectionLost is returned by the requests pending when the connection to the AP is lost
+var ErrConnectionLost = errors.New("mercury: connection lost")
+
+// ErrClientClosed is returned by the requests pending when the client is closed
+var ErrClientClosed = errors.New("mercury: client closed")
+
+// responseHandler receives the response of a request, or the error explaining why it will never come
+type responseHandler func(res Response, err error)
+
 type Pending struct {
 	parts   [][]byte
 	partial []byte
 }
 
 type Internal struct {
-	seqLock sync.Mutex
-	nextSeq uint32
-	pending map[string]Pending
-	stream  connection.PacketStream
+	seqLock     sync.Mutex
+	nextSeq     uint32
+	pending     map[string]Pending
+	pendingLock sync.Mutex
+	stream      connection.PacketStream
+	streamLock  sync.RWMutex
 }
 
 type Client struct {
-	subscriptions map[string][]chan Response
-	callbacks     map[string]Callback
-	internal      *Internal
-	cbMu          sync.Mutex
+	// subscriptions holds the subscriptions receiving the events of each URI, which includes the URIs reported by the
+	// server in its response to the SUB requests
+	subscriptions map[string][]*Subscription
+	// subscribed holds the subscriptions to each URI passed to Subscribe, in order to replay them after a reconnection
+	subscribed map[string][]*Subscription
+	callbacks  map[string]responseHandler
+	internal   *Internal
+	cbMu       sync.Mutex
+	log        logging.Logger
+	metrics    metrics.Metrics
+	timeout    time.Duration
+	retry      RetryPolicy
+	// cache stores the metadata fetched by the typed getters for cacheTTL, nil disables caching
+	cache    MetadataCache
+	cacheTTL time.Duration
+	// country is the country code of the user, part of the cache keys
+	country atomic.Value
+	// metadataGroup deduplicates the concurrent requests for the same metadata
+	metadataGroup singleflight.Group
 }
 
 type Connection interface {
-	Subscribe(uri string, recv chan Response, cb Callback) error
-	Request(req Request, cb Callback) (err error)
+	Subscribe(ctx context.Context, uri string, recv chan Response) (*Subscription, error)
+	Request(ctx context.Context, req Request, cb Callback) (err error)
 	Handle(cmd uint8, reader io.Reader) (err error)
 }
 
 // CreateMercury initializes a Connection for the specified session.
 func CreateMercury(stream connection.PacketStream) *Client {
 	client := &Client{
-		callbacks:     make(map[string]Callback),
-		subscriptions: make(map[string][]chan Response),
+		callbacks:     make(map[string]responseHandler),
+		subscriptions: make(map[string][]*Subscription),
+		subscribed:    make(map[string][]*Subscription),
 		internal: &Internal{
 			pending: make(map[string]Pending),
 			stream:  stream,
 		},
+		log:     logging.Discard,
+		metrics: metrics.Nop{},
+		timeout: DefaultTimeout,
+		retry:   DefaultRetryPolicy(),
 	}
 	return client
 }
 
-// Subscribe subscribes the specified receiving channel to the specified URI, and calls the callback function
-// whenever there's an event happening.
-func (m *Client) Subscribe(uri string, recv chan Response, cb Callback) error {
-	m.addChannelSubscriber(uri, recv)
-	err := m.Request(Request{
+// SetTimeout sets the time after which the requests without response are abandoned, whatever their context. A
+// timeout of 0 disables it. It must be called before the client is used.
+func (m *Client) SetTimeout(timeout time.Duration) {
+	m.timeout = timeout
+}
+
+// SetLogger sets the logger receiving the logs of the client, it must be called before the client is used
+func (m *Client) SetLogger(logger logging.Logger) {
+	m.log = logging.OrDiscard(logger)
+}
+
+// SetMetrics sets the Metrics receiving the events of the client, it must be called before the client is used
+func (m *Client) SetMetrics(hooks metrics.Metrics) {
+	m.metrics = metrics.OrNop(hooks)
+}
+
+// SetRetryPolicy sets the policy followed by the typed getters to retry their requests after a 5xx response, it must
+// be called before the client is used
+func (m *Client) SetRetryPolicy(policy RetryPolicy) {
+	m.retry = policy
+}
+
+// SetCache sets the cache of the metadata fetched by the typed getters, and the time they stay in the cache when the
+// server doesn't specify it. A ttl of 0 stands for DefaultCacheTTL. It must be called before the client is used.
+func (m *Client) SetCache(cache MetadataCache, ttl time.Duration) {
+	if ttl == 0 {
+		ttl = DefaultCacheTTL
+	}
+	m.cache = cache
+	m.cacheTTL = ttl
+}
+
+// SetCountry sets the country code of the user, as the metadata cached depend on it. It can be called at any time,
+// e.g. once the AP has sent the country code.
+func (m *Client) SetCountry(country string) {
+	m.country.Store(country)
+}
+
+func (m *Client) cacheKey(id spotifyid.SpotifyID) string {
+	country, _ := m.country.Load().(string)
+	return string(id.Type) + "/" + id.Hex() + "/" + country
+}
+
+// cacheGet returns the cached metadata of id, false if they aren't cached
+func (m *Client) cacheGet(id spotifyid.SpotifyID) ([]byte, bool) {
+	if m.cache == nil {
+		return nil, false
+	}
+	return m.cache.Get(m.cacheKey(id))
+}
+
+// cacheSet caches the metadata of id for ttl, or for the TTL of the client when 0
+func (m *Client) cacheSet(id spotifyid.SpotifyID, data []byte, ttl time.Duration) {
+	if m.cache == nil {
+		return
+	}
+	if ttl <= 0 {
+		ttl = m.cacheTTL
+	}
+	m.cache.Set(m.cacheKey(id), data, ttl)
+}
+
+// Subscribe subscribes the specified receiving channel to the specified URI, and returns once the server has
+// confirmed the subscription. The events of the URI are then sent to the channel, until the returned Subscription is
+// cancelled. The context only bounds the SUB request.
+func (m *Client) Subscribe(ctx context.Context, uri string, recv chan Response) (*Subscription, error) {
+	sub := newSubscription(m, uri, recv)
+
+	// The subscription is registered first, so that no event following the SUB response is missed
+	m.cbMu.Lock()
+	m.subscribed[uri] = append(m.subscribed[uri], sub)
+	m.cbMu.Unlock()
+	m.addSubscriber(uri, sub)
+
+	err := m.sendSubscribe(ctx, uri, []*Subscription{sub})
+	if err != nil {
+		sub.cancel()
+		m.removeSubscription(sub)
+		return nil, err
+	}
+	return sub, nil
+}
+
+// sendSubscribe sends the SUB request for uri, and subscribes subs to the URIs the server reports in its response
+func (m *Client) sendSubscribe(ctx context.Context, uri string, subs []*Subscription) error {
+	req := Request{
 		Method: "SUB",
 		Uri:    uri,
-	}, func(response Response) {
-		for _, part := range response.Payload {
-			sub := &Spotify.Subscription{}
-			err := proto.Unmarshal(part, sub)
-			if err == nil && *sub.Uri != uri {
-				m.addChannelSubscriber(*sub.Uri, recv)
+	}
+	res, err := m.Do(ctx, req)
+	if err != nil {
+		return err
+	}
+	err = checkStatus(req, res)
+	if err != nil {
+		return err
+	}
+
+	for _, part := range res.Payload {
+		reported := &Spotify.Subscription{}
+		err := proto.Unmarshal(part, reported)
+		if err == nil && reported.GetUri() != uri {
+			for _, sub := range subs {
+				m.addSubscriber(reported.GetUri(), sub)
 			}
 		}
-		cb(response)
-	})
+	}
+	return nil
+}
+
+func (m *Client) addSubscriber(uri string, sub *Subscription) {
+	m.cbMu.Lock()
+	defer m.cbMu.Unlock()
+
+	for _, existing := range m.subscriptions[uri] {
+		if existing == sub {
+			// Already subscribed, which happens when the subscriptions are replayed
+			return
+		}
+	}
+	m.subscriptions[uri] = append(m.subscriptions[uri], sub)
+}
+
+// removeSubscription removes sub from all the URIs it receives the events of. It returns true if no other
+// subscription to its URI remains.
+func (m *Client) removeSubscription(sub *Subscription) bool {
+	m.cbMu.Lock()
+	defer m.cbMu.Unlock()
 
-	return err
+	for uri, subs := range m.subscriptions {
+		m.subscriptions[uri] = without(subs, sub)
+		if len(m.subscriptions[uri]) == 0 {
+			delete(m.subscriptions, uri)
+		}
+	}
+
+	m.subscribed[sub.uri] = without(m.subscribed[sub.uri], sub)
+	if len(m.subscribed[sub.uri]) > 0 {
+		return false
+	}
+	delete(m.subscribed, sub.uri)
+	return true
 }
 
-func (m *Client) addChannelSubscriber(uri string, recv chan Response) {
-	chList, ok := m.subscriptions[uri]
-	if !ok {
-		chList = make([]chan Response, 0)
+// without returns a copy of subs without sub, the slices being shared with the deliveries in progress
+func without(subs []*Subscription, sub *Subscription) []*Subscription {
+	res := make([]*Subscription, 0, len(subs))
+	for _, s := range subs {
+		if s != sub {
+			res = append(res, s)
+		}
 	}
+	return res
+}
 
-	chList = append(chList, recv)
-	m.subscriptions[uri] = chList
+// Rebind makes the client send its requests over a new stream, once the session has reconnected to an AP. The
+// requests pending on the previous stream are failed with a 500 status code, as their response will never come.
+func (m *Client) Rebind(stream connection.PacketStream) {
+	m.internal.streamLock.Lock()
+	m.internal.stream = stream
+	m.internal.streamLock.Unlock()
+	m.internal.pendingLock.Lock()
+	m.internal.pending = make(map[string]Pending)
+	m.internal.pendingLock.Unlock()
+
+	m.failPending(ErrConnectionLost)
 }
 
-func (m *Client) Request(req Request, cb Callback) (err error) {
-	seq, err := m.internal.request(req)
-	if err != nil {
-		// Call the callback with a 500 error-code so that the request doesn't remain pending in case of error
+// Resubscribe sends the SUB requests of all the active subscriptions again. It is used after a reconnection, as
+// the new AP doesn't know about the subscriptions made on the previous one.
+func (m *Client) Resubscribe(ctx context.Context) error {
+	m.cbMu.Lock()
+	subscribed := make(map[string][]*Subscription, len(m.subscribed))
+	for uri, subs := range m.subscribed {
+		subscribed[uri] = subs
+	}
+	m.cbMu.Unlock()
+
+	for uri, subs := range subscribed {
+		err := m.sendSubscribe(ctx, uri, subs)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Request sends req and calls cb with its response. If no response has been received once ctx is done, or once the
+// timeout of the client has elapsed, the request is abandoned and cb is called with a 500 status code, as when the
+// request fails locally.
+func (m *Client) Request(ctx context.Context, req Request, cb Callback) (err error) {
+	return m.request(ctx, req, func(res Response, err error) {
+		if err != nil {
+			res = Response{Uri: req.Uri, StatusCode: 500}
+		}
 		if cb != nil {
-			cb(Response{
-				StatusCode: 500,
-			})
+			cb(res)
 		}
+	})
+}
 
-		return err
+// Do sends req and waits for its response. It fails with the error of ctx if no response has been received once
+// ctx is done, with context.DeadlineExceeded once the timeout of the client has elapsed, and with
+// ErrConnectionLost if the connection is lost in the meantime.
+func (m *Client) Do(ctx context.Context, req Request) (Response, error) {
+	type result struct {
+		res Response
+		err error
+	}
+	done := make(chan result, 1)
+	err := m.request(ctx, req, func(res Response, err error) {
+		done <- result{res, err}
+	})
+	if err != nil {
+		return Response{}, err
+	}
+
+	r := <-done
+	return r.res, r.err
+}
+
+// request sends req and calls handler once with its response or the error explaining why it will never come, which
+// includes ctx being done and the timeout elapsing. The handler is registered before the request is sent, so that
+// the response can't arrive before it.
+func (m *Client) request(ctx context.Context, req Request, handler responseHandler) error {
+	handler = m.meteredHandler(req, handler)
+
+	var cancel context.CancelFunc
+	if m.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, m.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
 	}
 
+	_, seq := m.internal.NextSeq()
+	seqKey := string(seq)
 	m.cbMu.Lock()
-	m.callbacks[string(seq)] = cb
+	m.callbacks[seqKey] = func(res Response, err error) {
+		cancel()
+		handler(res, err)
+	}
 	m.cbMu.Unlock()
 
+	// Abandon the request once ctx is done, unless its response has been received
+	go func() {
+		<-ctx.Done()
+		if abandoned := m.abandon(seqKey); abandoned != nil {
+			abandoned(Response{}, ctx.Err())
+		}
+	}()
+
+	err := m.internal.request(seq, req)
+	if err != nil {
+		if failed := m.abandon(seqKey); failed != nil {
+			failed(Response{}, err)
+		}
+		return err
+	}
 	return nil
 }
 
+// abandon removes the pending request seqKey, and returns its handler if it was still pending
+func (m *Client) abandon(seqKey string) responseHandler {
+	m.cbMu.Lock()
+	handler, ok := m.callbacks[seqKey]
+	delete(m.callbacks, seqKey)
+	m.cbMu.Unlock()
+
+	m.internal.pendingLock.Lock()
+	delete(m.internal.pending, seqKey)
+	m.internal.pendingLock.Unlock()
+
+	if !ok {
+		return nil
+	}
+	return handler
+}
+
+// meteredHandler wraps handler so that the latency and the status code of the request are reported to the metrics
+func (m *Client) meteredHandler(req Request, handler responseHandler) responseHandler {
+	prefix := metrics.URIPrefix(req.Uri)
+	m.metrics.MercuryRequestSent(req.Method, prefix)
+
+	start := time.Now()
+	return func(res Response, err error) {
+		status := res.StatusCode
+		if err != nil {
+			status = 500
+		}
+		m.metrics.MercuryResponse(req.Method, prefix, status, time.Since(start))
+		handler(res, err)
+	}
+}
+
+// Close fails every pending request with a 500 status code, so that no caller remains blocked waiting for a response
+// that will never come, and cancels all the subscriptions. The client must not be used afterwards.
+func (m *Client) Close() {
+	m.cbMu.Lock()
+	subscribed := m.subscribed
+	m.subscriptions = make(map[string][]*Subscription)
+	m.subscribed = make(map[string][]*Subscription)
+	m.cbMu.Unlock()
+
+	for _, subs := range subscribed {
+		for _, sub := range subs {
+			sub.cancel()
+		}
+	}
+
+	m.failPending(ErrClientClosed)
+}
+
+// failPending fails all the pending requests with err
+func (m *Client) failPending(err error) {
+	m.cbMu.Lock()
+	callbacks := m.callbacks
+	m.callbacks = make(map[string]responseHandler)
+	m.cbMu.Unlock()
+
+	for _, handler := range callbacks {
+		handler(Response{}, err)
+	}
+}
+
 func (m *Client) NextSeq() []byte {
 	_, seq := m.internal.NextSeq()
 	return seq
@@ -142,11 +457,10 @@ func (m *Internal) NextSeq() (uint32, []byte) {
 	return seqInt, seq
 }
 
-func (m *Internal) request(req Request) (seqKey string, err error) {
-	_, seq := m.NextSeq()
+func (m *Internal) request(seq []byte, req Request) error {
 	data, err := encodeRequest(seq, req)
 	if err != nil {
-		return "", err
+		return err
 	}
 
 	var cmd uint8
@@ -159,12 +473,11 @@ func (m *Internal) request(req Request) (seqKey string, err error) {
 		cmd = 0xb2
 	}
 
-	err = m.stream.SendPacket(cmd, data)
-	if err != nil {
-		return "", err
-	}
+	m.streamLock.RLock()
+	stream := m.stream
+	m.streamLock.RUnlock()
 
-	return string(seq), nil
+	return stream.SendPacket(cmd, data)
 }
 
 func encodeMercuryHead(seq []byte, partsLength uint16, flags uint8) (*bytes.Buffer, error) {
@@ -237,18 +550,15 @@ func handleHead(reader io.Reader) (seq []byte, flags uint8, count uint16, err er
 	seq = make([]byte, seqLength)
 	_, err = io.ReadFull(reader, seq)
 	if err != nil {
-		fmt.Println("read seq")
 		return
 	}
 
 	err = binary.Read(reader, binary.BigEndian, &flags)
 	if err != nil {
-		fmt.Println("read flags")
 		return
 	}
 	err = binary.Read(reader, binary.BigEndian, &count)
 	if err != nil {
-		fmt.Println("read count")
 		return
 	}
 
@@ -262,11 +572,16 @@ func (m *Client) Handle(cmd uint8, reader io.Reader) (err error) {
 	}
 	if response != nil {
 		if cmd == 0xb5 {
-			chList, ok := m.subscriptions[response.Uri]
+			// The slices of subscriptions are never modified in place, so they can be iterated without the lock
+			m.cbMu.Lock()
+			subs, ok := m.subscriptions[response.Uri]
+			m.cbMu.Unlock()
 			if ok {
-				for _, ch := range chList {
-					ch <- *response
+				for _, sub := range subs {
+					sub.deliver(*response)
 				}
+			} else {
+				m.log.Debug("mercury: event without subscriber", logging.KeyURI, response.Uri)
 			}
 		} else {
 			m.cbMu.Lock()
@@ -274,7 +589,10 @@ func (m *Client) Handle(cmd uint8, reader io.Reader) (err error) {
 			delete(m.callbacks, response.SeqKey) // no-op if element does not exist
 			m.cbMu.Unlock()
 			if ok {
-				cb(*response)
+				cb(*response, nil)
+			} else {
+				m.log.Debug("mercury: response without pending request", logging.KeyURI, response.Uri,
+					logging.KeySeq, fmt.Sprintf("%x", response.SeqKey))
 			}
 		}
 	}
@@ -285,11 +603,12 @@ func (m *Client) Handle(cmd uint8, reader io.Reader) (err error) {
 func (m *Internal) parseResponse(cmd uint8, reader io.Reader) (response *Response, err error) {
 	seq, flags, count, err := handleHead(reader)
 	if err != nil {
-		fmt.Println("error handling response", err)
 		return
 	}
 
 	seqKey := string(seq)
+	m.pendingLock.Lock()
+	defer m.pendingLock.Unlock()
 	pending, ok := m.pending[seqKey]
 
 	if !ok && cmd == 0xb5 {
@@ -301,7 +620,6 @@ func (m *Internal) parseResponse(cmd uint8, reader io.Reader) (response *Respons
 	for i := uint16(0); i < count; i++ {
 		part, err := parsePart(reader)
 		if err != nil {
-			fmt.Println("read part")
 			return nil, err
 		}
 
@@ -327,6 +645,9 @@ func (m *Internal) parseResponse(cmd uint8, reader io.Reader) (response *Respons
 }
 
 func (m *Internal) completeRequest(cmd uint8, pending Pending, seqKey string) (response *Response, err error) {
+	if len(pending.parts) == 0 {
+		return nil, fmt.Errorf("mercury: packet 0x%x without header", cmd)
+	}
 	headerData := pending.parts[0]
 	header := &Spotify.Header{}
 	err = proto.Unmarshal(headerData, header)
@@ -336,7 +657,7 @@ func (m *Internal) completeRequest(cmd uint8, pending Pending, seqKey string) (r
 
 	return &Response{
 		HeaderData: headerData,
-		Uri:        *header.Uri,
+		Uri:        header.GetUri(),
 		Payload:    pending.parts[1:],
 		StatusCode: header.GetStatusCode(),
 		SeqKey:     seqKey,
@@ -346,10 +667,14 @@ func (m *Internal) completeRequest(cmd uint8, pending Pending, seqKey string) (r
 
 func parsePart(reader io.Reader) ([]byte, error) {
 	var size uint16
-	binary.Read(reader, binary.BigEndian, &size)
+	if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
 	buf := make([]byte, size)
-	_, err := io.ReadFull(reader, buf)
-	return buf, err
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
 }
 
 func (res *Response) CombinePayload() []byte {
@@ -1,34 +1,28 @@
 package mercury
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/golang/protobuf/proto"
 	"github.com/librespot-org/librespot-golang/Spotify"
-	"github.com/librespot-org/librespot-golang/librespot/connection"
-	"github.com/librespot-org/librespot-golang/librespot/core"
-	"github.com/librespot-org/librespot-golang/librespot/spirc"
+	"github.com/librespot-org/librespot-golang/librespot/spotifyid"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
-func setupTestController(stream connection.PacketStream) *spirc.Controller {
-	s := &core.Session{
-		stream:   stream,
-		deviceId: "testDevice",
-	}
-	s.mercury = CreateMercury(s)
-	return setupController(s, "fakeUser", []byte{})
-}
-
 func TestMultiPart(t *testing.T) {
-	stream := &fakeStream{
-		recvPackets: make(chan shanPacket, 5),
-		sendPackets: make(chan shanPacket, 5),
-	}
-
-	controller := setupTestController(stream)
+	client := CreateMercury(&recordingStream{})
 
 	subHeader := &Spotify.Header{
-		Uri: proto.String("hm://searchview/km/v2/search/Future"),
+		Uri: proto.String("hm://remote/user/fakeUser/"),
 	}
 	subHeaderData, _ := proto.Marshal(subHeader)
 
@@ -40,9 +34,10 @@ func TestMultiPart(t *testing.T) {
 	body := []byte("{searchResults: {tracks: [], albums: [], tracks: []}}")
 
 	headerData, _ := proto.Marshal(header)
-	seq := []byte{0, 0, 0, 1}
+	seq := []byte{0, 0, 0, 0}
 
-	p0, _ := encodeMercuryHead([]byte{0, 0, 0, 0}, 1, 1)
+	// An event interleaved with the parts of the response
+	p0, _ := encodeMercuryHead([]byte{0, 0, 0, 9}, 1, 1)
 	binary.Write(p0, binary.BigEndian, uint16(len(subHeaderData)))
 	p0.Write(subHeaderData)
 
@@ -55,27 +50,733 @@ func TestMultiPart(t *testing.T) {
 	p2.Write(body)
 
 	didRecieveCallback := false
-	controller.session.mercurySendRequest(Request{
+	client.Request(context.Background(), Request{
 		Method:  "SEND",
 		Uri:     "hm://searchview/km/v2/search/Future",
 		Payload: [][]byte{},
 	}, func(res Response) {
 		didRecieveCallback = true
-		if string(res.Payload[0]) != string(body) {
+		if len(res.Payload) != 1 || string(res.Payload[0]) != string(body) {
 			t.Errorf("bad body received")
 		}
 	})
 
-	stream.recvPackets <- shanPacket{cmd: 0xb2, buf: p0.Bytes()}
-	stream.recvPackets <- shanPacket{cmd: 0xb2, buf: p1.Bytes()}
-	stream.recvPackets <- shanPacket{cmd: 0xb2, buf: p2.Bytes()}
-
-	controller.session.poll()
-	controller.session.poll()
-	controller.session.poll()
+	client.Handle(0xb2, bytes.NewReader(p1.Bytes()))
+	client.Handle(0xb5, bytes.NewReader(p0.Bytes()))
+	client.Handle(0xb2, bytes.NewReader(p2.Bytes()))
 
 	if !didRecieveCallback {
 		t.Errorf("never received callback")
 	}
 
 }
+
+func TestMalformedPacket(t *testing.T) {
+	client := CreateMercury(&recordingStream{})
+
+	for _, data := range [][]byte{
+		{0, 1, 0, 1, 0, 0},
+		{0, 1, 0, 1, 0, 1, 0},
+		{0, 1, 0, 1, 0, 1, 0, 9, 1},
+	} {
+		if err := client.Handle(0xb2, bytes.NewReader(data)); err == nil {
+			t.Errorf("Expected %x to fail", data)
+		}
+	}
+
+	// A header without URI doesn't panic either
+	header, _ := proto.Marshal(&Spotify.Header{StatusCode: proto.Int32(200)})
+	data := append([]byte{0, 1, 0, 1, 0, 1, 0, byte(len(header))}, header...)
+	if err := client.Handle(0xb2, bytes.NewReader(data)); err != nil {
+		t.Errorf("Handle failed: %v", err)
+	}
+}
+
+type sentPacket struct {
+	cmd uint8
+	buf []byte
+}
+
+// recordingStream is a PacketStream recording the packets sent
+type recordingStream struct {
+	lock sync.Mutex
+	sent []sentPacket
+}
+
+func (r *recordingStream) SendPacket(cmd uint8, data []byte) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.sent = append(r.sent, sentPacket{cmd: cmd, buf: data})
+	return nil
+}
+
+func (r *recordingStream) RecvPacket() (uint8, []byte, error) {
+	select {}
+}
+
+// answeringStream is a PacketStream recording the packets sent, and answering the requests with a 200 status
+type answeringStream struct {
+	recordingStream
+	client *Client
+}
+
+func (a *answeringStream) SendPacket(cmd uint8, data []byte) error {
+	a.recordingStream.SendPacket(cmd, data)
+
+	reader := bytes.NewReader(data)
+	seq, _, _, _ := handleHead(reader)
+	headerData, _ := parsePart(reader)
+	header := &Spotify.Header{}
+	proto.Unmarshal(headerData, header)
+
+	go a.client.Handle(cmd, bytes.NewReader(encodeMessage(seq, header.GetUri(), 200)))
+	return nil
+}
+
+func (r *recordingStream) packets() []sentPacket {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]sentPacket{}, r.sent...)
+}
+
+// encodeMessage encodes a single-packet mercury message without payload
+func encodeMessage(seq []byte, uri string, status int32) []byte {
+	headerData, _ := proto.Marshal(&Spotify.Header{Uri: proto.String(uri), StatusCode: proto.Int32(status)})
+	buf, _ := encodeMercuryHead(seq, 1, 1)
+	binary.Write(buf, binary.BigEndian, uint16(len(headerData)))
+	buf.Write(headerData)
+	return buf.Bytes()
+}
+
+func newAnsweringClient() (*Client, *answeringStream) {
+	stream := &answeringStream{}
+	client := CreateMercury(stream)
+	stream.client = client
+	return client, stream
+}
+
+func TestResubscribe(t *testing.T) {
+	client, _ := newAnsweringClient()
+
+	recv := make(chan Response)
+	if _, err := client.Subscribe(context.Background(), "hm://remote/user/fakeUser/", recv); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	status := make(chan int32, 1)
+	client.Request(context.Background(), Request{Method: "GET", Uri: "hm://metadata/4/track/0"}, func(res Response) {
+		status <- res.StatusCode
+	})
+
+	second := &answeringStream{client: client}
+	client.Rebind(second)
+
+	if code := <-status; code != 500 {
+		t.Errorf("Pending request not failed on rebind. Got status %d", code)
+	}
+
+	client.Resubscribe(context.Background())
+	sent := second.packets()
+	if len(sent) != 1 || sent[0].cmd != 0xb3 {
+		t.Fatalf("Expected a single SUB packet on the new stream. Got %v", sent)
+	}
+
+	reader := bytes.NewReader(sent[0].buf)
+	handleHead(reader)
+	headerData, _ := parsePart(reader)
+	header := &Spotify.Header{}
+	proto.Unmarshal(headerData, header)
+	if header.GetUri() != "hm://remote/user/fakeUser/" {
+		t.Errorf("Wrong URI resubscribed. Got %q", header.GetUri())
+	}
+}
+
+func TestSubscription(t *testing.T) {
+	client, stream := newAnsweringClient()
+	ctx := context.Background()
+	uri := "hm://playlist/user/fakeUser/rootlist"
+	event := encodeMessage([]byte{0xff}, uri, 200)
+
+	first := make(chan Response, 1)
+	firstSub, err := client.Subscribe(ctx, uri, first)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	second := make(chan Response)
+	secondSub, err := client.Subscribe(ctx, uri, second)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	// The events are delivered to all the subscribers
+	go client.Handle(0xb5, bytes.NewReader(event))
+	for _, recv := range []chan Response{first, second} {
+		if res := <-recv; res.Uri != uri {
+			t.Errorf("Wrong event delivered. Got %+v", res)
+		}
+	}
+
+	// Unsubscribing aborts the delivery blocked on the channel which isn't read anymore
+	delivered := make(chan struct{})
+	go func() {
+		client.Handle(0xb5, bytes.NewReader(event))
+		close(delivered)
+	}()
+	<-first
+	if err := secondSub.Unsubscribe(); err != nil {
+		t.Errorf("Unsubscribe failed: %v", err)
+	}
+	<-delivered
+	close(second)
+	client.Handle(0xb5, bytes.NewReader(event))
+	<-first
+
+	// The UNSUB request is only sent once the last subscriber is gone
+	countUnsub := func() int {
+		n := 0
+		for _, packet := range stream.packets() {
+			if packet.cmd == 0xb4 {
+				n++
+			}
+		}
+		return n
+	}
+	if n := countUnsub(); n != 0 {
+		t.Errorf("UNSUB sent while a subscriber remains")
+	}
+	if err := firstSub.Unsubscribe(); err != nil {
+		t.Errorf("Unsubscribe failed: %v", err)
+	}
+	if err := firstSub.Unsubscribe(); err != nil || countUnsub() != 1 {
+		t.Errorf("Expected a single UNSUB request. Got %d, %v", countUnsub(), err)
+	}
+	close(first)
+	client.Handle(0xb5, bytes.NewReader(event))
+}
+
+func TestRequestContext(t *testing.T) {
+	client := CreateMercury(&recordingStream{})
+
+	// The first part of the response has been received when the request is cancelled
+	header, _ := proto.Marshal(&Spotify.Header{Uri: proto.String("hm://metadata/4/track/0"), StatusCode: proto.Int32(200)})
+	part, _ := encodeMercuryHead([]byte{0, 0, 0, 0}, 1, 2)
+	binary.Write(part, binary.BigEndian, uint16(len(header)))
+	part.Write(header)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := client.Do(ctx, Request{Method: "GET", Uri: "hm://metadata/4/track/0"})
+		errs <- err
+	}()
+	for client.pendingRequests() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	client.Handle(0xb2, bytes.NewReader(part.Bytes()))
+	cancel()
+
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the request to be cancelled. Got %v", err)
+	}
+	client.internal.pendingLock.Lock()
+	pending := len(client.internal.pending)
+	client.internal.pendingLock.Unlock()
+	if client.pendingRequests() != 0 || pending != 0 {
+		t.Errorf("Cancelled request still pending: %d callbacks, %d partial responses", client.pendingRequests(),
+			pending)
+	}
+
+	// The requests without deadline are abandoned after the timeout of the client
+	client.SetTimeout(20 * time.Millisecond)
+	status := make(chan int32, 1)
+	client.Request(context.Background(), Request{Method: "GET", Uri: "hm://metadata/4/track/1"}, func(res Response) {
+		status <- res.StatusCode
+	})
+	if code := <-status; code != 500 {
+		t.Errorf("Expected the request to time out with a 500 status. Got %d", code)
+	}
+	if _, err := client.Do(context.Background(), Request{Method: "GET"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the request to time out. Got %v", err)
+	}
+}
+
+func (m *Client) pendingRequests() int {
+	m.cbMu.Lock()
+	defer m.cbMu.Unlock()
+	return len(m.callbacks)
+}
+
+func TestSuggest(t *testing.T) {
+	body := `{"sections":[{"type":"top-results","items":[{"name":"Heartbeats","uri":"spotify:album:19WDf08G2WEC79RE94n5Ze","artists":[{"name":"Various Artists","uri":"spotify:artist:0LyfQWJT6nXafLPZqxe9Of"}],"image":"https://d3rt1990lpmkn.cloudfront.net/120/e73927144181509d38d1e933fa5a339659fcd394","log":{"top_hit":"albums","origin":"suggest"}}]},{"type":"track-results","items":[{"name":"Heartbeats","uri":"spotify:track:2YacpExEbX9tF8IbFlFOo4","album":{"name":"Deep Cuts","uri":"spotify:album:1iqMDM4Io1tnDDl58NGeVJ"},"artists":[{"name":"The Knife","uri":"spotify:artist:7eQZTqEMozBcuSubfu52i4"}],"image":"https://d3rt1990lpmkn.cloudfront.net/120/3d06fa074f91e222d2eb6a68c27d374c1845f753","log":{"top_hit":"albums","origin":"suggest"}},{"name":"Heartbeats","uri":"spotify:track:5YqpHuXpFjDVZ7tY1ClFll","album":{"name":"Veneer","uri":"spotify:album:2e0BYdQ7VJlzSNHafdmfrl"},"artists":[{"name":"José González","uri":"spotify:artist:6xrCU6zdcSTsG2hLrojpmI"}],"image":"https://d3rt1990lpmkn.cloudfront.net/120/8ee5e7276f8aec109c37434b1e0e36e0d10479e5","log":{"top_hit":"albums","origin":"suggest"}},{"name":"Heartbeats","uri":"spotify:track:0yfWSUKUNA13Xy1zuLE3f4","album":{"name":"Heartbeats","uri":"spotify:album:7i1iWK8e4opfXm4OOV3O9I"},"artists":[{"name":"Daniela Andrade","uri":"spotify:artist:0WfaItAbs4vlgIA1cuqGtJ"},{"name":"Dabin","uri":"spotify:artist:7lZauDnRoAC3kmaYae2opv"}],"image":"https://d3rt1990lpmkn.cloudfront.net/120/b0129fc373bbeebb6c3200870ee55293496dc092","log":{"top_hit":"albums","origin":"suggest"}}]},{"type":"artist-results","items":[{"name":"The Heartbeats","uri":"spotify:artist:12InvBNZTKboiU2xT663oK","image":"https://d3rt1990lpmkn.cloudfront.net/120/686252a8a11f18c39cd10c55a25bc18ffe24d3b2","log":{"top_hit":"albums","origin":"suggest"}},{"name":"The 5 Heartbeats","uri":"spotify:artist:08XJ8En6r470i5QJV4vzrG","log":{"top_hit":"albums","origin":"suggest"}},{"name":"HeartBeats Pro","uri":"spotify:artist:4gILz9pWk2kOHM3vgn8tZi","image":"https://d3rt1990lpmkn.cloudfront.net/120/0e2fdcaf3bdab06b7a9724303a6a61b44c341f67","log":{"top_hit":"albums","origin":"suggest"}}]},{"type":"album-results","items":[{"name":"Heartbeats","uri":"spotify:album:19WDf08G2WEC79RE94n5Ze","artists":[{"name":"Various Artists","uri":"spotify:artist:0LyfQWJT6nXafLPZqxe9Of"}],"image":"https://d3rt1990lpmkn.cloudfront.net/120/e73927144181509d38d1e933fa5a339659fcd394","log":{"top_hit":"albums","origin":"suggest"}},{"name":"Heartbeats - EP","uri":"spotify:album:3cM7bhwxxzbhhTfrCOxRbH","artists":[{"name":"Avec","uri":"spotify:artist:6N8vbhxZ0CYJHd8WGJ9Snf"}],"image":"https://d3rt1990lpmkn.cloudfront.net/120/3564ebeb04d5a920610d317cba29161d536b0402","log":{"top_hit":"albums","origin":"suggest"}},{"name":"Heartbeats","uri":"spotify:album:2sDfdp7RQQZnMoM4hWbrsh","artists":[{"name":"Mirror Kisses","uri":"spotify:artist:3QsA8x5kNe6XkKT6uwaaio"}],"image":"https://d3rt1990lpmkn.cloudfront.net/120/f9ddabe80ab560f9a911a3185bf1c98831c4dbdf","log":{"top_hit":"albums","origin":"suggest"}}]},{"type":"playlist-results","items":[{"name":"The Knife - Heartbeats","uri":"spotify:user:1228858172:playlist:4vEyU9bTcuALukJMs8MAG3","followers":1003,"image":"https://d3rt1990lpmkn.cloudfront.net/120/3d06fa074f91e222d2eb6a68c27d374c1845f753b938b0685042d686315a949ee153593709e495e52dd032b0e78dd3722df270a797ab18ad533a83dab80655dfb5e10a67486f0189f9bc2d1dd3b0cd5e","log":{"top_hit":"albums","origin":"suggest"},"owner":{"name":"Al Gordon","uri":"spotify:user:1228858172"}},{"name":"José González — Heartbeats","uri":"spotify:user:12185260184:playlist:1LAvLvk08XvB0OZeFABp8d","followers":676,"image":"https://d3rt1990lpmkn.cloudfront.net/120/8ee5e7276f8aec109c37434b1e0e36e0d10479e572d78924e506cb6fd12ac77c5f4a0e3fa1de6880422a60d8628dd6b47cb16206be41599c55443796e491217b123cfbf84d169352d89cd9ba15f08d6b","log":{"top_hit":"albums","origin":"suggest"},"owner":{"name":"Brice Parker","uri":"spotify:user:12185260184"}}]},{"type":"profile-results","items":[{"name":"heartbeatsss","uri":"spotify:user:heartbeatsss","followers":48,"log":{"top_hit":"albums","origin":"suggest"}},{"name":"#heartbeat","uri":"spotify:user:%23heartbeat","followers":99,"log":{"misspelling":true,"top_hit":"albums","origin":"suggest"}},{"name":"Alfredo Simon Romeo Caceres","uri":"spotify:user:heartbeat1997","followers":47,"image":"https://scontent.xx.fbcdn.net/v/t1.0-1/p200x200/12065742_10209381269912728_7979961412840376089_n.jpg?oh=54007c8311bcf40f8978886f785609e4&oe=5808EC03","log":{"misspelling":true,"top_hit":"albums","origin":"suggest"}}]}]}`
+	result, _ := parseSuggest([]byte(body))
+	if result.TopHits[0].Uri != "spotify:album:19WDf08G2WEC79RE94n5Ze" {
+		t.Error("bad uri for top hit")
+	}
+}
+
+// multiGetStream is a PacketStream answering the requests and the multi-get requests of tracks, whose names are their
+// hex GIDs. The GIDs starting with 0xff are answered with a 404 status.
+type multiGetStream struct {
+	client *Client
+	// release holds the responses back until it is closed, when set
+	release chan struct{}
+
+	lock     sync.Mutex
+	requests int
+	inFlight int
+	maxBusy  int
+}
+
+func (s *multiGetStream) SendPacket(cmd uint8, data []byte) error {
+	reader := bytes.NewReader(data)
+	seq, _, _, _ := handleHead(reader)
+	headerData, _ := parsePart(reader)
+	header := &Spotify.Header{}
+	proto.Unmarshal(headerData, header)
+	body, _ := parsePart(reader)
+	request := &Spotify.MercuryMultiGetRequest{}
+	proto.Unmarshal(body, request)
+
+	s.lock.Lock()
+	s.requests++
+	s.inFlight++
+	if s.inFlight > s.maxBusy {
+		s.maxBusy = s.inFlight
+	}
+	s.lock.Unlock()
+
+	reply := &Spotify.MercuryMultiGetReply{}
+	for _, item := range request.GetRequest() {
+		id := strings.TrimPrefix(item.GetUri(), "hm://metadata/4/track/")
+		if strings.HasPrefix(id, "ff") {
+			reply.Reply = append(reply.Reply, &Spotify.MercuryReply{StatusCode: proto.Int32(404)})
+			continue
+		}
+		track, _ := proto.Marshal(&Spotify.Track{Name: proto.String(id)})
+		reply.Reply = append(reply.Reply, &Spotify.MercuryReply{StatusCode: proto.Int32(200), Body: track})
+	}
+	payload, _ := proto.Marshal(reply)
+	status := int32(200)
+	var userFields []*Spotify.UserField
+	if id := strings.TrimPrefix(header.GetUri(), "hm://metadata/4/track/"); id != header.GetUri() {
+		payload, _ = proto.Marshal(&Spotify.Track{Name: proto.String(id)})
+		if strings.HasPrefix(id, "fe") {
+			userFields = append(userFields, &Spotify.UserField{Key: proto.String("MC-Cache-Policy"),
+				Value: []byte("no")})
+		}
+	} else if header.GetUri() != "hm://metadata/4/tracks" || header.GetContentType() != multiGetRequestType {
+		status = 400
+	}
+
+	headerData, _ = proto.Marshal(&Spotify.Header{Uri: proto.String(header.GetUri()), StatusCode: proto.Int32(status),
+		UserFields: userFields})
+	buf, _ := encodeMercuryHead(seq, 2, 1)
+	for _, part := range [][]byte{headerData, payload} {
+		binary.Write(buf, binary.BigEndian, uint16(len(part)))
+		buf.Write(part)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		if s.release != nil {
+			<-s.release
+		}
+		s.lock.Lock()
+		s.inFlight--
+		s.lock.Unlock()
+		s.client.Handle(cmd, bytes.NewReader(buf.Bytes()))
+	}()
+	return nil
+}
+
+func (s *multiGetStream) RecvPacket() (uint8, []byte, error) {
+	select {}
+}
+
+// testTrackID returns the id of a track whose GID ends with n
+func testTrackID(n int) spotifyid.SpotifyID {
+	id := spotifyid.SpotifyID{Type: spotifyid.Track}
+	binary.BigEndian.PutUint32(id.GID[12:], uint32(n))
+	return id
+}
+
+func TestGetTracks(t *testing.T) {
+	stream := &multiGetStream{}
+	client := CreateMercury(stream)
+	stream.client = client
+
+	ids := make([]spotifyid.SpotifyID, 450)
+	for i := range ids {
+		ids[i] = testTrackID(i)
+	}
+	ids[120].GID[0] = 0xff
+	ids[449].GID[0] = 0xff
+	// The ids of another type are reported without being requested
+	ids = append(ids, spotifyid.SpotifyID{Type: spotifyid.Album})
+
+	tracks, err := client.GetTracks(context.Background(), ids)
+
+	var multiErr *MultiGetError
+	if !errors.As(err, &multiErr) || len(multiErr.Errors) != 3 {
+		t.Fatalf("Expected the missing tracks to be reported. Got %v", err)
+	}
+	var statusErr *StatusError
+	if !errors.As(multiErr.Errors[ids[120]], &statusErr) || statusErr.StatusCode != 404 ||
+		statusErr.Uri != "hm://metadata/4/track/"+ids[120].Hex() {
+		t.Errorf("Wrong error for a missing track. Got %v", multiErr.Errors[ids[120]])
+	}
+	if !errors.Is(multiErr.Errors[ids[450]], spotifyid.ErrWrongType) {
+		t.Errorf("Expected ErrWrongType for an album. Got %v", multiErr.Errors[ids[450]])
+	}
+	for i, track := range tracks {
+		if i == 120 || i >= 449 {
+			if track != nil {
+				t.Errorf("Expected no track for %s. Got %v", ids[i], track)
+			}
+		} else if track.GetName() != ids[i].Hex() {
+			t.Errorf("Wrong track at %d. Got %v", i, track)
+		}
+	}
+
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	if stream.requests != 5 || stream.maxBusy > multiGetConcurrency {
+		t.Errorf("Expected 5 batches, %d at most at once. Got %d batches, %d at once", multiGetConcurrency,
+			stream.requests, stream.maxBusy)
+	}
+}
+
+func TestMetadataCache(t *testing.T) {
+	stream := &multiGetStream{release: make(chan struct{})}
+	client := CreateMercury(stream)
+	stream.client = client
+	client.SetCache(NewMemoryCache(10), time.Minute)
+	client.SetCountry("SE")
+
+	requests := func() int {
+		stream.lock.Lock()
+		defer stream.lock.Unlock()
+		return stream.requests
+	}
+
+	// The concurrent requests for the same track share a single mercury request, which goes on when a caller gives up
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i == 0 {
+				if _, err := client.GetTrack(ctx, testTrackID(0)); !errors.Is(err, context.Canceled) {
+					t.Errorf("Expected the cancelled request to fail. Got %v", err)
+				}
+				return
+			}
+			track, err := client.GetTrack(context.Background(), testTrackID(0))
+			if err != nil || track.GetName() != testTrackID(0).Hex() {
+				t.Errorf("Wrong track. Got %v, %v", track, err)
+			}
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	close(stream.release)
+	wg.Wait()
+	if n := requests(); n != 1 {
+		t.Errorf("Expected a single request. Got %d", n)
+	}
+
+	// The cached tracks aren't requested again, neither on their own nor in a batch
+	track, err := client.GetTrack(context.Background(), testTrackID(0))
+	if err != nil || track.GetName() != testTrackID(0).Hex() {
+		t.Errorf("Wrong cached track. Got %v, %v", track, err)
+	}
+	if n := requests(); n != 1 {
+		t.Errorf("Expected the track to be cached. Got %d requests", n)
+	}
+	tracks, err := client.GetTracks(context.Background(), []spotifyid.SpotifyID{testTrackID(0), testTrackID(1)})
+	if err != nil || tracks[0].GetName() != testTrackID(0).Hex() || tracks[1].GetName() != testTrackID(1).Hex() {
+		t.Errorf("Wrong tracks. Got %v, %v", tracks, err)
+	}
+	if _, err := client.GetTrack(context.Background(), testTrackID(1)); err != nil || requests() != 2 {
+		t.Errorf("Expected the batched track to be cached. Got %d requests, %v", requests(), err)
+	}
+
+	// The metadata depend on the country of the user
+	client.SetCountry("FR")
+	if _, err := client.GetTrack(context.Background(), testTrackID(0)); err != nil || requests() != 3 {
+		t.Errorf("Expected the track to be requested for the new country. Got %d requests, %v", requests(), err)
+	}
+
+	// The metadata the server asks not to cache are requested each time
+	uncached := testTrackID(2)
+	uncached.GID[0] = 0xfe
+	for i := 0; i < 2; i++ {
+		if _, err := client.GetTrack(context.Background(), uncached); err != nil {
+			t.Errorf("GetTrack failed: %v", err)
+		}
+	}
+	if n := requests(); n != 5 {
+		t.Errorf("Expected the uncacheable track to be requested twice. Got %d requests", n)
+	}
+}
+
+func TestCachePolicy(t *testing.T) {
+	for _, test := range []struct {
+		fields map[string]string
+		ttl    time.Duration
+		cache  bool
+	}{
+		{nil, 0, true},
+		{map[string]string{"MC-TTL": "3600", "MC-Cache-Policy": "public"}, time.Hour, true},
+		{map[string]string{"MC-TTL": "invalid"}, 0, true},
+		{map[string]string{"MC-Cache-Policy": "no"}, 0, false},
+	} {
+		header := &Spotify.Header{}
+		for key, value := range test.fields {
+			header.UserFields = append(header.UserFields, &Spotify.UserField{Key: proto.String(key),
+				Value: []byte(value)})
+		}
+		headerData, _ := proto.Marshal(header)
+		if ttl, cache := cachePolicy(Response{HeaderData: headerData}); ttl != test.ttl || cache != test.cache {
+			t.Errorf("Wrong policy for %v. Got %v, %v", test.fields, ttl, cache)
+		}
+	}
+}
+
+func testMetadataCache(t *testing.T, cache MetadataCache) {
+	cache.Set("track/00/SE", []byte("first"), time.Minute)
+	cache.Set("track/01/SE", []byte("second"), time.Millisecond)
+	cache.Set("track/00/SE", []byte("updated"), time.Minute)
+
+	if data, ok := cache.Get("track/00/SE"); !ok || string(data) != "updated" {
+		t.Errorf("Wrong cached data. Got %q, %v", data, ok)
+	}
+	if _, ok := cache.Get("track/00/FR"); ok {
+		t.Error("Unexpected data for an unknown key")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := cache.Get("track/01/SE"); ok {
+		t.Error("Expected the data to expire")
+	}
+}
+
+func TestMemoryCache(t *testing.T) {
+	unbounded := NewMemoryCache(0)
+	for i := 0; i < 3; i++ {
+		unbounded.Set(fmt.Sprintf("track/%02d/SE", i), []byte("track"), time.Minute)
+	}
+	if unbounded.Len() != 3 {
+		t.Errorf("Expected an unbounded cache to keep all its entries. Got %d", unbounded.Len())
+	}
+
+	cache := NewMemoryCache(2)
+	testMetadataCache(t, cache)
+
+	// The least recently used entries are evicted first
+	cache.Set("album/00/SE", []byte("album"), time.Minute)
+	cache.Get("track/00/SE")
+	cache.Set("artist/00/SE", []byte("artist"), time.Minute)
+	if _, ok := cache.Get("album/00/SE"); ok || cache.Len() != 2 {
+		t.Errorf("Expected the album to be evicted. Got %d entries", cache.Len())
+	}
+	if _, ok := cache.Get("track/00/SE"); !ok {
+		t.Error("Expected the track to stay in the cache")
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewDiskCache(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatalf("NewDiskCache failed: %v", err)
+	}
+	testMetadataCache(t, cache)
+
+	// The entries survive the cache, and the expired ones are removed
+	reopened, _ := NewDiskCache(filepath.Join(dir, "cache"))
+	if data, ok := reopened.Get("track/00/SE"); !ok || string(data) != "updated" {
+		t.Errorf("Wrong data after reopening the cache. Got %q, %v", data, ok)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "cache")); len(files) != 1 {
+		t.Errorf("Expected a single file in the cache. Got %d", len(files))
+	}
+}
+
+func TestPlaylistEdits(t *testing.T) {
+	track := func(c byte) spotifyid.SpotifyID {
+		id, _ := spotifyid.FromBase62(spotifyid.Track, "0"+strings.Repeat(string(c), spotifyid.Base62Size-1))
+		return id
+	}
+	// playlist returns the items whose ids end with the characters of s
+	playlist := func(s string) []*Spotify.Item {
+		var items []*Spotify.Item
+		for _, c := range s {
+			items = append(items, &Spotify.Item{Uri: proto.String(track(byte(c)).URI())})
+		}
+		return items
+	}
+	items := playlist("abcdef")
+	// short returns the last characters of the ids of the items
+	short := func(items []*Spotify.Item) string {
+		result := ""
+		for _, item := range items {
+			result += item.GetUri()[len(item.GetUri())-1:]
+		}
+		return result
+	}
+
+	for _, test := range []struct {
+		edit     PlaylistEdit
+		expected string
+	}{
+		{AddTracks(1, track('x'), track('y')), "axybcdef"},
+		{AddTracks(-1, track('x')), "abcdefx"},
+		{RemoveTracks(track('b'), track('c'), track('f'), track('z')), "ade"},
+		{MoveTracks(0, 2, 4), "cdabef"},
+		{MoveTracks(4, 2, 1), "aefbcd"},
+		{MoveTracks(1, 1, 6), "acdefb"},
+		{RenamePlaylist("name"), "abcdef"},
+	} {
+		ops, err := test.edit.ops(items, items)
+		if err != nil {
+			t.Errorf("Failed to build the ops for %q: %v", test.expected, err)
+			continue
+		}
+		result, err := applyOps(items, ops)
+		if err != nil || short(result) != test.expected {
+			t.Errorf("Wrong result. Expected %s, got %s, %v", test.expected, short(result), err)
+		}
+	}
+	if short(items) != "abcdef" {
+		t.Errorf("The edits modified the original items: %s", short(items))
+	}
+
+	for _, edit := range []PlaylistEdit{MoveTracks(0, 2, 1), MoveTracks(5, 2, 0), AddTracks(0, spotifyid.SpotifyID{})} {
+		if _, err := edit.ops(items, items); err == nil {
+			t.Errorf("Expected an invalid edit to fail")
+		}
+	}
+
+	// The edits rebased on a concurrent change target the same items
+	for _, test := range []struct {
+		edit     PlaylistEdit
+		current  string
+		expected string
+	}{
+		{AddTracks(1, track('y')), "xabcdef", "xaybcdef"},
+		{AddTracks(1, track('y')), "cdefab", "cdefayb"},
+		{MoveTracks(0, 2, 4), "xacbdef", ""},
+		{MoveTracks(0, 2, 4), "efabcd", "abefcd"},
+		{MoveTracks(3, 2, 6), "abcdefg", "abcfgde"},
+		{MoveTracks(1, 1, 0), "acdef", ""},
+	} {
+		current := playlist(test.current)
+		ops, err := test.edit.ops(items, current)
+		if test.expected == "" {
+			if !errors.Is(err, ErrPlaylistConflict) {
+				t.Errorf("Expected a conflict rebasing on %s. Got %v", test.current, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Failed to rebase on %s: %v", test.current, err)
+			continue
+		}
+		result, err := applyOps(current, ops)
+		if err != nil || short(result) != test.expected {
+			t.Errorf("Wrong result rebasing on %s. Expected %s, got %s, %v", test.current, test.expected,
+				short(result), err)
+		}
+	}
+}
+
+func TestPlaylistChanges(t *testing.T) {
+	revision := func(n uint32) []byte {
+		return []byte{0, 0, 0, byte(n), 0xaa}
+	}
+	event := func(contentType string, msg proto.Message) Response {
+		header, _ := proto.Marshal(&Spotify.Header{ContentType: proto.String(contentType)})
+		payload, _ := proto.Marshal(msg)
+		return Response{HeaderData: header, Payload: [][]byte{payload}}
+	}
+	items := func(uris ...string) []*Spotify.Item {
+		var items []*Spotify.Item
+		for _, uri := range uris {
+			items = append(items, &Spotify.Item{Uri: proto.String(uri)})
+		}
+		return items
+	}
+
+	w := &PlaylistWatcher{
+		client: CreateMercury(&recordingStream{}),
+		events: make(chan PlaylistEvent, playlistEventBuffer),
+		content: &Spotify.SelectedListContent{Revision: revision(1),
+			Contents: &Spotify.ListItems{Items: items("a", "b", "c")}},
+	}
+
+	for _, res := range []Response{
+		event(playlistDiffType, &Spotify.Diff{FromRevision: revision(1), ToRevision: revision(2), Ops: []*Spotify.Op{
+			{Kind: Spotify.Op_REM.Enum(), Rem: &Spotify.Rem{FromIndex: proto.Int32(0), Length: proto.Int32(1)}},
+		}}),
+		event(playlistChangesType, &Spotify.ListChanges{
+			BaseRevision: revision(2),
+			Deltas: []*Spotify.Delta{{Ops: []*Spotify.Op{
+				{Kind: Spotify.Op_ADD.Enum(), Add: &Spotify.Add{AddLast: proto.Bool(true), Items: items("d", "e")}},
+				{Kind: Spotify.Op_MOV.Enum(), Mov: &Spotify.Mov{FromIndex: proto.Int32(0), Length: proto.Int32(1),
+					ToIndex: proto.Int32(4)}},
+			}}},
+			Dump: &Spotify.ListDump{LatestRevision: revision(3)},
+		}),
+		// A change already applied is ignored
+		event(playlistChangeSetType, &Spotify.RevisionTaggedChangeSet{Revision: revision(2),
+			ChangeSet: &Spotify.ChangeSet{Kind: Spotify.ChangeSet_DELTA.Enum(), Delta: &Spotify.Delta{
+				BaseVersion: revision(1), Ops: []*Spotify.Op{{Kind: Spotify.Op_ADD.Enum(),
+					Add: &Spotify.Add{AddFirst: proto.Bool(true), Items: items("x")}}}}}}),
+		event(playlistChangeSetType, &Spotify.RevisionTaggedChangeSet{Revision: revision(4),
+			ChangeSet: &Spotify.ChangeSet{Kind: Spotify.ChangeSet_DELTA.Enum(), Delta: &Spotify.Delta{
+				BaseVersion: revision(3), Ops: []*Spotify.Op{{Kind: Spotify.Op_UPDATE_LIST_ATTRIBUTES.Enum(),
+					UpdateListAttributes: &Spotify.UpdateListAttributes{NewAttributes: &Spotify.ListAttributesPartialState{
+						Values: &Spotify.ListAttributes{Name: proto.String("name")}}}}}}}}),
+	} {
+		change, err := decodePlaylistChange(res)
+		if err != nil {
+			t.Fatalf("Failed to decode the change: %v", err)
+		}
+		w.apply(change)
+	}
+
+	expected := []PlaylistEvent{
+		{Kind: PlaylistItemsRemoved, Index: 0, Length: 1},
+		{Kind: PlaylistItemsAdded, Index: 2, Length: 2},
+		{Kind: PlaylistItemsMoved, Index: 0, Length: 1, ToIndex: 4},
+		{Kind: PlaylistAttributesChanged},
+	}
+	if len(w.events) != len(expected) {
+		t.Fatalf("Expected %d events. Got %d", len(expected), len(w.events))
+	}
+	for _, e := range expected {
+		got := <-w.events
+		if got.Kind != e.Kind || got.Index != e.Index || got.Length != e.Length || got.ToIndex != e.ToIndex {
+			t.Errorf("Wrong event. Expected %s %d/%d/%d, got %s %d/%d/%d", e.Kind, e.Index, e.Length, e.ToIndex,
+				got.Kind, got.Index, got.Length, got.ToIndex)
+		}
+	}
+
+	content := w.Content()
+	uris := ""
+	for _, item := range content.GetContents().GetItems() {
+		uris += item.GetUri()
+	}
+	if uris != "cdeb" || content.GetLength() != 4 || content.GetAttributes().GetName() != "name" {
+		t.Errorf("Wrong content: %v", content)
+	}
+	if !bytes.Equal(w.Revision(), revision(4)) {
+		t.Errorf("Wrong revision %x", w.Revision())
+	}
+}
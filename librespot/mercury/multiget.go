@@ -0,0 +1,208 @@
+package mercury
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/librespot-org/librespot-golang/Spotify"
+	"github.com/librespot-org/librespot-golang/librespot/spotifyid"
+)
+
+const (
+	// multiGetBatchSize is the number of items requested at most by a single multi-get request
+	multiGetBatchSize = 100
+	// multiGetConcurrency is the number of multi-get requests sent concurrently at most by a batched getter
+	multiGetConcurrency = 4
+
+	// multiGetRequestType is the content type of the multi-get requests, whose payload is a MercuryMultiGetRequest
+	multiGetRequestType = "vnd.spotify/mercury-mget-request"
+)
+
+// MultiGetError is returned by the batched getters when some of the items couldn't be fetched. The other items are
+// returned nonetheless.
+type MultiGetError struct {
+	// Errors maps the ids of the items which couldn't be fetched to the reason why, usually a StatusError
+	Errors map[spotifyid.SpotifyID]error
+}
+
+func (e *MultiGetError) Error() string {
+	ids := make([]string, 0, len(e.Errors))
+	for id := range e.Errors {
+		ids = append(ids, id.String())
+		if len(ids) == 3 {
+			break
+		}
+	}
+	if len(e.Errors) > len(ids) {
+		ids = append(ids, "...")
+	}
+	return fmt.Sprintf("mercury: failed to get %d items (%s)", len(e.Errors), strings.Join(ids, ", "))
+}
+
+// GetTracks returns the tracks with the specified ids, in the same order. They are fetched in batches sent
+// concurrently, instead of one request per track. The tracks which couldn't be fetched are nil, and are reported by
+// a MultiGetError, as are the ids of another type.
+func (m *Client) GetTracks(ctx context.Context, ids []spotifyid.SpotifyID) ([]*Spotify.Track, error) {
+	result := make([]*Spotify.Track, len(ids))
+	err := m.multiGet(ctx, spotifyid.Track, ids, func(i int, data []byte) error {
+		track := &Spotify.Track{}
+		if err := proto.Unmarshal(data, track); err != nil {
+			return err
+		}
+		result[i] = track
+		return nil
+	})
+	return result, err
+}
+
+// GetAlbums returns the albums with the specified ids, in the same order. The albums which couldn't be fetched are
+// nil, and are reported by a MultiGetError, as are the ids of another type.
+func (m *Client) GetAlbums(ctx context.Context, ids []spotifyid.SpotifyID) ([]*Spotify.Album, error) {
+	result := make([]*Spotify.Album, len(ids))
+	err := m.multiGet(ctx, spotifyid.Album, ids, func(i int, data []byte) error {
+		album := &Spotify.Album{}
+		if err := proto.Unmarshal(data, album); err != nil {
+			return err
+		}
+		result[i] = album
+		return nil
+	})
+	return result, err
+}
+
+// GetArtists returns the artists with the specified ids, in the same order. The artists which couldn't be fetched are
+// nil, and are reported by a MultiGetError, as are the ids of another type.
+func (m *Client) GetArtists(ctx context.Context, ids []spotifyid.SpotifyID) ([]*Spotify.Artist, error) {
+	result := make([]*Spotify.Artist, len(ids))
+	err := m.multiGet(ctx, spotifyid.Artist, ids, func(i int, data []byte) error {
+		artist := &Spotify.Artist{}
+		if err := proto.Unmarshal(data, artist); err != nil {
+			return err
+		}
+		result[i] = artist
+		return nil
+	})
+	return result, err
+}
+
+// multiGet fetches the metadata of each id, which must be of type typ, through multi-get requests of
+// multiGetBatchSize items at most, multiGetConcurrency of them being sent concurrently. The items found in the cache
+// of the client are not requested. decode is called with the index and the body of each item, from concurrent
+// goroutines for distinct indexes.
+func (m *Client) multiGet(ctx context.Context, typ spotifyid.Type, ids []spotifyid.SpotifyID,
+	decode func(i int, data []byte) error) error {
+	errs := make([]error, len(ids))
+
+	missing := make([]int, 0, len(ids))
+	for i, id := range ids {
+		if errs[i] = id.Expect(typ); errs[i] != nil {
+			continue
+		}
+		if data, ok := m.cacheGet(id); !ok || decode(i, data) != nil {
+			missing = append(missing, i)
+		}
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, multiGetConcurrency)
+	for start := 0; start < len(missing); start += multiGetBatchSize {
+		end := start + multiGetBatchSize
+		if end > len(missing) {
+			end = len(missing)
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(indexes []int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			batch := make([]spotifyid.SpotifyID, len(indexes))
+			for j, i := range indexes {
+				batch[j] = ids[i]
+			}
+			replies, batchErrs := m.getBatch(ctx, typ, batch)
+			for j, i := range indexes {
+				if batchErrs[j] != nil {
+					errs[i] = batchErrs[j]
+					continue
+				}
+				errs[i] = decode(i, replies[j].GetBody())
+				// The policy defaults to CACHE_NO when unset, only an explicit one prevents caching
+				if errs[i] == nil && (replies[j].CachePolicy == nil ||
+					replies[j].GetCachePolicy() != Spotify.MercuryReply_CACHE_NO) {
+					ttl := time.Duration(replies[j].GetTtl()) * time.Second
+					m.cacheSet(ids[i], replies[j].GetBody(), ttl)
+				}
+			}
+		}(missing[start:end])
+	}
+	wg.Wait()
+
+	var failed map[spotifyid.SpotifyID]error
+	for i, err := range errs {
+		if err != nil {
+			if failed == nil {
+				failed = make(map[spotifyid.SpotifyID]error)
+			}
+			failed[ids[i]] = err
+		}
+	}
+	if failed != nil {
+		return &MultiGetError{Errors: failed}
+	}
+	return nil
+}
+
+// getBatch sends a single multi-get request for ids, and returns the reply and the error of each item. A failure of
+// the whole request is the error of all its items.
+func (m *Client) getBatch(ctx context.Context, typ spotifyid.Type,
+	ids []spotifyid.SpotifyID) ([]*Spotify.MercuryReply, []error) {
+	errs := make([]error, len(ids))
+	fail := func(err error) ([]*Spotify.MercuryReply, []error) {
+		for i := range errs {
+			errs[i] = err
+		}
+		return nil, errs
+	}
+
+	uris := make([]string, len(ids))
+	request := &Spotify.MercuryMultiGetRequest{Request: make([]*Spotify.MercuryRequest, len(ids))}
+	for i, id := range ids {
+		uris[i] = fmt.Sprintf("hm://metadata/4/%s/%s", typ, id.Hex())
+		request.Request[i] = &Spotify.MercuryRequest{Uri: proto.String(uris[i])}
+	}
+	data, err := proto.Marshal(request)
+	if err != nil {
+		return fail(err)
+	}
+
+	res, err := m.doWithRetry(ctx, Request{
+		Method:      "GET",
+		Uri:         fmt.Sprintf("hm://metadata/4/%ss", typ),
+		ContentType: multiGetRequestType,
+		Payload:     [][]byte{data},
+	})
+	if err != nil {
+		return fail(err)
+	}
+
+	reply := &Spotify.MercuryMultiGetReply{}
+	if err := proto.Unmarshal(res.CombinePayload(), reply); err != nil {
+		return fail(fmt.Errorf("mercury: invalid multi-get reply: %w", err))
+	}
+	if len(reply.GetReply()) != len(ids) {
+		return fail(fmt.Errorf("mercury: multi-get returned %d replies for %d items", len(reply.GetReply()), len(ids)))
+	}
+
+	for i, item := range reply.GetReply() {
+		if code := item.GetStatusCode(); code < 200 || code >= 300 {
+			errs[i] = &StatusError{Method: "GET", Uri: uris[i], StatusCode: code}
+		}
+	}
+	return reply.GetReply(), errs
+}
@@ -0,0 +1,346 @@
+package mercury
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/librespot-org/librespot-golang/Spotify"
+	"github.com/librespot-org/librespot-golang/librespot/logging"
+	"github.com/librespot-org/librespot-golang/librespot/spotifyid"
+)
+
+const (
+	// playlistChangesType is the content type of the playlist modifications, whose payload is a ListChanges
+	playlistChangesType = "vnd.spotify/playlist4-changes"
+	// maxPlaylistAttempts is the number of times EditPlaylist sends its changes at most, rebasing them on the latest
+	// revision of the playlist after each conflict
+	maxPlaylistAttempts = 3
+)
+
+// ErrPlaylistConflict is returned by EditPlaylist when the playlist kept being changed concurrently, so that the
+// edits couldn't be applied to its latest revision
+var ErrPlaylistConflict = errors.New("mercury: playlist changed concurrently")
+
+// ErrInvalidEdit is returned, wrapped with the reason, when an edit doesn't apply to the content of the playlist,
+// e.g. a move out of its bounds
+var ErrInvalidEdit = errors.New("mercury: invalid playlist edit")
+
+// PlaylistEdit is a change made to a playlist by EditPlaylist. It is turned into playlist4 ops against the current
+// content of the playlist, so that it can be rebased when the playlist changes in the meantime.
+type PlaylistEdit interface {
+	// ops returns the ops performing the edit on the playlist with the specified items. The indexes of the edit refer
+	// to seen, the items of the playlist as the caller saw them, and the items they designate are looked up in items,
+	// which may have changed since. It fails with ErrPlaylistConflict when they are no longer in the playlist.
+	ops(seen []*Spotify.Item, items []*Spotify.Item) ([]*Spotify.Op, error)
+}
+
+type playlistEditFunc func(seen []*Spotify.Item, items []*Spotify.Item) ([]*Spotify.Op, error)
+
+func (f playlistEditFunc) ops(seen []*Spotify.Item, items []*Spotify.Item) ([]*Spotify.Op, error) {
+	return f(seen, items)
+}
+
+// locate returns the index in items of the item at index in seen, found by its URI and the number of times it
+// appears before. The index following the last item of seen is located after the last item of items.
+func locate(seen []*Spotify.Item, items []*Spotify.Item, index int) (int, error) {
+	if index == len(seen) {
+		return len(items), nil
+	}
+	uri := seen[index].GetUri()
+	occurrence := 0
+	for _, item := range seen[:index] {
+		if item.GetUri() == uri {
+			occurrence++
+		}
+	}
+
+	for i, item := range items {
+		if item.GetUri() != uri {
+			continue
+		}
+		if occurrence == 0 {
+			return i, nil
+		}
+		occurrence--
+	}
+	return 0, fmt.Errorf("%w: %s at %d has been removed", ErrPlaylistConflict, uri, index)
+}
+
+// AddTracks inserts the tracks before the item at index, or at the end of the playlist when index is negative or
+// beyond its length. When the playlist changed concurrently, they are inserted before the same item, wherever it is.
+func AddTracks(index int, ids ...spotifyid.SpotifyID) PlaylistEdit {
+	return playlistEditFunc(func(seen []*Spotify.Item, items []*Spotify.Item) ([]*Spotify.Op, error) {
+		if len(ids) == 0 {
+			return nil, nil
+		}
+		add := &Spotify.Add{Items: make([]*Spotify.Item, len(ids))}
+		for i, id := range ids {
+			if err := id.Expect(spotifyid.Track); err != nil {
+				return nil, err
+			}
+			add.Items[i] = &Spotify.Item{Uri: proto.String(id.URI())}
+		}
+
+		if index < 0 || index >= len(seen) {
+			add.AddLast = proto.Bool(true)
+		} else {
+			at, err := locate(seen, items, index)
+			if err != nil {
+				return nil, err
+			}
+			add.FromIndex = proto.Int32(int32(at))
+		}
+		return []*Spotify.Op{{Kind: Spotify.Op_ADD.Enum(), Add: add}}, nil
+	})
+}
+
+// RemoveTracks removes all the occurrences of the tracks from the playlist. The tracks no longer in the playlist,
+// e.g. removed by another client in the meantime, are ignored.
+func RemoveTracks(ids ...spotifyid.SpotifyID) PlaylistEdit {
+	return playlistEditFunc(func(seen []*Spotify.Item, items []*Spotify.Item) ([]*Spotify.Op, error) {
+		removed := make(map[string]bool, len(ids))
+		for _, id := range ids {
+			removed[id.URI()] = true
+		}
+
+		// Remove the contiguous runs of items from the last one, so that the indexes of the others don't change
+		var ops []*Spotify.Op
+		for end := len(items); end > 0; {
+			if !removed[items[end-1].GetUri()] {
+				end--
+				continue
+			}
+			start := end - 1
+			for start > 0 && removed[items[start-1].GetUri()] {
+				start--
+			}
+
+			rem := &Spotify.Rem{
+				FromIndex: proto.Int32(int32(start)),
+				Length:    proto.Int32(int32(end - start)),
+			}
+			for _, item := range items[start:end] {
+				rem.Items = append(rem.Items, &Spotify.Item{Uri: proto.String(item.GetUri())})
+			}
+			ops = append(ops, &Spotify.Op{Kind: Spotify.Op_REM.Enum(), Rem: rem})
+			end = start
+		}
+		return ops, nil
+	})
+}
+
+// MoveTracks moves the length items starting at from before the item at index to, as counted before the move. Use
+// the length of the playlist as to in order to move the items to its end. When the playlist changed concurrently, the
+// same items are moved before the same item, wherever they are, and the edit fails with ErrPlaylistConflict if the
+// moved items are no longer contiguous.
+func MoveTracks(from int, length int, to int) PlaylistEdit {
+	return playlistEditFunc(func(seen []*Spotify.Item, items []*Spotify.Item) ([]*Spotify.Op, error) {
+		if from < 0 || length <= 0 || from+length > len(seen) {
+			return nil, fmt.Errorf("%w: moving %d items from %d out of %d", ErrInvalidEdit, length, from, len(seen))
+		}
+		if to < 0 || to > len(seen) || (to > from && to < from+length) {
+			return nil, fmt.Errorf("%w: moving %d items from %d to %d", ErrInvalidEdit, length, from, to)
+		}
+		if to == from || to == from+length {
+			return nil, nil
+		}
+
+		newFrom, err := locate(seen, items, from)
+		if err != nil {
+			return nil, err
+		}
+		for i := 1; i < length; i++ {
+			index, err := locate(seen, items, from+i)
+			if err != nil {
+				return nil, err
+			}
+			if index != newFrom+i {
+				return nil, fmt.Errorf("%w: the moved items are no longer contiguous", ErrPlaylistConflict)
+			}
+		}
+		newTo, err := locate(seen, items, to)
+		if err != nil {
+			return nil, err
+		}
+		if newTo > newFrom && newTo < newFrom+length {
+			return nil, fmt.Errorf("%w: the destination of the move is among the moved items", ErrPlaylistConflict)
+		}
+		if newTo == newFrom || newTo == newFrom+length {
+			return nil, nil
+		}
+
+		mov := &Spotify.Mov{
+			FromIndex: proto.Int32(int32(newFrom)),
+			Length:    proto.Int32(int32(length)),
+			ToIndex:   proto.Int32(int32(newTo)),
+		}
+		return []*Spotify.Op{{Kind: Spotify.Op_MOV.Enum(), Mov: mov}}, nil
+	})
+}
+
+// RenamePlaylist sets the name of the playlist
+func RenamePlaylist(name string) PlaylistEdit {
+	return updateListAttributes(&Spotify.ListAttributes{Name: proto.String(name)})
+}
+
+// DescribePlaylist sets the description of the playlist
+func DescribePlaylist(description string) PlaylistEdit {
+	return updateListAttributes(&Spotify.ListAttributes{Description: proto.String(description)})
+}
+
+func updateListAttributes(values *Spotify.ListAttributes) PlaylistEdit {
+	return playlistEditFunc(func(seen []*Spotify.Item, items []*Spotify.Item) ([]*Spotify.Op, error) {
+		update := &Spotify.UpdateListAttributes{
+			NewAttributes: &Spotify.ListAttributesPartialState{Values: values},
+		}
+		return []*Spotify.Op{{Kind: Spotify.Op_UPDATE_LIST_ATTRIBUTES.Enum(), UpdateListAttributes: update}}, nil
+	})
+}
+
+// applyOps applies ops to the items of a playlist, and returns the resulting items. It fails with ErrInvalidEdit if
+// an op doesn't apply to the items.
+func applyOps(items []*Spotify.Item, ops []*Spotify.Op) ([]*Spotify.Item, error) {
+	result := append([]*Spotify.Item{}, items...)
+	for _, op := range ops {
+		switch op.GetKind() {
+		case Spotify.Op_ADD:
+			add := op.GetAdd()
+			index := int(add.GetFromIndex())
+			if add.GetAddLast() {
+				index = len(result)
+			} else if add.GetAddFirst() {
+				index = 0
+			}
+			if index < 0 || index > len(result) {
+				return nil, fmt.Errorf("%w: adding items at %d out of %d", ErrInvalidEdit, index, len(result))
+			}
+			added := append(append([]*Spotify.Item{}, add.GetItems()...), result[index:]...)
+			result = append(result[:index], added...)
+
+		case Spotify.Op_REM:
+			rem := op.GetRem()
+			from, length := int(rem.GetFromIndex()), int(rem.GetLength())
+			if from < 0 || length < 0 || from+length > len(result) {
+				return nil, fmt.Errorf("%w: removing %d items from %d out of %d", ErrInvalidEdit, length, from,
+					len(result))
+			}
+			for i, item := range rem.GetItems() {
+				if i >= length || result[from+i].GetUri() != item.GetUri() {
+					return nil, fmt.Errorf("%w: removing %s which isn't at %d", ErrInvalidEdit, item.GetUri(), from+i)
+				}
+			}
+			result = append(result[:from], result[from+length:]...)
+
+		case Spotify.Op_MOV:
+			mov := op.GetMov()
+			from, length, to := int(mov.GetFromIndex()), int(mov.GetLength()), int(mov.GetToIndex())
+			if from < 0 || length < 0 || from+length > len(result) || to < 0 || to > len(result) ||
+				(to > from && to < from+length) {
+				return nil, fmt.Errorf("%w: moving %d items from %d to %d out of %d", ErrInvalidEdit, length, from,
+					to, len(result))
+			}
+			moved := append([]*Spotify.Item{}, result[from:from+length]...)
+			result = append(result[:from], result[from+length:]...)
+			if to > from {
+				to -= length
+			}
+			result = append(result[:to], append(moved, result[to:]...)...)
+		}
+	}
+	return result, nil
+}
+
+// EditPlaylist applies the edits to the playlist id, as given to GetPlaylist, in a single change. The indexes of the
+// edits refer to base, the content of the playlist the caller computed them from, e.g. as returned by GetPlaylist or
+// PlaylistWatcher.Content. When the playlist has been changed since base, the edits are rebased on its latest
+// revision, targeting the same items at their new indexes, and sent again. The latest content is fetched first when
+// base is nil, which only suits the edits that don't depend on indexes. EditPlaylist fails with ErrPlaylistConflict if
+// the playlist keeps changing, or if the items targeted have been removed in the meantime. It returns the response of
+// the server, which holds the new revision of the playlist, or the current content when the edits change nothing.
+func (m *Client) EditPlaylist(ctx context.Context, id string, base *Spotify.SelectedListContent,
+	edits ...PlaylistEdit) (*Spotify.SelectedListContent, error) {
+	content := base
+	for attempt := 1; ; attempt++ {
+		if content == nil || attempt > 1 {
+			var err error
+			if content, err = m.GetPlaylist(ctx, id); err != nil {
+				return nil, err
+			}
+		}
+		if base == nil {
+			base = content
+		}
+
+		// Each edit applies to the result of the previous ones, both on the playlist as the caller saw it and as it
+		// is now
+		seen, items := base.GetContents().GetItems(), content.GetContents().GetItems()
+		var ops []*Spotify.Op
+		for _, edit := range edits {
+			seenOps, err := edit.ops(seen, seen)
+			if err != nil {
+				return nil, err
+			}
+			editOps, err := edit.ops(seen, items)
+			if err != nil {
+				return nil, err
+			}
+			if seen, err = applyOps(seen, seenOps); err != nil {
+				return nil, err
+			}
+			if items, err = applyOps(items, editOps); err != nil {
+				return nil, err
+			}
+			ops = append(ops, editOps...)
+		}
+		if len(ops) == 0 {
+			return content, nil
+		}
+
+		result, err := m.sendPlaylistChanges(ctx, id, content.GetRevision(), ops)
+		var statusErr *StatusError
+		if !errors.As(err, &statusErr) || statusErr.StatusCode != 409 {
+			return result, err
+		}
+		if attempt >= maxPlaylistAttempts {
+			return nil, fmt.Errorf("%w: %v", ErrPlaylistConflict, err)
+		}
+		m.log.Debug("mercury: rebasing playlist changes", logging.KeyURI, statusErr.Uri, "attempt", attempt)
+	}
+}
+
+// sendPlaylistChanges sends ops as a delta against revision, the server answering with a 409 status if the playlist
+// is no longer at that revision
+func (m *Client) sendPlaylistChanges(ctx context.Context, id string, revision []byte,
+	ops []*Spotify.Op) (*Spotify.SelectedListContent, error) {
+	changes := &Spotify.ListChanges{
+		BaseRevision:           revision,
+		Deltas:                 []*Spotify.Delta{{BaseVersion: revision, Ops: ops}},
+		WantResultingRevisions: proto.Bool(true),
+	}
+	data, err := proto.Marshal(changes)
+	if err != nil {
+		return nil, err
+	}
+
+	req := Request{
+		Method:      "MODIFY",
+		Uri:         fmt.Sprintf("hm://playlist/%s?syncpublished=1", id),
+		ContentType: playlistChangesType,
+		Payload:     [][]byte{data},
+	}
+	res, err := m.Do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkStatus(req, res); err != nil {
+		return nil, err
+	}
+
+	result := &Spotify.SelectedListContent{}
+	if err := proto.Unmarshal(res.CombinePayload(), result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
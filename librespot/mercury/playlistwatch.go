@@ -0,0 +1,429 @@
+package mercury
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/librespot-org/librespot-golang/Spotify"
+	"github.com/librespot-org/librespot-golang/librespot/logging"
+)
+
+const (
+	// playlistDiffType is the content type of the playlist notifications whose payload is a Diff
+	playlistDiffType = "vnd.spotify/playlist4-diff"
+	// playlistChangeSetType is the content type of the playlist notifications whose payload is a
+	// RevisionTaggedChangeSet, which is assumed when a notification has no content type
+	playlistChangeSetType = "vnd.spotify/playlist4-revision-tagged-changeset"
+
+	// playlistEventBuffer is the capacity of the channel returned by PlaylistWatcher.Events
+	playlistEventBuffer = 64
+)
+
+// PlaylistEventKind describes what changed in a watched playlist
+type PlaylistEventKind int
+
+const (
+	// PlaylistItemsAdded is the kind of the events of items inserted at Index
+	PlaylistItemsAdded PlaylistEventKind = iota
+	// PlaylistItemsRemoved is the kind of the events of items removed from Index
+	PlaylistItemsRemoved
+	// PlaylistItemsMoved is the kind of the events of Length items moved from Index before the item at ToIndex, as
+	// counted before the move
+	PlaylistItemsMoved
+	// PlaylistItemChanged is the kind of the events of the attributes of the item at Index changing
+	PlaylistItemChanged
+	// PlaylistAttributesChanged is the kind of the events of the attributes of the playlist changing, e.g. its name
+	PlaylistAttributesChanged
+	// PlaylistResynced is the kind of the events sent when the changes couldn't be followed, e.g. after a missed
+	// notification, and the whole playlist has been fetched again. Its content must be read again with Content.
+	PlaylistResynced
+)
+
+func (k PlaylistEventKind) String() string {
+	switch k {
+	case PlaylistItemsAdded:
+		return "items added"
+	case PlaylistItemsRemoved:
+		return "items removed"
+	case PlaylistItemsMoved:
+		return "items moved"
+	case PlaylistItemChanged:
+		return "item changed"
+	case PlaylistAttributesChanged:
+		return "attributes changed"
+	case PlaylistResynced:
+		return "resynced"
+	default:
+		return "unknown"
+	}
+}
+
+// PlaylistEvent is a change of a watched playlist
+type PlaylistEvent struct {
+	Kind PlaylistEventKind
+	// Index is the index of the first item added, removed, moved or changed
+	Index int
+	// Length is the number of items added, removed or moved
+	Length int
+	// ToIndex is the index the items are moved before, as counted before the move
+	ToIndex int
+	// Items are the items added or removed, or the item changed with its new attributes
+	Items []*Spotify.Item
+	// Attributes are the attributes of the playlist once changed
+	Attributes *Spotify.ListAttributes
+	// Revision is the revision of the playlist once changed, nil when the server didn't tell it
+	Revision []byte
+}
+
+// playlistChange is a change of a playlist from a base revision, decoded from a notification
+type playlistChange struct {
+	base []byte
+	// result is the revision of the playlist once changed, nil when unknown
+	result []byte
+	ops    []*Spotify.Op
+}
+
+// PlaylistWatcher keeps a copy of a playlist in sync with the changes notified by the server, and emits them as
+// events. The changes are applied to the copy only when they follow its revision, the whole playlist is fetched again
+// otherwise.
+type PlaylistWatcher struct {
+	client *Client
+	id     string
+	sub    *Subscription
+	recv   chan Response
+	events chan PlaylistEvent
+	done   chan struct{}
+
+	lock    sync.Mutex
+	content *Spotify.SelectedListContent
+	// loading is true while the playlist is being fetched, the changes received in the meantime are pending
+	loading bool
+	pending []playlistChange
+	// stale is true once fetching the playlist failed, the next change fetches it again
+	stale  bool
+	closed bool
+}
+
+// WatchPlaylist subscribes to the changes of the playlist id, as given to GetPlaylist, and fetches its current
+// content. The watcher must be closed once no longer used.
+func (m *Client) WatchPlaylist(ctx context.Context, id string) (*PlaylistWatcher, error) {
+	w := &PlaylistWatcher{
+		client:  m,
+		id:      id,
+		recv:    make(chan Response),
+		events:  make(chan PlaylistEvent, playlistEventBuffer),
+		done:    make(chan struct{}),
+		loading: true,
+	}
+	// The notifications are received while the playlist is fetched, so that none is missed
+	go w.run()
+
+	sub, err := m.Subscribe(ctx, "hm://playlist/"+id, w.recv)
+	if err != nil {
+		close(w.done)
+		return nil, err
+	}
+	w.sub = sub
+
+	if err := w.load(ctx, false); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Events returns the channel receiving the changes of the playlist. It is closed by Close. The events are dropped
+// when the channel is full, Content always reflects all the changes though.
+func (w *PlaylistWatcher) Events() <-chan PlaylistEvent {
+	return w.events
+}
+
+// Content returns a copy of the playlist, as of its latest known revision
+func (w *PlaylistWatcher) Content() *Spotify.SelectedListContent {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return proto.Clone(w.content).(*Spotify.SelectedListContent)
+}
+
+// Revision returns the latest known revision of the playlist, nil when unknown
+func (w *PlaylistWatcher) Revision() []byte {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.content.GetRevision()
+}
+
+// Close unsubscribes from the changes of the playlist, and closes the channel of the events
+func (w *PlaylistWatcher) Close() error {
+	w.lock.Lock()
+	if w.closed {
+		w.lock.Unlock()
+		return nil
+	}
+	w.closed = true
+	w.lock.Unlock()
+
+	// No notification is delivered once unsubscribed, the run loop can be stopped
+	err := w.sub.Unsubscribe()
+	close(w.done)
+
+	w.lock.Lock()
+	close(w.events)
+	w.lock.Unlock()
+	return err
+}
+
+func (w *PlaylistWatcher) run() {
+	for {
+		select {
+		case res := <-w.recv:
+			change, err := decodePlaylistChange(res)
+			if err != nil {
+				w.client.log.Warn("mercury: failed to decode playlist change", logging.KeyURI, res.Uri,
+					logging.KeyError, err)
+				continue
+			}
+
+			w.lock.Lock()
+			if w.loading {
+				w.pending = append(w.pending, change)
+			} else {
+				w.apply(change)
+			}
+			w.lock.Unlock()
+
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// load fetches the playlist, then applies the changes received in the meantime. A PlaylistResynced event is sent when
+// notify is true.
+func (w *PlaylistWatcher) load(ctx context.Context, notify bool) error {
+	content, err := w.client.GetPlaylist(ctx, w.id)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.loading = false
+	if err != nil {
+		w.stale = true
+		return err
+	}
+	w.content = content
+	w.stale = false
+	if notify {
+		w.emit(PlaylistEvent{Kind: PlaylistResynced, Revision: content.GetRevision()})
+	}
+
+	pending := w.pending
+	w.pending = nil
+	for i, change := range pending {
+		if w.loading {
+			// Applying a change started fetching the playlist again
+			w.pending = append(w.pending, pending[i:]...)
+			break
+		}
+		w.apply(change)
+	}
+	return nil
+}
+
+// resync fetches the playlist again in the background, as the run loop must keep receiving the notifications for the
+// response to arrive. It must be called with the lock held.
+func (w *PlaylistWatcher) resync() {
+	if w.loading {
+		return
+	}
+	w.loading = true
+	go func() {
+		if err := w.load(context.Background(), true); err != nil {
+			w.client.log.Warn("mercury: failed to fetch playlist", "playlist", w.id, logging.KeyError, err)
+		}
+	}()
+}
+
+// apply applies a change to the copy of the playlist and emits its events if it follows its revision, ignores it if
+// it is older, and fetches the playlist again otherwise. It must be called with the lock held.
+func (w *PlaylistWatcher) apply(change playlistChange) {
+	if w.stale || !bytes.Equal(change.base, w.content.GetRevision()) {
+		if !w.stale && change.result != nil && !revisionAfter(change.result, w.content.GetRevision()) {
+			// The change is already part of the copy, e.g. it was received while fetching the playlist
+			return
+		}
+		w.resync()
+		return
+	}
+
+	content := proto.Clone(w.content).(*Spotify.SelectedListContent)
+	if content.Contents == nil {
+		content.Contents = &Spotify.ListItems{}
+	}
+	events := make([]PlaylistEvent, 0, len(change.ops))
+	for _, op := range change.ops {
+		event, err := applyOp(content, op)
+		if err != nil {
+			w.client.log.Warn("mercury: failed to apply playlist change", "playlist", w.id, logging.KeyError, err)
+			w.resync()
+			return
+		}
+		event.Revision = change.result
+		events = append(events, event)
+	}
+	content.Revision = change.result
+	content.Length = proto.Int32(int32(len(content.Contents.Items)))
+	w.content = content
+
+	for _, event := range events {
+		w.emit(event)
+	}
+	if change.result == nil {
+		// The revision of the copy must be known to follow the next changes
+		w.resync()
+	}
+}
+
+// emit sends an event without blocking, it must be called with the lock held
+func (w *PlaylistWatcher) emit(event PlaylistEvent) {
+	if w.closed {
+		return
+	}
+	select {
+	case w.events <- event:
+	default:
+		w.client.log.Debug("mercury: dropped playlist event, the channel is full", "playlist", w.id)
+	}
+}
+
+// applyOp applies a single op to content, and returns the event describing it
+func applyOp(content *Spotify.SelectedListContent, op *Spotify.Op) (PlaylistEvent, error) {
+	items := content.Contents.Items
+	var event PlaylistEvent
+
+	switch op.GetKind() {
+	case Spotify.Op_ADD:
+		event = PlaylistEvent{Kind: PlaylistItemsAdded, Index: int(op.GetAdd().GetFromIndex()),
+			Length: len(op.GetAdd().GetItems()), Items: op.GetAdd().GetItems()}
+		if op.GetAdd().GetAddLast() {
+			event.Index = len(items)
+		} else if op.GetAdd().GetAddFirst() {
+			event.Index = 0
+		}
+
+	case Spotify.Op_REM:
+		from, length := int(op.GetRem().GetFromIndex()), int(op.GetRem().GetLength())
+		event = PlaylistEvent{Kind: PlaylistItemsRemoved, Index: from, Length: length}
+		if from >= 0 && length >= 0 && from+length <= len(items) {
+			event.Items = append([]*Spotify.Item{}, items[from:from+length]...)
+		}
+
+	case Spotify.Op_MOV:
+		event = PlaylistEvent{Kind: PlaylistItemsMoved, Index: int(op.GetMov().GetFromIndex()),
+			Length: int(op.GetMov().GetLength()), ToIndex: int(op.GetMov().GetToIndex())}
+
+	case Spotify.Op_UPDATE_ITEM_ATTRIBUTES:
+		update := op.GetUpdateItemAttributes()
+		index := int(update.GetIndex())
+		if index < 0 || index >= len(items) {
+			return event, fmt.Errorf("%w: updating item %d out of %d", ErrInvalidEdit, index, len(items))
+		}
+		item := proto.Clone(items[index]).(*Spotify.Item)
+		if item.Attributes == nil {
+			item.Attributes = &Spotify.ItemAttributes{}
+		}
+		proto.Merge(item.Attributes, update.GetNewAttributes().GetValues())
+		items[index] = item
+		return PlaylistEvent{Kind: PlaylistItemChanged, Index: index, Length: 1, Items: []*Spotify.Item{item}}, nil
+
+	case Spotify.Op_UPDATE_LIST_ATTRIBUTES:
+		if content.Attributes == nil {
+			content.Attributes = &Spotify.ListAttributes{}
+		}
+		state := op.GetUpdateListAttributes().GetNewAttributes()
+		proto.Merge(content.Attributes, state.GetValues())
+		for _, kind := range state.GetNoValue() {
+			clearListAttribute(content.Attributes, kind)
+		}
+		return PlaylistEvent{Kind: PlaylistAttributesChanged, Attributes: content.Attributes}, nil
+
+	default:
+		return event, fmt.Errorf("%w: unsupported op %s", ErrInvalidEdit, op.GetKind())
+	}
+
+	items, err := applyOps(items, []*Spotify.Op{op})
+	if err != nil {
+		return event, err
+	}
+	content.Contents.Items = items
+	return event, nil
+}
+
+func clearListAttribute(attributes *Spotify.ListAttributes, kind Spotify.ListAttributesPartialState_ListAttributeKind) {
+	switch kind {
+	case Spotify.ListAttributesPartialState_LIST_NAME:
+		attributes.Name = nil
+	case Spotify.ListAttributesPartialState_LIST_DESCRIPTION:
+		attributes.Description = nil
+	case Spotify.ListAttributesPartialState_LIST_PICTURE:
+		attributes.Picture = nil
+	case Spotify.ListAttributesPartialState_LIST_COLLABORATIVE:
+		attributes.Collaborative = nil
+	}
+}
+
+// decodePlaylistChange decodes a playlist notification, according to the content type of its header
+func decodePlaylistChange(res Response) (playlistChange, error) {
+	header := &Spotify.Header{}
+	if err := proto.Unmarshal(res.HeaderData, header); err != nil {
+		return playlistChange{}, err
+	}
+	payload := res.CombinePayload()
+
+	switch header.GetContentType() {
+	case playlistChangesType:
+		changes := &Spotify.ListChanges{}
+		if err := proto.Unmarshal(payload, changes); err != nil {
+			return playlistChange{}, err
+		}
+		change := playlistChange{base: changes.GetBaseRevision(), result: changes.GetDump().GetLatestRevision()}
+		for _, delta := range changes.GetDeltas() {
+			change.ops = append(change.ops, delta.GetOps()...)
+		}
+		return change, nil
+
+	case playlistDiffType:
+		diff := &Spotify.Diff{}
+		if err := proto.Unmarshal(payload, diff); err != nil {
+			return playlistChange{}, err
+		}
+		return playlistChange{base: diff.GetFromRevision(), result: diff.GetToRevision(), ops: diff.GetOps()}, nil
+
+	case playlistChangeSetType, "":
+		changeSet := &Spotify.RevisionTaggedChangeSet{}
+		if err := proto.Unmarshal(payload, changeSet); err != nil {
+			return playlistChange{}, err
+		}
+		if changeSet.GetChangeSet().GetKind() != Spotify.ChangeSet_DELTA {
+			// A merge can't be applied locally, its unknown base makes the playlist be fetched again
+			return playlistChange{result: changeSet.GetRevision()}, nil
+		}
+		delta := changeSet.GetChangeSet().GetDelta()
+		return playlistChange{base: delta.GetBaseVersion(), result: changeSet.GetRevision(), ops: delta.GetOps()}, nil
+
+	default:
+		return playlistChange{}, fmt.Errorf("mercury: unsupported playlist change type %q", header.GetContentType())
+	}
+}
+
+// revisionAfter tells if revision a comes after revision b. The revisions start with a counter incremented by each
+// change, followed by a hash of the content.
+func revisionAfter(a []byte, b []byte) bool {
+	if len(a) < 4 || len(b) < 4 {
+		return true
+	}
+	return binary.BigEndian.Uint32(a) > binary.BigEndian.Uint32(b)
+}
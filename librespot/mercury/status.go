@@ -0,0 +1,76 @@
+package mercury
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/librespot-org/librespot-golang/Spotify"
+)
+
+// StatusError is returned by the typed getters when the response to their request doesn't have a 2xx status code,
+// e.g. 404 for an unknown track or 403 for a track unavailable to the account
+type StatusError struct {
+	Method     string
+	Uri        string
+	StatusCode int32
+	// UserFields are the user fields of the response header, which may explain the failure
+	UserFields map[string]string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("mercury: %s %s: status %d", e.Method, e.Uri, e.StatusCode)
+}
+
+// Temporary tells if the request may succeed when retried, which is the case of the 5xx status codes
+func (e *StatusError) Temporary() bool {
+	return e.StatusCode >= 500
+}
+
+// checkStatus returns a StatusError if res doesn't have a 2xx status code
+func checkStatus(req Request, res Response) error {
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+
+	err := &StatusError{Method: req.Method, Uri: req.Uri, StatusCode: res.StatusCode}
+	header := &Spotify.Header{}
+	if proto.Unmarshal(res.HeaderData, header) == nil && len(header.GetUserFields()) > 0 {
+		err.UserFields = make(map[string]string, len(header.GetUserFields()))
+		for _, field := range header.GetUserFields() {
+			err.UserFields[field.GetKey()] = string(field.GetValue())
+		}
+	}
+	return err
+}
+
+// RetryPolicy describes how the typed getters retry their requests after a 5xx response. The delay before the n-th
+// retry (starting at 0) is InitialDelay * 2^n, capped to MaxDelay.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a request is sent at most, 0 or 1 disables the retries
+	MaxAttempts int
+	// InitialDelay is the delay before the first retry
+	InitialDelay time.Duration
+	// MaxDelay caps the delay between two attempts
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy returns the policy used by the clients unless configured otherwise: the requests are sent up to
+// 3 times, half a second apart and then a second.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:  3,
+		InitialDelay: 500 * time.Millisecond,
+		MaxDelay:     5 * time.Second,
+	}
+}
+
+// Delay returns the time to wait before the specified retry, starting at 0
+func (p RetryPolicy) Delay(retry int) time.Duration {
+	delay := float64(p.InitialDelay) * math.Pow(2, float64(retry))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	return time.Duration(delay)
+}
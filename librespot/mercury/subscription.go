@@ -0,0 +1,82 @@
+package mercury
+
+import (
+	"context"
+	"sync"
+)
+
+// Subscription is the subscription of a channel to the events of a mercury URI, as returned by Client.Subscribe. The
+// events are delivered in order, the client waiting for the channel to receive each of them: a subscriber which
+// stops receiving must Unsubscribe, which aborts the pending delivery.
+type Subscription struct {
+	client *Client
+	uri    string
+	recv   chan Response
+
+	// done is closed once the subscription is cancelled, it aborts the pending delivery
+	done     chan struct{}
+	doneOnce sync.Once
+	// lock serializes the deliveries, and protects closed
+	lock   sync.Mutex
+	closed bool
+}
+
+func newSubscription(client *Client, uri string, recv chan Response) *Subscription {
+	return &Subscription{client: client, uri: uri, recv: recv, done: make(chan struct{})}
+}
+
+// Uri returns the URI passed to Subscribe
+func (s *Subscription) Uri() string {
+	return s.uri
+}
+
+// deliver sends an event to the channel of the subscription, unless it is cancelled in the meantime
+func (s *Subscription) deliver(res Response) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return
+	}
+	select {
+	case s.recv <- res:
+	case <-s.done:
+	}
+}
+
+// cancel stops the deliveries. Once it returns, no event is sent to the channel anymore. It returns false if the
+// subscription was already cancelled.
+func (s *Subscription) cancel() bool {
+	cancelled := false
+	s.doneOnce.Do(func() {
+		cancelled = true
+		close(s.done)
+	})
+
+	// Wait for the pending delivery, which has been aborted
+	s.lock.Lock()
+	s.closed = true
+	s.lock.Unlock()
+
+	return cancelled
+}
+
+// Unsubscribe cancels the subscription. Once it returns, no event is sent to the channel anymore, which can then be
+// closed safely. The UNSUB request is sent once the last subscription to the URI is cancelled, bounded by the timeout
+// of the client. Unsubscribing twice does nothing.
+func (s *Subscription) Unsubscribe() error {
+	if !s.cancel() {
+		return nil
+	}
+	if !s.client.removeSubscription(s) {
+		// Other subscribers are still interested in the URI
+		return nil
+	}
+
+	req := Request{Method: "UNSUB", Uri: s.uri}
+	res, err := s.client.Do(context.Background(), req)
+	if err != nil {
+		return err
+	}
+	return checkStatus(req, res)
+}
@@ -0,0 +1,74 @@
+// Package metrics defines the hooks through which the sessions, the mercury clients and the players report what they
+// are doing, so that they can be monitored. The hooks are called synchronously and concurrently from the goroutines
+// of the library, they must therefore be safe for concurrent use and return quickly.
+//
+// Nothing is reported unless a Metrics is set, e.g. through core.SessionConfig. The prometheus subpackage exposes
+// the metrics to Prometheus.
+package metrics
+
+import (
+	"strings"
+	"time"
+)
+
+// Metrics receives the events of the library. The counts are reported as increments, so that a single Metrics can
+// aggregate the events of many sessions.
+type Metrics interface {
+	// PacketSent is called for each packet sent to the AP, with its command and payload size
+	PacketSent(cmd uint8, size int)
+	// PacketReceived is called for each packet received from the AP, with its command and payload size
+	PacketReceived(cmd uint8, size int)
+	// Reconnected is called after each reconnection attempt, err being nil when it succeeded
+	Reconnected(err error)
+
+	// MercuryRequestSent is called when a mercury request is sent, it is pending until MercuryResponse is called.
+	// The prefix is the one returned by URIPrefix.
+	MercuryRequestSent(method string, prefix string)
+	// MercuryResponse is called when a mercury request completes, with its status code and the time elapsed since
+	// it has been sent. The requests failed locally, e.g. because the connection has been lost, have a 500 status.
+	MercuryResponse(method string, prefix string, status int32, latency time.Duration)
+
+	// AudioKeyReceived is called when an audio key request completes, err being nil when the key was received
+	AudioKeyReceived(latency time.Duration, err error)
+	// ChunkDownloaded is called when an audio chunk has been downloaded, with its size in bytes and the time taken
+	ChunkDownloaded(size int, duration time.Duration)
+	// ChannelOpened is called when an audio channel is allocated
+	ChannelOpened()
+	// ChannelClosed is called when an audio channel is released
+	ChannelClosed()
+}
+
+// Nop is a Metrics ignoring all the events. It can be embedded to implement only some of the hooks.
+type Nop struct{}
+
+func (Nop) PacketSent(cmd uint8, size int)                                                    {}
+func (Nop) PacketReceived(cmd uint8, size int)                                                {}
+func (Nop) Reconnected(err error)                                                             {}
+func (Nop) MercuryRequestSent(method string, prefix string)                                   {}
+func (Nop) MercuryResponse(method string, prefix string, status int32, latency time.Duration) {}
+func (Nop) AudioKeyReceived(latency time.Duration, err error)                                 {}
+func (Nop) ChunkDownloaded(size int, duration time.Duration)                                  {}
+func (Nop) ChannelOpened()                                                                    {}
+func (Nop) ChannelClosed()                                                                    {}
+
+// OrNop returns m, or Nop when it is nil
+func OrNop(m Metrics) Metrics {
+	if m == nil {
+		return Nop{}
+	}
+	return m
+}
+
+// URIPrefix returns the part of a mercury URI identifying the service it targets, e.g. "hm://metadata/" for
+// "hm://metadata/4/track/<id>". It drops the ids and usernames, which would make the label cardinality explode.
+func URIPrefix(uri string) string {
+	scheme := strings.Index(uri, "://")
+	if scheme < 0 {
+		return ""
+	}
+	service := uri[scheme+3:]
+	if end := strings.IndexAny(service, "/?"); end >= 0 {
+		service = service[:end]
+	}
+	return uri[:scheme+3] + service + "/"
+}
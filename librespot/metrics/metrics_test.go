@@ -0,0 +1,18 @@
+package metrics
+
+import "testing"
+
+func TestURIPrefix(t *testing.T) {
+	tests := map[string]string{
+		"hm://metadata/4/track/0065fc321db74b10c41f2a6446451b4d": "hm://metadata/",
+		"hm://remote/user/fakeUser/":                             "hm://remote/",
+		"hm://keymaster/token/authenticated?client_id=abc":       "hm://keymaster/",
+		"hm://searchview?query=test":                             "hm://searchview/",
+		"spotify:track:abc":                                      "",
+	}
+	for uri, expected := range tests {
+		if got := URIPrefix(uri); got != expected {
+			t.Errorf("Wrong prefix for %s. Got %q, want %q", uri, got, expected)
+		}
+	}
+}
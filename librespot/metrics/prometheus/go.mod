@@ -0,0 +1,8 @@
+module github.com/librespot-org/librespot-golang/librespot/metrics/prometheus
+
+go 1.16
+
+require (
+	github.com/librespot-org/librespot-golang v0.0.0-20261018094054-432b76d9bc75
+	github.com/prometheus/client_golang v1.11.1
+)
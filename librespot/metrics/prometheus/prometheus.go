@@ -0,0 +1,179 @@
+// Package prometheus exposes the metrics of the library to Prometheus. A single Metrics is meant to be shared by all
+// the sessions of a process, use Opts.ConstLabels to tell apart the metrics of several instances.
+//
+// The package is a module of its own, so that the library doesn't depend on the Prometheus client unless it is used.
+//
+//	m, err := prometheus.New(prom.DefaultRegisterer, prometheus.Opts{})
+//	session, err := (&core.SessionConfig{Metrics: m}).Login(ctx, username, password, deviceName)
+package prometheus
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// Opts holds the settings of the Prometheus metrics
+type Opts struct {
+	// Namespace prefixes the names of the metrics, "librespot" is used when empty
+	Namespace string
+	// ConstLabels are added to all the metrics
+	ConstLabels prom.Labels
+	// LatencyBuckets are the buckets of the latency histograms, in seconds. prom.DefBuckets is used when nil.
+	LatencyBuckets []float64
+}
+
+// Metrics implements metrics.Metrics with Prometheus collectors:
+//
+//   - packets_sent_total, packets_received_total: counters by command, e.g. cmd="0xb2"
+//   - packet_bytes_sent_total, packet_bytes_received_total: counters of payload bytes by command
+//   - reconnects_total: counter of the reconnection attempts by result, "success" or "failure"
+//   - mercury_requests_pending: gauge of the mercury requests waiting for their response
+//   - mercury_request_duration_seconds: histogram by method and uri_prefix
+//   - mercury_responses_total: counter by method, uri_prefix and status
+//   - audio_key_duration_seconds: histogram of the audio key requests
+//   - audio_key_errors_total: counter of the failed audio key requests
+//   - chunk_bytes_total: counter of the audio bytes downloaded
+//   - chunk_download_duration_seconds: histogram of the audio chunk downloads
+//   - audio_channels_open: gauge of the audio channels currently allocated
+type Metrics struct {
+	packetsSent         *prom.CounterVec
+	packetsReceived     *prom.CounterVec
+	packetBytesSent     *prom.CounterVec
+	packetBytesReceived *prom.CounterVec
+	reconnects          *prom.CounterVec
+	mercuryPending      prom.Gauge
+	mercuryDuration     *prom.HistogramVec
+	mercuryResponses    *prom.CounterVec
+	audioKeyDuration    prom.Histogram
+	audioKeyErrors      prom.Counter
+	chunkBytes          prom.Counter
+	chunkDuration       prom.Histogram
+	channels            prom.Gauge
+}
+
+// New creates the collectors and registers them with reg
+func New(reg prom.Registerer, opts Opts) (*Metrics, error) {
+	namespace := opts.Namespace
+	if namespace == "" {
+		namespace = "librespot"
+	}
+	buckets := opts.LatencyBuckets
+	if buckets == nil {
+		buckets = prom.DefBuckets
+	}
+
+	counterVec := func(name string, help string, labels ...string) *prom.CounterVec {
+		return prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace, Name: name, Help: help, ConstLabels: opts.ConstLabels,
+		}, labels)
+	}
+	counter := func(name string, help string) prom.Counter {
+		return prom.NewCounter(prom.CounterOpts{
+			Namespace: namespace, Name: name, Help: help, ConstLabels: opts.ConstLabels,
+		})
+	}
+	gauge := func(name string, help string) prom.Gauge {
+		return prom.NewGauge(prom.GaugeOpts{
+			Namespace: namespace, Name: name, Help: help, ConstLabels: opts.ConstLabels,
+		})
+	}
+	histogram := func(name string, help string) prom.Histogram {
+		return prom.NewHistogram(prom.HistogramOpts{
+			Namespace: namespace, Name: name, Help: help, ConstLabels: opts.ConstLabels, Buckets: buckets,
+		})
+	}
+	histogramVec := func(name string, help string, labels ...string) *prom.HistogramVec {
+		return prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: namespace, Name: name, Help: help, ConstLabels: opts.ConstLabels, Buckets: buckets,
+		}, labels)
+	}
+
+	m := &Metrics{
+		packetsSent:         counterVec("packets_sent_total", "Packets sent to the AP.", "cmd"),
+		packetsReceived:     counterVec("packets_received_total", "Packets received from the AP.", "cmd"),
+		packetBytesSent:     counterVec("packet_bytes_sent_total", "Payload bytes sent to the AP.", "cmd"),
+		packetBytesReceived: counterVec("packet_bytes_received_total", "Payload bytes received from the AP.", "cmd"),
+		reconnects:          counterVec("reconnects_total", "Reconnection attempts.", "result"),
+		mercuryPending:      gauge("mercury_requests_pending", "Mercury requests waiting for their response."),
+		mercuryDuration: histogramVec("mercury_request_duration_seconds",
+			"Time taken by the mercury requests to complete.", "method", "uri_prefix"),
+		mercuryResponses: counterVec("mercury_responses_total", "Mercury responses by status code.",
+			"method", "uri_prefix", "status"),
+		audioKeyDuration: histogram("audio_key_duration_seconds", "Time taken by the audio key requests."),
+		audioKeyErrors:   counter("audio_key_errors_total", "Failed audio key requests."),
+		chunkBytes:       counter("chunk_bytes_total", "Audio bytes downloaded."),
+		chunkDuration:    histogram("chunk_download_duration_seconds", "Time taken to download the audio chunks."),
+		channels:         gauge("audio_channels_open", "Audio channels currently allocated."),
+	}
+
+	for _, collector := range m.collectors() {
+		err := reg.Register(collector)
+		if err != nil {
+			return nil, fmt.Errorf("registering librespot metrics: %w", err)
+		}
+	}
+	return m, nil
+}
+
+func (m *Metrics) collectors() []prom.Collector {
+	return []prom.Collector{
+		m.packetsSent, m.packetsReceived, m.packetBytesSent, m.packetBytesReceived, m.reconnects,
+		m.mercuryPending, m.mercuryDuration, m.mercuryResponses,
+		m.audioKeyDuration, m.audioKeyErrors, m.chunkBytes, m.chunkDuration, m.channels,
+	}
+}
+
+func cmdLabel(cmd uint8) string {
+	return fmt.Sprintf("0x%02x", cmd)
+}
+
+func (m *Metrics) PacketSent(cmd uint8, size int) {
+	m.packetsSent.WithLabelValues(cmdLabel(cmd)).Inc()
+	m.packetBytesSent.WithLabelValues(cmdLabel(cmd)).Add(float64(size))
+}
+
+func (m *Metrics) PacketReceived(cmd uint8, size int) {
+	m.packetsReceived.WithLabelValues(cmdLabel(cmd)).Inc()
+	m.packetBytesReceived.WithLabelValues(cmdLabel(cmd)).Add(float64(size))
+}
+
+func (m *Metrics) Reconnected(err error) {
+	if err == nil {
+		m.reconnects.WithLabelValues("success").Inc()
+	} else {
+		m.reconnects.WithLabelValues("failure").Inc()
+	}
+}
+
+func (m *Metrics) MercuryRequestSent(method string, prefix string) {
+	m.mercuryPending.Inc()
+}
+
+func (m *Metrics) MercuryResponse(method string, prefix string, status int32, latency time.Duration) {
+	m.mercuryPending.Dec()
+	m.mercuryDuration.WithLabelValues(method, prefix).Observe(latency.Seconds())
+	m.mercuryResponses.WithLabelValues(method, prefix, strconv.Itoa(int(status))).Inc()
+}
+
+func (m *Metrics) AudioKeyReceived(latency time.Duration, err error) {
+	m.audioKeyDuration.Observe(latency.Seconds())
+	if err != nil {
+		m.audioKeyErrors.Inc()
+	}
+}
+
+func (m *Metrics) ChunkDownloaded(size int, duration time.Duration) {
+	m.chunkBytes.Add(float64(size))
+	m.chunkDuration.Observe(duration.Seconds())
+}
+
+func (m *Metrics) ChannelOpened() {
+	m.channels.Inc()
+}
+
+func (m *Metrics) ChannelClosed() {
+	m.channels.Dec()
+}
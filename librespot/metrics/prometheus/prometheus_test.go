@@ -0,0 +1,58 @@
+package prometheus
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/librespot-org/librespot-golang/librespot/metrics"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// The adapter must implement the hooks
+var _ metrics.Metrics = &Metrics{}
+
+func TestMetrics(t *testing.T) {
+	reg := prom.NewPedanticRegistry()
+	m, err := New(reg, Opts{ConstLabels: prom.Labels{"instance": "test"}})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	m.PacketReceived(0xb2, 10)
+	m.PacketReceived(0xb2, 20)
+	m.MercuryRequestSent("GET", "hm://metadata/")
+	m.MercuryRequestSent("GET", "hm://metadata/")
+	m.MercuryResponse("GET", "hm://metadata/", 404, time.Millisecond)
+	m.AudioKeyReceived(time.Millisecond, errors.New("refused"))
+	m.ChannelOpened()
+	m.Reconnected(nil)
+
+	checks := []struct {
+		collector prom.Collector
+		expected  float64
+	}{
+		{m.packetsReceived.WithLabelValues("0xb2"), 2},
+		{m.packetBytesReceived.WithLabelValues("0xb2"), 30},
+		{m.mercuryPending, 1},
+		{m.mercuryResponses.WithLabelValues("GET", "hm://metadata/", "404"), 1},
+		{m.audioKeyErrors, 1},
+		{m.channels, 1},
+		{m.reconnects.WithLabelValues("success"), 1},
+	}
+	for i, check := range checks {
+		if got := testutil.ToFloat64(check.collector); got != check.expected {
+			t.Errorf("Wrong value for metric %d. Got %v, want %v", i, got, check.expected)
+		}
+	}
+
+	if _, err := reg.Gather(); err != nil {
+		t.Errorf("Gathering failed: %v", err)
+	}
+
+	// The same metrics can't be registered twice
+	if _, err := New(reg, Opts{ConstLabels: prom.Labels{"instance": "test"}}); err == nil {
+		t.Errorf("Expected registering twice to fail")
+	}
+}
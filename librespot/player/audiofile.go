@@ -5,12 +5,13 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"encoding/binary"
-	"fmt"
 	"github.com/librespot-org/librespot-golang/Spotify"
 	"github.com/librespot-org/librespot-golang/librespot/connection"
+	"github.com/librespot-org/librespot-golang/librespot/logging"
 	"io"
 	"math"
 	"sync"
+	"time"
 )
 
 const kChunkSize = 32768 // In number of words (so actual byte size is kChunkSize*4, aka. kChunkByteSize)
@@ -189,7 +190,7 @@ func (a *AudioFile) hasChunk(index int) bool {
 func (a *AudioFile) loadKey(trackId []byte) error {
 	key, err := a.player.loadTrackKey(trackId, a.fileId)
 	if err != nil {
-		fmt.Printf("[audiofile] Unable to load key: %s\n", err)
+		a.player.log.Warn("player: unable to load audio key", logging.KeyError, err)
 		return err
 	}
 
@@ -245,22 +246,38 @@ func (a *AudioFile) requestChunk(chunkIndex int) {
 func (a *AudioFile) loadChunk(chunkIndex int) error {
 	chunkData := make([]byte, kChunkByteSize)
 
+	// Get the stream before allocating the channel, so that a reconnection in between is noticed
+	stream, lost := a.player.currentStream()
 	channel := a.player.AllocateChannel()
 	channel.onHeader = a.onChannelHeader
 	channel.onData = a.onChannelData
 
+	start := time.Now()
 	chunkOffsetStart := uint32(chunkIndex * kChunkSize)
 	chunkOffsetEnd := uint32((chunkIndex + 1) * kChunkSize)
-	err := a.player.stream.SendPacket(connection.PacketStreamChunk, buildAudioChunkRequest(channel.num, a.fileId, chunkOffsetStart, chunkOffsetEnd))
+	err := stream.SendPacket(connection.PacketStreamChunk, buildAudioChunkRequest(channel.num, a.fileId, chunkOffsetStart, chunkOffsetEnd))
 
 	if err != nil {
-		return err
+		// The connection is broken, wait for the session to reconnect so that the chunk can be requested again
+		select {
+		case <-lost:
+			return ErrConnectionLost
+		case <-a.player.closed:
+			return ErrClosed
+		}
 	}
 
 	chunkSz := 0
 
 	for {
-		chunk := <-a.responseChan
+		var chunk []byte
+		select {
+		case chunk = <-a.responseChan:
+		case <-lost:
+			return ErrConnectionLost
+		case <-a.player.closed:
+			return ErrClosed
+		}
 		chunkLen := len(chunk)
 
 		if chunkLen > 0 {
@@ -274,6 +291,7 @@ func (a *AudioFile) loadChunk(chunkIndex int) error {
 	}
 
 	// fmt.Printf("[AudioFile] Got encrypted chunk %d, len=%d...\n", i, len(wholeData))
+	a.player.metrics.ChunkDownloaded(chunkSz, time.Since(start))
 
 	a.putEncryptedChunk(chunkIndex, chunkData[0:chunkSz])
 
@@ -297,7 +315,18 @@ func (a *AudioFile) loadNextChunk() {
 	a.chunkLock.Unlock()
 
 	if !a.hasChunk(chunkIndex) {
-		a.loadChunk(chunkIndex)
+		err := a.loadChunk(chunkIndex)
+		if err == ErrClosed {
+			a.chunkLock.Lock()
+			a.chunksLoading = false
+			a.chunkLock.Unlock()
+			return
+		} else if err == ErrConnectionLost {
+			// Download this chunk again first, now that the session has reconnected
+			a.chunkLock.Lock()
+			a.chunkLoadOrder = append([]int{chunkIndex}, a.chunkLoadOrder...)
+			a.chunkLock.Unlock()
+		}
 	}
 
 	a.chunkLock.Lock()
@@ -356,15 +385,16 @@ func (a *AudioFile) onChannelHeader(channel *Channel, id byte, data *bytes.Reade
 }
 
 func (a *AudioFile) onChannelData(channel *Channel, data []byte) uint16 {
-	if data != nil {
-		a.responseChan <- data
-
-		return 0 // uint16(len(data))
-	} else {
+	if data == nil {
 		// fmt.Printf("[AudioFile] Got EOF (nil) audio data on channel %d!\n", channel.num)
-		a.responseChan <- []byte{}
+		data = []byte{}
+	}
 
-		return 0
+	select {
+	case a.responseChan <- data:
+	case <-a.player.closed:
 	}
 
+	return 0 // uint16(len(data))
+
 }
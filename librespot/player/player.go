@@ -3,16 +3,38 @@ package player
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/librespot-org/librespot-golang/Spotify"
 	"github.com/librespot-org/librespot-golang/librespot/connection"
+	"github.com/librespot-org/librespot-golang/librespot/logging"
 	"github.com/librespot-org/librespot-golang/librespot/mercury"
-	"log"
+	"github.com/librespot-org/librespot-golang/librespot/metrics"
 	"sync"
+	"time"
 )
 
+// ErrClosed is returned by the operations that were pending, or started, when the player has been closed
+var ErrClosed = errors.New("player closed")
+
+// ErrConnectionLost is returned by the operations that were pending when the session lost its connection. They
+// can be tried again once the session has reconnected.
+var ErrConnectionLost = errors.New("connection lost")
+
+// ErrAudioKey is returned when the AP refuses to give the key of an audio file, e.g. because it doesn't exist
+var ErrAudioKey = errors.New("audio key request refused")
+
+// audioKeyResponse is the answer of the AP to an audio key request
+type audioKeyResponse struct {
+	key []byte
+	err error
+}
+
 type Player struct {
-	stream   connection.PacketStream
+	stream     connection.PacketStream
+	streamLock sync.RWMutex
+	// lost is closed when the stream is replaced, to interrupt the operations waiting for a response on it
+	lost     chan struct{}
 	mercury  *mercury.Client
 	seq      uint32
 	audioKey []byte
@@ -22,6 +44,12 @@ type Player struct {
 	channels    map[uint16]*Channel
 	seqChans    sync.Map
 	nextChan    uint16
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	log     logging.Logger
+	metrics metrics.Metrics
 }
 
 func CreatePlayer(conn connection.PacketStream, client *mercury.Client) *Player {
@@ -32,9 +60,55 @@ func CreatePlayer(conn connection.PacketStream, client *mercury.Client) *Player
 		seqChans: sync.Map{},
 		chanLock: sync.Mutex{},
 		nextChan: 0,
+		closed:   make(chan struct{}),
+		lost:     make(chan struct{}),
+		log:      logging.Discard,
+		metrics:  metrics.Nop{},
 	}
 }
 
+// SetLogger sets the logger receiving the logs of the player, it must be called before the player is used
+func (p *Player) SetLogger(logger logging.Logger) {
+	p.log = logging.OrDiscard(logger)
+}
+
+// SetMetrics sets the Metrics receiving the events of the player, it must be called before the player is used
+func (p *Player) SetMetrics(hooks metrics.Metrics) {
+	p.metrics = metrics.OrNop(hooks)
+}
+
+// Rebind makes the player use a new stream once the session has reconnected to an AP. The audio keys and chunks
+// pending on the previous stream fail with ErrConnectionLost, the chunks are then requested again on the new stream.
+func (p *Player) Rebind(stream connection.PacketStream) {
+	p.streamLock.Lock()
+	p.stream = stream
+	close(p.lost)
+	p.lost = make(chan struct{})
+	p.streamLock.Unlock()
+
+	// The channels were opened on the previous connection, their data will never come
+	p.chanLock.Lock()
+	for range p.channels {
+		p.metrics.ChannelClosed()
+	}
+	p.channels = map[uint16]*Channel{}
+	p.chanLock.Unlock()
+}
+
+// currentStream returns the stream to send packets to, and a channel closed when this stream is replaced
+func (p *Player) currentStream() (connection.PacketStream, <-chan struct{}) {
+	p.streamLock.RLock()
+	defer p.streamLock.RUnlock()
+	return p.stream, p.lost
+}
+
+// Close stops the player: pending audio key requests and chunk downloads are interrupted and return ErrClosed.
+func (p *Player) Close() {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+}
+
 func (p *Player) LoadTrack(file *Spotify.AudioFile, trackId []byte) (*AudioFile, error) {
 	return p.LoadTrackWithIdAndFormat(file.FileId, file.GetFormat(), trackId)
 }
@@ -54,23 +128,36 @@ func (p *Player) LoadTrackWithIdAndFormat(fileId []byte, format Spotify.AudioFil
 	return audioFile, err
 }
 
-func (p *Player) loadTrackKey(trackId []byte, fileId []byte) ([]byte, error) {
+func (p *Player) loadTrackKey(trackId []byte, fileId []byte) (key []byte, err error) {
+	start := time.Now()
+	defer func() {
+		if err != ErrClosed {
+			p.metrics.AudioKeyReceived(time.Since(start), err)
+		}
+	}()
+
 	seqInt, seq := p.mercury.NextSeqWithInt()
 
-	p.seqChans.Store(seqInt, make(chan []byte))
+	// The reply may arrive after we gave up waiting for it, it must not block the poll loop then
+	channel := make(chan audioKeyResponse, 1)
+	p.seqChans.Store(seqInt, channel)
+	defer p.seqChans.Delete(seqInt)
 
+	stream, lost := p.currentStream()
 	req := buildKeyRequest(seq, trackId, fileId)
-	err := p.stream.SendPacket(connection.PacketRequestKey, req)
+	err = stream.SendPacket(connection.PacketRequestKey, req)
 	if err != nil {
-		log.Println("Error while sending packet", err)
 		return nil, err
 	}
 
-	channel, _ := p.seqChans.Load(seqInt)
-	key := <-channel.(chan []byte)
-	p.seqChans.Delete(seqInt)
-
-	return key, nil
+	select {
+	case response := <-channel:
+		return response.key, response.err
+	case <-lost:
+		return nil, ErrConnectionLost
+	case <-p.closed:
+		return nil, ErrClosed
+	}
 }
 
 func (p *Player) AllocateChannel() *Channel {
@@ -80,6 +167,7 @@ func (p *Player) AllocateChannel() *Channel {
 
 	p.channels[channel.num] = channel
 	p.chanLock.Unlock()
+	p.metrics.ChannelOpened()
 
 	return channel
 }
@@ -93,15 +181,31 @@ func (p *Player) HandleCmd(cmd byte, data []byte) {
 		binary.Read(dataReader, binary.BigEndian, &seqNum)
 
 		if channel, ok := p.seqChans.Load(seqNum); ok {
-			channel.(chan []byte) <- data[4:20]
+			select {
+			case channel.(chan audioKeyResponse) <- audioKeyResponse{key: data[4:20]}:
+			case <-p.closed:
+			}
 		} else {
-			fmt.Printf("[player] Unknown channel for audio key seqNum %d\n", seqNum)
+			p.log.Debug("player: audio key for unknown request", logging.KeySeq, seqNum)
 		}
 
 	case cmd == connection.PacketAesKeyError:
 		// Audio key error
-		fmt.Println("[player] Audio key error!")
-		fmt.Printf("%x\n", data)
+		// The payload is [ uint32 seq, uint16 error code ]
+		var seqNum uint32
+		var code uint16
+		dataReader := bytes.NewReader(data)
+		binary.Read(dataReader, binary.BigEndian, &seqNum)
+		binary.Read(dataReader, binary.BigEndian, &code)
+		if channel, ok := p.seqChans.Load(seqNum); ok {
+			err := fmt.Errorf("%w: code 0x%04x", ErrAudioKey, code)
+			select {
+			case channel.(chan audioKeyResponse) <- audioKeyResponse{err: err}:
+			case <-p.closed:
+			}
+		} else {
+			p.log.Debug("player: audio key error for unknown request", logging.KeySeq, seqNum, "code", code)
+		}
 
 	case cmd == connection.PacketStreamChunkRes:
 		// Audio data response
@@ -111,17 +215,25 @@ func (p *Player) HandleCmd(cmd byte, data []byte) {
 
 		// fmt.Printf("[player] Data on channel %d: %d bytes\n", channel, len(data[2:]))
 
-		if val, ok := p.channels[channel]; ok {
+		p.chanLock.Lock()
+		val, ok := p.channels[channel]
+		p.chanLock.Unlock()
+
+		if ok {
 			val.handlePacket(data[2:])
 		} else {
-			fmt.Printf("Unknown channel!\n")
+			p.log.Debug("player: data for unknown channel", logging.KeyChannel, channel)
 		}
 	}
 }
 
 func (p *Player) releaseChannel(channel *Channel) {
 	p.chanLock.Lock()
+	_, ok := p.channels[channel.num]
 	delete(p.channels, channel.num)
 	p.chanLock.Unlock()
+	if ok {
+		p.metrics.ChannelClosed()
+	}
 	// fmt.Printf("[player] Released channel %d\n", channel.num)
 }
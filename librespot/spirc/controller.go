@@ -1,13 +1,15 @@
 package spirc
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/golang/protobuf/proto"
 	"github.com/librespot-org/librespot-golang/Spotify"
 	"github.com/librespot-org/librespot-golang/librespot/core"
+	"github.com/librespot-org/librespot-golang/librespot/logging"
 	"github.com/librespot-org/librespot-golang/librespot/mercury"
-	"github.com/librespot-org/librespot-golang/librespot/utils"
+	"github.com/librespot-org/librespot-golang/librespot/spotifyid"
 	"strings"
 	"sync"
 )
@@ -19,6 +21,11 @@ type Controller struct {
 	devices     map[string]ConnectDevice
 	devicesLock sync.RWMutex
 	updateChan  chan Spotify.Frame
+	log         logging.Logger
+	// subscription is the subscription to the frames of the user, nil if subscribing failed
+	subscription *mercury.Subscription
+	// frames receives the frames of the subscription, it is closed by Close
+	frames chan mercury.Response
 
 	SavedCredentials []byte
 }
@@ -34,34 +41,45 @@ type ConnectDevice struct {
 }
 
 // CreateController creates a Spirc controller. Registers listeners for Spotify connect device
-// updates, and opens connection for sending commands
+// updates, and opens connection for sending commands. Use Close to detach it from the session.
 func CreateController(userSession *core.Session, credentials []byte) *Controller {
 	controller := &Controller{
 		devices:          make(map[string]ConnectDevice),
 		session:          userSession,
 		SavedCredentials: credentials,
+		log:              userSession.Logger(),
 	}
 	controller.subscribe()
 	return controller
 }
 
-// Load comma seperated tracks
+// Load comma seperated tracks, given as URIs, URLs or base62 ids
 func (c *Controller) LoadTrackIds(ident string, ids string) error {
-	return c.LoadTrack(ident, strings.Split(ids, ","))
+	tracks := make([]spotifyid.SpotifyID, 0)
+	for _, s := range strings.Split(ids, ",") {
+		id, err := spotifyid.ParseAs(spotifyid.Track, strings.TrimSpace(s))
+		if err != nil {
+			return err
+		}
+		tracks = append(tracks, id)
+	}
+	return c.LoadTrack(ident, tracks)
 }
 
 // Load given list of tracks on spotify connect device with given
-// ident.  Gids are formated base62 spotify ids.
-func (c *Controller) LoadTrack(ident string, gids []string) error {
-	c.seqNr += 1
-
-	tracks := make([]*Spotify.TrackRef, 0, len(gids))
-	for _, g := range gids {
+// ident. The ids must be of type spotifyid.Track.
+func (c *Controller) LoadTrack(ident string, ids []spotifyid.SpotifyID) error {
+	tracks := make([]*Spotify.TrackRef, 0, len(ids))
+	for _, id := range ids {
+		if err := id.Expect(spotifyid.Track); err != nil {
+			return err
+		}
 		tracks = append(tracks, &Spotify.TrackRef{
-			Gid:    utils.Convert62(g),
+			Gid:    id.Bytes(),
 			Queued: proto.Bool(false),
 		})
 	}
+	c.seqNr += 1
 
 	state := &Spotify.State{
 		Index:             proto.Uint32(0),
@@ -117,8 +135,8 @@ func (c *Controller) SendVolume(recipient string, volume int) error {
 
 // Connect to Spotify Connect device at address (local network path). Uses credentials from saved blob to authenticate
 // on the device automagically.
-func (c *Controller) ConnectToDevice(address string) {
-	c.session.Discovery().ConnectToDevice(address)
+func (c *Controller) ConnectToDevice(address string) error {
+	return c.session.Discovery().ConnectToDevice(address)
 }
 
 // Lists devices on local network advertising spotify connect
@@ -157,23 +175,23 @@ func (c *Controller) ListDevices() []ConnectDevice {
 func (c *Controller) sendFrame(frame *Spotify.Frame) error {
 	frameData, err := proto.Marshal(frame)
 	if err != nil {
-		return fmt.Errorf("could not Marshal spirc Request frame: ", err)
+		return fmt.Errorf("could not Marshal spirc Request frame: %v", err)
 	}
 
 	payload := make([][]byte, 1)
 	payload[0] = frameData
 
-	status := make(chan int32)
-
-	go c.session.Mercury().Request(mercury.Request{
+	// The frames are bounded by the timeout of the mercury client
+	res, err := c.session.Mercury().Do(context.Background(), mercury.Request{
 		Method:  "SEND",
 		Uri:     "hm://remote/user/" + c.session.Username() + "/",
 		Payload: payload,
-	}, func(res mercury.Response) {
-		status <- res.StatusCode
 	})
+	if err != nil {
+		return fmt.Errorf("spirc send frame: %w", err)
+	}
 
-	code := <-status
+	code := res.StatusCode
 	if code >= 200 && code < 300 {
 		return nil
 	} else {
@@ -196,21 +214,45 @@ func (c *Controller) sendCmd(recipient []string, messageType Spotify.MessageType
 }
 
 func (c *Controller) subscribe() {
-	ch := make(chan mercury.Response)
-	c.session.Mercury().Subscribe(fmt.Sprintf("hm://remote/user/%s/", c.session.Username()), ch, func(_ mercury.Response) {
-		go c.run(ch)
-		go c.SendHello()
-	})
+	c.frames = make(chan mercury.Response)
+	go c.run(c.frames)
+
+	uri := fmt.Sprintf("hm://remote/user/%s/", c.session.Username())
+	sub, err := c.session.Mercury().Subscribe(context.Background(), uri, c.frames)
+	if err != nil {
+		c.log.Warn("spirc: failed to subscribe", logging.KeyURI, uri, logging.KeyError, err)
+		return
+	}
+	c.subscription = sub
+	go c.SendHello()
+}
+
+// Close unsubscribes the controller from the Spotify Connect frames, it must not be used afterwards. The session is
+// left open.
+func (c *Controller) Close() error {
+	var err error
+	if c.subscription != nil {
+		err = c.subscription.Unsubscribe()
+	}
+	if c.frames != nil {
+		// No frame is delivered once unsubscribed, which ends the run loop
+		close(c.frames)
+		c.frames = nil
+	}
+	return err
 }
 
 func (c *Controller) run(ch chan mercury.Response) {
-	for {
-		response := <-ch
+	for response := range ch {
+		if len(response.Payload) == 0 {
+			c.log.Warn("spirc: received an empty frame", logging.KeyURI, response.Uri)
+			continue
+		}
 
 		frame := &Spotify.Frame{}
 		err := proto.Unmarshal(response.Payload[0], frame)
 		if err != nil {
-			fmt.Println("error getting packet")
+			c.log.Warn("spirc: failed to decode frame", logging.KeyURI, response.Uri, logging.KeyError, err)
 			continue
 		}
 
@@ -232,21 +274,19 @@ func (c *Controller) run(ch chan mercury.Response) {
 		if c.updateChan != nil {
 			select {
 			case c.updateChan <- *frame:
-				fmt.Println("sent update")
 			default:
-				fmt.Println("dropped update")
+				c.log.Debug("spirc: dropped update, the channel is full", "ident", frame.GetIdent())
 			}
 		}
 
-		fmt.Printf("%v %v %v %v %v %v \n",
-			frame.Typ,
-			frame.DeviceState.GetName(),
-			*frame.Ident,
-			*frame.SeqNr,
-			frame.GetStateUpdateId(),
-			frame.Recipient,
+		c.log.Debug("spirc: received frame",
+			"type", frame.GetTyp().String(),
+			"name", frame.DeviceState.GetName(),
+			"ident", frame.GetIdent(),
+			logging.KeySeq, frame.GetSeqNr(),
+			"state_update_id", frame.GetStateUpdateId(),
+			"recipient", frame.GetRecipient(),
 		)
-
 	}
 
 }
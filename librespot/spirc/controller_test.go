@@ -1,89 +1,159 @@
 package spirc
 
 import (
-	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
 	"github.com/golang/protobuf/proto"
 	"github.com/librespot-org/librespot-golang/Spotify"
-	"github.com/librespot-org/librespot-golang/librespot/connection"
-	"github.com/librespot-org/librespot-golang/librespot/mercury"
-	"testing"
+	"github.com/librespot-org/librespot-golang/librespot/core"
+	"github.com/librespot-org/librespot-golang/librespot/spotifyid"
+	"github.com/librespot-org/librespot-golang/librespot/testing/fakeap"
 )
 
-type fakeServer struct {
-	stream    connection.PacketStream
-	responses []mercury.Response
-	mInternal *mercury.Internal
+const remoteUri = "hm://remote/user/fakeUser/"
+
+// setupControllerAndServer logs in to a fake AP, and returns a controller along the frames the AP received from it
+func setupControllerAndServer(t *testing.T) (*Controller, *fakeap.Server, chan *Spotify.Frame) {
+	server, err := fakeap.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.AddUser("fakeUser", "123")
+
+	frames := make(chan *Spotify.Frame, 10)
+	server.HandleMercury(remoteUri, func(req fakeap.MercuryRequest) fakeap.MercuryResponse {
+		if req.Method == "SUB" || req.Method == "UNSUB" {
+			return fakeap.MercuryResponse{StatusCode: 200}
+		}
+
+		frame := &Spotify.Frame{}
+		if req.Method != "SEND" || len(req.Payload) != 1 || proto.Unmarshal(req.Payload[0], frame) != nil {
+			return fakeap.MercuryResponse{StatusCode: 400}
+		}
+		frames <- frame
+		return fakeap.MercuryResponse{StatusCode: 200}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	config := &core.SessionConfig{Resolver: server.Resolver(), ServerKey: server.PublicKey()}
+	session, err := config.Login(ctx, "fakeUser", "123", "testDevice")
+	if err != nil {
+		server.Close()
+		t.Fatalf("Login failed: %v", err)
+	}
+	t.Cleanup(func() {
+		session.Close(context.Background())
+		server.Close()
+	})
+
+	return CreateController(session, []byte{}), server, frames
 }
 
-func setupFakeServer(stream connection.PacketStream) *fakeServer {
-	return &fakeServer{
-		stream:    stream,
-		responses: make([]mercury.Response, 5),
-		mInternal: &mercury.Internal{
-			pending: make(map[string]mercury.Pending),
-			stream:  stream,
-		},
+func nextFrame(t *testing.T, frames chan *Spotify.Frame) *Spotify.Frame {
+	select {
+	case frame := <-frames:
+		return frame
+	case <-time.After(5 * time.Second):
+		t.Fatal("No frame received")
+		return nil
 	}
 }
 
-func (f *fakeServer) getResponse(t *testing.T) *mercury.Response {
-	cmd, data, err := f.stream.RecvPacket()
+func TestHelloCmd(t *testing.T) {
+	controller, _, frames := setupControllerAndServer(t)
+
+	// The controller says hello once subscribed
+	frame := nextFrame(t, frames)
+	if frame.GetTyp() != Spotify.MessageType_kMessageTypeHello {
+		t.Errorf("Wrong message type. Got %v", frame.GetTyp())
+	}
+	if frame.GetIdent() != controller.session.DeviceId() {
+		t.Errorf("Wrong ident. Got %q, want %q", frame.GetIdent(), controller.session.DeviceId())
+	}
+
+	err := controller.SendHello()
 	if err != nil {
-		t.Error("poll error", err)
-	}
-	if 0xb2 <= cmd && cmd <= 0xb6 || cmd == 0x1b {
-		var response *mercuryResponse
-		var err error
-		for ; response == nil && err == nil; response, err = f.mInternal.parseResponse(cmd, bytes.NewReader(data)) {
-			if err != nil {
-				t.Errorf("Handle 0xbx %q ", err)
-			}
-		}
-		return response
-	} else {
-		t.Errorf("Non mercury command %q ", cmd)
+		t.Errorf("SendHello failed: %v", err)
+	}
+	if frame := nextFrame(t, frames); frame.GetTyp() != Spotify.MessageType_kMessageTypeHello {
+		t.Errorf("Wrong message type. Got %v", frame.GetTyp())
 	}
-	return nil
 }
 
-func (f *fakeServer) getResponseFrame(t *testing.T) (*Spotify.Frame, *mercuryResponse) {
-	response := f.getResponse(t)
-	frame := &Spotify.Frame{}
-	proto.Unmarshal(response.headerData, frame)
-	return frame, response
-}
+func TestLoadTrackCmd(t *testing.T) {
+	controller, _, frames := setupControllerAndServer(t)
+	nextFrame(t, frames)
 
-func setupContollerAndServer(t *testing.T) (*Controller, *fakeServer) {
-	sessionStream := &fakeStream{
-		recvPackets: make(chan shanPacket, 5),
-		sendPackets: make(chan shanPacket, 5),
+	// The invalid ids are rejected before anything is sent
+	err := controller.LoadTrackIds("device", "0065zxtT6XKaQww7cLne0h,spotify:album:0065zxtT6XKaQww7cLne0h")
+	if !errors.Is(err, spotifyid.ErrWrongType) {
+		t.Errorf("Expected ErrWrongType. Got %v", err)
 	}
 
-	serverStream := &fakeStream{
-		recvPackets: sessionStream.sendPackets,
-		sendPackets: sessionStream.recvPackets,
+	err = controller.LoadTrackIds("device", "0065zxtT6XKaQww7cLne0h,spotify:track:0065zxtT6XKaQww7cLne0i")
+	if err != nil {
+		t.Fatalf("LoadTrackIds failed: %v", err)
 	}
 
-	server := setupFakeServer(serverStream)
+	frame := nextFrame(t, frames)
+	if frame.GetTyp() != Spotify.MessageType_kMessageTypeLoad || len(frame.GetRecipient()) != 1 ||
+		frame.GetRecipient()[0] != "device" {
+		t.Fatalf("Wrong load frame. Got %v", frame)
+	}
+	tracks := frame.GetState().GetTrack()
+	if len(tracks) != 2 {
+		t.Fatalf("Wrong number of tracks loaded. Got %v", tracks)
+	}
+	if first, _ := spotifyid.FromGID(spotifyid.Track, tracks[0].GetGid()); first.Base62() != "0065zxtT6XKaQww7cLne0h" {
+		t.Errorf("Wrong tracks loaded. Got %v", tracks)
+	}
+}
 
-	s := &session{
-		stream:   sessionStream,
-		deviceId: "testDevice",
+func TestDeviceNotify(t *testing.T) {
+	controller, server, frames := setupControllerAndServer(t)
+	nextFrame(t, frames)
+
+	notify, _ := proto.Marshal(&Spotify.Frame{
+		Ident: proto.String("otherDevice"),
+		SeqNr: proto.Uint32(1),
+		Typ:   Spotify.MessageType_kMessageTypeNotify.Enum(),
+		DeviceState: &Spotify.DeviceState{
+			Name:   proto.String("Other device"),
+			Volume: proto.Uint32(42),
+		},
+	})
+	sent, err := server.Publish(remoteUri, notify)
+	if err != nil || sent != 1 {
+		t.Fatalf("Failed to publish the notification: %d sent, %v", sent, err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(controller.ListDevices()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	devices := controller.ListDevices()
+	if len(devices) != 1 || devices[0].Name != "Other device" || devices[0].Volume != 42 {
+		t.Errorf("Wrong devices listed. Got %v", devices)
 	}
-	s.mercury = setupMercury(s)
-	controller := CreateController(s, "fakeUser", []byte{})
-	return controller, server
 }
 
-func TestHelloCmd(t *testing.T) {
-	controller, server := setupContollerAndServer(t)
-	go controller.SendHello()
+func TestControllerClose(t *testing.T) {
+	controller, server, frames := setupControllerAndServer(t)
+	nextFrame(t, frames)
 
-	frame, response := server.getResponseFrame(t)
-	if response.uri != "hm://remote/user/fakeUser/" {
-		t.Errorf("Bad response uri %q ", response.uri)
+	if err := controller.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
 	}
-	if frame.GetTyp() != Spotify.MessageType_kMessageTypeHello {
-		t.Errorf("Wrong message type")
+
+	// The AP no longer sends the frames to the session
+	notify, _ := proto.Marshal(&Spotify.Frame{Ident: proto.String("otherDevice")})
+	if sent, err := server.Publish(remoteUri, notify); err != nil || sent != 0 {
+		t.Errorf("Frames still sent after Close: %d sent, %v", sent, err)
 	}
 }
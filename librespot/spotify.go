@@ -1,6 +1,8 @@
 package librespot
 
 import (
+	"context"
+
 	core "github.com/librespot-org/librespot-golang/librespot/core"
 )
 
@@ -9,11 +11,21 @@ func Login(username string, password string, deviceName string) (*core.Session,
 	return core.Login(username, password, deviceName)
 }
 
+// LoginContext is like Login, but gives up connecting and authenticating once ctx is done
+func LoginContext(ctx context.Context, username string, password string, deviceName string) (*core.Session, error) {
+	return core.LoginContext(ctx, username, password, deviceName)
+}
+
 // Login to Spotify using an existing authData blob
 func LoginSaved(username string, authData []byte, deviceName string) (*core.Session, error) {
 	return core.LoginSaved(username, authData, deviceName)
 }
 
+// LoginSavedContext is like LoginSaved, but gives up connecting and authenticating once ctx is done
+func LoginSavedContext(ctx context.Context, username string, authData []byte, deviceName string) (*core.Session, error) {
+	return core.LoginSavedContext(ctx, username, authData, deviceName)
+}
+
 // Registers librespot as a Spotify Connect device via mdns. When user connects, logs on to Spotify and saves
 // credentials in file at cacheBlobPath. Once saved, the blob credentials allow the program to connect to other
 // Spotify Connect devices and control them.
@@ -27,13 +39,29 @@ func LoginDiscoveryBlob(username string, blob string, deviceName string) (*core.
 	return core.LoginDiscoveryBlob(username, blob, deviceName)
 }
 
+// LoginDiscoveryBlobContext is like LoginDiscoveryBlob, but gives up connecting and authenticating once ctx is done
+func LoginDiscoveryBlobContext(ctx context.Context, username string, blob string, deviceName string) (*core.Session, error) {
+	return core.LoginDiscoveryBlobContext(ctx, username, blob, deviceName)
+}
+
 // Login from credentials at cacheBlobPath previously saved by LoginDiscovery. Similar to LoginDiscoveryBlob, except
 // it reads it directly from a file.
 func LoginDiscoveryBlobFile(cacheBlobPath string, deviceName string) (*core.Session, error) {
 	return core.LoginDiscoveryBlobFile(cacheBlobPath, deviceName)
 }
 
+// LoginDiscoveryBlobFileContext is like LoginDiscoveryBlobFile, but gives up connecting and authenticating once ctx
+// is done
+func LoginDiscoveryBlobFileContext(ctx context.Context, cacheBlobPath string, deviceName string) (*core.Session, error) {
+	return core.LoginDiscoveryBlobFileContext(ctx, cacheBlobPath, deviceName)
+}
+
 // Login to Spotify using the OAuth method
 func LoginOAuth(deviceName string, clientId string, clientSecret string) (*core.Session, error) {
 	return core.LoginOAuth(deviceName, clientId, clientSecret)
 }
+
+// LoginWithToken logs in to Spotify using an OAuth access token with the "streaming" scope
+func LoginWithToken(ctx context.Context, accessToken string, deviceName string) (*core.Session, error) {
+	return core.LoginWithToken(ctx, accessToken, deviceName)
+}
@@ -0,0 +1,197 @@
+// Package spotifyid parses, validates and formats the ids of the Spotify items, in any of the forms they come in:
+// URIs (spotify:track:6rqhFgbbKwnb9MLmUQDhG6), open.spotify.com URLs, base62 ids, hex GIDs and raw 16-byte GIDs.
+package spotifyid
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+)
+
+// Type is the type of a Spotify item, as found in its URI
+type Type string
+
+const (
+	Track    Type = "track"
+	Album    Type = "album"
+	Artist   Type = "artist"
+	Episode  Type = "episode"
+	Show     Type = "show"
+	Playlist Type = "playlist"
+)
+
+// Valid tells if t is one of the types of items identified by a GID
+func (t Type) Valid() bool {
+	switch t {
+	case Track, Album, Artist, Episode, Show, Playlist:
+		return true
+	}
+	return false
+}
+
+const (
+	// GIDSize is the size of a raw GID, in bytes
+	GIDSize = 16
+	// Base62Size is the length of a base62 id
+	Base62Size = 22
+	// HexSize is the length of a hex GID
+	HexSize = 2 * GIDSize
+
+	alphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+)
+
+// ErrInvalidID is returned, wrapped with the offending input, when an id can't be parsed
+var ErrInvalidID = errors.New("spotifyid: invalid id")
+
+// ErrWrongType is returned, wrapped with the offending id, when an id isn't of the expected type
+var ErrWrongType = errors.New("spotifyid: wrong type")
+
+// SpotifyID identifies a Spotify item by its type and its GID. The zero value identifies nothing. SpotifyIDs are
+// comparable, and can be used as map keys.
+type SpotifyID struct {
+	Type Type
+	GID  [GIDSize]byte
+}
+
+// FromGID returns the id of the item of type typ with the specified raw GID, as found in the metadata
+func FromGID(typ Type, gid []byte) (SpotifyID, error) {
+	if !typ.Valid() {
+		return SpotifyID{}, fmt.Errorf("%w: unknown type %q", ErrInvalidID, typ)
+	}
+	if len(gid) != GIDSize {
+		return SpotifyID{}, fmt.Errorf("%w: GID of %d bytes", ErrInvalidID, len(gid))
+	}
+	id := SpotifyID{Type: typ}
+	copy(id.GID[:], gid)
+	return id, nil
+}
+
+// FromBase62 returns the id of the item of type typ with the specified base62 id, as found in the URIs
+func FromBase62(typ Type, s string) (SpotifyID, error) {
+	if len(s) != Base62Size {
+		return SpotifyID{}, fmt.Errorf("%w: %q is not a base62 id", ErrInvalidID, s)
+	}
+
+	n := &big.Int{}
+	base := big.NewInt(62)
+	for i := 0; i < len(s); i++ {
+		d := strings.IndexByte(alphabet, s[i])
+		if d < 0 {
+			return SpotifyID{}, fmt.Errorf("%w: %q is not a base62 id", ErrInvalidID, s)
+		}
+		n.Mul(n, base)
+		n.Add(n, big.NewInt(int64(d)))
+	}
+	// 22 base62 digits hold slightly more than 16 bytes
+	if n.BitLen() > 8*GIDSize {
+		return SpotifyID{}, fmt.Errorf("%w: %q is out of range", ErrInvalidID, s)
+	}
+
+	var gid [GIDSize]byte
+	return FromGID(typ, n.FillBytes(gid[:]))
+}
+
+// FromHex returns the id of the item of type typ with the specified hex GID, as used by the mercury metadata URIs
+func FromHex(typ Type, s string) (SpotifyID, error) {
+	gid, err := hex.DecodeString(s)
+	if err != nil || len(gid) != GIDSize {
+		return SpotifyID{}, fmt.Errorf("%w: %q is not a hex GID", ErrInvalidID, s)
+	}
+	return FromGID(typ, gid)
+}
+
+// Parse parses a URI such as spotify:track:6rqhFgbbKwnb9MLmUQDhG6, or a URL such as
+// https://open.spotify.com/track/6rqhFgbbKwnb9MLmUQDhG6?si=abc, which carry the type of the item
+func Parse(s string) (SpotifyID, error) {
+	if strings.HasPrefix(s, "spotify:") {
+		parts := strings.Split(s, ":")
+		if len(parts) != 3 {
+			return SpotifyID{}, fmt.Errorf("%w: %q is not a Spotify URI", ErrInvalidID, s)
+		}
+		return FromBase62(Type(parts[1]), parts[2])
+	}
+
+	if !strings.Contains(s, "://") {
+		s = "https://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host != "open.spotify.com" {
+		return SpotifyID{}, fmt.Errorf("%w: %q is neither a Spotify URI nor URL", ErrInvalidID, s)
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	// The localized URLs start with the locale, e.g. /intl-fr/track/6rqhFgbbKwnb9MLmUQDhG6
+	if len(parts) == 3 && strings.HasPrefix(parts[0], "intl-") {
+		parts = parts[1:]
+	}
+	if len(parts) != 2 {
+		return SpotifyID{}, fmt.Errorf("%w: %q is not the URL of an item", ErrInvalidID, s)
+	}
+	return FromBase62(Type(parts[0]), parts[1])
+}
+
+// ParseAs parses the id of an item of type typ, given as a URI, a URL, a base62 id or a hex GID. It fails with
+// ErrWrongType when a URI or URL is of another type.
+func ParseAs(typ Type, s string) (SpotifyID, error) {
+	switch len(s) {
+	case Base62Size:
+		return FromBase62(typ, s)
+	case HexSize:
+		return FromHex(typ, s)
+	}
+
+	id, err := Parse(s)
+	if err != nil {
+		return SpotifyID{}, err
+	}
+	return id, id.Expect(typ)
+}
+
+// Expect returns an error wrapping ErrWrongType unless id is of type typ
+func (id SpotifyID) Expect(typ Type) error {
+	if id.Type != typ {
+		return fmt.Errorf("%w: %s is not a %s", ErrWrongType, id, typ)
+	}
+	return nil
+}
+
+// Bytes returns the raw GID, as found in the metadata
+func (id SpotifyID) Bytes() []byte {
+	return append([]byte{}, id.GID[:]...)
+}
+
+// Hex returns the GID in hex, as used by the mercury metadata URIs
+func (id SpotifyID) Hex() string {
+	return hex.EncodeToString(id.GID[:])
+}
+
+// Base62 returns the base62 id, as used by the URIs
+func (id SpotifyID) Base62() string {
+	n := new(big.Int).SetBytes(id.GID[:])
+	base := big.NewInt(62)
+	rem := new(big.Int)
+
+	var result [Base62Size]byte
+	for i := Base62Size - 1; i >= 0; i-- {
+		n.DivMod(n, base, rem)
+		result[i] = alphabet[rem.Int64()]
+	}
+	return string(result[:])
+}
+
+// URI returns the URI of the item, e.g. spotify:track:6rqhFgbbKwnb9MLmUQDhG6
+func (id SpotifyID) URI() string {
+	return fmt.Sprintf("spotify:%s:%s", id.Type, id.Base62())
+}
+
+// URL returns the URL of the item on open.spotify.com
+func (id SpotifyID) URL() string {
+	return fmt.Sprintf("https://open.spotify.com/%s/%s", id.Type, id.Base62())
+}
+
+// String returns the URI of the item
+func (id SpotifyID) String() string {
+	return id.URI()
+}
@@ -0,0 +1,93 @@
+package spotifyid
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+var testGID = []byte{0x00, 0x0d, 0x53, 0x65, 0x35, 0x86, 0x4e, 0x0f, 0x99, 0x76, 0x1f, 0x9d, 0xa9, 0x00, 0xb1, 0xc1}
+
+func TestParse(t *testing.T) {
+	for _, s := range []string{
+		"spotify:track:0065zxtT6XKaQww7cLne0h",
+		"https://open.spotify.com/track/0065zxtT6XKaQww7cLne0h",
+		"https://open.spotify.com/track/0065zxtT6XKaQww7cLne0h?si=5f4b8c",
+		"https://open.spotify.com/intl-fr/track/0065zxtT6XKaQww7cLne0h",
+		"open.spotify.com/track/0065zxtT6XKaQww7cLne0h",
+	} {
+		id, err := Parse(s)
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %v", s, err)
+			continue
+		}
+		if id.Type != Track || !bytes.Equal(id.Bytes(), testGID) {
+			t.Errorf("Parse(%q): wrong id %v", s, id)
+		}
+	}
+
+	for _, s := range []string{
+		"",
+		"spotify:track",
+		"spotify:user:someone:playlist:0065zxtT6XKaQww7cLne0h",
+		"spotify:podcast:0065zxtT6XKaQww7cLne0h",
+		"spotify:track:0065zxtT6XKaQww7cLne0",
+		"spotify:track:0065zxtT6XKaQww7cLne0_",
+		"spotify:track:ZZZZZZZZZZZZZZZZZZZZZZ",
+		"https://example.com/track/0065zxtT6XKaQww7cLne0h",
+		"https://open.spotify.com/track",
+	} {
+		if id, err := Parse(s); !errors.Is(err, ErrInvalidID) {
+			t.Errorf("Parse(%q): expected ErrInvalidID. Got %v, %v", s, id, err)
+		}
+	}
+}
+
+func TestParseAs(t *testing.T) {
+	for _, s := range []string{
+		"0065zxtT6XKaQww7cLne0h",
+		"000d536535864e0f99761f9da900b1c1",
+		"spotify:album:0065zxtT6XKaQww7cLne0h",
+	} {
+		id, err := ParseAs(Album, s)
+		if err != nil || id.Type != Album || !bytes.Equal(id.Bytes(), testGID) {
+			t.Errorf("ParseAs(%q): wrong id %v, %v", s, id, err)
+		}
+	}
+
+	if _, err := ParseAs(Album, "spotify:track:0065zxtT6XKaQww7cLne0h"); !errors.Is(err, ErrWrongType) {
+		t.Errorf("Expected ErrWrongType. Got %v", err)
+	}
+	if _, err := ParseAs(Album, "000d536535864e0f99761f9da900b1cz"); !errors.Is(err, ErrInvalidID) {
+		t.Errorf("Expected ErrInvalidID. Got %v", err)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	id, err := FromGID(Track, testGID)
+	if err != nil {
+		t.Fatalf("FromGID failed: %v", err)
+	}
+
+	if id.Base62() != "0065zxtT6XKaQww7cLne0h" || id.Hex() != "000d536535864e0f99761f9da900b1c1" {
+		t.Errorf("Wrong encoding. Got %s, %s", id.Base62(), id.Hex())
+	}
+	if id.String() != "spotify:track:0065zxtT6XKaQww7cLne0h" ||
+		id.URL() != "https://open.spotify.com/track/0065zxtT6XKaQww7cLne0h" {
+		t.Errorf("Wrong URI or URL. Got %s, %s", id, id.URL())
+	}
+
+	// All the forms round-trip, including the extreme GIDs
+	for _, gid := range [][]byte{make([]byte, GIDSize), bytes.Repeat([]byte{0xff}, GIDSize), testGID} {
+		id, _ := FromGID(Episode, gid)
+		for _, s := range []string{id.URI(), id.URL(), id.Base62(), id.Hex()} {
+			if parsed, err := ParseAs(Episode, s); err != nil || parsed != id {
+				t.Errorf("%q doesn't round-trip. Got %v, %v", s, parsed, err)
+			}
+		}
+	}
+
+	if _, err := FromGID(Track, testGID[1:]); !errors.Is(err, ErrInvalidID) {
+		t.Errorf("Expected ErrInvalidID for a short GID. Got %v", err)
+	}
+}
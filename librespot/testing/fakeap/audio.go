@@ -0,0 +1,125 @@
+package fakeap
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/librespot-org/librespot-golang/librespot/connection"
+)
+
+// audioIV is the initial counter of the AES-CTR encryption of the audio files
+var audioIV = []byte{0x72, 0xe0, 0x67, 0xfb, 0xdd, 0xcb, 0xcf, 0x77, 0xeb, 0xe8, 0xbc, 0x64, 0x3f, 0x63, 0x0d, 0x93}
+
+// chunkPacketSize is the size of the audio data sent in each packet of a chunk
+const chunkPacketSize = 0x4000
+
+type audioFile struct {
+	key []byte
+	// data is the encrypted file, padded to a whole number of 32 bits words
+	data []byte
+}
+
+// AddAudioFile registers an audio file, served to the players requesting fileId. The data is the plain audio file
+// (including the Spotify OGG header, if any), it is encrypted with key the way Spotify does. The key must be 16 bytes
+// long.
+func (s *Server) AddAudioFile(fileId []byte, key []byte, data []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+
+	// Sizes are exchanged in words
+	padded := make([]byte, (len(data)+3)/4*4)
+	copy(padded, data)
+	cipher.NewCTR(block, audioIV).XORKeyStream(padded, padded)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.audioFiles[fmt.Sprintf("%x", fileId)] = &audioFile{
+		key:  key,
+		data: padded,
+	}
+	return nil
+}
+
+func (s *Server) audioFile(fileId []byte) (*audioFile, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	file, ok := s.audioFiles[fmt.Sprintf("%x", fileId)]
+	return file, ok
+}
+
+func (s *Server) handleKeyRequest(conn *apConn, data []byte) error {
+	// [ 20 bytes file id, 16 bytes track id, 4 bytes seq, uint16 0 ]
+	if len(data) < 40 {
+		return fmt.Errorf("decoding audio key request: too short")
+	}
+	fileId := data[0:20]
+	seq := data[36:40]
+
+	file, ok := s.audioFile(fileId)
+	if !ok {
+		response := append(append([]byte{}, seq...), 0x00, 0x01)
+		return conn.stream.SendPacket(connection.PacketAesKeyError, response)
+	}
+
+	response := append(append([]byte{}, seq...), file.key...)
+	return conn.stream.SendPacket(connection.PacketAesKey, append(response, 0x00, 0x00))
+}
+
+func (s *Server) handleChunkRequest(conn *apConn, data []byte) error {
+	// [ uint16 channel, 16 bytes of constants, 20 bytes file id, uint32 start, uint32 end ], offsets are in words
+	if len(data) < 46 {
+		return fmt.Errorf("decoding chunk request: too short")
+	}
+	channel := data[0:2]
+	fileId := data[18:38]
+	start := int(binary.BigEndian.Uint32(data[38:42])) * 4
+	end := int(binary.BigEndian.Uint32(data[42:46])) * 4
+
+	file, ok := s.audioFile(fileId)
+	if !ok {
+		return conn.stream.SendPacket(connection.PacketChannelError, append(append([]byte{}, channel...), 0x00, 0x01))
+	}
+
+	if end > len(file.data) {
+		end = len(file.data)
+	}
+	if start > end {
+		start = end
+	}
+
+	// The first packet holds the headers, the file size (id 0x3) being the only one we send
+	header := new(bytes.Buffer)
+	header.Write(channel)
+	binary.Write(header, binary.BigEndian, uint16(5))
+	header.WriteByte(0x3)
+	binary.Write(header, binary.BigEndian, uint32(len(file.data)/4))
+	binary.Write(header, binary.BigEndian, uint16(0))
+
+	err := conn.stream.SendPacket(connection.PacketStreamChunkRes, header.Bytes())
+	if err != nil {
+		return err
+	}
+
+	for offset := start; offset < end; offset += chunkPacketSize {
+		packetEnd := offset + chunkPacketSize
+		if packetEnd > end {
+			packetEnd = end
+		}
+
+		packet := append(append([]byte{}, channel...), file.data[offset:packetEnd]...)
+		err = conn.stream.SendPacket(connection.PacketStreamChunkRes, packet)
+		if err != nil {
+			return err
+		}
+	}
+
+	// An empty packet ends the chunk
+	return conn.stream.SendPacket(connection.PacketStreamChunkRes, channel)
+}
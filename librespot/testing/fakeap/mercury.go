@@ -0,0 +1,284 @@
+package fakeap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/librespot-org/librespot-golang/Spotify"
+	"github.com/librespot-org/librespot-golang/librespot/connection"
+)
+
+// maxMercuryPacket is the size above which a mercury message is split in several packets, it leaves room for the
+// mercury head in the 16 bits sized Shannon packet
+const maxMercuryPacket = 0xff00
+
+// MercuryRequest is a mercury request received by the server
+type MercuryRequest struct {
+	Method      string
+	Uri         string
+	ContentType string
+	Payload     [][]byte
+	// Username is the canonical username of the client which sent the request
+	Username string
+}
+
+// MercuryResponse is the response of a MercuryHandler
+type MercuryResponse struct {
+	StatusCode  int32
+	ContentType string
+	// UserFields are sent as the user fields of the response header
+	UserFields map[string]string
+	Payload    [][]byte
+}
+
+// MercuryHandler serves the mercury requests made to a given URI
+type MercuryHandler func(req MercuryRequest) MercuryResponse
+
+// HandleMercury registers the handler for the requests made to uri, replacing any previous one. The requests made to
+// URIs without handler get a 404 response, except for the subscriptions which are all accepted.
+func (s *Server) HandleMercury(uri string, handler MercuryHandler) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.handlers[uri] = handler
+}
+
+// ServeProto registers a fixture: the GET requests made to uri are answered with the marshalled message
+func (s *Server) ServeProto(uri string, message proto.Message) error {
+	data, err := proto.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	s.HandleMercury(uri, func(req MercuryRequest) MercuryResponse {
+		if req.Method != "GET" {
+			return MercuryResponse{StatusCode: 405}
+		}
+		return MercuryResponse{
+			StatusCode:  200,
+			ContentType: "vnd.spotify/metadata",
+			Payload:     [][]byte{data},
+		}
+	})
+	return nil
+}
+
+// AddTrack registers the metadata of a track, served as mercury.Client.GetTrack expects it
+func (s *Server) AddTrack(track *Spotify.Track) error {
+	return s.ServeProto(fmt.Sprintf("hm://metadata/4/track/%x", track.GetGid()), track)
+}
+
+// Publish sends an event to the logged in clients which subscribed to uri, it returns the number of clients the
+// event has been sent to
+func (s *Server) Publish(uri string, payload ...[]byte) (int, error) {
+	return s.PublishContent(uri, "", payload...)
+}
+
+// PublishContent sends an event like Publish, with the specified content type in its header
+func (s *Server) PublishContent(uri string, contentType string, payload ...[]byte) (int, error) {
+	header := &Spotify.Header{Uri: proto.String(uri)}
+	if contentType != "" {
+		header.ContentType = proto.String(contentType)
+	}
+	headerData, err := proto.Marshal(header)
+	if err != nil {
+		return 0, err
+	}
+
+	parts := append([][]byte{headerData}, payload...)
+
+	sent := 0
+	for _, conn := range s.loggedIn() {
+		if !conn.subscribed(uri) {
+			continue
+		}
+
+		err = sendMercury(conn.stream, 0xb5, make([]byte, 8), parts)
+		if err != nil {
+			return sent, err
+		}
+		sent++
+	}
+
+	return sent, nil
+}
+
+func (c *apConn) subscribed(uri string) bool {
+	c.subLock.Lock()
+	defer c.subLock.Unlock()
+	return c.subscriptions[uri]
+}
+
+func (s *Server) handleMercury(conn *apConn, cmd uint8, data []byte) error {
+	reader := bytes.NewReader(data)
+	seq, flags, parts, err := decodeMercury(reader)
+	if err != nil {
+		return fmt.Errorf("decoding mercury request: %w", err)
+	}
+	if flags != 1 || len(parts) == 0 {
+		return fmt.Errorf("decoding mercury request: unsupported multi-packet request")
+	}
+
+	header := &Spotify.Header{}
+	err = proto.Unmarshal(parts[0], header)
+	if err != nil {
+		return fmt.Errorf("decoding mercury header: %w", err)
+	}
+
+	req := MercuryRequest{
+		Method:      header.GetMethod(),
+		Uri:         header.GetUri(),
+		ContentType: header.GetContentType(),
+		Payload:     parts[1:],
+		Username:    conn.username,
+	}
+
+	s.lock.Lock()
+	handler, ok := s.handlers[req.Uri]
+	s.lock.Unlock()
+
+	var res MercuryResponse
+	switch {
+	case ok:
+		res = handler(req)
+	case cmd == connection.PacketMercurySub:
+		res = MercuryResponse{StatusCode: 200}
+	default:
+		res = MercuryResponse{StatusCode: 404}
+	}
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		switch cmd {
+		case connection.PacketMercurySub:
+			conn.subLock.Lock()
+			conn.subscriptions[req.Uri] = true
+			conn.subLock.Unlock()
+
+			if res.Payload == nil {
+				// Confirm the subscription like Spotify does
+				sub, err := proto.Marshal(&Spotify.Subscription{Uri: proto.String(req.Uri)})
+				if err != nil {
+					return err
+				}
+				res.Payload = [][]byte{sub}
+			}
+
+		case connection.PacketMercuryUnsub:
+			conn.subLock.Lock()
+			delete(conn.subscriptions, req.Uri)
+			conn.subLock.Unlock()
+		}
+	}
+
+	resHeader := &Spotify.Header{
+		Uri:        proto.String(req.Uri),
+		StatusCode: proto.Int32(res.StatusCode),
+	}
+	if res.ContentType != "" {
+		resHeader.ContentType = proto.String(res.ContentType)
+	}
+	for key, value := range res.UserFields {
+		resHeader.UserFields = append(resHeader.UserFields, &Spotify.UserField{
+			Key:   proto.String(key),
+			Value: []byte(value),
+		})
+	}
+
+	resHeaderData, err := proto.Marshal(resHeader)
+	if err != nil {
+		return err
+	}
+
+	return sendMercury(conn.stream, cmd, seq, append([][]byte{resHeaderData}, res.Payload...))
+}
+
+// sendMercury sends a mercury message, split in several packets if it is too large to fit in a single one
+func sendMercury(stream connection.PacketStream, cmd uint8, seq []byte, parts [][]byte) error {
+	current := make([][]byte, 0)
+	size := 0
+
+	for _, part := range parts {
+		for {
+			room := maxMercuryPacket - size - 2
+			if len(part) <= room {
+				current = append(current, part)
+				size += 2 + len(part)
+				break
+			}
+
+			// Flag 2 tells the last part continues in the next packet, flag 0 only that more packets follow
+			flags := uint8(0)
+			if room > 0 {
+				current = append(current, part[:room])
+				part = part[room:]
+				flags = 2
+			}
+
+			err := stream.SendPacket(cmd, encodeMercury(seq, flags, current))
+			if err != nil {
+				return err
+			}
+			current = make([][]byte, 0)
+			size = 0
+		}
+	}
+
+	return stream.SendPacket(cmd, encodeMercury(seq, 1, current))
+}
+
+func encodeMercury(seq []byte, flags uint8, parts [][]byte) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, uint16(len(seq)))
+	buf.Write(seq)
+	binary.Write(buf, binary.BigEndian, flags)
+	binary.Write(buf, binary.BigEndian, uint16(len(parts)))
+
+	for _, part := range parts {
+		binary.Write(buf, binary.BigEndian, uint16(len(part)))
+		buf.Write(part)
+	}
+
+	return buf.Bytes()
+}
+
+func decodeMercury(reader io.Reader) (seq []byte, flags uint8, parts [][]byte, err error) {
+	var seqLength uint16
+	err = binary.Read(reader, binary.BigEndian, &seqLength)
+	if err != nil {
+		return
+	}
+	seq = make([]byte, seqLength)
+	_, err = io.ReadFull(reader, seq)
+	if err != nil {
+		return
+	}
+
+	err = binary.Read(reader, binary.BigEndian, &flags)
+	if err != nil {
+		return
+	}
+	var count uint16
+	err = binary.Read(reader, binary.BigEndian, &count)
+	if err != nil {
+		return
+	}
+
+	for i := uint16(0); i < count; i++ {
+		var size uint16
+		err = binary.Read(reader, binary.BigEndian, &size)
+		if err != nil {
+			return
+		}
+		part := make([]byte, size)
+		_, err = io.ReadFull(reader, part)
+		if err != nil {
+			return
+		}
+		parts = append(parts, part)
+	}
+
+	return
+}
@@ -0,0 +1,229 @@
+package fakeap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/librespot-org/librespot-golang/Spotify"
+)
+
+// Playlist is a playlist served by the server. The clients read it with GET requests to hm://playlist/<id>, and
+// modify it with MODIFY requests to hm://playlist/<id>?syncpublished=1 carrying playlist4 ops against its current
+// revision. The modifications against an older revision are answered with a 409 status. Each modification is
+// published to the clients subscribed to hm://playlist/<id> as a RevisionTaggedChangeSet.
+type Playlist struct {
+	id     string
+	server *Server
+
+	lock       sync.Mutex
+	revision   uint32
+	attributes *Spotify.ListAttributes
+	items      []*Spotify.Item
+	// beforeModify is called before each modification request is processed
+	beforeModify func()
+}
+
+// AddPlaylist serves a playlist with the specified id, e.g. user/fakeUser/playlist/abc, name and item URIs
+func (s *Server) AddPlaylist(id string, name string, uris ...string) *Playlist {
+	p := &Playlist{id: id, server: s, revision: 1, attributes: &Spotify.ListAttributes{Name: proto.String(name)}}
+	for _, uri := range uris {
+		p.items = append(p.items, &Spotify.Item{Uri: proto.String(uri)})
+	}
+
+	s.HandleMercury("hm://playlist/"+id, func(req MercuryRequest) MercuryResponse {
+		if req.Method == "SUB" || req.Method == "UNSUB" {
+			return MercuryResponse{StatusCode: 200}
+		}
+		if req.Method != "GET" {
+			return MercuryResponse{StatusCode: 405}
+		}
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		return p.contentResponse()
+	})
+	s.HandleMercury("hm://playlist/"+id+"?syncpublished=1", p.handleModify)
+	return p
+}
+
+// Revision returns the current revision of the playlist
+func (p *Playlist) Revision() []byte {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.revisionBytes()
+}
+
+// Items returns the URIs of the items of the playlist
+func (p *Playlist) Items() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	uris := make([]string, len(p.items))
+	for i, item := range p.items {
+		uris[i] = item.GetUri()
+	}
+	return uris
+}
+
+// Attributes returns the attributes of the playlist, such as its name
+func (p *Playlist) Attributes() *Spotify.ListAttributes {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return proto.Clone(p.attributes).(*Spotify.ListAttributes)
+}
+
+// Modify applies ops to the playlist as another client would, which creates a new revision
+func (p *Playlist) Modify(ops ...*Spotify.Op) error {
+	p.lock.Lock()
+	changeSet, err := p.apply(ops)
+	p.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return p.publish(changeSet)
+}
+
+// BeforeModify sets a function called before each modification request is processed, e.g. to modify the playlist
+// concurrently
+func (p *Playlist) BeforeModify(f func()) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.beforeModify = f
+}
+
+func (p *Playlist) revisionBytes() []byte {
+	revision := make([]byte, 4)
+	binary.BigEndian.PutUint32(revision, p.revision)
+	return revision
+}
+
+func (p *Playlist) contentResponse() MercuryResponse {
+	data, err := proto.Marshal(&Spotify.SelectedListContent{
+		Revision:           p.revisionBytes(),
+		Length:             proto.Int32(int32(len(p.items))),
+		Attributes:         p.attributes,
+		Contents:           &Spotify.ListItems{Pos: proto.Int32(0), Items: p.items},
+		ResultingRevisions: [][]byte{p.revisionBytes()},
+	})
+	if err != nil {
+		return MercuryResponse{StatusCode: 500}
+	}
+	return MercuryResponse{StatusCode: 200, ContentType: "vnd.spotify/playlist4-selectedlistcontent",
+		Payload: [][]byte{data}}
+}
+
+func (p *Playlist) handleModify(req MercuryRequest) MercuryResponse {
+	if req.Method != "MODIFY" {
+		return MercuryResponse{StatusCode: 405}
+	}
+	changes := &Spotify.ListChanges{}
+	if len(req.Payload) != 1 || proto.Unmarshal(req.Payload[0], changes) != nil {
+		return MercuryResponse{StatusCode: 400}
+	}
+
+	p.lock.Lock()
+	beforeModify := p.beforeModify
+	p.lock.Unlock()
+	if beforeModify != nil {
+		beforeModify()
+	}
+
+	p.lock.Lock()
+	if !bytes.Equal(changes.GetBaseRevision(), p.revisionBytes()) {
+		p.lock.Unlock()
+		return MercuryResponse{StatusCode: 409}
+	}
+	var ops []*Spotify.Op
+	for _, delta := range changes.GetDeltas() {
+		ops = append(ops, delta.GetOps()...)
+	}
+	changeSet, err := p.apply(ops)
+	if err != nil {
+		p.lock.Unlock()
+		return MercuryResponse{StatusCode: 400, UserFields: map[string]string{"MC-Error": err.Error()}}
+	}
+	res := p.contentResponse()
+	p.lock.Unlock()
+
+	if err := p.publish(changeSet); err != nil {
+		return MercuryResponse{StatusCode: 500}
+	}
+	return res
+}
+
+// publish notifies the subscribed clients of a modification
+func (p *Playlist) publish(changeSet *Spotify.RevisionTaggedChangeSet) error {
+	data, err := proto.Marshal(changeSet)
+	if err != nil {
+		return err
+	}
+	_, err = p.server.PublishContent("hm://playlist/"+p.id, "vnd.spotify/playlist4-revision-tagged-changeset", data)
+	return err
+}
+
+// apply applies ops to a copy of the items, which replaces them once all the ops are applied, and returns the change
+// set to publish
+func (p *Playlist) apply(ops []*Spotify.Op) (*Spotify.RevisionTaggedChangeSet, error) {
+	items := append([]*Spotify.Item{}, p.items...)
+	attributes := proto.Clone(p.attributes).(*Spotify.ListAttributes)
+
+	for _, op := range ops {
+		switch op.GetKind() {
+		case Spotify.Op_ADD:
+			index := int(op.GetAdd().GetFromIndex())
+			if op.GetAdd().GetAddLast() {
+				index = len(items)
+			}
+			if index < 0 || index > len(items) {
+				return nil, fmt.Errorf("add at %d out of %d", index, len(items))
+			}
+			added := append(append([]*Spotify.Item{}, op.GetAdd().GetItems()...), items[index:]...)
+			items = append(items[:index], added...)
+
+		case Spotify.Op_REM:
+			from, length := int(op.GetRem().GetFromIndex()), int(op.GetRem().GetLength())
+			if from < 0 || from+length > len(items) {
+				return nil, fmt.Errorf("remove %d from %d out of %d", length, from, len(items))
+			}
+			for i, item := range op.GetRem().GetItems() {
+				if items[from+i].GetUri() != item.GetUri() {
+					return nil, fmt.Errorf("remove %s at %d: found %s", item.GetUri(), from+i, items[from+i].GetUri())
+				}
+			}
+			items = append(items[:from], items[from+length:]...)
+
+		case Spotify.Op_MOV:
+			mov := op.GetMov()
+			from, length, to := int(mov.GetFromIndex()), int(mov.GetLength()), int(mov.GetToIndex())
+			if from < 0 || from+length > len(items) || to < 0 || to > len(items) {
+				return nil, fmt.Errorf("move %d from %d to %d out of %d", length, from, to, len(items))
+			}
+			moved := append([]*Spotify.Item{}, items[from:from+length]...)
+			rest := append(append([]*Spotify.Item{}, items[:from]...), items[from+length:]...)
+			if to > from {
+				to -= length
+			}
+			items = append(append(rest[:to:to], moved...), rest[to:]...)
+
+		case Spotify.Op_UPDATE_LIST_ATTRIBUTES:
+			proto.Merge(attributes, op.GetUpdateListAttributes().GetNewAttributes().GetValues())
+
+		default:
+			return nil, fmt.Errorf("unsupported op %s", op.GetKind())
+		}
+	}
+
+	base := p.revisionBytes()
+	p.items = items
+	p.attributes = attributes
+	p.revision++
+	return &Spotify.RevisionTaggedChangeSet{
+		Revision: p.revisionBytes(),
+		ChangeSet: &Spotify.ChangeSet{
+			Kind:  Spotify.ChangeSet_DELTA.Enum(),
+			Delta: &Spotify.Delta{BaseVersion: base, Ops: ops},
+		},
+	}, nil
+}
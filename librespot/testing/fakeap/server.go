@@ -0,0 +1,562 @@
+// Package fakeap implements a local fake Spotify access point (AP), in order to test the clients end to end without
+// reaching the Spotify servers. It speaks the real protocol: the Diffie-Hellman handshake, the Shannon-encrypted
+// framing and the authentication, then serves scripted mercury responses, audio keys and audio chunks from fixtures.
+//
+// A typical test starts a server, registers its fixtures, and points the session at it:
+//
+//	server, _ := fakeap.NewServer()
+//	defer server.Close()
+//	server.AddUser("user", "password")
+//	config := &core.SessionConfig{Resolver: server.Resolver(), ServerKey: server.PublicKey()}
+//	session, err := config.Login(ctx, "user", "password", "device")
+package fakeap
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/librespot-org/librespot-golang/Spotify"
+	"github.com/librespot-org/librespot-golang/librespot/connection"
+	"github.com/librespot-org/librespot-golang/librespot/crypto"
+	"github.com/librespot-org/librespot-golang/librespot/logging"
+	"github.com/librespot-org/librespot-golang/librespot/utils"
+)
+
+// Server is a fake AP listening on the loopback interface. Its methods are safe for concurrent use, and the fixtures
+// can be changed while clients are connected.
+type Server struct {
+	// Country is the country code sent to the clients once they are logged in, none is sent when empty
+	Country string
+	// ProductInfo holds the product attributes sent to the clients once they are logged in, none are sent when nil
+	ProductInfo map[string]string
+	// LicenseVersion is the license version sent to the clients once they are logged in, none is sent when empty
+	LicenseVersion string
+	// HashCashLength is the number of zero bits required by the hashcash challenge sent during the handshake, no
+	// challenge is sent when 0
+	HashCashLength int32
+	// Logger receives the errors of the client connections and the packets ignored by the server, nothing is logged
+	// when nil
+	Logger logging.Logger
+
+	listener net.Listener
+	// key signs the Diffie-Hellman key sent during the handshake, in place of Spotify's key
+	key  *rsa.PrivateKey
+	lock sync.Mutex
+	// users maps the usernames to their account
+	users map[string]*account
+	// tokens maps the access tokens accepted for login to the username they authenticate
+	tokens map[string]string
+	// handlers maps the mercury URIs to the handler serving them
+	handlers map[string]MercuryHandler
+	// audioFiles maps the hex file ids to the audio files served
+	audioFiles map[string]*audioFile
+	// conns holds the connections currently open
+	conns map[*apConn]struct{}
+	// stalls is the number of the next handshakes which go silent after the client hello
+	stalls int
+	// routines tracks the serving goroutines, so that Close can wait for them
+	routines sync.WaitGroup
+}
+
+type account struct {
+	password string
+	authBlob []byte
+	// previousBlob is the blob replaced by RotateCredentials, which is still accepted
+	previousBlob []byte
+}
+
+// apConn is a client connection to the fake AP
+type apConn struct {
+	net.Conn
+	stream connection.PacketStream
+	// username is the canonical username of the client, it is empty until the client is logged in
+	username string
+	// subscriptions holds the URIs the client subscribed to
+	subscriptions map[string]bool
+	subLock       sync.Mutex
+}
+
+// NewServer starts a fake AP on a random port of the loopback interface
+func NewServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("fakeap: listening: %w", err)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("fakeap: generating server key: %w", err)
+	}
+
+	s := &Server{
+		Country:        "SE",
+		ProductInfo:    map[string]string{"type": "premium", "catalogue": "premium"},
+		LicenseVersion: "1.0.1-SE",
+		listener:       listener,
+		key:            key,
+		users:          make(map[string]*account),
+		tokens:         make(map[string]string),
+		handlers:       make(map[string]MercuryHandler),
+		audioFiles:     make(map[string]*audioFile),
+		conns:          make(map[*apConn]struct{}),
+	}
+
+	s.routines.Add(1)
+	go s.serve()
+
+	return s, nil
+}
+
+// Addr returns the host:port address the server listens on
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Resolver returns an AP resolver yielding this server only, to be used in a core.SessionConfig
+func (s *Server) Resolver() utils.StaticAPResolver {
+	return utils.StaticAPResolver{s.Addr()}
+}
+
+// PublicKey returns the key the server signs its handshake with, to be used as the ServerKey of a core.SessionConfig
+func (s *Server) PublicKey() *rsa.PublicKey {
+	return &s.key.PublicKey
+}
+
+func (s *Server) logger() logging.Logger {
+	return logging.OrDiscard(s.Logger)
+}
+
+// Close stops listening, closes all the client connections and waits for the serving goroutines to exit
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.Disconnect()
+	s.routines.Wait()
+	return err
+}
+
+// Disconnect closes all the client connections, while the server keeps accepting new ones. It simulates a network
+// failure or an AP going down.
+func (s *Server) Disconnect() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// StallHandshakes makes the next n connections go silent once the client hello is received, as a half-open
+// connection to an AP would. They are closed by the server once the client gives up on them.
+func (s *Server) StallHandshakes(n int) {
+	s.lock.Lock()
+	s.stalls = n
+	s.lock.Unlock()
+}
+
+// AddUser registers an account accepted by the server, and returns the reusable credentials blob sent to the client
+// once it is logged in. This blob is also accepted to log in with the stored credentials.
+func (s *Server) AddUser(username string, password string) []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	authBlob := []byte("fakeap-blob-" + username)
+	s.users[username] = &account{
+		password: password,
+		authBlob: authBlob,
+	}
+
+	return authBlob
+}
+
+// RotateCredentials replaces the reusable credentials blob of an account, as the AP may do at any login, and returns
+// the new blob. The previous blob is still accepted to log in.
+func (s *Server) RotateCredentials(username string) []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	account, ok := s.users[username]
+	if !ok {
+		return nil
+	}
+	account.previousBlob = account.authBlob
+	account.authBlob = []byte(fmt.Sprintf("fakeap-blob-%s-%x", username, crypto.RandomVec(4)))
+	return account.authBlob
+}
+
+// AddToken registers an access token accepted by the server to log in as username
+func (s *Server) AddToken(token string, username string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.users[username]; !ok {
+		s.users[username] = &account{authBlob: []byte("fakeap-blob-" + username)}
+	}
+	s.tokens[token] = username
+}
+
+func (s *Server) serve() {
+	defer s.routines.Done()
+
+	for {
+		netConn, err := s.listener.Accept()
+		if err != nil {
+			// The listener has been closed
+			return
+		}
+
+		conn := &apConn{
+			Conn:          netConn,
+			subscriptions: make(map[string]bool),
+		}
+
+		s.lock.Lock()
+		s.conns[conn] = struct{}{}
+		s.lock.Unlock()
+
+		s.routines.Add(1)
+		go func() {
+			defer s.routines.Done()
+
+			err := s.serveConn(conn)
+			if err != nil && err != io.EOF {
+				s.logger().Warn("fakeap: serving connection", logging.KeyError, err)
+			}
+
+			conn.Close()
+			s.lock.Lock()
+			delete(s.conns, conn)
+			s.lock.Unlock()
+		}()
+	}
+}
+
+func (s *Server) serveConn(conn *apConn) error {
+	stream, err := s.handshake(conn)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	conn.stream = stream
+	s.lock.Unlock()
+
+	ok, err := s.login(conn)
+	if err != nil || !ok {
+		return err
+	}
+
+	for {
+		cmd, data, err := stream.RecvPacket()
+		if err != nil {
+			return err
+		}
+
+		err = s.handle(conn, cmd, data)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// handshake performs the server side of the key exchange on conn, and returns the Shannon-encrypted stream
+// established with the client
+func (s *Server) handshake(conn net.Conn) (connection.PacketStream, error) {
+	// The client hello is prefixed by the protocol version, and its size includes this prefix
+	var header [6]byte
+	_, err := io.ReadFull(conn, header[:])
+	if err != nil {
+		return nil, fmt.Errorf("reading client hello: %w", err)
+	}
+	size := binary.BigEndian.Uint32(header[2:])
+	if size < uint32(len(header)) {
+		return nil, fmt.Errorf("reading client hello: invalid size %d", size)
+	}
+
+	clientPacket := make([]byte, size)
+	copy(clientPacket, header[:])
+	_, err = io.ReadFull(conn, clientPacket[len(header):])
+	if err != nil {
+		return nil, fmt.Errorf("reading client hello: %w", err)
+	}
+
+	hello := &Spotify.ClientHello{}
+	err = proto.Unmarshal(clientPacket[len(header):], hello)
+	if err != nil {
+		return nil, fmt.Errorf("decoding client hello: %w", err)
+	}
+
+	s.lock.Lock()
+	stall := s.stalls > 0
+	if stall {
+		s.stalls--
+	}
+	s.lock.Unlock()
+	if stall {
+		// Never answer, until the client closes the connection
+		io.Copy(io.Discard, conn)
+		return nil, io.EOF
+	}
+
+	powChallenge := &Spotify.PoWChallengeUnion{}
+	if s.HashCashLength > 0 {
+		powChallenge.HashCash = &Spotify.PoWHashCashChallenge{
+			Prefix: crypto.RandomVec(0x10),
+			Length: proto.Int32(s.HashCashLength),
+			Target: proto.Int32(int32(binary.BigEndian.Uint32(crypto.RandomVec(4)))),
+		}
+	}
+
+	keys := crypto.GenerateKeys()
+	signature, err := crypto.SignServerKey(s.key, keys.PubKey())
+	if err != nil {
+		return nil, fmt.Errorf("signing server key: %w", err)
+	}
+
+	response := &Spotify.APResponseMessage{
+		Challenge: &Spotify.APChallenge{
+			LoginCryptoChallenge: &Spotify.LoginCryptoChallengeUnion{
+				DiffieHellman: &Spotify.LoginCryptoDiffieHellmanChallenge{
+					Gs:                 keys.PubKey(),
+					ServerSignatureKey: proto.Int32(1),
+					GsSignature:        signature,
+				},
+			},
+			FingerprintChallenge: &Spotify.FingerprintChallengeUnion{},
+			PowChallenge:         powChallenge,
+			CryptoChallenge:      &Spotify.CryptoChallengeUnion{},
+			ServerNonce:          crypto.RandomVec(0x10),
+		},
+	}
+
+	responseData, err := proto.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("building server hello: %w", err)
+	}
+
+	plain := connection.MakePlainConnection(conn, conn)
+	serverPacket, err := plain.SendPrefixPacket([]byte{}, responseData)
+	if err != nil {
+		return nil, fmt.Errorf("writing server hello: %w", err)
+	}
+
+	sharedKeys := keys.AddRemoteKey(hello.GetLoginCryptoHello().GetDiffieHellman().GetGc(), clientPacket, serverPacket)
+
+	clientResponse, err := plain.RecvPacket()
+	if err != nil {
+		return nil, fmt.Errorf("reading client response: %w", err)
+	}
+
+	plainResponse := &Spotify.ClientResponsePlaintext{}
+	err = proto.Unmarshal(clientResponse[4:], plainResponse)
+	if err != nil {
+		return nil, fmt.Errorf("decoding client response: %w", err)
+	}
+
+	if !hmac.Equal(plainResponse.GetLoginCryptoResponse().GetDiffieHellman().GetHmac(), sharedKeys.Challenge()) {
+		return nil, fmt.Errorf("client response: challenge mismatch")
+	}
+
+	if hashCash := powChallenge.GetHashCash(); hashCash != nil {
+		suffix := plainResponse.GetPowResponse().GetHashCash().GetHashSuffix()
+		if !crypto.CheckHashCash(hashCash.GetPrefix(), hashCash.GetLength(), suffix) {
+			return nil, fmt.Errorf("client response: invalid hashcash")
+		}
+	}
+
+	return crypto.CreateStream(sharedKeys.Reversed(), plain), nil
+}
+
+// login authenticates the client, it returns false if the credentials have been refused
+func (s *Server) login(conn *apConn) (bool, error) {
+	cmd, data, err := conn.stream.RecvPacket()
+	if err != nil {
+		return false, fmt.Errorf("reading login: %w", err)
+	}
+	if cmd != connection.PacketLogin {
+		return false, fmt.Errorf("reading login: unexpected cmd 0x%x", cmd)
+	}
+
+	request := &Spotify.ClientResponseEncrypted{}
+	err = proto.Unmarshal(data, request)
+	if err != nil {
+		return false, fmt.Errorf("decoding login: %w", err)
+	}
+
+	username, authBlob, ok := s.authenticate(request.GetLoginCredentials())
+	if !ok {
+		failed, err := proto.Marshal(&Spotify.APLoginFailed{
+			ErrorCode: Spotify.ErrorCode_BadCredentials.Enum(),
+		})
+		if err != nil {
+			return false, err
+		}
+		return false, conn.stream.SendPacket(connection.PacketAuthFailure, failed)
+	}
+
+	welcome, err := proto.Marshal(&Spotify.APWelcome{
+		CanonicalUsername:           proto.String(username),
+		AccountTypeLoggedIn:         Spotify.AccountType_Spotify.Enum(),
+		CredentialsTypeLoggedIn:     Spotify.AccountType_Spotify.Enum(),
+		ReusableAuthCredentialsType: Spotify.AuthenticationType_AUTHENTICATION_STORED_SPOTIFY_CREDENTIALS.Enum(),
+		ReusableAuthCredentials:     authBlob,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	err = conn.stream.SendPacket(connection.PacketAPWelcome, welcome)
+	if err != nil {
+		return false, err
+	}
+
+	s.lock.Lock()
+	conn.username = username
+	s.lock.Unlock()
+
+	if s.Country != "" {
+		err = conn.stream.SendPacket(connection.PacketCountryCode, []byte(s.Country))
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if s.ProductInfo != nil {
+		err = sendProductInfo(conn, s.ProductInfo)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if s.LicenseVersion != "" {
+		license := new(bytes.Buffer)
+		binary.Write(license, binary.BigEndian, uint16(1))
+		binary.Write(license, binary.BigEndian, uint8(len(s.LicenseVersion)))
+		license.WriteString(s.LicenseVersion)
+
+		err = conn.stream.SendPacket(connection.PacketLicenseVersion, license.Bytes())
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// SendProductInfo sends new product attributes to all the logged in clients, e.g. to simulate a subscription change
+func (s *Server) SendProductInfo(attributes map[string]string) error {
+	for _, conn := range s.loggedIn() {
+		err := sendProductInfo(conn, attributes)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sendProductInfo(conn *apConn, attributes map[string]string) error {
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	info := new(bytes.Buffer)
+	info.WriteString("<products><product>")
+	for _, name := range names {
+		fmt.Fprintf(info, "<%s>", name)
+		xml.EscapeText(info, []byte(attributes[name]))
+		fmt.Fprintf(info, "</%s>", name)
+	}
+	info.WriteString("</product></products>")
+
+	return conn.stream.SendPacket(connection.PacketProductInfo, info.Bytes())
+}
+
+// authenticate checks the credentials, and returns the canonical username and the reusable credentials of the
+// account they belong to
+func (s *Server) authenticate(credentials *Spotify.LoginCredentials) (string, []byte, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	username := credentials.GetUsername()
+	authData := credentials.GetAuthData()
+
+	switch credentials.GetTyp() {
+	case Spotify.AuthenticationType_AUTHENTICATION_USER_PASS:
+		account, ok := s.users[username]
+		if ok && account.password == string(authData) {
+			return username, account.authBlob, true
+		}
+
+	case Spotify.AuthenticationType_AUTHENTICATION_STORED_SPOTIFY_CREDENTIALS:
+		account, ok := s.users[username]
+		if ok && (bytes.Equal(account.authBlob, authData) ||
+			account.previousBlob != nil && bytes.Equal(account.previousBlob, authData)) {
+			return username, account.authBlob, true
+		}
+
+	case Spotify.AuthenticationType_AUTHENTICATION_SPOTIFY_TOKEN:
+		username, ok := s.tokens[string(authData)]
+		if ok {
+			return username, s.users[username].authBlob, true
+		}
+	}
+
+	return "", nil, false
+}
+
+func (s *Server) handle(conn *apConn, cmd uint8, data []byte) error {
+	switch cmd {
+	case connection.PacketPong:
+		return conn.stream.SendPacket(connection.PacketPongAck, nil)
+
+	case connection.PacketMercuryReq, connection.PacketMercurySub, connection.PacketMercuryUnsub:
+		return s.handleMercury(conn, cmd, data)
+
+	case connection.PacketRequestKey:
+		return s.handleKeyRequest(conn, data)
+
+	case connection.PacketStreamChunk:
+		return s.handleChunkRequest(conn, data)
+
+	default:
+		s.logger().Debug("fakeap: ignoring packet", logging.KeyCmd, cmd)
+	}
+
+	return nil
+}
+
+// Ping sends a ping to all the logged in clients, which are expected to answer with a pong
+func (s *Server) Ping() error {
+	for _, conn := range s.loggedIn() {
+		err := conn.stream.SendPacket(connection.PacketPing, make([]byte, 4))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loggedIn returns the connections of the clients which are logged in
+func (s *Server) loggedIn() []*apConn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	conns := make([]*apConn, 0, len(s.conns))
+	for conn := range s.conns {
+		if conn.stream != nil && conn.username != "" {
+			conns = append(conns, conn)
+		}
+	}
+	return conns
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
@@ -15,28 +16,87 @@ type APList struct {
 	ApList []string `json:"ap_list"`
 }
 
-// APResolve fetches the available Spotify servers (AP) and picks a random one
-func APResolve() (string, error) {
-	r, err := http.Get(kAPEndpoint)
+// APResolver returns the addresses of the Spotify servers (AP) to connect to, in order of preference
+type APResolver interface {
+	ResolveAP(ctx context.Context) ([]string, error)
+}
+
+// APResolverFunc is an adapter allowing the use of ordinary functions as APResolver
+type APResolverFunc func(ctx context.Context) ([]string, error)
+
+func (f APResolverFunc) ResolveAP(ctx context.Context) ([]string, error) {
+	return f(ctx)
+}
+
+// StaticAPResolver always resolves to the same list of APs, for instance to connect to a fixed or local AP
+type StaticAPResolver []string
+
+func (r StaticAPResolver) ResolveAP(ctx context.Context) ([]string, error) {
+	if len(r) == 0 {
+		return nil, errors.New("AP endpoint list is empty")
+	}
+	return r, nil
+}
+
+// HTTPAPResolver fetches the available APs from the Spotify AP resolve endpoint
+type HTTPAPResolver struct {
+	// Client is the HTTP client used to query the endpoint, http.DefaultClient is used when nil
+	Client *http.Client
+	// Endpoint is the URL of the endpoint, Spotify's one is used when empty
+	Endpoint string
+}
+
+func (r *HTTPAPResolver) ResolveAP(ctx context.Context) ([]string, error) {
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	endpoint := r.Endpoint
+	if endpoint == "" {
+		endpoint = kAPEndpoint
+	}
+
+	req, err := http.NewRequest("GET", endpoint, nil)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
 	}
-	defer r.Body.Close()
+	defer resp.Body.Close()
 
 	var endpoints APList
 
-	body, err := ioutil.ReadAll(r.Body)
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	err = json.Unmarshal(body, &endpoints)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	if len(endpoints.ApList) == 0 {
-		return "", errors.New("AP endpoint list is empty")
+		return nil, errors.New("AP endpoint list is empty")
+	}
+
+	return endpoints.ApList, nil
+}
+
+// APResolve fetches the available Spotify servers (AP) and picks a random one
+func APResolve() (string, error) {
+	endpoints, err := APResolveAll()
+	if err != nil {
+		return "", err
 	}
 
-	return endpoints.ApList[rand.Intn(len(endpoints.ApList))], nil
+	return endpoints[rand.Intn(len(endpoints))], nil
+}
+
+// APResolveAll fetches the list of all the available Spotify servers (AP), in the order returned by Spotify
+func APResolveAll() ([]string, error) {
+	resolver := &HTTPAPResolver{}
+	return resolver.ResolveAP(context.Background())
 }
@@ -8,6 +8,9 @@ import (
 
 const alphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
+// Convert62 converts a base62 id to a raw GID, without validating it.
+//
+// Deprecated: use spotifyid.FromBase62, which rejects the invalid ids.
 func Convert62(id string) []byte {
 	base := big.NewInt(62)
 
@@ -34,6 +37,9 @@ func reverse(s string) string {
 	return string(r)
 }
 
+// ConvertTo62 converts a raw GID to a base62 id.
+//
+// Deprecated: use spotifyid.FromGID and SpotifyID.Base62.
 func ConvertTo62(raw []byte) string {
 	bi := big.Int{}
 	bi.SetBytes(raw)
@@ -53,6 +59,9 @@ func ConvertTo62(raw []byte) string {
 	return reverse(result)
 }
 
+// Base62ToHex converts a base62 id to a hex GID, without validating it.
+//
+// Deprecated: use spotifyid.FromBase62 and SpotifyID.Hex.
 func Base62ToHex(b62 string) string {
 	return fmt.Sprintf("%x", Convert62(b62))
 }
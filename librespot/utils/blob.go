@@ -12,7 +12,6 @@ import (
 	"errors"
 	"github.com/librespot-org/librespot-golang/librespot/crypto"
 	"golang.org/x/crypto/pbkdf2"
-	"log"
 	"math/big"
 	"os"
 )
@@ -192,7 +191,6 @@ func decodeBlob(blob64 string, client64 string, keys crypto.PrivateKeys) (string
 	mac := macHash.Sum(nil)
 
 	if !bytes.Equal(mac, ckSum) {
-		log.Println("add user error, mac doesn't match")
 		return "", errors.New("mac mismatch")
 	}
 
@@ -1,9 +1,11 @@
 package librespotmobile
 
 import (
+	"context"
 	"encoding/json"
 	"github.com/librespot-org/librespot-golang/librespot/core"
 	"github.com/librespot-org/librespot-golang/librespot/mercury"
+	"github.com/librespot-org/librespot-golang/librespot/spotifyid"
 )
 
 type MobileMercury struct {
@@ -21,8 +23,13 @@ func createMobileMercury(session *core.Session) *MobileMercury {
 	}
 }
 
+// GetTrack returns the metadata of a track in JSON, its id being a URI, a URL, a base62 id or a hex GID
 func (m *MobileMercury) GetTrack(id string) (string, error) {
-	spt, err := m.mercury.GetTrack(id)
+	trackId, err := spotifyid.ParseAs(spotifyid.Track, id)
+	if err != nil {
+		return "", err
+	}
+	spt, err := m.mercury.GetTrack(context.Background(), trackId)
 	if err != nil {
 		return "", err
 	}
@@ -30,8 +37,13 @@ func (m *MobileMercury) GetTrack(id string) (string, error) {
 	return marshalJson(spt), nil
 }
 
+// GetAlbum returns the metadata of a album in JSON, its id being a URI, a URL, a base62 id or a hex GID
 func (m *MobileMercury) GetAlbum(id string) (string, error) {
-	spt, err := m.mercury.GetAlbum(id)
+	albumId, err := spotifyid.ParseAs(spotifyid.Album, id)
+	if err != nil {
+		return "", err
+	}
+	spt, err := m.mercury.GetAlbum(context.Background(), albumId)
 	if err != nil {
 		return "", err
 	}
@@ -39,8 +51,13 @@ func (m *MobileMercury) GetAlbum(id string) (string, error) {
 	return marshalJson(spt), nil
 }
 
+// GetArtist returns the metadata of a artist in JSON, its id being a URI, a URL, a base62 id or a hex GID
 func (m *MobileMercury) GetArtist(id string) (string, error) {
-	spt, err := m.mercury.GetArtist(id)
+	artistId, err := spotifyid.ParseAs(spotifyid.Artist, id)
+	if err != nil {
+		return "", err
+	}
+	spt, err := m.mercury.GetArtist(context.Background(), artistId)
 	if err != nil {
 		return "", err
 	}
@@ -49,7 +66,7 @@ func (m *MobileMercury) GetArtist(id string) (string, error) {
 }
 
 func (m *MobileMercury) GetPlaylist(id string) (string, error) {
-	spt, err := m.mercury.GetPlaylist(id)
+	spt, err := m.mercury.GetPlaylist(context.Background(), id)
 	if err != nil {
 		return "", err
 	}
@@ -58,7 +75,7 @@ func (m *MobileMercury) GetPlaylist(id string) (string, error) {
 }
 
 func (m *MobileMercury) GetRootPlaylist(username string) (string, error) {
-	spt, err := m.mercury.GetRootPlaylist(username)
+	spt, err := m.mercury.GetRootPlaylist(context.Background(), username)
 	if err != nil {
 		return "", err
 	}
@@ -67,7 +84,7 @@ func (m *MobileMercury) GetRootPlaylist(username string) (string, error) {
 }
 
 func (m *MobileMercury) GetToken(clientId string, scopes string) (string, error) {
-	spt, err := m.mercury.GetToken(clientId, scopes)
+	spt, err := m.mercury.GetToken(context.Background(), clientId, scopes)
 	if err != nil {
 		return "", err
 	}
@@ -2,9 +2,9 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
 	"strings"
@@ -14,7 +14,7 @@ import (
 	"github.com/librespot-org/librespot-golang/Spotify"
 	"github.com/librespot-org/librespot-golang/librespot"
 	"github.com/librespot-org/librespot-golang/librespot/core"
-	"github.com/librespot-org/librespot-golang/librespot/utils"
+	"github.com/librespot-org/librespot-golang/librespot/spotifyid"
 	"github.com/xlab/portaudio-go/portaudio"
 	"github.com/xlab/vorbis-go/decoder"
 )
@@ -39,42 +39,36 @@ func main() {
 	// Read flags from commandline
 	username := flag.String("username", "", "spotify username")
 	password := flag.String("password", "", "spotify password")
-	blob := flag.String("blob", "blob.bin", "spotify auth blob")
+	credentials := flag.String("credentials", "credentials.json", "file storing the spotify credentials")
 	devicename := flag.String("devicename", defaultDeviceName, "name of device")
 	flag.Parse()
 
+	// The credentials are saved after each login, encrypted when a passphrase is set in the environment
+	var store core.CredentialStore = &core.FileCredentialStore{Path: *credentials}
+	if passphrase := os.Getenv("LIBRESPOT_PASSPHRASE"); passphrase != "" {
+		store = core.NewEncryptedCredentialStore(store, []byte(passphrase))
+	}
+	config := &core.SessionConfig{CredentialStore: store}
+
 	// Authenticate
 	var session *core.Session
 	var err error
 
 	if *username != "" && *password != "" {
-		// Authenticate using a regular login and password, and store it in the blob file.
-		session, err = librespot.Login(*username, *password, *devicename)
-
-		err := ioutil.WriteFile(*blob, session.ReusableAuthBlob(), 0600)
-		if err != nil {
-			fmt.Printf("Could not store authentication blob in blob.bin: %s\n", err)
-		}
-	} else if *blob != "" && *username != "" {
-		// Authenticate reusing an existing blob
-		blobBytes, err := ioutil.ReadFile(*blob)
-
-		if err != nil {
-			fmt.Printf("Unable to read auth blob from %s: %s\n", *blob, err)
-			os.Exit(1)
-			return
-		}
-
-		session, err = librespot.LoginSaved(*username, blobBytes, *devicename)
+		// Authenticate using a regular login and password, the credentials are stored in the credentials file
+		session, err = config.Login(context.Background(), *username, *password, *devicename)
+	} else if *credentials != "" && *username != "" {
+		// Authenticate reusing the stored credentials
+		session, err = config.LoginStored(context.Background(), *username, *devicename)
 	} else if os.Getenv("client_secret") != "" {
 		// Authenticate using OAuth (untested)
 		session, err = librespot.LoginOAuth(*devicename, os.Getenv("client_id"), os.Getenv("client_secret"))
 	} else {
 		// No valid options, show the helo
-		fmt.Println("need to supply a username and password or a blob file path")
-		fmt.Println("./microclient --username SPOTIFY_USERNAME [--blob ./path/to/blob]")
+		fmt.Println("need to supply a username and password or a credentials file path")
+		fmt.Println("./microclient --username SPOTIFY_USERNAME [--credentials ./path/to/credentials.json]")
 		fmt.Println("or")
-		fmt.Println("./microclient --username SPOTIFY_USERNAME --password SPOTIFY_PASSWORD [--blob ./path/to/blob]")
+		fmt.Println("./microclient --username SPOTIFY_USERNAME --password SPOTIFY_PASSWORD [--credentials ./path/to/credentials.json]")
 		return
 	}
 
@@ -140,19 +134,33 @@ func main() {
 
 func printHelp() {
 	fmt.Println("\nAvailable commands:")
-	fmt.Println("play <track>:                   play specified track by spotify base62 id")
-	fmt.Println("track <track>:                  show details on specified track by spotify base62 id")
-	fmt.Println("album <album>:                  show details on specified album by spotify base62 id")
-	fmt.Println("artist <artist>:                show details on specified artist by spotify base62 id")
+	fmt.Println("play <track>:                   play specified track by spotify URI, URL or base62 id")
+	fmt.Println("track <track>:                  show details on specified track by spotify URI, URL or base62 id")
+	fmt.Println("album <album>:                  show details on specified album by spotify URI, URL or base62 id")
+	fmt.Println("artist <artist>:                show details on specified artist by spotify URI, URL or base62 id")
 	fmt.Println("search <keyword>:               start a search on the specified keyword")
 	fmt.Println("playlists:                      show your playlists")
 	fmt.Println("help:                           show this help")
 }
 
+// base62 returns the base62 id of the item with the specified GID, as expected by the commands
+func base62(typ spotifyid.Type, gid []byte) string {
+	id, err := spotifyid.FromGID(typ, gid)
+	if err != nil {
+		return "<invalid>"
+	}
+	return id.Base62()
+}
+
 func funcTrack(session *core.Session, trackID string) {
 	fmt.Println("Loading track: ", trackID)
 
-	track, err := session.Mercury().GetTrack(utils.Base62ToHex(trackID))
+	id, err := spotifyid.ParseAs(spotifyid.Track, trackID)
+	if err != nil {
+		fmt.Println("Invalid track id: ", err)
+		return
+	}
+	track, err := session.Mercury().GetTrack(context.Background(), id)
 	if err != nil {
 		fmt.Println("Error loading track: ", err)
 		return
@@ -162,7 +170,12 @@ func funcTrack(session *core.Session, trackID string) {
 }
 
 func funcArtist(session *core.Session, artistID string) {
-	artist, err := session.Mercury().GetArtist(utils.Base62ToHex(artistID))
+	id, err := spotifyid.ParseAs(spotifyid.Artist, artistID)
+	if err != nil {
+		fmt.Println("Invalid artist id:", err)
+		return
+	}
+	artist, err := session.Mercury().GetArtist(context.Background(), id)
 	if err != nil {
 		fmt.Println("Error loading artist:", err)
 		return
@@ -182,21 +195,26 @@ func funcArtist(session *core.Session, artistID string) {
 		for _, t := range tt.GetTrack() {
 			// To save bandwidth, only track IDs are returned. If you want
 			// the track name, you need to fetch it.
-			fmt.Printf(" => %s\n", utils.ConvertTo62(t.GetGid()))
+			fmt.Printf(" => %s\n", base62(spotifyid.Track, t.GetGid()))
 		}
 	}
 
 	fmt.Printf("\nAlbums:\n")
 	for _, ag := range artist.GetAlbumGroup() {
 		for _, a := range ag.GetAlbum() {
-			fmt.Printf(" => %s\n", utils.ConvertTo62(a.GetGid()))
+			fmt.Printf(" => %s\n", base62(spotifyid.Album, a.GetGid()))
 		}
 	}
 
 }
 
 func funcAlbum(session *core.Session, albumID string) {
-	album, err := session.Mercury().GetAlbum(utils.Base62ToHex(albumID))
+	id, err := spotifyid.ParseAs(spotifyid.Album, albumID)
+	if err != nil {
+		fmt.Println("Invalid album id:", err)
+		return
+	}
+	album, err := session.Mercury().GetAlbum(context.Background(), id)
 	if err != nil {
 		fmt.Println("Error loading album:", err)
 		return
@@ -211,7 +229,7 @@ func funcAlbum(session *core.Session, albumID string) {
 
 	fmt.Printf("Artists: ")
 	for _, artist := range album.GetArtist() {
-		fmt.Printf("%s ", utils.ConvertTo62(artist.GetGid()))
+		fmt.Printf("%s ", base62(spotifyid.Artist, artist.GetGid()))
 	}
 	fmt.Printf("\n")
 
@@ -219,7 +237,7 @@ func funcAlbum(session *core.Session, albumID string) {
 		fmt.Printf("\nDisc %d (%s): \n", disc.GetNumber(), disc.GetName())
 
 		for _, track := range disc.GetTrack() {
-			fmt.Printf(" => %s\n", utils.ConvertTo62(track.GetGid()))
+			fmt.Printf(" => %s\n", base62(spotifyid.Track, track.GetGid()))
 		}
 	}
 
@@ -228,7 +246,7 @@ func funcAlbum(session *core.Session, albumID string) {
 func funcPlaylists(session *core.Session) {
 	fmt.Println("Listing playlists")
 
-	playlist, err := session.Mercury().GetRootPlaylist(session.Username())
+	playlist, err := session.Mercury().GetRootPlaylist(context.Background(), session.Username())
 
 	if err != nil || playlist.Contents == nil {
 		fmt.Println("Error getting root list: ", err)
@@ -239,7 +257,11 @@ func funcPlaylists(session *core.Session) {
 	for i := 0; i < len(items); i++ {
 		id := strings.TrimPrefix(items[i].GetUri(), "spotify:")
 		id = strings.Replace(id, ":", "/", -1)
-		list, _ := session.Mercury().GetPlaylist(id)
+		list, err := session.Mercury().GetPlaylist(context.Background(), id)
+		if err != nil {
+			fmt.Println("Error getting playlist ", id, ": ", err)
+			continue
+		}
 		fmt.Println(list.Attributes.GetName(), id)
 
 		if list.Contents != nil {
@@ -252,7 +274,7 @@ func funcPlaylists(session *core.Session) {
 }
 
 func funcSearch(session *core.Session, keyword string) {
-	resp, err := session.Mercury().Search(keyword, 12, session.Country(), session.Username())
+	resp, err := session.Mercury().Search(context.Background(), keyword, 12, session.Country(), session.Username())
 
 	if err != nil {
 		fmt.Println("Failed to search:", err)
@@ -291,7 +313,12 @@ func funcPlay(session *core.Session, trackID string) {
 	fmt.Println("Loading track for play: ", trackID)
 
 	// Get the track metadata: it holds information about which files and encodings are available
-	track, err := session.Mercury().GetTrack(utils.Base62ToHex(trackID))
+	id, err := spotifyid.ParseAs(spotifyid.Track, trackID)
+	if err != nil {
+		fmt.Println("Invalid track id: ", err)
+		return
+	}
+	track, err := session.Mercury().GetTrack(context.Background(), id)
 	if err != nil {
 		fmt.Println("Error loading track: ", err)
 		return